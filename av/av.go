@@ -0,0 +1,85 @@
+package av
+
+import (
+	"fmt"
+	"github.com/mmmorris1975/go-upnp/description"
+	"github.com/mmmorris1975/go-upnp/didl"
+	"log"
+	"time"
+)
+
+const (
+	MEDIA_RENDERER_1 = "urn:schemas-upnp-org:device:MediaRenderer:1"
+	MEDIA_SERVER_1   = "urn:schemas-upnp-org:device:MediaServer:1"
+
+	AV_TRANSPORT       = "urn:schemas-upnp-org:service:AVTransport"
+	RENDERING_CONTROL  = "urn:schemas-upnp-org:service:RenderingControl"
+	CONNECTION_MANAGER = "urn:schemas-upnp-org:service:ConnectionManager"
+	CONTENT_DIRECTORY  = "urn:schemas-upnp-org:service:ContentDirectory"
+
+	// Maximum number of concurrent requests sent to a device
+	MAX_CONCURRENT_REQUESTS = 2
+)
+
+// AVTransport error codes
+const (
+	ERR_TRANSITION_NOT_AVAILABLE = 701
+	ERR_NO_CONTENTS              = 702
+	ERR_SEEK_MODE_NOT_SUPPORTED  = 710
+	ERR_ILLEGAL_SEEK_TARGET      = 711
+	ERR_ILLEGAL_MIME_TYPE        = 714
+	ERR_INVALID_INSTANCE_ID      = 718
+)
+
+var Logger *log.Logger
+
+// findService returns the highest version of the service type (without version) found in the device
+func findService(dd *description.DeviceDescription, svcType string) string {
+	for v := 4; v > 0; v-- {
+		st := fmt.Sprintf("%s:%d", svcType, v)
+		if dd.ServiceByType(st) != nil {
+			return st
+		}
+	}
+	return ""
+}
+
+// Media describes a media resource to load in a renderer, used to create its DIDL-Lite metadata
+type Media struct {
+	URI   string
+	Title string
+	// upnp:class of the item, ex. object.item.audioItem.musicTrack
+	Class string
+	// protocolInfo of the resource, ex. http-get:*:audio/mpeg:*
+	ProtocolInfo string
+	Duration     time.Duration
+	Size         int64
+	AlbumArtURI  string
+}
+
+// Metadata returns the DIDL-Lite document describing the media
+func (m *Media) Metadata() (string, error) {
+	i := didl.Item{Object: didl.Object{ID: "0", ParentID: "-1", Restricted: true, Title: m.Title, Class: m.Class,
+		AlbumArtURI: m.AlbumArtURI}}
+	r := didl.Resource{URI: m.URI, ProtocolInfo: m.ProtocolInfo, Duration: m.Duration, Size: -1}
+
+	if len(i.Class) < 1 {
+		i.Class = "object.item"
+	}
+	if len(r.ProtocolInfo) < 1 {
+		r.ProtocolInfo = "http-get:*:*:*"
+	}
+	if m.Size > 0 {
+		r.Size = m.Size
+	}
+	i.Resources = []didl.Resource{r}
+
+	d := didl.Document{Items: []didl.Item{i}}
+	return d.Marshal()
+}
+
+func doLog(fmt string, vars ...interface{}) {
+	if Logger != nil {
+		Logger.Printf(fmt, vars...)
+	}
+}
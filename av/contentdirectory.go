@@ -0,0 +1,294 @@
+package av
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/mmmorris1975/go-upnp/control"
+	"github.com/mmmorris1975/go-upnp/description"
+	"github.com/mmmorris1975/go-upnp/didl"
+	"github.com/mmmorris1975/go-upnp/discovery"
+	"time"
+)
+
+const (
+	// ID of the root container of every ContentDirectory
+	ROOT_CONTAINER_ID = "0"
+	// Number of objects requested per Browse or Search request when paging
+	BROWSE_PAGE_SIZE = 100
+	// Return all properties of each object
+	FILTER_ALL = "*"
+)
+
+// ContentDirectory error codes
+const (
+	ERR_NO_SUCH_OBJECT          = 701
+	ERR_INVALID_SEARCH_CRITERIA = 708
+	ERR_INVALID_SORT_CRITERIA   = 709
+	ERR_NO_SUCH_CONTAINER       = 710
+	ERR_CANNOT_PROCESS_REQUEST  = 720
+)
+
+// SkipContainer is returned by a WalkFunc to skip the children of a container
+var SkipContainer = errors.New("skip this container")
+
+// BrowseResult is one page of a Browse or Search response
+type BrowseResult struct {
+	Containers     []didl.Container
+	Items          []didl.Item
+	NumberReturned uint32
+	// Total number of matching objects, 0 if the server doesn't know
+	TotalMatches uint32
+	UpdateID     uint32
+	// The DIDL-Lite document returned by the server
+	Result string
+}
+
+// ContentDirectory is a client for the ContentDirectory service of a media server
+type ContentDirectory struct {
+	Device      *description.DeviceDescription
+	ServiceType string
+	exec        *control.Executor
+}
+
+// DiscoverMediaServers searches for media servers, returning a ContentDirectory client for each one found
+func DiscoverMediaServers(wait time.Duration) ([]*ContentDirectory, error) {
+	ch := make(chan *discovery.SearchResponse, 10)
+	req := discovery.NewSearchRequest()
+	req.Target = MEDIA_SERVER_1
+	req.Wait = wait
+	discovery.Discover(req, ch)
+
+	seen := make(map[string]bool)
+	res := make([]*ContentDirectory, 0)
+	for r := range ch {
+		if seen[r.Location] {
+			continue
+		}
+		seen[r.Location] = true
+
+		dd, err := description.DescribeDevice(r.Location, wait)
+		if err != nil {
+			doLog("DiscoverMediaServers() - DescribeDevice(%s): %v", r.Location, err)
+			continue
+		}
+
+		cd, err := NewContentDirectory(dd, wait)
+		if err != nil {
+			doLog("DiscoverMediaServers() - NewContentDirectory(%s): %v", r.Location, err)
+			continue
+		}
+		res = append(res, cd)
+	}
+
+	return res, nil
+}
+
+// NewContentDirectory creates a client for the ContentDirectory service of the device
+func NewContentDirectory(dd *description.DeviceDescription, wait time.Duration) (*ContentDirectory, error) {
+	st := findService(dd, CONTENT_DIRECTORY)
+	if len(st) < 1 {
+		return nil, fmt.Errorf("no ContentDirectory service found")
+	}
+
+	return &ContentDirectory{Device: dd, ServiceType: st, exec: control.NewExecutor(dd, MAX_CONCURRENT_REQUESTS, wait)}, nil
+}
+
+// Executor returns the control.Executor used by the client, to add interceptors or send other actions
+func (c *ContentDirectory) Executor() *control.Executor {
+	return c.exec
+}
+
+func (c *ContentDirectory) call(ctx context.Context, action string, args []control.Arg) (*BrowseResult, error) {
+	ret := struct {
+		Result         string
+		NumberReturned uint32
+		TotalMatches   uint32
+		UpdateID       uint32
+	}{}
+
+	if err := c.exec.Call(ctx, c.ServiceType, action, args, &ret); err != nil {
+		return nil, err
+	}
+
+	d, err := didl.Parse(ret.Result)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DIDL-Lite result: %v", err)
+	}
+
+	return &BrowseResult{Containers: d.Containers, Items: d.Items, NumberReturned: ret.NumberReturned,
+		TotalMatches: ret.TotalMatches, UpdateID: ret.UpdateID, Result: ret.Result}, nil
+}
+
+func (c *ContentDirectory) browse(ctx context.Context, id, flag, filter string, start, count uint32, sort string) (*BrowseResult, error) {
+	if len(filter) < 1 {
+		filter = FILTER_ALL
+	}
+
+	return c.call(ctx, "Browse", []control.Arg{
+		control.NewArg("ObjectID", id),
+		control.NewArg("BrowseFlag", flag),
+		control.NewArg("Filter", filter),
+		control.NewArg("StartingIndex", start),
+		control.NewArg("RequestedCount", count),
+		control.NewArg("SortCriteria", sort),
+	})
+}
+
+// BrowseMetadata returns the properties of the object itself, filter is a comma separated list of
+// properties to return (all if empty)
+func (c *ContentDirectory) BrowseMetadata(ctx context.Context, id, filter string) (*BrowseResult, error) {
+	return c.browse(ctx, id, "BrowseMetadata", filter, 0, 0, "")
+}
+
+// BrowseChildren returns a page of the children of a container.  A count of 0 requests all children,
+// but servers may return fewer than requested.  sort is a list of properties, ex. +upnp:artist,-dc:date
+func (c *ContentDirectory) BrowseChildren(ctx context.Context, id, filter string, start, count uint32, sort string) (*BrowseResult, error) {
+	return c.browse(ctx, id, "BrowseDirectChildren", filter, start, count, sort)
+}
+
+// Search returns a page of the objects below the container matching the criteria, ex. upnp:class
+// derivedfrom "object.item.audioItem" and dc:title contains "love"
+func (c *ContentDirectory) Search(ctx context.Context, id, criteria, filter string, start, count uint32, sort string) (*BrowseResult, error) {
+	if len(filter) < 1 {
+		filter = FILTER_ALL
+	}
+
+	return c.call(ctx, "Search", []control.Arg{
+		control.NewArg("ContainerID", id),
+		control.NewArg("SearchCriteria", criteria),
+		control.NewArg("Filter", filter),
+		control.NewArg("StartingIndex", start),
+		control.NewArg("RequestedCount", count),
+		control.NewArg("SortCriteria", sort),
+	})
+}
+
+// pages calls page for successive pages of BROWSE_PAGE_SIZE objects, until all have been returned
+// or fn returns an error
+func pages(ctx context.Context, page func(start uint32) (*BrowseResult, error), fn func(r *BrowseResult) error) error {
+	var start uint32
+	for {
+		r, err := page(start)
+		if err != nil {
+			return err
+		}
+
+		if err := fn(r); err != nil {
+			return err
+		}
+
+		start += r.NumberReturned
+		if r.NumberReturned < 1 || (r.TotalMatches > 0 && start >= r.TotalMatches) {
+			return nil
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+// BrowseAllChildren calls fn with each page of the children of a container.  Returning an error from fn
+// stops paging, and the error is returned; control.ErrStopIteration stops without error
+func (c *ContentDirectory) BrowseAllChildren(ctx context.Context, id, filter, sort string, fn func(r *BrowseResult) error) error {
+	err := pages(ctx, func(start uint32) (*BrowseResult, error) {
+		return c.BrowseChildren(ctx, id, filter, start, BROWSE_PAGE_SIZE, sort)
+	}, fn)
+
+	if err == control.ErrStopIteration {
+		return nil
+	}
+	return err
+}
+
+// SearchAll calls fn with each page of the search results, as for BrowseAllChildren
+func (c *ContentDirectory) SearchAll(ctx context.Context, id, criteria, filter, sort string, fn func(r *BrowseResult) error) error {
+	err := pages(ctx, func(start uint32) (*BrowseResult, error) {
+		return c.Search(ctx, id, criteria, filter, start, BROWSE_PAGE_SIZE, sort)
+	}, fn)
+
+	if err == control.ErrStopIteration {
+		return nil
+	}
+	return err
+}
+
+// WalkFunc is called for each object found by Walk, with the containers leading to it from the starting
+// container.  Exactly one of c and i is set.  Returning SkipContainer for a container skips its children,
+// and control.ErrStopIteration stops the walk without error
+type WalkFunc func(path []didl.Container, c *didl.Container, i *didl.Item) error
+
+// Walk visits every object below the container, depth first
+func (c *ContentDirectory) Walk(ctx context.Context, id string, fn WalkFunc) error {
+	err := c.walk(ctx, id, make([]didl.Container, 0), fn, make(map[string]bool))
+	if err == control.ErrStopIteration {
+		return nil
+	}
+	return err
+}
+
+func (c *ContentDirectory) walk(ctx context.Context, id string, path []didl.Container, fn WalkFunc, seen map[string]bool) error {
+	// guard against servers with loops in their tree
+	if seen[id] {
+		return nil
+	}
+	seen[id] = true
+
+	children := make([]didl.Container, 0)
+	err := c.BrowseAllChildren(ctx, id, FILTER_ALL, "", func(r *BrowseResult) error {
+		for i := range r.Containers {
+			err := fn(path, &r.Containers[i], nil)
+			if err == SkipContainer {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			children = append(children, r.Containers[i])
+		}
+
+		for i := range r.Items {
+			if err := fn(path, nil, &r.Items[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, ch := range children {
+		p := append(append(make([]didl.Container, 0, len(path)+1), path...), ch)
+		if err := c.walk(ctx, ch.ID, p, fn, seen); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetSearchCapabilities returns the properties which can be used in search criteria
+func (c *ContentDirectory) GetSearchCapabilities(ctx context.Context) ([]string, error) {
+	ret := struct {
+		SearchCaps string
+	}{}
+
+	if err := c.exec.Call(ctx, c.ServiceType, "GetSearchCapabilities", nil, &ret); err != nil {
+		return nil, err
+	}
+	return splitList(ret.SearchCaps), nil
+}
+
+// GetSortCapabilities returns the properties which can be used in sort criteria
+func (c *ContentDirectory) GetSortCapabilities(ctx context.Context) ([]string, error) {
+	ret := struct {
+		SortCaps string
+	}{}
+
+	if err := c.exec.Call(ctx, c.ServiceType, "GetSortCapabilities", nil, &ret); err != nil {
+		return nil, err
+	}
+	return splitList(ret.SortCaps), nil
+}
@@ -0,0 +1,223 @@
+package av
+
+import (
+	"context"
+	"fmt"
+	"github.com/mmmorris1975/go-upnp/control"
+	"github.com/mmmorris1975/go-upnp/description"
+	"github.com/mmmorris1975/go-upnp/device"
+	"github.com/mmmorris1975/go-upnp/didl"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type mockObject struct {
+	id, parent, title string
+	container         bool
+}
+
+func mockLibrary() []mockObject {
+	objs := []mockObject{
+		{"1", "0", "Music", true},
+		{"2", "0", "Video", true},
+		{"3", "2", "Empty", true},
+		{"20", "2", "Movie", false},
+	}
+	for n := 0; n < 150; n++ {
+		objs = append(objs, mockObject{fmt.Sprintf("1.%d", n), "1", fmt.Sprintf("Track %d", n), false})
+	}
+	return objs
+}
+
+func mockDIDL(objs []mockObject) string {
+	s := `<DIDL-Lite xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:upnp="urn:schemas-upnp-org:metadata-1-0/upnp/">`
+	for _, o := range objs {
+		if o.container {
+			s += fmt.Sprintf(`<container id="%s" parentID="%s" restricted="1"><dc:title>%s</dc:title><upnp:class>object.container</upnp:class></container>`, o.id, o.parent, o.title)
+		} else {
+			s += fmt.Sprintf(`<item id="%s" parentID="%s" restricted="1"><dc:title>%s</dc:title><upnp:class>object.item.audioItem</upnp:class>`+
+				`<res protocolInfo="http-get:*:audio/mpeg:*">http://example.com/%s.mp3</res></item>`, o.id, o.parent, o.title, o.id)
+		}
+	}
+	return s + "</DIDL-Lite>"
+}
+
+func page(objs []mockObject, c *device.Call) error {
+	start, count := int(c.In("StartingIndex").(uint32)), int(c.In("RequestedCount").(uint32))
+	total := len(objs)
+	if start > total {
+		start = total
+	}
+	end := total
+	if count > 0 && start+count < total {
+		end = start + count
+	}
+
+	// servers may return fewer than requested
+	if end-start > 60 {
+		end = start + 60
+	}
+
+	c.Out("Result", mockDIDL(objs[start:end]))
+	c.Out("NumberReturned", uint32(end-start))
+	c.Out("TotalMatches", uint32(total))
+	c.Out("UpdateID", uint32(7))
+	return nil
+}
+
+func contentDirectoryDef() *device.ServiceDef {
+	lib := mockLibrary()
+	out := []device.ArgDef{{Name: "Result", Variable: "A_ARG_TYPE_Result"}, {Name: "NumberReturned", Variable: "A_ARG_TYPE_Count"},
+		{Name: "TotalMatches", Variable: "A_ARG_TYPE_Count"}, {Name: "UpdateID", Variable: "A_ARG_TYPE_UpdateID"}}
+	common := []device.ArgDef{{Name: "Filter", Variable: "A_ARG_TYPE_Filter"}, {Name: "StartingIndex", Variable: "A_ARG_TYPE_Index"},
+		{Name: "RequestedCount", Variable: "A_ARG_TYPE_Count"}, {Name: "SortCriteria", Variable: "A_ARG_TYPE_SortCriteria"}}
+
+	return &device.ServiceDef{
+		ServiceType: CONTENT_DIRECTORY + ":1",
+		ServiceId:   "urn:upnp-org:serviceId:ContentDirectory",
+		Variables: []device.VariableDef{
+			{Name: "A_ARG_TYPE_ObjectID", DataType: "string"},
+			{Name: "A_ARG_TYPE_Result", DataType: "string"},
+			{Name: "A_ARG_TYPE_SearchCriteria", DataType: "string"},
+			{Name: "A_ARG_TYPE_BrowseFlag", DataType: "string", Allowed: []string{"BrowseMetadata", "BrowseDirectChildren"}},
+			{Name: "A_ARG_TYPE_Filter", DataType: "string"},
+			{Name: "A_ARG_TYPE_SortCriteria", DataType: "string"},
+			{Name: "A_ARG_TYPE_Index", DataType: "ui4"},
+			{Name: "A_ARG_TYPE_Count", DataType: "ui4"},
+			{Name: "A_ARG_TYPE_UpdateID", DataType: "ui4"},
+			{Name: "SearchCapabilities", DataType: "string", Default: "dc:title,upnp:class"},
+		},
+		Actions: []device.ActionDef{
+			{Name: "Browse", In: append([]device.ArgDef{{Name: "ObjectID", Variable: "A_ARG_TYPE_ObjectID"},
+				{Name: "BrowseFlag", Variable: "A_ARG_TYPE_BrowseFlag"}}, common...), Out: out, Handler: func(c *device.Call) error {
+				id := c.In("ObjectID").(string)
+				res := make([]mockObject, 0)
+				for _, o := range lib {
+					if (c.In("BrowseFlag") == "BrowseMetadata" && o.id == id) || (c.In("BrowseFlag") == "BrowseDirectChildren" && o.parent == id) {
+						res = append(res, o)
+					}
+				}
+				if len(res) < 1 && id != "3" {
+					return control.NewFault(ERR_NO_SUCH_OBJECT, "No such object")
+				}
+				return page(res, c)
+			}},
+			{Name: "Search", In: append([]device.ArgDef{{Name: "ContainerID", Variable: "A_ARG_TYPE_ObjectID"},
+				{Name: "SearchCriteria", Variable: "A_ARG_TYPE_SearchCriteria"}}, common...), Out: out, Handler: func(c *device.Call) error {
+				// only supports: dc:title contains "..."
+				term := strings.TrimSuffix(strings.TrimPrefix(c.In("SearchCriteria").(string), `dc:title contains "`), `"`)
+				res := make([]mockObject, 0)
+				for _, o := range lib {
+					if strings.Contains(o.title, term) {
+						res = append(res, o)
+					}
+				}
+				return page(res, c)
+			}},
+			{Name: "GetSearchCapabilities", Out: []device.ArgDef{{Name: "SearchCaps", Variable: "SearchCapabilities"}}},
+		},
+	}
+}
+
+func newMockMediaServer(t *testing.T) (*ContentDirectory, func()) {
+	h := device.NewHost(description.Device{DeviceType: MEDIA_SERVER_1, FriendlyName: "Server", Manufacturer: "go-upnp", ModelName: "server"})
+	if _, err := h.Declare("", contentDirectoryDef()); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(h)
+	dd, err := description.DescribeDevice(srv.URL+device.DESCRIPTION_PATH, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cd, err := NewContentDirectory(dd, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cd, srv.Close
+}
+
+func TestContentDirectory(t *testing.T) {
+	cd, done := newMockMediaServer(t)
+	defer done()
+	ctx := context.Background()
+
+	r, err := cd.BrowseMetadata(ctx, "2", "")
+	if err != nil || len(r.Containers) != 1 || r.Containers[0].Title != "Video" || r.UpdateID != 7 {
+		t.Errorf("unexpected metadata %+v %v", r, err)
+	}
+
+	if _, err := cd.BrowseMetadata(ctx, "99", ""); control.FaultCode(err) != ERR_NO_SUCH_OBJECT {
+		t.Errorf("expected fault 701, got %v", err)
+	}
+
+	r, err = cd.BrowseChildren(ctx, "1", "", 10, 5, "")
+	if err != nil || len(r.Items) != 5 || r.Items[0].Title != "Track 10" || r.TotalMatches != 150 {
+		t.Errorf("unexpected children %+v %v", r, err)
+	}
+
+	pages, count := 0, 0
+	err = cd.BrowseAllChildren(ctx, "1", "", "", func(r *BrowseResult) error {
+		pages++
+		count += len(r.Items)
+		return nil
+	})
+	if err != nil || count != 150 || pages != 3 {
+		t.Errorf("expected 150 items in 3 pages, got %d in %d (%v)", count, pages, err)
+	}
+
+	found := 0
+	err = cd.SearchAll(ctx, ROOT_CONTAINER_ID, `dc:title contains "Track 1"`, "", "", func(r *BrowseResult) error {
+		found += len(r.Items)
+		return nil
+	})
+	if err != nil || found != 61 {
+		t.Errorf("expected 61 search results, got %d (%v)", found, err)
+	}
+
+	if caps, err := cd.GetSearchCapabilities(ctx); err != nil || len(caps) != 2 {
+		t.Errorf("unexpected search capabilities %v %v", caps, err)
+	}
+}
+
+func TestWalk(t *testing.T) {
+	cd, done := newMockMediaServer(t)
+	defer done()
+
+	items, containers := 0, 0
+	var moviePath string
+	err := cd.Walk(context.Background(), ROOT_CONTAINER_ID, func(path []didl.Container, c *didl.Container, i *didl.Item) error {
+		if c != nil {
+			containers++
+			return nil
+		}
+		items++
+		if i.ID == "20" {
+			for _, p := range path {
+				moviePath += "/" + p.Title
+			}
+		}
+		return nil
+	})
+	if err != nil || items != 151 || containers != 3 || moviePath != "/Video" {
+		t.Errorf("unexpected walk: %d items, %d containers, movie path %s (%v)", items, containers, moviePath, err)
+	}
+
+	items = 0
+	err = cd.Walk(context.Background(), ROOT_CONTAINER_ID, func(path []didl.Container, c *didl.Container, i *didl.Item) error {
+		if c != nil && c.Title == "Music" {
+			return SkipContainer
+		}
+		if i != nil {
+			items++
+			return control.ErrStopIteration
+		}
+		return nil
+	})
+	if err != nil || items != 1 {
+		t.Errorf("expected walk to stop after the first item, got %d (%v)", items, err)
+	}
+}
@@ -0,0 +1,444 @@
+package av
+
+import (
+	"context"
+	"fmt"
+	"github.com/mmmorris1975/go-upnp/control"
+	"github.com/mmmorris1975/go-upnp/description"
+	"github.com/mmmorris1975/go-upnp/didl"
+	"github.com/mmmorris1975/go-upnp/discovery"
+	"github.com/mmmorris1975/go-upnp/eventing"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transport states reported by AVTransport
+const (
+	STATE_STOPPED          = "STOPPED"
+	STATE_PLAYING          = "PLAYING"
+	STATE_PAUSED_PLAYBACK  = "PAUSED_PLAYBACK"
+	STATE_TRANSITIONING    = "TRANSITIONING"
+	STATE_NO_MEDIA_PRESENT = "NO_MEDIA_PRESENT"
+)
+
+// Renderer controls a media renderer through its AVTransport, RenderingControl and ConnectionManager
+// services.  The ConnectionManager is optional, and RenderingControl is only required for volume and mute
+type Renderer struct {
+	Device *description.DeviceDescription
+	// AVTransport and RenderingControl instance to control, 0 unless a connection was prepared
+	InstanceID uint32
+	// Receives events for Watch(), eventing.DefaultCallbackServer if nil
+	CallbackServer *eventing.CallbackServer
+
+	avt  string
+	rcs  string
+	cms  string
+	exec *control.Executor
+}
+
+// DiscoverRenderers searches for media renderers, returning a Renderer for each one found
+func DiscoverRenderers(wait time.Duration) ([]*Renderer, error) {
+	ch := make(chan *discovery.SearchResponse, 10)
+	req := discovery.NewSearchRequest()
+	req.Target = MEDIA_RENDERER_1
+	req.Wait = wait
+	discovery.Discover(req, ch)
+
+	seen := make(map[string]bool)
+	res := make([]*Renderer, 0)
+	for r := range ch {
+		if seen[r.Location] {
+			continue
+		}
+		seen[r.Location] = true
+
+		dd, err := description.DescribeDevice(r.Location, wait)
+		if err != nil {
+			doLog("DiscoverRenderers() - DescribeDevice(%s): %v", r.Location, err)
+			continue
+		}
+
+		rr, err := NewRenderer(dd, wait)
+		if err != nil {
+			doLog("DiscoverRenderers() - NewRenderer(%s): %v", r.Location, err)
+			continue
+		}
+		res = append(res, rr)
+	}
+
+	return res, nil
+}
+
+// NewRenderer creates a Renderer for the device, which must have an AVTransport service
+func NewRenderer(dd *description.DeviceDescription, wait time.Duration) (*Renderer, error) {
+	r := &Renderer{
+		Device: dd,
+		avt:    findService(dd, AV_TRANSPORT),
+		rcs:    findService(dd, RENDERING_CONTROL),
+		cms:    findService(dd, CONNECTION_MANAGER),
+		exec:   control.NewExecutor(dd, MAX_CONCURRENT_REQUESTS, wait),
+	}
+
+	if len(r.avt) < 1 {
+		return nil, fmt.Errorf("no AVTransport service found")
+	}
+
+	return r, nil
+}
+
+// Executor returns the control.Executor used by the renderer, to add interceptors or send other actions
+func (r *Renderer) Executor() *control.Executor {
+	return r.exec
+}
+
+func (r *Renderer) instanceArg() control.Arg {
+	return control.NewArg("InstanceID", r.InstanceID)
+}
+
+func (r *Renderer) transport(ctx context.Context, action string, args []control.Arg, ret interface{}) error {
+	return r.exec.Call(ctx, r.avt, action, append([]control.Arg{r.instanceArg()}, args...), ret)
+}
+
+func (r *Renderer) rendering(ctx context.Context, action string, args []control.Arg, ret interface{}) error {
+	if len(r.rcs) < 1 {
+		return fmt.Errorf("no RenderingControl service found")
+	}
+	return r.exec.Call(ctx, r.rcs, action, append([]control.Arg{r.instanceArg()}, args...), ret)
+}
+
+// SetAVTransportURI loads the URI, metadata is a DIDL-Lite document and may be empty
+func (r *Renderer) SetAVTransportURI(ctx context.Context, uri, metadata string) error {
+	return r.transport(ctx, "SetAVTransportURI", []control.Arg{
+		control.NewArg("CurrentURI", uri),
+		control.NewArg("CurrentURIMetaData", metadata),
+	}, nil)
+}
+
+// SetNextAVTransportURI queues the URI to play after the current one (optional action)
+func (r *Renderer) SetNextAVTransportURI(ctx context.Context, uri, metadata string) error {
+	return r.transport(ctx, "SetNextAVTransportURI", []control.Arg{
+		control.NewArg("NextURI", uri),
+		control.NewArg("NextURIMetaData", metadata),
+	}, nil)
+}
+
+// Load loads the media, with DIDL-Lite metadata created from m
+func (r *Renderer) Load(ctx context.Context, m *Media) error {
+	md, err := m.Metadata()
+	if err != nil {
+		return err
+	}
+	return r.SetAVTransportURI(ctx, m.URI, md)
+}
+
+// Play starts playback at normal speed
+func (r *Renderer) Play(ctx context.Context) error {
+	return r.PlaySpeed(ctx, "1")
+}
+
+// PlaySpeed starts playback at the given speed, ex. "2" or "1/2"
+func (r *Renderer) PlaySpeed(ctx context.Context, speed string) error {
+	return r.transport(ctx, "Play", []control.Arg{control.NewArg("Speed", speed)}, nil)
+}
+
+func (r *Renderer) Pause(ctx context.Context) error {
+	return r.transport(ctx, "Pause", nil, nil)
+}
+
+func (r *Renderer) Stop(ctx context.Context) error {
+	return r.transport(ctx, "Stop", nil, nil)
+}
+
+func (r *Renderer) Next(ctx context.Context) error {
+	return r.transport(ctx, "Next", nil, nil)
+}
+
+func (r *Renderer) Previous(ctx context.Context) error {
+	return r.transport(ctx, "Previous", nil, nil)
+}
+
+// Seek moves to a position in the current track
+func (r *Renderer) Seek(ctx context.Context, pos time.Duration) error {
+	return r.SeekTarget(ctx, "REL_TIME", didl.FormatDuration(pos))
+}
+
+// SeekTarget seeks with any unit supported by the renderer, ex. TRACK_NR
+func (r *Renderer) SeekTarget(ctx context.Context, unit, target string) error {
+	return r.transport(ctx, "Seek", []control.Arg{control.NewArg("Unit", unit), control.NewArg("Target", target)}, nil)
+}
+
+type TransportInfo struct {
+	State  string `xml:"CurrentTransportState"`
+	Status string `xml:"CurrentTransportStatus"`
+	Speed  string `xml:"CurrentSpeed"`
+}
+
+func (r *Renderer) GetTransportInfo(ctx context.Context) (*TransportInfo, error) {
+	ti := new(TransportInfo)
+	if err := r.transport(ctx, "GetTransportInfo", nil, ti); err != nil {
+		return nil, err
+	}
+	return ti, nil
+}
+
+type PositionInfo struct {
+	Track         uint32
+	TrackDuration time.Duration
+	// DIDL-Lite metadata of the current track
+	TrackMetaData string
+	TrackURI      string
+	RelTime       time.Duration
+	AbsTime       time.Duration
+}
+
+func (r *Renderer) GetPositionInfo(ctx context.Context) (*PositionInfo, error) {
+	ret := struct {
+		Track         uint32
+		TrackDuration string
+		TrackMetaData string
+		TrackURI      string
+		RelTime       string
+		AbsTime       string
+	}{}
+
+	if err := r.transport(ctx, "GetPositionInfo", nil, &ret); err != nil {
+		return nil, err
+	}
+
+	p := &PositionInfo{Track: ret.Track, TrackMetaData: ret.TrackMetaData, TrackURI: ret.TrackURI}
+	p.TrackDuration, _ = didl.ParseDuration(ret.TrackDuration)
+	p.RelTime, _ = didl.ParseDuration(ret.RelTime)
+	p.AbsTime, _ = didl.ParseDuration(ret.AbsTime)
+
+	return p, nil
+}
+
+type MediaInfo struct {
+	NrTracks           uint32
+	MediaDuration      time.Duration
+	CurrentURI         string
+	CurrentURIMetaData string
+	NextURI            string
+	NextURIMetaData    string
+}
+
+func (r *Renderer) GetMediaInfo(ctx context.Context) (*MediaInfo, error) {
+	ret := struct {
+		NrTracks           uint32
+		MediaDuration      string
+		CurrentURI         string
+		CurrentURIMetaData string
+		NextURI            string
+		NextURIMetaData    string
+	}{}
+
+	if err := r.transport(ctx, "GetMediaInfo", nil, &ret); err != nil {
+		return nil, err
+	}
+
+	m := &MediaInfo{NrTracks: ret.NrTracks, CurrentURI: ret.CurrentURI, CurrentURIMetaData: ret.CurrentURIMetaData,
+		NextURI: ret.NextURI, NextURIMetaData: ret.NextURIMetaData}
+	m.MediaDuration, _ = didl.ParseDuration(ret.MediaDuration)
+
+	return m, nil
+}
+
+// GetVolume returns the volume of the Master channel
+func (r *Renderer) GetVolume(ctx context.Context) (uint16, error) {
+	ret := struct {
+		CurrentVolume uint16
+	}{}
+
+	err := r.rendering(ctx, "GetVolume", []control.Arg{control.NewArg("Channel", "Master")}, &ret)
+	return ret.CurrentVolume, err
+}
+
+// SetVolume sets the volume of the Master channel
+func (r *Renderer) SetVolume(ctx context.Context, v uint16) error {
+	return r.rendering(ctx, "SetVolume", []control.Arg{control.NewArg("Channel", "Master"), control.NewArg("DesiredVolume", v)}, nil)
+}
+
+// GetMute returns the mute setting of the Master channel
+func (r *Renderer) GetMute(ctx context.Context) (bool, error) {
+	ret := struct {
+		CurrentMute string
+	}{}
+
+	err := r.rendering(ctx, "GetMute", []control.Arg{control.NewArg("Channel", "Master")}, &ret)
+	return parseBool(ret.CurrentMute), err
+}
+
+// SetMute sets the mute setting of the Master channel
+func (r *Renderer) SetMute(ctx context.Context, mute bool) error {
+	return r.rendering(ctx, "SetMute", []control.Arg{control.NewArg("Channel", "Master"), control.NewArg("DesiredMute", mute)}, nil)
+}
+
+// GetProtocolInfo returns the protocolInfo values the renderer can play (sink) and serve (source)
+func (r *Renderer) GetProtocolInfo(ctx context.Context) (source, sink []string, err error) {
+	if len(r.cms) < 1 {
+		return nil, nil, fmt.Errorf("no ConnectionManager service found")
+	}
+
+	ret := struct {
+		Source string
+		Sink   string
+	}{}
+
+	if err := r.exec.Call(ctx, r.cms, "GetProtocolInfo", nil, &ret); err != nil {
+		return nil, nil, err
+	}
+
+	return splitList(ret.Source), splitList(ret.Sink), nil
+}
+
+func splitList(s string) []string {
+	res := make([]string, 0)
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); len(e) > 0 {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+func parseBool(s string) bool {
+	b, err := strconv.ParseBool(strings.TrimSpace(s))
+	return err == nil && b
+}
+
+// RendererState is a snapshot of the renderer state, built from LastChange events
+type RendererState struct {
+	TransportState       string
+	TransportStatus      string
+	CurrentTrackURI      string
+	CurrentTrackDuration time.Duration
+	// DIDL-Lite metadata of the current track
+	CurrentTrackMetaData string
+	Volume               uint16
+	Mute                 bool
+	Updated              time.Time
+}
+
+// update applies the LastChange of an event, returning true if anything changed
+func (s *RendererState) update(lc *eventing.LastChange, id uint32) bool {
+	ic := lc.Instance(id)
+	if ic == nil {
+		return false
+	}
+
+	changed := false
+	set := func(name string, fn func(v string)) {
+		if v, ok := ic.Get(name, ""); ok {
+			fn(v)
+			changed = true
+		}
+	}
+	setChannel := func(name string, fn func(v string)) {
+		if v, ok := ic.Get(name, "Master"); ok {
+			fn(v)
+			changed = true
+		}
+	}
+
+	set("TransportState", func(v string) { s.TransportState = v })
+	set("TransportStatus", func(v string) { s.TransportStatus = v })
+	set("CurrentTrackURI", func(v string) { s.CurrentTrackURI = v })
+	set("CurrentTrackMetaData", func(v string) { s.CurrentTrackMetaData = v })
+	set("CurrentTrackDuration", func(v string) { s.CurrentTrackDuration, _ = didl.ParseDuration(v) })
+	setChannel("Volume", func(v string) {
+		if n, err := strconv.ParseUint(v, 10, 16); err == nil {
+			s.Volume = uint16(n)
+		}
+	})
+	setChannel("Mute", func(v string) { s.Mute = parseBool(v) })
+
+	return changed
+}
+
+// Watch subscribes to the AVTransport and RenderingControl events of the renderer, sending a snapshot
+// of the renderer state to ch each time it changes, until ctx is done.  ch is closed before returning
+func (r *Renderer) Watch(ctx context.Context, ch chan<- RendererState) error {
+	defer close(ch)
+
+	srv := r.CallbackServer
+	if srv == nil {
+		srv = eventing.DefaultCallbackServer
+		if err := srv.Start(); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	events := make(chan *eventing.Event, 10)
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+
+	for _, st := range []string{r.avt, r.rcs} {
+		if len(st) < 1 {
+			continue
+		}
+
+		u, err := r.Device.BuildURL(r.Device.ServiceByType(st).EventSubURL)
+		if err != nil {
+			return err
+		}
+
+		m, err := eventing.NewSubscriptionManagerWithServer(u, eventing.DEFAULT_SUBSCRIPTION_DURATION, srv)
+		if err != nil {
+			return err
+		}
+
+		sub := make(chan *eventing.Event, 10)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := m.Run(ctx, sub); err != nil {
+				errs <- err
+				cancel()
+			}
+		}()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range sub {
+				select {
+				case events <- e:
+				case <-ctx.Done():
+				}
+			}
+		}()
+	}
+
+	state := RendererState{}
+	for {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			select {
+			case err := <-errs:
+				return err
+			default:
+				return nil
+			}
+		case e := <-events:
+			lc, err := e.LastChange()
+			if err != nil || lc == nil {
+				doLog("Watch() - LastChange(): %v", err)
+				continue
+			}
+
+			if state.update(lc, r.InstanceID) {
+				state.Updated = e.Received
+				select {
+				case ch <- state:
+				case <-ctx.Done():
+				}
+			}
+		}
+	}
+}
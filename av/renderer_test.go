@@ -0,0 +1,217 @@
+package av
+
+import (
+	"context"
+	"fmt"
+	"github.com/mmmorris1975/go-upnp/description"
+	"github.com/mmmorris1975/go-upnp/device"
+	"github.com/mmmorris1975/go-upnp/eventing"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func lastChange(ns, vars string) string {
+	return fmt.Sprintf(`<Event xmlns="urn:schemas-upnp-org:metadata-1-0/%s/"><InstanceID val="0">%s</InstanceID></Event>`, ns, vars)
+}
+
+func avTransportDef(seek *string) *device.ServiceDef {
+	instance := device.ArgDef{Name: "InstanceID", Variable: "A_ARG_TYPE_InstanceID"}
+	setState := func(c *device.Call, state string) error {
+		return c.Service.SetMany(map[string]interface{}{"TransportState": state,
+			"LastChange": lastChange("AVT", fmt.Sprintf(`<TransportState val="%s"/>`, state))})
+	}
+
+	return &device.ServiceDef{
+		ServiceType: AV_TRANSPORT + ":1",
+		ServiceId:   "urn:upnp-org:serviceId:AVTransport",
+		Variables: []device.VariableDef{
+			{Name: "A_ARG_TYPE_InstanceID", DataType: "ui4"},
+			{Name: "A_ARG_TYPE_SeekMode", DataType: "string", Allowed: []string{"REL_TIME", "TRACK_NR"}},
+			{Name: "A_ARG_TYPE_SeekTarget", DataType: "string"},
+			{Name: "TransportState", DataType: "string", Default: STATE_NO_MEDIA_PRESENT},
+			{Name: "TransportStatus", DataType: "string", Default: "OK"},
+			{Name: "TransportPlaySpeed", DataType: "string", Default: "1"},
+			{Name: "AVTransportURI", DataType: "string"},
+			{Name: "AVTransportURIMetaData", DataType: "string"},
+			{Name: "CurrentTrack", DataType: "ui4", Default: "1"},
+			{Name: "CurrentTrackDuration", DataType: "string", Default: "0:03:25"},
+			{Name: "RelativeTimePosition", DataType: "string", Default: "0:00:10.500"},
+			{Name: "LastChange", DataType: "string", Evented: true},
+		},
+		Actions: []device.ActionDef{
+			{Name: "SetAVTransportURI", In: []device.ArgDef{instance, {Name: "CurrentURI", Variable: "AVTransportURI"},
+				{Name: "CurrentURIMetaData", Variable: "AVTransportURIMetaData"}}, Handler: func(c *device.Call) error {
+				return c.Service.SetMany(map[string]interface{}{"AVTransportURI": c.In("CurrentURI"),
+					"AVTransportURIMetaData": c.In("CurrentURIMetaData"), "TransportState": STATE_STOPPED})
+			}},
+			{Name: "Play", In: []device.ArgDef{instance, {Name: "Speed", Variable: "TransportPlaySpeed"}}, Handler: func(c *device.Call) error {
+				return setState(c, STATE_PLAYING)
+			}},
+			{Name: "Pause", In: []device.ArgDef{instance}, Handler: func(c *device.Call) error {
+				return setState(c, STATE_PAUSED_PLAYBACK)
+			}},
+			{Name: "Stop", In: []device.ArgDef{instance}, Handler: func(c *device.Call) error {
+				return setState(c, STATE_STOPPED)
+			}},
+			{Name: "Seek", In: []device.ArgDef{instance, {Name: "Unit", Variable: "A_ARG_TYPE_SeekMode"},
+				{Name: "Target", Variable: "A_ARG_TYPE_SeekTarget"}}, Handler: func(c *device.Call) error {
+				*seek = c.In("Unit").(string) + " " + c.In("Target").(string)
+				return nil
+			}},
+			{Name: "GetTransportInfo", In: []device.ArgDef{instance}, Out: []device.ArgDef{
+				{Name: "CurrentTransportState", Variable: "TransportState"},
+				{Name: "CurrentTransportStatus", Variable: "TransportStatus"},
+				{Name: "CurrentSpeed", Variable: "TransportPlaySpeed"}}},
+			{Name: "GetPositionInfo", In: []device.ArgDef{instance}, Out: []device.ArgDef{
+				{Name: "Track", Variable: "CurrentTrack"},
+				{Name: "TrackDuration", Variable: "CurrentTrackDuration"},
+				{Name: "TrackMetaData", Variable: "AVTransportURIMetaData"},
+				{Name: "TrackURI", Variable: "AVTransportURI"},
+				{Name: "RelTime", Variable: "RelativeTimePosition"},
+				{Name: "AbsTime", Variable: "RelativeTimePosition"}}},
+		},
+	}
+}
+
+func renderingControlDef() *device.ServiceDef {
+	instance := device.ArgDef{Name: "InstanceID", Variable: "A_ARG_TYPE_InstanceID"}
+	channel := device.ArgDef{Name: "Channel", Variable: "A_ARG_TYPE_Channel"}
+
+	return &device.ServiceDef{
+		ServiceType: RENDERING_CONTROL + ":1",
+		ServiceId:   "urn:upnp-org:serviceId:RenderingControl",
+		Variables: []device.VariableDef{
+			{Name: "A_ARG_TYPE_InstanceID", DataType: "ui4"},
+			{Name: "A_ARG_TYPE_Channel", DataType: "string", Allowed: []string{"Master"}},
+			{Name: "Volume", DataType: "ui2", Default: "10", Min: "0", Max: "100", Step: "1"},
+			{Name: "Mute", DataType: "boolean", Default: "0"},
+			{Name: "LastChange", DataType: "string", Evented: true},
+		},
+		Actions: []device.ActionDef{
+			{Name: "GetVolume", In: []device.ArgDef{instance, channel}, Out: []device.ArgDef{{Name: "CurrentVolume", Variable: "Volume"}}},
+			{Name: "SetVolume", In: []device.ArgDef{instance, channel, {Name: "DesiredVolume", Variable: "Volume"}}, Handler: func(c *device.Call) error {
+				v := c.In("DesiredVolume").(uint16)
+				return c.Service.SetMany(map[string]interface{}{"Volume": v,
+					"LastChange": lastChange("RCS", fmt.Sprintf(`<Volume channel="Master" val="%d"/>`, v))})
+			}},
+			{Name: "GetMute", In: []device.ArgDef{instance, channel}, Out: []device.ArgDef{{Name: "CurrentMute", Variable: "Mute"}}},
+			{Name: "SetMute", In: []device.ArgDef{instance, channel, {Name: "DesiredMute", Variable: "Mute"}}, Handler: func(c *device.Call) error {
+				return c.Service.Set("Mute", c.In("DesiredMute"))
+			}},
+		},
+	}
+}
+
+// newMockRenderer hosts a media renderer, returning its description and the last Seek request
+func newMockRenderer(t *testing.T) (*description.DeviceDescription, *string, func()) {
+	h := device.NewHost(description.Device{DeviceType: MEDIA_RENDERER_1, FriendlyName: "Renderer",
+		Manufacturer: "go-upnp", ModelName: "renderer"})
+
+	seek := new(string)
+	if _, err := h.Declare("", avTransportDef(seek)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Declare("", renderingControlDef()); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(h)
+	dd, err := description.DescribeDevice(srv.URL+device.DESCRIPTION_PATH, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dd, seek, srv.Close
+}
+
+func TestRenderer(t *testing.T) {
+	dd, seek, done := newMockRenderer(t)
+	defer done()
+
+	r, err := NewRenderer(dd, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.CallbackServer = eventing.NewCallbackServer("127.0.0.1:0")
+	if err := r.CallbackServer.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.CallbackServer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	states := make(chan RendererState, 10)
+	watchErr := make(chan error, 1)
+	go func() { watchErr <- r.Watch(ctx, states) }()
+
+	waitState := func(fn func(s RendererState) bool) {
+		timeout := time.After(2 * time.Second)
+		for {
+			select {
+			case s := <-states:
+				if fn(s) {
+					return
+				}
+			case <-timeout:
+				t.Fatal("timed out waiting for renderer state")
+			}
+		}
+	}
+
+	bg := context.Background()
+	m := &Media{URI: "http://example.com/a.mp3", Title: "Track & <1>", Class: "object.item.audioItem.musicTrack",
+		ProtocolInfo: "http-get:*:audio/mpeg:*", Duration: 205 * time.Second}
+	if err := r.Load(bg, m); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := r.GetPositionInfo(bg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.TrackURI != m.URI || p.TrackDuration != 205*time.Second || p.RelTime != 10500*time.Millisecond ||
+		!strings.Contains(p.TrackMetaData, "<dc:title>Track &amp; &lt;1&gt;</dc:title>") {
+		t.Errorf("unexpected position info %+v", p)
+	}
+
+	if err := r.Play(bg); err != nil {
+		t.Fatal(err)
+	}
+	if ti, err := r.GetTransportInfo(bg); err != nil || ti.State != STATE_PLAYING || ti.Speed != "1" {
+		t.Errorf("unexpected transport info %+v %v", ti, err)
+	}
+	waitState(func(s RendererState) bool { return s.TransportState == STATE_PLAYING })
+
+	if err := r.Seek(bg, 65*time.Second); err != nil || *seek != "REL_TIME 0:01:05" {
+		t.Errorf("unexpected seek %s %v", *seek, err)
+	}
+
+	if err := r.SetVolume(bg, 30); err != nil {
+		t.Fatal(err)
+	}
+	waitState(func(s RendererState) bool { return s.Volume == 30 && s.TransportState == STATE_PLAYING })
+	if v, err := r.GetVolume(bg); err != nil || v != 30 {
+		t.Errorf("unexpected volume %d %v", v, err)
+	}
+
+	if err := r.SetMute(bg, true); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := r.GetMute(bg); err != nil || !m {
+		t.Errorf("unexpected mute %t %v", m, err)
+	}
+
+	if err := r.Stop(bg); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.GetProtocolInfo(bg); err == nil {
+		t.Error("expected error without ConnectionManager")
+	}
+
+	cancel()
+	if err := <-watchErr; err != nil {
+		t.Errorf("unexpected Watch error %v", err)
+	}
+}
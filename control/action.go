@@ -2,6 +2,7 @@ package control
 
 import (
 	"bytes"
+	"context"
 	"encoding/xml"
 	"fmt"
 	"github.com/mmmorris1975/go-upnp/description"
@@ -20,15 +21,43 @@ type Action interface {
 	Invoke(ret interface{}) error
 }
 
-type SimpleAction struct {
+// Arg is a single named action argument.  The UPnP spec requires arguments be sent in
+// the order defined by the service description, so these are kept in a slice, not a map
+type Arg struct {
 	XMLName xml.Name
-	ctrlUrl *url.URL
-	action  string
-	service string
-	c       *http.Client
+	Value   string `xml:",chardata"`
+}
+
+// NewArg converts v to its UPnP string representation, booleans are sent as 1 or 0
+func NewArg(name string, v interface{}) Arg {
+	var s string
+	switch t := v.(type) {
+	case bool:
+		if t {
+			s = "1"
+		} else {
+			s = "0"
+		}
+	default:
+		s = fmt.Sprint(v)
+	}
+
+	return Arg{XMLName: xml.Name{Local: name}, Value: s}
 }
 
-func NewAction(dd *description.DeviceDescription, svc, action string, wait time.Duration) (Action, error) {
+type SimpleAction struct {
+	XMLName      xml.Name
+	Args         []Arg
+	ctrlUrl      *url.URL
+	action       string
+	service      string
+	c            *http.Client
+	mode         ParseMode
+	interceptors []Interceptor
+}
+
+// NewAction creates an action for the service of the device, which implements Action
+func NewAction(dd *description.DeviceDescription, svc, action string, wait time.Duration) (*SimpleAction, error) {
 	ctrl, err := getControlUrl(dd, svc)
 	if err != nil {
 		return nil, err
@@ -44,70 +73,126 @@ func newSimpleAction(ctrl *url.URL, svc, action string, wait time.Duration) *Sim
 	a.action = action
 	a.c = &http.Client{Timeout: wait}
 	a.XMLName = xml.Name{Space: svc, Local: action}
+	a.mode = DefaultParseMode
 	return a
 }
 
+// SetParseMode controls how strictly responses are decoded, a matching entry in Quirks takes precedence
+func (a *SimpleAction) SetParseMode(m ParseMode) {
+	a.mode = m
+}
+
+// Use adds interceptors which are only called for this action, after any package-level Interceptors
+func (a *SimpleAction) Use(i ...Interceptor) {
+	a.interceptors = append(a.interceptors, i...)
+}
+
+// SetArgs replaces the input arguments sent with the action
+func (a *SimpleAction) SetArgs(args ...Arg) {
+	a.Args = args
+}
+
 func (a *SimpleAction) Invoke(ret interface{}) error {
-	req, err := a.buildSoapRequest()
+	return a.InvokeContext(context.Background(), ret)
+}
+
+// InvokeContext is the same as Invoke, but the request is cancelled if ctx is done
+func (a *SimpleAction) InvokeContext(ctx context.Context, ret interface{}) error {
+	req, body, err := a.buildSoapRequest()
 	if err != nil {
 		return err
 	}
+	req = req.WithContext(ctx)
+
+	chain := make([]Interceptor, 0, len(Interceptors)+len(a.interceptors))
+	chain = append(chain, Interceptors...)
+	chain = append(chain, a.interceptors...)
+
+	ar := &ActionRequest{Service: a.service, Action: a.action, Request: req, Body: body}
+	for _, i := range chain {
+		i.BeforeSend(ar)
+	}
+
+	start := time.Now()
+	rr := new(ActionResponse)
+	rr.Err = a.doInvoke(req, rr, ret)
+	rr.Latency = time.Since(start)
+
+	for _, i := range chain {
+		i.AfterReceive(ar, rr)
+	}
+
+	return rr.Err
+}
 
+func (a *SimpleAction) doInvoke(req *http.Request, rr *ActionResponse, ret interface{}) error {
 	res, err := a.c.Do(req)
 	if err != nil {
 		return err
 	}
 	defer res.Body.Close()
 
+	rr.StatusCode = res.StatusCode
+	rr.Header = res.Header
+
 	b, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		doLog("Invoke() - ReadAll(): %v", err)
 		return err
 	}
+	rr.Body = b
 
-	r := new(responseEnvelope)
-	if err = xml.Unmarshal(b, r); err != nil {
+	mode, charset := a.mode, ""
+	if q := findQuirk(res.Header.Get("Server")); q != nil {
+		if q.Mode != 0 {
+			mode = q.Mode
+		}
+		charset = q.Charset
+	}
+
+	r, f, err := parseResponse(b, res.Header.Get("Content-Type"), mode, charset)
+	if err != nil {
 		return err
 	}
 
-	if res.StatusCode == http.StatusOK {
-		if ret != nil {
-			if err := xml.Unmarshal(r.Body.Result, ret); err != nil {
-				return err
-			}
-		}
-	} else {
-		f := new(Fault)
-		if err := xml.Unmarshal(r.Body.Result, f); err != nil {
-			return err
-		}
+	// Some devices return HTTP 200 with a Fault, so check the body regardless of status code
+	if f != nil {
 		log.Printf("action returned HTTP %d: %s", res.StatusCode, f.Error())
-
 		return f
 	}
 
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("action returned HTTP %d", res.StatusCode)
+	}
+
+	if ret != nil {
+		if err := unmarshalResult(r, ret, mode); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func (a *SimpleAction) buildSoapRequest() (*http.Request, error) {
+func (a *SimpleAction) buildSoapRequest() (*http.Request, []byte, error) {
 	e := NewEnvelope()
 	e.Body.Action = a
 
 	x, err := xml.Marshal(e)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	req, err := http.NewRequest(http.MethodPost, a.ctrlUrl.String(), bytes.NewBuffer(x))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	req.Header.Set("SOAPACTION", fmt.Sprintf(`"%s#%s"`, a.service, a.action))
 	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
 	req.Header.Set("User-Agent", fmt.Sprintf(`%s/%s UPnP/1.1 xxx/1.0`, runtime.GOOS, runtime.Version()))
 
-	return req, nil
+	return req, x, nil
 }
 
 func getControlUrl(dd *description.DeviceDescription, svc string) (*url.URL, error) {
@@ -12,7 +12,7 @@ func TestAction(t *testing.T) {
 	a := newSimpleAction(u, "myService", "myAction", 1*time.Second)
 
 	t.Run("request", func(t *testing.T) {
-		r, err := a.buildSoapRequest()
+		r, _, err := a.buildSoapRequest()
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -3,6 +3,24 @@ package control
 import (
 	"encoding/xml"
 	"fmt"
+	"strconv"
+	"strings"
+)
+
+// UPnP error codes returned in a Fault, see UPnP 1.1 spec, section 3.2.2
+const (
+	ERR_INVALID_ACTION                  = 401
+	ERR_INVALID_ARGS                    = 402
+	ERR_ACTION_FAILED                   = 501
+	ERR_ARGUMENT_VALUE_INVALID          = 600
+	ERR_ARGUMENT_VALUE_OUT_OF_RANGE     = 601
+	ERR_OPTIONAL_ACTION_NOT_IMPLEMENTED = 602
+	ERR_OUT_OF_MEMORY                   = 603
+	ERR_HUMAN_INTERVENTION_REQUIRED     = 604
+	ERR_STRING_ARGUMENT_TOO_LONG        = 605
+
+	// Common to services with indexed actions, like WANIPConnection GetGenericPortMappingEntry
+	ERR_SPECIFIED_ARRAY_INDEX_INVALID = 713
 )
 
 type Fault struct {
@@ -17,6 +35,35 @@ func (f Fault) Error() string {
 	return fmt.Sprintf("%v: %v", f.ErrorDescription, f.ErrorCode)
 }
 
+// Code returns the numeric UPnP error code, or 0 if it is missing or not a number
+func (f Fault) Code() int {
+	c, err := strconv.Atoi(strings.TrimSpace(f.ErrorCode))
+	if err != nil {
+		return 0
+	}
+	return c
+}
+
+// FaultCode returns the UPnP error code if err is a Fault, otherwise 0
+func FaultCode(err error) int {
+	switch t := err.(type) {
+	case Fault:
+		return t.Code()
+	case *Fault:
+		return t.Code()
+	}
+	return 0
+}
+
+// IsFault returns true if the error is a SOAP Fault returned by the device
+func IsFault(err error) bool {
+	switch err.(type) {
+	case Fault, *Fault:
+		return true
+	}
+	return false
+}
+
 type Body struct {
 	XMLName xml.Name `xml:"s:Body"`
 	Action
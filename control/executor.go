@@ -0,0 +1,127 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"github.com/mmmorris1975/go-upnp/description"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ErrStopIteration can be returned from the Iterate() callback to end the iteration without error
+var ErrStopIteration = errors.New("stop iteration")
+
+// Executor sends actions to a single device, limiting the number of requests in flight at once and
+// reusing keep-alive connections between requests.  Requests beyond the limit are queued until a slot
+// is available, or the request context is done.  An Executor is safe for concurrent use
+type Executor struct {
+	dd           *description.DeviceDescription
+	c            *http.Client
+	sem          chan struct{}
+	interceptors []Interceptor
+	mode         ParseMode
+}
+
+// NewExecutor creates an Executor for the device, allowing at most max concurrent requests (minimum 1),
+// each of which must complete within wait
+func NewExecutor(dd *description.DeviceDescription, max int, wait time.Duration) *Executor {
+	if max < 1 {
+		max = 1
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxConnsPerHost = max
+	t.MaxIdleConnsPerHost = max
+	t.IdleConnTimeout = 90 * time.Second
+
+	return &Executor{
+		dd:   dd,
+		c:    &http.Client{Timeout: wait, Transport: t},
+		sem:  make(chan struct{}, max),
+		mode: DefaultParseMode,
+	}
+}
+
+// Use adds interceptors to every action sent through this Executor
+func (e *Executor) Use(i ...Interceptor) {
+	e.interceptors = append(e.interceptors, i...)
+}
+
+func (e *Executor) SetParseMode(m ParseMode) {
+	e.mode = m
+}
+
+// NewAction returns an action using the executor's connection pool, however calling Invoke on the
+// action directly bypasses the concurrency limit, use Call() to honor it
+func (e *Executor) NewAction(svc, action string) (*SimpleAction, error) {
+	u, err := getControlUrl(e.dd, svc)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.newAction(u, svc, action), nil
+}
+
+func (e *Executor) newAction(u *url.URL, svc, action string) *SimpleAction {
+	a := newSimpleAction(u, svc, action, 0)
+	a.c = e.c
+	a.mode = e.mode
+	a.Use(e.interceptors...)
+	return a
+}
+
+// Call invokes the action with the given arguments, waiting for a free slot if the concurrency
+// limit has been reached.  The result is unmarshalled in to ret, if not nil
+func (e *Executor) Call(ctx context.Context, svc, action string, args []Arg, ret interface{}) error {
+	a, err := e.NewAction(svc, action)
+	if err != nil {
+		return err
+	}
+	a.SetArgs(args...)
+
+	return e.invoke(ctx, a, ret)
+}
+
+func (e *Executor) invoke(ctx context.Context, a *SimpleAction, ret interface{}) error {
+	select {
+	case e.sem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-e.sem }()
+
+	return a.InvokeContext(ctx, ret)
+}
+
+// Iterate calls an indexed action (like GetGenericPortMappingEntry) with the indexArg argument set to
+// 0, 1, 2 ... followed by args.  For each index, newRet is called to obtain the value to unmarshal the
+// result in to, which is passed to fn.  Iteration stops without error when the device returns fault
+// 713 (SpecifiedArrayIndexInvalid) or fn returns ErrStopIteration.  Returns the number of entries read
+func (e *Executor) Iterate(ctx context.Context, svc, action, indexArg string, args []Arg,
+	newRet func() interface{}, fn func(ret interface{}) error) (int, error) {
+	u, err := getControlUrl(e.dd, svc)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := 0; ; i++ {
+		a := e.newAction(u, svc, action)
+		a.SetArgs(append([]Arg{NewArg(indexArg, i)}, args...)...)
+
+		ret := newRet()
+		if err := e.invoke(ctx, a, ret); err != nil {
+			if FaultCode(err) == ERR_SPECIFIED_ARRAY_INDEX_INVALID {
+				return i, nil
+			}
+			return i, err
+		}
+
+		if err := fn(ret); err != nil {
+			if err == ErrStopIteration {
+				return i + 1, nil
+			}
+			return i + 1, err
+		}
+	}
+}
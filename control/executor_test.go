@@ -0,0 +1,130 @@
+package control
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"github.com/mmmorris1975/go-upnp/description"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const mockDeviceDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0"><specVersion><major>1</major><minor>1</minor></specVersion>
+<device><deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+<serviceList><service><serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+<serviceId>urn:upnp-org:serviceId:WANIPConn1</serviceId><SCPDURL>/scpd.xml</SCPDURL>
+<controlURL>/ctl</controlURL><eventSubURL>/evt</eventSubURL></service></serviceList></device></root>`
+
+const wanIP = "urn:schemas-upnp-org:service:WANIPConnection:1"
+
+type mockEntry struct {
+	Port int `xml:"NewExternalPort"`
+}
+
+// mock gateway with 5 port mappings, which tracks the max number of concurrent requests
+func mockGateway(inFlight, maxInFlight *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/desc.xml" {
+			w.Write([]byte(mockDeviceDescription))
+			return
+		}
+
+		n := atomic.AddInt32(inFlight, 1)
+		defer atomic.AddInt32(inFlight, -1)
+		for {
+			m := atomic.LoadInt32(maxInFlight)
+			if n <= m || atomic.CompareAndSwapInt32(maxInFlight, m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		b, _ := ioutil.ReadAll(r.Body)
+		v := struct {
+			Index int `xml:"Body>GetGenericPortMappingEntry>NewPortMappingIndex"`
+		}{}
+		xml.Unmarshal(b, &v)
+
+		if v.Index >= 5 {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(strings.Replace(strings.Replace(faultResponse, "401", "713", 1), "Invalid Action", "SpecifiedArrayIndexInvalid", 1)))
+			return
+		}
+
+		fmt.Fprintf(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>
+<u:GetGenericPortMappingEntryResponse xmlns:u="%s"><NewExternalPort>%d</NewExternalPort>
+</u:GetGenericPortMappingEntryResponse></s:Body></s:Envelope>`, wanIP, 1000+v.Index)
+	}))
+}
+
+func TestExecutor(t *testing.T) {
+	var inFlight, maxInFlight int32
+	s := mockGateway(&inFlight, &maxInFlight)
+	defer s.Close()
+
+	dd, err := description.DescribeDevice(s.URL+"/desc.xml", 1*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := NewExecutor(dd, 2, 1*time.Second)
+
+	t.Run("concurrency", func(t *testing.T) {
+		wg := sync.WaitGroup{}
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				ret := new(mockEntry)
+				args := []Arg{NewArg("NewPortMappingIndex", i%5)}
+				if err := e.Call(context.Background(), wanIP, "GetGenericPortMappingEntry", args, ret); err != nil {
+					t.Error(err)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		if maxInFlight > 2 {
+			t.Errorf("concurrency limit exceeded: %d", maxInFlight)
+		}
+	})
+
+	t.Run("iterate", func(t *testing.T) {
+		ports := make([]int, 0)
+		n, err := e.Iterate(context.Background(), wanIP, "GetGenericPortMappingEntry", "NewPortMappingIndex", nil,
+			func() interface{} { return new(mockEntry) },
+			func(ret interface{}) error {
+				ports = append(ports, ret.(*mockEntry).Port)
+				return nil
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n != 5 || len(ports) != 5 || ports[4] != 1004 {
+			t.Errorf("unexpected iteration result: %d %v", n, ports)
+		}
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		// fill all slots, so the next call is queued until the context expires
+		e.sem <- struct{}{}
+		e.sem <- struct{}{}
+		defer func() { <-e.sem; <-e.sem }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+
+		err := e.Call(ctx, wanIP, "GetGenericPortMappingEntry", nil, nil)
+		if err != context.DeadlineExceeded {
+			t.Errorf("expected deadline exceeded, got %v", err)
+		}
+	})
+}
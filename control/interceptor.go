@@ -0,0 +1,174 @@
+package control
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Interceptors registered here are called for every action invoked by this package, before
+// any interceptors registered on an individual action via Use()
+var Interceptors []Interceptor
+
+// Interceptor provides hooks in to the request/response cycle of a SOAP action.  BeforeSend is
+// called with the fully built HTTP request (including SOAP body) just before it is sent, so it
+// is allowed to modify request headers.  AfterReceive is called once the exchange is complete,
+// even when the request failed at the transport level
+type Interceptor interface {
+	BeforeSend(req *ActionRequest)
+	AfterReceive(req *ActionRequest, res *ActionResponse)
+}
+
+type ActionRequest struct {
+	Service string
+	Action  string
+	Request *http.Request
+	Body    []byte
+}
+
+type ActionResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	Latency    time.Duration
+	// Err will be a Fault if the device returned a SOAP fault, otherwise any error
+	// encountered sending the request or handling the response
+	Err error
+}
+
+// InterceptorFunc adapts a pair of functions to the Interceptor interface, either may be nil
+type InterceptorFunc struct {
+	Before func(req *ActionRequest)
+	After  func(req *ActionRequest, res *ActionResponse)
+}
+
+func (f InterceptorFunc) BeforeSend(req *ActionRequest) {
+	if f.Before != nil {
+		f.Before(req)
+	}
+}
+
+func (f InterceptorFunc) AfterReceive(req *ActionRequest, res *ActionResponse) {
+	if f.After != nil {
+		f.After(req, res)
+	}
+}
+
+// WireDumper writes the raw HTTP request and response of each action to the provided writer
+type WireDumper struct {
+	w  io.Writer
+	mu sync.Mutex
+}
+
+func NewWireDumper(w io.Writer) *WireDumper {
+	return &WireDumper{w: w}
+}
+
+func (d *WireDumper) BeforeSend(req *ActionRequest) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	r := req.Request
+	fmt.Fprintf(d.w, ">>> %s %s %s\r\n", r.Method, r.URL.RequestURI(), r.Proto)
+	fmt.Fprintf(d.w, "Host: %s\r\n", r.URL.Host)
+	r.Header.Write(d.w)
+	fmt.Fprintf(d.w, "\r\n%s\n", req.Body)
+}
+
+func (d *WireDumper) AfterReceive(req *ActionRequest, res *ActionResponse) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if res.StatusCode == 0 {
+		fmt.Fprintf(d.w, "<<< %s#%s failed after %s: %v\n", req.Service, req.Action, res.Latency, res.Err)
+		return
+	}
+
+	fmt.Fprintf(d.w, "<<< HTTP %d %s (%s)\r\n", res.StatusCode, http.StatusText(res.StatusCode), res.Latency)
+	res.Header.Write(d.w)
+	fmt.Fprintf(d.w, "\r\n%s\n", res.Body)
+}
+
+type ActionStats struct {
+	Service      string
+	Action       string
+	Calls        int
+	Faults       int
+	Errors       int
+	TotalLatency time.Duration
+	MaxLatency   time.Duration
+}
+
+func (s ActionStats) AvgLatency() time.Duration {
+	if s.Calls < 1 {
+		return 0
+	}
+	return s.TotalLatency / time.Duration(s.Calls)
+}
+
+// Metrics counts calls, faults, non-fault errors and latency per service and action
+type Metrics struct {
+	mu    sync.Mutex
+	stats map[string]*ActionStats
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{stats: make(map[string]*ActionStats)}
+}
+
+func (m *Metrics) BeforeSend(req *ActionRequest) {}
+
+func (m *Metrics) AfterReceive(req *ActionRequest, res *ActionResponse) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k := fmt.Sprintf("%s#%s", req.Service, req.Action)
+	s, ok := m.stats[k]
+	if !ok {
+		s = &ActionStats{Service: req.Service, Action: req.Action}
+		m.stats[k] = s
+	}
+
+	s.Calls++
+	s.TotalLatency += res.Latency
+	if res.Latency > s.MaxLatency {
+		s.MaxLatency = res.Latency
+	}
+
+	if res.Err != nil {
+		if IsFault(res.Err) {
+			s.Faults++
+		} else {
+			s.Errors++
+		}
+	}
+}
+
+// Snapshot returns a copy of the current stats, sorted by service and action
+func (m *Metrics) Snapshot() []ActionStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r := make([]ActionStats, 0, len(m.stats))
+	for _, s := range m.stats {
+		r = append(r, *s)
+	}
+
+	sort.Slice(r, func(i, j int) bool {
+		if r[i].Service == r[j].Service {
+			return r[i].Action < r[j].Action
+		}
+		return r[i].Service < r[j].Service
+	})
+
+	return r
+}
+
+func (m *Metrics) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stats = make(map[string]*ActionStats)
+}
@@ -0,0 +1,102 @@
+package control
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const faultResponse = `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+<s:Body><s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring>
+<detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>401</errorCode>
+<errorDescription>Invalid Action</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`
+
+const okResponse = `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+<s:Body><u:myActionResponse xmlns:u="myService"><Out>42</Out></u:myActionResponse></s:Body></s:Envelope>`
+
+func mockDevice() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+		if strings.Contains(r.Header.Get("SOAPACTION"), "#bad") {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(faultResponse))
+			return
+		}
+		w.Write([]byte(okResponse))
+	}))
+}
+
+func TestInterceptors(t *testing.T) {
+	s := mockDevice()
+	defer s.Close()
+	u, _ := url.Parse(s.URL)
+
+	m := NewMetrics()
+	buf := new(bytes.Buffer)
+
+	ok := newSimpleAction(u, "myService", "myAction", 1*time.Second)
+	ok.Use(m, NewWireDumper(buf))
+	bad := newSimpleAction(u, "myService", "bad", 1*time.Second)
+	bad.Use(m)
+
+	t.Run("ok", func(t *testing.T) {
+		ret := struct {
+			Out int
+		}{}
+		if err := ok.Invoke(&ret); err != nil {
+			t.Fatal(err)
+		}
+		if ret.Out != 42 {
+			t.Errorf("unexpected result: %d", ret.Out)
+		}
+
+		d := buf.String()
+		if !strings.Contains(d, `Soapaction: "myService#myAction"`) || !strings.Contains(d, "<Out>42</Out>") {
+			t.Errorf("wire dump missing request or response data:\n%s", d)
+		}
+	})
+
+	t.Run("fault", func(t *testing.T) {
+		err := bad.Invoke(nil)
+		if !IsFault(err) {
+			t.Fatalf("expected fault, got %v", err)
+		}
+	})
+
+	t.Run("metrics", func(t *testing.T) {
+		stats := m.Snapshot()
+		if len(stats) != 2 {
+			t.Fatalf("expected stats for 2 actions, got %d", len(stats))
+		}
+
+		if stats[0].Action != "bad" || stats[0].Calls != 1 || stats[0].Faults != 1 {
+			t.Errorf("unexpected stats: %+v", stats[0])
+		}
+
+		if stats[1].Action != "myAction" || stats[1].Calls != 1 || stats[1].Faults != 0 || stats[1].Errors != 0 {
+			t.Errorf("unexpected stats: %+v", stats[1])
+		}
+	})
+
+	t.Run("modify request", func(t *testing.T) {
+		var h string
+		a := newSimpleAction(u, "myService", "myAction", 1*time.Second)
+		a.Use(InterceptorFunc{
+			Before: func(req *ActionRequest) { req.Request.Header.Set("X-Test", "1") },
+			After:  func(req *ActionRequest, res *ActionResponse) { h = req.Request.Header.Get("X-Test") },
+		})
+
+		if err := a.Invoke(nil); err != nil {
+			t.Fatal(err)
+		}
+		if h != "1" {
+			t.Error("header set in BeforeSend not present")
+		}
+	})
+}
@@ -0,0 +1,283 @@
+package control
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+type ParseMode int
+
+const (
+	// StrictParsing requires a well-formed, UTF-8 SOAP Envelope>Body response
+	StrictParsing ParseMode = iota + 1
+	// LenientParsing tolerates byte order marks, non UTF-8 charsets, unescaped ampersands,
+	// and missing or undeclared SOAP envelope namespaces
+	LenientParsing
+)
+
+// DefaultParseMode is used for actions which have not been configured with SetParseMode()
+var DefaultParseMode = StrictParsing
+
+// Quirk describes how to handle responses from a class of devices, matched by the Server header
+type Quirk struct {
+	// Case-insensitive substring of the HTTP Server response header
+	Server string
+	// If set, overrides the parse mode of the action
+	Mode ParseMode
+	// If set, assume the response body uses this charset no matter what it declares
+	Charset string
+}
+
+// Quirks are checked in order, and the first matching entry applies
+var Quirks []Quirk
+
+func findQuirk(server string) *Quirk {
+	server = strings.ToLower(server)
+	for i := range Quirks {
+		if len(Quirks[i].Server) > 0 && strings.Contains(server, strings.ToLower(Quirks[i].Server)) {
+			return &Quirks[i]
+		}
+	}
+	return nil
+}
+
+// parseResponse returns the inner XML of the SOAP Body, or the Fault if the body contains one
+func parseResponse(b []byte, contentType string, mode ParseMode, charset string) ([]byte, *Fault, error) {
+	var res []byte
+
+	if mode == LenientParsing {
+		r, err := lenientBody(b, contentType, charset)
+		if err != nil {
+			return nil, nil, err
+		}
+		res = r
+	} else {
+		if len(charset) > 0 {
+			u, err := toUTF8(b, contentType, charset)
+			if err != nil {
+				return nil, nil, err
+			}
+			b = stripXMLDecl(u)
+		}
+
+		r := new(responseEnvelope)
+		if err := xml.Unmarshal(b, r); err != nil {
+			return nil, nil, err
+		}
+		res = r.Body.Result
+	}
+
+	if firstElement(res) == "Fault" {
+		f := new(Fault)
+		if err := xml.Unmarshal(res, f); err != nil {
+			return nil, nil, err
+		}
+		return res, f, nil
+	}
+
+	return res, nil, nil
+}
+
+func unmarshalResult(b []byte, v interface{}, mode ParseMode) error {
+	if mode != LenientParsing {
+		return xml.Unmarshal(b, v)
+	}
+
+	d := xml.NewDecoder(bytes.NewReader(b))
+	d.Strict = false
+	d.Entity = xml.HTMLEntity
+	return d.Decode(v)
+}
+
+func firstElement(b []byte) string {
+	d := xml.NewDecoder(bytes.NewReader(b))
+	d.Strict = false
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return ""
+		}
+		if se, ok := t.(xml.StartElement); ok {
+			return se.Name.Local
+		}
+	}
+}
+
+func lenientBody(b []byte, contentType, charset string) ([]byte, error) {
+	b, err := toUTF8(b, contentType, charset)
+	if err != nil {
+		return nil, err
+	}
+	b = stripXMLDecl(b)
+	b = fixAmpersands(b)
+
+	d := xml.NewDecoder(bytes.NewReader(b))
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		se, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		switch se.Name.Local {
+		case "Envelope":
+			continue
+		case "Header":
+			if err := d.Skip(); err != nil {
+				return nil, err
+			}
+		case "Body":
+			v := struct {
+				Inner []byte `xml:",innerxml"`
+			}{}
+			if err := d.DecodeElement(&v, &se); err != nil {
+				return nil, err
+			}
+			return v.Inner, nil
+		default:
+			// No Body element, assume the device sent the response element on its own
+			return b, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no SOAP Body found in response")
+}
+
+var xmlDeclRe = regexp.MustCompile(`^\s*<\?xml[^>]*\?>`)
+var xmlEncodingRe = regexp.MustCompile(`encoding\s*=\s*["']([A-Za-z0-9._-]+)["']`)
+
+func stripXMLDecl(b []byte) []byte {
+	return xmlDeclRe.ReplaceAll(b, nil)
+}
+
+var ampRe = regexp.MustCompile(`&(#[0-9]+;|#x[0-9a-fA-F]+;|[A-Za-z][A-Za-z0-9]*;)?`)
+
+// fixAmpersands escapes any '&' which doesn't start a character or entity reference
+func fixAmpersands(b []byte) []byte {
+	return ampRe.ReplaceAllFunc(b, func(m []byte) []byte {
+		if len(m) > 1 {
+			return m
+		}
+		return []byte("&amp;")
+	})
+}
+
+// toUTF8 removes any byte order mark and converts the body to UTF-8.  The charset is determined by
+// (in order) the override, the XML declaration, and the Content-Type header, defaulting to UTF-8
+func toUTF8(b []byte, contentType, charset string) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(b, []byte{0xEF, 0xBB, 0xBF}):
+		return b[3:], nil
+	case bytes.HasPrefix(b, []byte{0xFF, 0xFE}):
+		return decodeUTF16(b[2:], false), nil
+	case bytes.HasPrefix(b, []byte{0xFE, 0xFF}):
+		return decodeUTF16(b[2:], true), nil
+	}
+
+	if len(charset) < 1 {
+		if m := xmlDeclRe.Find(b); m != nil {
+			if e := xmlEncodingRe.FindSubmatch(m); e != nil {
+				charset = string(e[1])
+			}
+		}
+	}
+
+	if len(charset) < 1 {
+		if _, p, err := mime.ParseMediaType(contentType); err == nil {
+			charset = p["charset"]
+		}
+	}
+
+	r, err := charsetReader(charset, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(r)
+}
+
+// charsetReader supports the single-byte charsets commonly (mis)used by consumer devices,
+// and can be used as an xml.Decoder CharsetReader
+func charsetReader(label string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(strings.Trim(label, `"' `)) {
+	case "", "utf-8", "utf8":
+		return input, nil
+	case "us-ascii", "ascii", "iso-8859-1", "iso8859-1", "latin1", "latin-1", "l1":
+		return &singleByteReader{r: input}, nil
+	case "windows-1252", "cp1252":
+		return &singleByteReader{r: input, table: &cp1252}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported charset: %s", label)
+}
+
+// cp1252 differs from ISO-8859-1 only in the 0x80-0x9F range
+var cp1252 = [32]rune{
+	0x20AC, 0xFFFD, 0x201A, 0x0192, 0x201E, 0x2026, 0x2020, 0x2021,
+	0x02C6, 0x2030, 0x0160, 0x2039, 0x0152, 0xFFFD, 0x017D, 0xFFFD,
+	0xFFFD, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014,
+	0x02DC, 0x2122, 0x0161, 0x203A, 0x0153, 0xFFFD, 0x017E, 0x0178,
+}
+
+type singleByteReader struct {
+	r     io.Reader
+	table *[32]rune
+	buf   []byte
+}
+
+func (s *singleByteReader) Read(p []byte) (int, error) {
+	for len(s.buf) < 1 {
+		in := make([]byte, 1024)
+		n, err := s.r.Read(in)
+		for _, c := range in[:n] {
+			r := rune(c)
+			if s.table != nil && c >= 0x80 && c < 0xA0 {
+				r = s.table[c-0x80]
+			}
+			s.buf = utf8.AppendRune(s.buf, r)
+		}
+		if err != nil && len(s.buf) < 1 {
+			return 0, err
+		}
+	}
+
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+func decodeUTF16(b []byte, bigEndian bool) []byte {
+	u := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		if bigEndian {
+			u = append(u, uint16(b[i])<<8|uint16(b[i+1]))
+		} else {
+			u = append(u, uint16(b[i+1])<<8|uint16(b[i]))
+		}
+	}
+
+	out := new(bytes.Buffer)
+	for _, r := range utf16.Decode(u) {
+		out.WriteRune(r)
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,108 @@
+package control
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+type lenientResult struct {
+	Name string `xml:"NewName"`
+}
+
+func TestParseResponse(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		ct    string
+		fault bool
+		want  string
+	}{
+		{"bom", "\xEF\xBB\xBF" + `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><u:R xmlns:u="svc"><NewName>bom</NewName></u:R></s:Body></s:Envelope>`, "", false, "bom"},
+		{"latin1 decl", `<?xml version="1.0" encoding="ISO-8859-1"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><u:R xmlns:u="svc"><NewName>caf` + "\xE9" + `</NewName></u:R></s:Body></s:Envelope>`, "", false, "café"},
+		{"latin1 header", `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><u:R xmlns:u="svc"><NewName>caf` + "\xE9" + `</NewName></u:R></s:Body></s:Envelope>`, "text/xml; charset=iso-8859-1", false, "café"},
+		{"ampersand", `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><u:R xmlns:u="svc"><NewName>A & B &amp; C</NewName></u:R></s:Body></s:Envelope>`, "", false, "A & B & C"},
+		{"no namespace", `<s:Envelope><s:Body><u:R><NewName>nons</NewName></u:R></s:Body></s:Envelope>`, "", false, "nons"},
+		{"no envelope", `<u:R xmlns:u="svc"><NewName>bare</NewName></u:R>`, "", false, "bare"},
+		{"fault", faultResponse, "", true, ""},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b, f, err := parseResponse([]byte(tc.body), tc.ct, LenientParsing, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.fault {
+				if f == nil || f.ErrorCode != "401" {
+					t.Fatalf("expected fault 401, got %v", f)
+				}
+				return
+			}
+
+			r := new(lenientResult)
+			if err := unmarshalResult(b, r, LenientParsing); err != nil {
+				t.Fatal(err)
+			}
+			if r.Name != tc.want {
+				t.Errorf("got %q, want %q", r.Name, tc.want)
+			}
+		})
+	}
+}
+
+func TestQuirks(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "Linux/2.6 UPnP/1.0 CheapRouter/1.0")
+		// Fault with HTTP 200, and an unescaped ampersand in the description
+		w.Write([]byte(`<s:Envelope><s:Body><s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring>
+<detail><UPnPError><errorCode>714</errorCode><errorDescription>No Such Entry & Stuff</errorDescription></UPnPError></detail>
+</s:Fault></s:Body></s:Envelope>`))
+	}))
+	defer s.Close()
+	u, _ := url.Parse(s.URL)
+
+	a := newSimpleAction(u, "svc", "act", 1*time.Second)
+	if err := a.Invoke(nil); err == nil || IsFault(err) {
+		t.Fatalf("expected parse error in strict mode, got %v", err)
+	}
+
+	Quirks = append(Quirks, Quirk{Server: "cheaprouter", Mode: LenientParsing})
+	defer func() { Quirks = nil }()
+
+	err := a.Invoke(nil)
+	f, ok := err.(*Fault)
+	if !ok {
+		t.Fatalf("expected fault, got %v", err)
+	}
+	if f.ErrorCode != "714" {
+		t.Errorf("unexpected error code %s", f.ErrorCode)
+	}
+}
+
+func TestQuirkCharsetOnly(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "Linux/2.6 UPnP/1.0 CheapRouter/1.0")
+		w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+		w.Write([]byte(`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><u:R xmlns:u="svc"><Name>caf` + "\xE9" + `</Name></u:R></s:Body></s:Envelope>`))
+	}))
+	defer s.Close()
+	u, _ := url.Parse(s.URL)
+
+	Quirks = append(Quirks, Quirk{Server: "cheaprouter", Charset: "iso-8859-1"})
+	defer func() { Quirks = nil }()
+
+	a := newSimpleAction(u, "svc", "act", 1*time.Second)
+	r := struct {
+		Name string `xml:"Name"`
+	}{}
+	if err := a.Invoke(&r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Name != "café" {
+		t.Errorf("got %q, want %q", r.Name, "café")
+	}
+}
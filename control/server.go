@@ -0,0 +1,425 @@
+package control
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"github.com/mmmorris1975/go-upnp/description"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	SOAP_ENVELOPE_NS = "http://schemas.xmlsoap.org/soap/envelope/"
+	SOAP_ENCODING_NS = "http://schemas.xmlsoap.org/soap/encoding/"
+	UPNP_CONTROL_NS  = "urn:schemas-upnp-org:control-1-0"
+)
+
+var faultDescriptions = map[int]string{
+	ERR_INVALID_ACTION:                  "Invalid Action",
+	ERR_INVALID_ARGS:                    "Invalid Args",
+	ERR_ACTION_FAILED:                   "Action Failed",
+	ERR_ARGUMENT_VALUE_INVALID:          "Argument Value Invalid",
+	ERR_ARGUMENT_VALUE_OUT_OF_RANGE:     "Argument Value Out of Range",
+	ERR_OPTIONAL_ACTION_NOT_IMPLEMENTED: "Optional Action Not Implemented",
+	ERR_OUT_OF_MEMORY:                   "Out of Memory",
+	ERR_HUMAN_INTERVENTION_REQUIRED:     "Human Intervention Required",
+	ERR_STRING_ARGUMENT_TOO_LONG:        "String Argument Too Long",
+	ERR_SPECIFIED_ARRAY_INDEX_INVALID:   "SpecifiedArrayIndexInvalid",
+}
+
+// NewFault creates a Fault with the given UPnP error code, if desc is empty the standard
+// description for the error code is used
+func NewFault(code int, desc string) *Fault {
+	if len(desc) < 1 {
+		desc = faultDescriptions[code]
+	}
+
+	return &Fault{
+		FaultCode:        "s:Client",
+		FaultString:      "UPnPError",
+		ErrorCode:        strconv.Itoa(code),
+		ErrorDescription: desc,
+	}
+}
+
+// ActionCall is an incoming action request, Args are in the order sent by the control point
+type ActionCall struct {
+	ServiceType string
+	Action      string
+	Args        []Arg
+	Request     *http.Request
+}
+
+// Arg returns the value of the named argument, or an empty string if it was not sent
+func (c *ActionCall) Arg(name string) string {
+	for _, a := range c.Args {
+		if name == a.XMLName.Local {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// ActionHandler processes an action, returning the output arguments.  If the service was registered
+// with a description, the output arguments are sent in description order and all must be present.
+// Returning a *Fault sends that fault to the control point, any other error is sent as 501 Action Failed
+type ActionHandler func(c *ActionCall) ([]Arg, error)
+
+type serverService struct {
+	desc     *description.ServiceDescription
+	handlers map[string]ActionHandler
+}
+
+// Server is an http.Handler for the control URL of one or more services hosted by a device.  It decodes
+// the SOAP request, validates it against the service description (if provided), calls the handler
+// registered for the action and writes the SOAP response or Fault
+type Server struct {
+	mu       sync.RWMutex
+	services map[string]*serverService
+}
+
+func NewServer() *Server {
+	return &Server{services: make(map[string]*serverService)}
+}
+
+// RegisterService associates a service type with its description, used to validate incoming requests.
+// The description may be nil to disable validation
+func (s *Server) RegisterService(svcType string, sd *description.ServiceDescription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	svc, ok := s.services[svcType]
+	if !ok {
+		svc = &serverService{handlers: make(map[string]ActionHandler)}
+		s.services[svcType] = svc
+	}
+	svc.desc = sd
+}
+
+// Handle registers the handler for the action of the given service type
+func (s *Server) Handle(svcType, action string, h ActionHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	svc, ok := s.services[svcType]
+	if !ok {
+		svc = &serverService{handlers: make(map[string]ActionHandler)}
+		s.services[svcType] = svc
+	}
+	svc.handlers[action] = h
+}
+
+// findService returns the service for the type, allowing requests for an older version of
+// the service than the one registered, as required by the UPnP spec
+func (s *Server) findService(svcType string) *serverService {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if svc, ok := s.services[svcType]; ok {
+		return svc
+	}
+
+	name, ver := splitServiceVersion(svcType)
+	for k, v := range s.services {
+		n, rv := splitServiceVersion(k)
+		if n == name && ver > 0 && ver <= rv {
+			return v
+		}
+	}
+
+	return nil
+}
+
+func splitServiceVersion(svcType string) (string, int) {
+	i := strings.LastIndex(svcType, ":")
+	if i < 0 {
+		return svcType, 0
+	}
+
+	v, err := strconv.Atoi(svcType[i+1:])
+	if err != nil {
+		return svcType, 0
+	}
+	return svcType[:i], v
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	soapAction := r.Header.Get("SOAPACTION")
+	switch r.Method {
+	case http.MethodPost:
+	case "M-POST":
+		// UPnP 1.0 extended HTTP framework, the SOAPACTION header is prefixed with the MAN namespace
+		ns := ""
+		for _, p := range strings.Split(r.Header.Get("MAN"), ";") {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "ns=") {
+				ns = strings.TrimPrefix(p, "ns=")
+			}
+		}
+		soapAction = r.Header.Get(ns + "-SOAPACTION")
+	default:
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	svcType, action, err := parseSoapActionHeader(soapAction)
+	if err != nil {
+		doLog("ServeHTTP() - %v", err)
+		writeFault(w, NewFault(ERR_INVALID_ACTION, ""))
+		return
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		doLog("ServeHTTP() - ReadAll(): %v", err)
+		writeFault(w, NewFault(ERR_ACTION_FAILED, ""))
+		return
+	}
+
+	call, err := parseActionCall(b)
+	if err != nil {
+		doLog("ServeHTTP() - parseActionCall(): %v", err)
+		writeFault(w, NewFault(ERR_INVALID_ACTION, ""))
+		return
+	}
+	call.Request = r
+
+	// the body element must agree with the SOAPACTION header
+	if call.ServiceType != svcType || call.Action != action {
+		writeFault(w, NewFault(ERR_INVALID_ACTION, "SOAPACTION header does not match request body"))
+		return
+	}
+
+	svc := s.findService(svcType)
+	if svc == nil {
+		writeFault(w, NewFault(ERR_INVALID_ACTION, ""))
+		return
+	}
+
+	s.mu.RLock()
+	h, ok := svc.handlers[action]
+	sd := svc.desc
+	s.mu.RUnlock()
+
+	var da *description.Action
+	if sd != nil {
+		if da = sd.ActionByName(action); da == nil {
+			writeFault(w, NewFault(ERR_INVALID_ACTION, ""))
+			return
+		}
+
+		if f := validateArgs(sd, da, call.Args); f != nil {
+			writeFault(w, f)
+			return
+		}
+	}
+
+	if !ok {
+		writeFault(w, NewFault(ERR_OPTIONAL_ACTION_NOT_IMPLEMENTED, ""))
+		return
+	}
+
+	out, err := h(call)
+	if err != nil {
+		switch t := err.(type) {
+		case *Fault:
+			writeFault(w, t)
+		case Fault:
+			writeFault(w, &t)
+		default:
+			doLog("ServeHTTP() - %s#%s: %v", svcType, action, err)
+			writeFault(w, NewFault(ERR_ACTION_FAILED, ""))
+		}
+		return
+	}
+
+	if da != nil {
+		if out, err = orderOutArgs(da, out); err != nil {
+			doLog("ServeHTTP() - %s#%s: %v", svcType, action, err)
+			writeFault(w, NewFault(ERR_ACTION_FAILED, ""))
+			return
+		}
+	}
+
+	writeResponse(w, call.ServiceType, action, out)
+}
+
+func parseSoapActionHeader(h string) (string, string, error) {
+	h = strings.Trim(strings.TrimSpace(h), `"`)
+	i := strings.LastIndex(h, "#")
+	if i < 1 || i == len(h)-1 {
+		return "", "", fmt.Errorf("invalid SOAPACTION header: %s", h)
+	}
+
+	return h[:i], h[i+1:], nil
+}
+
+// parseActionCall finds the action element inside the SOAP Body, and collects its arguments
+func parseActionCall(b []byte) (*ActionCall, error) {
+	d := xml.NewDecoder(bytes.NewReader(b))
+	inBody := false
+
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		se, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		if !inBody {
+			switch se.Name.Local {
+			case "Envelope":
+			case "Body":
+				inBody = true
+			default:
+				if err := d.Skip(); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		v := struct {
+			Args []Arg `xml:",any"`
+		}{}
+		if err := d.DecodeElement(&v, &se); err != nil {
+			return nil, err
+		}
+
+		// arguments are not namespace qualified
+		for i := range v.Args {
+			v.Args[i].XMLName.Space = ""
+		}
+
+		return &ActionCall{ServiceType: se.Name.Space, Action: se.Name.Local, Args: v.Args}, nil
+	}
+}
+
+func validateArgs(sd *description.ServiceDescription, da *description.Action, args []Arg) *Fault {
+	in := da.Arguments("in")
+	if len(in) != len(args) {
+		return NewFault(ERR_INVALID_ARGS, "")
+	}
+
+	// argument names and order must match the description
+	for i, a := range in {
+		if a.Name != args[i].XMLName.Local {
+			return NewFault(ERR_INVALID_ARGS, "")
+		}
+
+		sv := sd.StateVariableByName(a.RelatedStateVariable)
+		if sv == nil {
+			continue
+		}
+
+		if err := sv.Validate(args[i].Value); err != nil {
+			if ve, ok := err.(*description.ValueError); ok && ve.OutOfRange {
+				return NewFault(ERR_ARGUMENT_VALUE_OUT_OF_RANGE, "")
+			}
+			return NewFault(ERR_ARGUMENT_VALUE_INVALID, "")
+		}
+	}
+
+	return nil
+}
+
+func orderOutArgs(da *description.Action, args []Arg) ([]Arg, error) {
+	out := da.Arguments("out")
+	res := make([]Arg, 0, len(out))
+
+	for _, a := range out {
+		found := false
+		for _, e := range args {
+			if a.Name == e.XMLName.Local {
+				res = append(res, e)
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return nil, fmt.Errorf("handler did not return output argument %s", a.Name)
+		}
+	}
+
+	return res, nil
+}
+
+// same namespace prefix hack as Envelope, but the body may hold either an action response or a Fault
+type serverEnvelope struct {
+	XMLName       xml.Name `xml:"s:Envelope"`
+	XMLNS         string   `xml:"xmlns:s,attr"`
+	EncodingStyle string   `xml:"s:encodingStyle,attr"`
+	Body          struct {
+		XMLName xml.Name `xml:"s:Body"`
+		Content interface{}
+	}
+}
+
+type actionResponse struct {
+	XMLName xml.Name
+	XMLNS   string `xml:"xmlns:u,attr"`
+	Args    []Arg
+}
+
+type serverFault struct {
+	XMLName     xml.Name `xml:"s:Fault"`
+	FaultCode   string   `xml:"faultcode"`
+	FaultString string   `xml:"faultstring"`
+	Detail      struct {
+		UPnPError struct {
+			XMLNS            string `xml:"xmlns,attr"`
+			ErrorCode        string `xml:"errorCode"`
+			ErrorDescription string `xml:"errorDescription"`
+		}
+	} `xml:"detail"`
+}
+
+func writeEnvelope(w http.ResponseWriter, status int, content interface{}) {
+	e := serverEnvelope{XMLNS: SOAP_ENVELOPE_NS, EncodingStyle: SOAP_ENCODING_NS}
+	e.Body.Content = content
+
+	buf := bytes.NewBufferString(xml.Header)
+	if err := xml.NewEncoder(buf).Encode(e); err != nil {
+		doLog("writeEnvelope() - Encode(): %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.Header().Set("EXT", "")
+	w.Header().Set("Server", fmt.Sprintf(`%s/%s UPnP/1.1 xxx/1.0`, runtime.GOOS, runtime.Version()))
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+func writeResponse(w http.ResponseWriter, svcType, action string, args []Arg) {
+	r := actionResponse{XMLName: xml.Name{Local: "u:" + action + "Response"}, XMLNS: svcType, Args: args}
+	writeEnvelope(w, http.StatusOK, r)
+}
+
+func writeFault(w http.ResponseWriter, f *Fault) {
+	r := serverFault{FaultCode: f.FaultCode, FaultString: f.FaultString}
+	if len(r.FaultCode) < 1 {
+		r.FaultCode = "s:Client"
+	}
+	if len(r.FaultString) < 1 {
+		r.FaultString = "UPnPError"
+	}
+	r.Detail.UPnPError.XMLNS = UPNP_CONTROL_NS
+	r.Detail.UPnPError.ErrorCode = f.ErrorCode
+	r.Detail.UPnPError.ErrorDescription = f.ErrorDescription
+
+	writeEnvelope(w, http.StatusInternalServerError, r)
+}
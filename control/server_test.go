@@ -0,0 +1,118 @@
+package control
+
+import (
+	"encoding/xml"
+	"github.com/mmmorris1975/go-upnp/description"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const mockSCPD = `<?xml version="1.0"?>
+<scpd xmlns="urn:schemas-upnp-org:service-1-0"><specVersion><major>1</major><minor>1</minor></specVersion>
+<actionList>
+<action><name>SetTarget</name><argumentList>
+<argument><name>newTargetValue</name><direction>in</direction><relatedStateVariable>Target</relatedStateVariable></argument>
+</argumentList></action>
+<action><name>GetLevel</name><argumentList>
+<argument><name>RetLevel</name><direction>out</direction><relatedStateVariable>Level</relatedStateVariable></argument>
+<argument><name>RetTarget</name><direction>out</direction><relatedStateVariable>Target</relatedStateVariable></argument>
+</argumentList></action>
+<action><name>Reset</name></action>
+</actionList>
+<serviceStateTable>
+<stateVariable sendEvents="yes"><name>Target</name><dataType>boolean</dataType></stateVariable>
+<stateVariable sendEvents="yes"><name>Level</name><dataType>ui1</dataType>
+<allowedValueRange><minimum>0</minimum><maximum>100</maximum></allowedValueRange></stateVariable>
+</serviceStateTable></scpd>`
+
+const switchPower = "urn:schemas-upnp-org:service:SwitchPower:2"
+
+func TestServer(t *testing.T) {
+	sd := new(description.ServiceDescription)
+	if err := xml.Unmarshal([]byte(mockSCPD), sd); err != nil {
+		t.Fatal(err)
+	}
+
+	target := false
+	srv := NewServer()
+	srv.RegisterService(switchPower, sd)
+	srv.Handle(switchPower, "SetTarget", func(c *ActionCall) ([]Arg, error) {
+		v, _ := strconv.ParseBool(c.Arg("newTargetValue"))
+		target = v
+		return nil, nil
+	})
+	srv.Handle(switchPower, "GetLevel", func(c *ActionCall) ([]Arg, error) {
+		// returned out of order, the server should reorder them
+		return []Arg{NewArg("RetTarget", target), NewArg("RetLevel", 42)}, nil
+	})
+
+	s := httptest.NewServer(srv)
+	defer s.Close()
+	u, _ := url.Parse(s.URL)
+
+	t.Run("set", func(t *testing.T) {
+		a := newSimpleAction(u, switchPower, "SetTarget", 1*time.Second)
+		a.SetArgs(NewArg("newTargetValue", true))
+		if err := a.Invoke(nil); err != nil {
+			t.Fatal(err)
+		}
+		if !target {
+			t.Error("handler not called")
+		}
+	})
+
+	t.Run("get", func(t *testing.T) {
+		ret := struct {
+			Level  int  `xml:"RetLevel"`
+			Target bool `xml:"RetTarget"`
+		}{}
+
+		// older version of the service must also be accepted
+		a := newSimpleAction(u, "urn:schemas-upnp-org:service:SwitchPower:1", "GetLevel", 1*time.Second)
+		if err := a.Invoke(&ret); err != nil {
+			t.Fatal(err)
+		}
+		if ret.Level != 42 || !ret.Target {
+			t.Errorf("unexpected result %+v", ret)
+		}
+	})
+
+	faults := []struct {
+		name   string
+		action string
+		args   []Arg
+		code   int
+	}{
+		{"unknown action", "Explode", nil, ERR_INVALID_ACTION},
+		{"missing args", "SetTarget", nil, ERR_INVALID_ARGS},
+		{"wrong arg", "SetTarget", []Arg{NewArg("Target", 1)}, ERR_INVALID_ARGS},
+		{"invalid value", "SetTarget", []Arg{NewArg("newTargetValue", "maybe")}, ERR_ARGUMENT_VALUE_INVALID},
+		{"not implemented", "Reset", nil, ERR_OPTIONAL_ACTION_NOT_IMPLEMENTED},
+	}
+
+	for _, tc := range faults {
+		t.Run(tc.name, func(t *testing.T) {
+			a := newSimpleAction(u, switchPower, tc.action, 1*time.Second)
+			a.SetArgs(tc.args...)
+			if err := a.Invoke(nil); FaultCode(err) != tc.code {
+				t.Errorf("expected fault %d, got %v", tc.code, err)
+			}
+		})
+	}
+
+	t.Run("method", func(t *testing.T) {
+		res, err := http.Get(s.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("expected HTTP 405, got %d", res.StatusCode)
+		}
+	})
+}
@@ -9,6 +9,12 @@ import (
 	"time"
 )
 
+// XML namespaces of device and service description documents
+const (
+	DEVICE_NAMESPACE  = "urn:schemas-upnp-org:device-1-0"
+	SERVICE_NAMESPACE = "urn:schemas-upnp-org:service-1-0"
+)
+
 var Logger *log.Logger
 
 func getDescription(url string, v interface{}, wait time.Duration) error {
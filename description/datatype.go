@@ -0,0 +1,206 @@
+package description
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ValueError describes a state variable or argument value which is not valid for its data type,
+// the allowed value list, or the allowed value range
+type ValueError struct {
+	Name       string
+	Value      string
+	OutOfRange bool
+	Reason     string
+}
+
+func (e *ValueError) Error() string {
+	return fmt.Sprintf("invalid value '%s' for %s: %s", e.Value, e.Name, e.Reason)
+}
+
+var dateLayouts = map[string][]string{
+	"date":        {"2006-01-02"},
+	"dateTime":    {"2006-01-02T15:04:05", "2006-01-02"},
+	"dateTime.tz": {"2006-01-02T15:04:05Z07:00", "2006-01-02T15:04:05", "2006-01-02"},
+	"time":        {"15:04:05"},
+	"time.tz":     {"15:04:05Z07:00", "15:04:05"},
+}
+
+// ParseValue converts the string representation of a value to a Go type based on the UPnP data type
+// of the variable: ui1-ui8 become uint8-uint64, i1-i8 become int8-int64 (int is int32), r4 is float32,
+// r8, number, float and fixed.14.4 are float64, char is rune, boolean is bool, date and time types are
+// time.Time, and bin.base64 and bin.hex are []byte.  All other types are returned as a string
+func (v *StateVariable) ParseValue(s string) (interface{}, error) {
+	var r interface{}
+	var err error
+
+	switch v.DataType {
+	case "ui1", "ui2", "ui4", "ui8":
+		var bits int
+		fmt.Sscanf(v.DataType, "ui%d", &bits)
+		var u uint64
+		u, err = strconv.ParseUint(strings.TrimSpace(s), 10, bits*8)
+		switch bits {
+		case 1:
+			r = uint8(u)
+		case 2:
+			r = uint16(u)
+		case 4:
+			r = uint32(u)
+		default:
+			r = u
+		}
+	case "i1", "i2", "i4", "i8", "int":
+		bits := 4
+		if v.DataType != "int" {
+			fmt.Sscanf(v.DataType, "i%d", &bits)
+		}
+		var i int64
+		i, err = strconv.ParseInt(strings.TrimSpace(s), 10, bits*8)
+		switch bits {
+		case 1:
+			r = int8(i)
+		case 2:
+			r = int16(i)
+		case 4:
+			r = int32(i)
+		default:
+			r = i
+		}
+	case "r4":
+		var f float64
+		f, err = strconv.ParseFloat(strings.TrimSpace(s), 32)
+		r = float32(f)
+	case "r8", "number", "float", "fixed.14.4":
+		r, err = strconv.ParseFloat(strings.TrimSpace(s), 64)
+	case "char":
+		if utf8.RuneCountInString(s) != 1 {
+			err = fmt.Errorf("expected a single character")
+		}
+		c, _ := utf8.DecodeRuneInString(s)
+		r = c
+	case "boolean":
+		switch strings.ToLower(strings.TrimSpace(s)) {
+		case "1", "true", "yes":
+			r = true
+		case "0", "false", "no":
+			r = false
+		default:
+			err = fmt.Errorf("expected a boolean")
+		}
+	case "date", "dateTime", "dateTime.tz", "time", "time.tz":
+		for _, l := range dateLayouts[v.DataType] {
+			var t time.Time
+			if t, err = time.Parse(l, strings.TrimSpace(s)); err == nil {
+				r = t
+				break
+			}
+		}
+	case "bin.base64":
+		r, err = base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	case "bin.hex":
+		r, err = hex.DecodeString(strings.TrimSpace(s))
+	default:
+		r = s
+	}
+
+	if err != nil {
+		return nil, &ValueError{Name: v.Name, Value: s, Reason: fmt.Sprintf("not a valid %s", v.DataType)}
+	}
+
+	return r, nil
+}
+
+// Validate checks the value against the data type, allowed value list and allowed value range
+// of the state variable, returning a *ValueError if it isn't allowed
+func (v *StateVariable) Validate(s string) error {
+	if _, err := v.ParseValue(s); err != nil {
+		return err
+	}
+
+	if len(v.AllowedValueList) > 0 {
+		ok := false
+		for _, a := range v.AllowedValueList {
+			if a == s {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return &ValueError{Name: v.Name, Value: s, Reason: "not in allowed value list"}
+		}
+	}
+
+	if len(v.MinValue) > 0 || len(v.MaxValue) > 0 {
+		f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil {
+			// ranges only apply to numeric types
+			return nil
+		}
+
+		if min, err := strconv.ParseFloat(v.MinValue, 64); err == nil && f < min {
+			return &ValueError{Name: v.Name, Value: s, OutOfRange: true, Reason: fmt.Sprintf("less than minimum %s", v.MinValue)}
+		}
+
+		if max, err := strconv.ParseFloat(v.MaxValue, 64); err == nil && f > max {
+			return &ValueError{Name: v.Name, Value: s, OutOfRange: true, Reason: fmt.Sprintf("greater than maximum %s", v.MaxValue)}
+		}
+
+		if step, err := strconv.ParseFloat(v.Step, 64); err == nil && step > 0 {
+			min, _ := strconv.ParseFloat(v.MinValue, 64)
+			n := (f - min) / step
+			if n != float64(int64(n)) {
+				return &ValueError{Name: v.Name, Value: s, OutOfRange: true, Reason: fmt.Sprintf("not a multiple of step %s", v.Step)}
+			}
+		}
+	}
+
+	return nil
+}
+
+// FormatValue converts a Go value to its string representation for the data type of the variable, the
+// reverse of ParseValue: booleans become 1 or 0, time.Time is formatted for the date or time type, and
+// []byte is encoded as base64 or hex.  The result is checked with Validate
+func (v *StateVariable) FormatValue(val interface{}) (string, error) {
+	var s string
+
+	// rune is the same type as int32, so it is only taken as a character for the char type
+	if r, ok := val.(rune); ok && v.DataType == "char" {
+		val = string(r)
+	}
+
+	switch t := val.(type) {
+	case string:
+		s = t
+	case bool:
+		s = "0"
+		if t {
+			s = "1"
+		}
+	case time.Time:
+		l, ok := dateLayouts[v.DataType]
+		if !ok {
+			return "", &ValueError{Name: v.Name, Value: t.String(), Reason: fmt.Sprintf("not a valid %s", v.DataType)}
+		}
+		s = t.Format(l[0])
+	case []byte:
+		if v.DataType == "bin.hex" {
+			s = hex.EncodeToString(t)
+		} else {
+			s = base64.StdEncoding.EncodeToString(t)
+		}
+	default:
+		s = fmt.Sprint(val)
+	}
+
+	if err := v.Validate(s); err != nil {
+		return "", err
+	}
+
+	return s, nil
+}
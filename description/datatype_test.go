@@ -0,0 +1,83 @@
+package description
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStateVariableValidate(t *testing.T) {
+	tests := []struct {
+		sv         StateVariable
+		value      string
+		ok         bool
+		outOfRange bool
+	}{
+		{StateVariable{Name: "a", DataType: "ui1"}, "255", true, false},
+		{StateVariable{Name: "a", DataType: "ui1"}, "256", false, false},
+		{StateVariable{Name: "a", DataType: "i4"}, "-12", true, false},
+		{StateVariable{Name: "a", DataType: "boolean"}, "yes", true, false},
+		{StateVariable{Name: "a", DataType: "boolean"}, "2", false, false},
+		{StateVariable{Name: "a", DataType: "string", AllowedValueList: []string{"TCP", "UDP"}}, "UDP", true, false},
+		{StateVariable{Name: "a", DataType: "string", AllowedValueList: []string{"TCP", "UDP"}}, "ICMP", false, false},
+		{StateVariable{Name: "a", DataType: "ui2", MinValue: "0", MaxValue: "100", Step: "5"}, "55", true, false},
+		{StateVariable{Name: "a", DataType: "ui2", MinValue: "0", MaxValue: "100", Step: "5"}, "101", false, true},
+		{StateVariable{Name: "a", DataType: "ui2", MinValue: "0", MaxValue: "100", Step: "5"}, "53", false, true},
+		{StateVariable{Name: "a", DataType: "dateTime"}, "2020-01-02T03:04:05", true, false},
+		{StateVariable{Name: "a", DataType: "bin.hex"}, "zz", false, false},
+	}
+
+	for _, tc := range tests {
+		err := tc.sv.Validate(tc.value)
+		if tc.ok != (err == nil) {
+			t.Errorf("%s %q: unexpected result %v", tc.sv.DataType, tc.value, err)
+			continue
+		}
+
+		if err != nil && err.(*ValueError).OutOfRange != tc.outOfRange {
+			t.Errorf("%s %q: expected out of range %v", tc.sv.DataType, tc.value, tc.outOfRange)
+		}
+	}
+}
+
+func TestStateVariableParseValue(t *testing.T) {
+	v, err := (&StateVariable{DataType: "ui4"}).ParseValue("4294967295")
+	if err != nil || v.(uint32) != 4294967295 {
+		t.Errorf("ui4: %v %v", v, err)
+	}
+
+	v, err = (&StateVariable{DataType: "boolean"}).ParseValue("0")
+	if err != nil || v.(bool) {
+		t.Errorf("boolean: %v %v", v, err)
+	}
+
+	v, err = (&StateVariable{DataType: "date"}).ParseValue("2020-02-29")
+	if err != nil || v.(time.Time).Day() != 29 {
+		t.Errorf("date: %v %v", v, err)
+	}
+}
+
+func TestStateVariableFormatValue(t *testing.T) {
+	tests := []struct {
+		v    StateVariable
+		in   interface{}
+		want string
+		ok   bool
+	}{
+		{StateVariable{DataType: "boolean"}, true, "1", true},
+		{StateVariable{DataType: "ui1"}, uint8(200), "200", true},
+		{StateVariable{DataType: "ui1"}, 300, "", false},
+		{StateVariable{DataType: "i4", MinValue: "0", MaxValue: "100"}, int32(101), "", false},
+		{StateVariable{DataType: "bin.hex"}, []byte{0xca, 0xfe}, "cafe", true},
+		{StateVariable{DataType: "date"}, time.Date(2020, 2, 3, 0, 0, 0, 0, time.UTC), "2020-02-03", true},
+		{StateVariable{DataType: "char"}, 'x', "x", true},
+		{StateVariable{DataType: "i4"}, int32(120), "120", true},
+		{StateVariable{DataType: "string", AllowedValueList: []string{"A", "B"}}, "C", "", false},
+	}
+
+	for _, tc := range tests {
+		s, err := tc.v.FormatValue(tc.in)
+		if (err == nil) != tc.ok || s != tc.want {
+			t.Errorf("%s %v: expected '%s' (%t), got '%s' %v", tc.v.DataType, tc.in, tc.want, tc.ok, s, err)
+		}
+	}
+}
@@ -32,18 +32,67 @@ type Device struct {
 	DeviceType       string    `xml:"deviceType"`
 	FriendlyName     string    `xml:"friendlyName"`
 	Manufacturer     string    `xml:"manufacturer"`
-	ManufacturerURL  string    `xml:"manufacturerURL"`
-	ModelDescription string    `xml:"modelDescription"`
+	ManufacturerURL  string    `xml:"manufacturerURL,omitempty"`
+	ModelDescription string    `xml:"modelDescription,omitempty"`
 	ModelName        string    `xml:"modelName"`
-	ModelNumber      string    `xml:"modelNumber"`
-	ModelURL         string    `xml:"modelURL"`
-	SerialNumber     string    `xml:"serialNumber"`
+	ModelNumber      string    `xml:"modelNumber,omitempty"`
+	ModelURL         string    `xml:"modelURL,omitempty"`
+	SerialNumber     string    `xml:"serialNumber,omitempty"`
 	UDN              string    `xml:"UDN"`
-	UPC              string    `xml:"UPC"`
-	IconList         []Icon    `xml:"iconList>icon"`
-	ServiceList      []Service `xml:"serviceList>service"`
-	DeviceList       []Device  `xml:"deviceList>device"`
-	PresentationURL  string    `xml:"presentationURL"`
+	UPC              string    `xml:"UPC,omitempty"`
+	IconList         []Icon    `xml:"iconList>icon,omitempty"`
+	ServiceList      []Service `xml:"serviceList>service,omitempty"`
+	DeviceList       []Device  `xml:"deviceList>device,omitempty"`
+	PresentationURL  string    `xml:"presentationURL,omitempty"`
+}
+
+// deviceXML is the wire form of Device, the schema doesn't allow empty lists so they are omitted
+type deviceXML struct {
+	XMLName          xml.Name        `xml:"device"`
+	DeviceType       string          `xml:"deviceType"`
+	FriendlyName     string          `xml:"friendlyName"`
+	Manufacturer     string          `xml:"manufacturer"`
+	ManufacturerURL  string          `xml:"manufacturerURL,omitempty"`
+	ModelDescription string          `xml:"modelDescription,omitempty"`
+	ModelName        string          `xml:"modelName"`
+	ModelNumber      string          `xml:"modelNumber,omitempty"`
+	ModelURL         string          `xml:"modelURL,omitempty"`
+	SerialNumber     string          `xml:"serialNumber,omitempty"`
+	UDN              string          `xml:"UDN"`
+	UPC              string          `xml:"UPC,omitempty"`
+	IconList         *iconListXML    `xml:"iconList"`
+	ServiceList      *serviceListXML `xml:"serviceList"`
+	DeviceList       *deviceListXML  `xml:"deviceList"`
+	PresentationURL  string          `xml:"presentationURL,omitempty"`
+}
+
+type iconListXML struct {
+	Icons []Icon `xml:"icon"`
+}
+
+type serviceListXML struct {
+	Services []Service `xml:"service"`
+}
+
+type deviceListXML struct {
+	Devices []Device `xml:"device"`
+}
+
+func (d Device) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	x := deviceXML{DeviceType: d.DeviceType, FriendlyName: d.FriendlyName, Manufacturer: d.Manufacturer,
+		ManufacturerURL: d.ManufacturerURL, ModelDescription: d.ModelDescription, ModelName: d.ModelName,
+		ModelNumber: d.ModelNumber, ModelURL: d.ModelURL, SerialNumber: d.SerialNumber, UDN: d.UDN, UPC: d.UPC,
+		PresentationURL: d.PresentationURL}
+	if len(d.IconList) > 0 {
+		x.IconList = &iconListXML{d.IconList}
+	}
+	if len(d.ServiceList) > 0 {
+		x.ServiceList = &serviceListXML{d.ServiceList}
+	}
+	if len(d.DeviceList) > 0 {
+		x.DeviceList = &deviceListXML{d.DeviceList}
+	}
+	return e.Encode(x)
 }
 
 var iconCache map[string]Icon
@@ -112,14 +161,31 @@ func (d *Device) DeviceByService(st string) *Device {
 	return nil
 }
 
+func (d *Device) DeviceByUDN(udn string) *Device {
+	if udn == d.UDN {
+		return d
+	}
+
+	for i := range d.DeviceList {
+		x := d.DeviceList[i].DeviceByUDN(udn)
+		if x != nil {
+			return x
+		}
+	}
+
+	return nil
+}
+
 // According to UPnP spec, section 2, devices can supply additional attributes
 // as part of Device or DeviceDescription, but should be ignored when processing
 type DeviceDescription struct {
-	XMLName          xml.Name `xml:"root"`
-	ConfigId         int      `xml:"configId,attr"`
-	UPnPMajorVersion int      `xml:"specVersion>major"`
-	UPnPMinorVersion int      `xml:"specVersion>minor"`
-	URLBase          string   `xml:"URLBase"` // UPnP 1.0, deprecated in UPnp 1.1
+	XMLName xml.Name `xml:"root"`
+	// Set to DEVICE_NAMESPACE when creating a description document
+	Xmlns            string `xml:"xmlns,attr,omitempty"`
+	ConfigId         int    `xml:"configId,attr,omitempty"`
+	UPnPMajorVersion int    `xml:"specVersion>major"`
+	UPnPMinorVersion int    `xml:"specVersion>minor"`
+	URLBase          string `xml:"URLBase,omitempty"` // UPnP 1.0, deprecated in UPnp 1.1
 	Device           Device
 	location         *url.URL
 }
@@ -132,10 +198,23 @@ func (d *DeviceDescription) DeviceByService(st string) *Device {
 	return d.Device.DeviceByService(st)
 }
 
+func (d *DeviceDescription) DeviceByUDN(udn string) *Device {
+	return d.Device.DeviceByUDN(udn)
+}
+
 func (d *DeviceDescription) ServiceByType(st string) *Service {
 	return d.Device.ServiceByType(st)
 }
 
+// Location returns the URL the description was retrieved from (or its URLBase), empty if it was not
+// retrieved with DescribeDevice()
+func (d *DeviceDescription) Location() string {
+	if d.location == nil {
+		return ""
+	}
+	return d.location.String()
+}
+
 func (d *DeviceDescription) BuildURL(path string) (*url.URL, error) {
 	p, err := url.Parse(path)
 	if err != nil {
@@ -2,6 +2,7 @@ package description
 
 import (
 	"encoding/xml"
+	"strings"
 	"time"
 )
 
@@ -15,38 +16,176 @@ type Argument struct {
 	RetVal               bool     `xml:"retval"`
 }
 
+// argumentXML is the wire form of Argument, the spec marks the return value with an empty <retval/> element
+type argumentXML struct {
+	XMLName              xml.Name  `xml:"argument"`
+	Name                 string    `xml:"name"`
+	Direction            string    `xml:"direction"`
+	RetVal               *struct{} `xml:"retval"`
+	RelatedStateVariable string    `xml:"relatedStateVariable"`
+}
+
+func (a Argument) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	x := argumentXML{Name: a.Name, Direction: a.Direction, RelatedStateVariable: a.RelatedStateVariable}
+	if a.RetVal {
+		x.RetVal = &struct{}{}
+	}
+	return e.EncodeElement(x, start)
+}
+
+func (a *Argument) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	x := argumentXML{}
+	if err := d.DecodeElement(&x, &start); err != nil {
+		return err
+	}
+
+	*a = Argument{XMLName: start.Name, Name: x.Name, Direction: x.Direction,
+		RelatedStateVariable: x.RelatedStateVariable, RetVal: x.RetVal != nil}
+	return nil
+}
+
 type StateVariable struct {
 	XMLName    xml.Name `xml:"stateVariable"`
-	SendEvents string   `xml:"sendEvents,attr"`
-	Multicast  string   `xml:"multicast,attr"`
+	SendEvents string   `xml:"sendEvents,attr,omitempty"`
+	Multicast  string   `xml:"multicast,attr,omitempty"`
 	Name       string   `xml:"name"`
 	DataType   string   `xml:"dataType"`
 	// FIXME - can't use dataType>type,attr tag syntax
 	//XmlType          string   `xml:"dataType>type,attr"`
-	DefaultValue     string   `xml:"defaultValue"`
-	MinValue         string   `xml:"allowedValueRange>minimum"`
-	MaxValue         string   `xml:"allowedValueRange>maximum"`
-	Step             string   `xml:"allowedValueRange>step"`
-	AllowedValueList []string `xml:"allowedValueList>allowedValue"`
+	DefaultValue     string   `xml:"defaultValue,omitempty"`
+	AllowedValueList []string `xml:"allowedValueList>allowedValue,omitempty"`
+	MinValue         string   `xml:"allowedValueRange>minimum,omitempty"`
+	MaxValue         string   `xml:"allowedValueRange>maximum,omitempty"`
+	Step             string   `xml:"allowedValueRange>step,omitempty"`
+}
+
+// stateVariableXML is the wire form of StateVariable, the schema doesn't allow an empty allowedValueList
+// or allowedValueRange so they are omitted
+type stateVariableXML struct {
+	XMLName           xml.Name              `xml:"stateVariable"`
+	SendEvents        string                `xml:"sendEvents,attr,omitempty"`
+	Multicast         string                `xml:"multicast,attr,omitempty"`
+	Name              string                `xml:"name"`
+	DataType          string                `xml:"dataType"`
+	DefaultValue      string                `xml:"defaultValue,omitempty"`
+	AllowedValueList  *allowedValueListXML  `xml:"allowedValueList"`
+	AllowedValueRange *allowedValueRangeXML `xml:"allowedValueRange"`
+}
+
+type allowedValueListXML struct {
+	Values []string `xml:"allowedValue"`
+}
+
+type allowedValueRangeXML struct {
+	Minimum string `xml:"minimum"`
+	Maximum string `xml:"maximum"`
+	Step    string `xml:"step,omitempty"`
+}
+
+func (v StateVariable) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	x := stateVariableXML{SendEvents: v.SendEvents, Multicast: v.Multicast, Name: v.Name, DataType: v.DataType,
+		DefaultValue: v.DefaultValue}
+	if len(v.AllowedValueList) > 0 {
+		x.AllowedValueList = &allowedValueListXML{v.AllowedValueList}
+	}
+	if len(v.MinValue) > 0 || len(v.MaxValue) > 0 || len(v.Step) > 0 {
+		x.AllowedValueRange = &allowedValueRangeXML{Minimum: v.MinValue, Maximum: v.MaxValue, Step: v.Step}
+	}
+	return e.Encode(x)
 }
 
 type Action struct {
 	XMLName      xml.Name   `xml:"action"`
 	Name         string     `xml:"name"`
-	ArgumentList []Argument `xml:"argumentList>argument"`
+	ArgumentList []Argument `xml:"argumentList>argument,omitempty"`
+}
+
+// actionXML is the wire form of Action, the schema doesn't allow an empty argumentList so it is omitted
+type actionXML struct {
+	XMLName      xml.Name         `xml:"action"`
+	Name         string           `xml:"name"`
+	ArgumentList *argumentListXML `xml:"argumentList"`
+}
+
+type argumentListXML struct {
+	Arguments []Argument `xml:"argument"`
+}
+
+func (a Action) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	x := actionXML{Name: a.Name}
+	if len(a.ArgumentList) > 0 {
+		x.ArgumentList = &argumentListXML{a.ArgumentList}
+	}
+	return e.Encode(x)
+}
+
+// Arguments returns the action arguments for the given direction ("in" or "out"), in description order
+func (a *Action) Arguments(dir string) []Argument {
+	args := make([]Argument, 0, len(a.ArgumentList))
+	for _, e := range a.ArgumentList {
+		if strings.EqualFold(dir, strings.TrimSpace(e.Direction)) {
+			args = append(args, e)
+		}
+	}
+	return args
 }
 
 // According to UPnP spec, section 2, services can supply additional attributes
 // as part of ServiceDescription, but should be ignored when processing
 type ServiceDescription struct {
+	XMLName xml.Name `xml:"scpd"`
+	// Set to SERVICE_NAMESPACE when creating a description document
+	Xmlns             string          `xml:"xmlns,attr,omitempty"`
+	ConfigId          int             `xml:"configId,attr,omitempty"`
+	UPnPMajorVersion  int             `xml:"specVersion>major"`
+	UPnPMinorVersion  int             `xml:"specVersion>minor"`
+	ActionList        []Action        `xml:"actionList>action,omitempty"`
+	ServiceStateTable []StateVariable `xml:"serviceStateTable>stateVariable"`
+}
+
+// serviceDescriptionXML is the wire form of ServiceDescription, the schema doesn't allow an empty
+// actionList so it is omitted
+type serviceDescriptionXML struct {
 	XMLName           xml.Name        `xml:"scpd"`
-	ConfigId          int             `xml:"configId,attr"`
+	Xmlns             string          `xml:"xmlns,attr,omitempty"`
+	ConfigId          int             `xml:"configId,attr,omitempty"`
 	UPnPMajorVersion  int             `xml:"specVersion>major"`
 	UPnPMinorVersion  int             `xml:"specVersion>minor"`
-	ActionList        []Action        `xml:"actionList>action"`
+	ActionList        *actionListXML  `xml:"actionList"`
 	ServiceStateTable []StateVariable `xml:"serviceStateTable>stateVariable"`
 }
 
+type actionListXML struct {
+	Actions []Action `xml:"action"`
+}
+
+func (sd ServiceDescription) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	x := serviceDescriptionXML{Xmlns: sd.Xmlns, ConfigId: sd.ConfigId, UPnPMajorVersion: sd.UPnPMajorVersion,
+		UPnPMinorVersion: sd.UPnPMinorVersion, ServiceStateTable: sd.ServiceStateTable}
+	if len(sd.ActionList) > 0 {
+		x.ActionList = &actionListXML{sd.ActionList}
+	}
+	return e.Encode(x)
+}
+
+func (sd *ServiceDescription) ActionByName(name string) *Action {
+	for i := range sd.ActionList {
+		if name == sd.ActionList[i].Name {
+			return &sd.ActionList[i]
+		}
+	}
+	return nil
+}
+
+func (sd *ServiceDescription) StateVariableByName(name string) *StateVariable {
+	for i := range sd.ServiceStateTable {
+		if name == sd.ServiceStateTable[i].Name {
+			return &sd.ServiceStateTable[i]
+		}
+	}
+	return nil
+}
+
 // Do a multicast discovery for the given service name and find the service description
 // At this point, we only support getting the description for the 1st device returned from the search
 func DiscoverServiceDescription(svcName string, wait time.Duration) (*ServiceDescription, error) {
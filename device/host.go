@@ -0,0 +1,370 @@
+package device
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/xml"
+	"fmt"
+	"github.com/mmmorris1975/go-upnp/control"
+	"github.com/mmmorris1975/go-upnp/description"
+	"github.com/mmmorris1975/go-upnp/eventing"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// Path of the device description document, use as the LOCATION of SSDP messages
+	DESCRIPTION_PATH = "/description.xml"
+	// Prefix of the SCPD, control, event and icon paths
+	DEVICE_PATH_PREFIX = "/upnp/"
+	// configId is limited to 24 bits
+	MAX_CONFIG_ID = 16777215
+)
+
+var Logger *log.Logger
+
+// Service is a service hosted by the device, with the handlers for its control and event URLs
+type Service struct {
+	UDN         string
+	Info        description.Service
+	Description *description.ServiceDescription
+	// Register action handlers here, for the service type in Info
+	Control *control.Server
+	// Publish evented state variable changes here
+	Events *eventing.Publisher
+}
+
+type icon struct {
+	mimetype string
+	data     []byte
+}
+
+// Host serves the description document of a root device (and its embedded devices), the SCPD of each
+// service, and icons.  Requests to the control and event URLs of each service are passed to the
+// Service's Control and Events handlers
+type Host struct {
+	mu       sync.RWMutex
+	root     description.DeviceDescription
+	services map[string]*Service
+	routes   map[string]http.Handler
+	icons    map[string]*icon
+	configId int
+}
+
+// NewHost creates the host for a root device.  Devices without a UDN are given one, which is stable
+// across restarts as long as the host name, device type and friendly name don't change
+func NewHost(d description.Device) *Host {
+	h := &Host{
+		root:     description.DeviceDescription{UPnPMajorVersion: 1, UPnPMinorVersion: 1, Device: d},
+		services: make(map[string]*Service),
+		routes:   make(map[string]http.Handler),
+		icons:    make(map[string]*icon),
+	}
+
+	hostname, _ := os.Hostname()
+	assignUDN(&h.root.Device, hostname)
+	h.updateConfigId()
+
+	return h
+}
+
+func assignUDN(d *description.Device, seed string) {
+	seed = seed + "/" + d.DeviceType + "/" + d.FriendlyName
+	if len(d.UDN) < 1 {
+		d.UDN = NewUDN(seed)
+	}
+
+	for i := range d.DeviceList {
+		assignUDN(&d.DeviceList[i], seed+"/"+strconv.Itoa(i))
+	}
+}
+
+// NewUDN returns a name based (version 5) UUID, so the same name always produces the same UDN
+func NewUDN(name string) string {
+	// RFC 4122 URL namespace
+	ns := []byte{0x6b, 0xa7, 0xb8, 0x11, 0x9d, 0xad, 0x11, 0xd1, 0x80, 0xb4, 0x00, 0xc0, 0x4f, 0xd4, 0x30, 0xc8}
+
+	s := sha1.New()
+	s.Write(ns)
+	s.Write([]byte(name))
+	b := s.Sum(nil)[:16]
+	b[6] = (b[6] & 0x0f) | 0x50
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("uuid:%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// UDN returns the UDN of the root device
+func (h *Host) UDN() string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.root.Device.UDN
+}
+
+// ConfigId returns the configId of the description, which changes when a device, service or icon is added
+func (h *Host) ConfigId() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.configId
+}
+
+// Description returns a copy of the device description document
+func (h *Host) Description() *description.DeviceDescription {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	dd := h.root
+	dd.Xmlns = description.DEVICE_NAMESPACE
+	dd.ConfigId = h.configId
+	dd.Device = copyDevice(&h.root.Device)
+	return &dd
+}
+
+// copyDevice copies the device, and the icon, service and device lists of it and its embedded devices
+func copyDevice(d *description.Device) description.Device {
+	c := *d
+	c.IconList = append([]description.Icon(nil), d.IconList...)
+	c.ServiceList = append([]description.Service(nil), d.ServiceList...)
+
+	c.DeviceList = nil
+	if d.DeviceList != nil {
+		c.DeviceList = make([]description.Device, len(d.DeviceList))
+		for i := range d.DeviceList {
+			c.DeviceList[i] = copyDevice(&d.DeviceList[i])
+		}
+	}
+	return c
+}
+
+// devicePath returns the path prefix for the device, using the UUID from the UDN
+func devicePath(udn string) string {
+	return DEVICE_PATH_PREFIX + strings.TrimPrefix(udn, "uuid:") + "/"
+}
+
+// findDevice returns the device with the UDN, or the root device if udn is empty.  Caller must hold h.mu
+func (h *Host) findDevice(udn string) (*description.Device, error) {
+	if len(udn) < 1 {
+		return &h.root.Device, nil
+	}
+
+	d := h.root.DeviceByUDN(udn)
+	if d == nil {
+		return nil, fmt.Errorf("device %s not found", udn)
+	}
+	return d, nil
+}
+
+// AddService hosts a service of the device with the UDN (the root device if empty).  The SCPD, control
+// and event URLs of svc are set by the host.  If the device already lists a service with the same
+// serviceId, that entry is updated
+func (h *Host) AddService(udn string, svc description.Service, sd *description.ServiceDescription) (*Service, error) {
+	if len(svc.ServiceType) < 1 || len(svc.ServiceId) < 1 {
+		return nil, fmt.Errorf("serviceType and serviceId are required")
+	}
+	if sd == nil {
+		return nil, fmt.Errorf("service description is required")
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	d, err := h.findDevice(udn)
+	if err != nil {
+		return nil, err
+	}
+
+	// last part of urn:upnp-org:serviceId:Name
+	id := svc.ServiceId[strings.LastIndex(svc.ServiceId, ":")+1:]
+	base := devicePath(d.UDN) + id + "/"
+	if _, ok := h.services[base]; ok {
+		return nil, fmt.Errorf("service %s already added to device %s", svc.ServiceId, d.UDN)
+	}
+
+	svc.SCPDURL = base + "scpd.xml"
+	svc.ControlURL = base + "control"
+	svc.EventSubURL = base + "event"
+
+	found := false
+	for i := range d.ServiceList {
+		if d.ServiceList[i].ServiceId == svc.ServiceId {
+			d.ServiceList[i] = svc
+			found = true
+		}
+	}
+	if !found {
+		d.ServiceList = append(d.ServiceList, svc)
+	}
+
+	s := &Service{
+		UDN:         d.UDN,
+		Info:        svc,
+		Description: sd,
+		Control:     control.NewServer(),
+		Events:      eventing.NewPublisher(sd),
+	}
+	s.Control.RegisterService(svc.ServiceType, sd)
+
+	h.services[base] = s
+	h.routes[svc.ControlURL] = s.Control
+	h.routes[svc.EventSubURL] = s.Events
+	h.updateConfigId()
+
+	return s, nil
+}
+
+// Service returns the hosted service with the serviceId, of the device with the UDN (the root device if empty)
+func (h *Host) Service(udn, serviceId string) *Service {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	d, err := h.findDevice(udn)
+	if err != nil {
+		return nil
+	}
+
+	for _, s := range h.services {
+		if s.UDN == d.UDN && s.Info.ServiceId == serviceId {
+			return s
+		}
+	}
+	return nil
+}
+
+// AddIcon adds an icon to the device with the UDN (the root device if empty), served from data
+func (h *Host) AddIcon(udn string, i description.Icon, data []byte) error {
+	if len(i.Mimetype) < 1 {
+		return fmt.Errorf("icon mimetype is required")
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	d, err := h.findDevice(udn)
+	if err != nil {
+		return err
+	}
+
+	ext := i.Mimetype[strings.LastIndex(i.Mimetype, "/")+1:]
+	i.URL = fmt.Sprintf("%sicon/%d.%s", devicePath(d.UDN), len(d.IconList), ext)
+	d.IconList = append(d.IconList, i)
+
+	h.icons[i.URL] = &icon{mimetype: i.Mimetype, data: data}
+	h.updateConfigId()
+
+	return nil
+}
+
+// updateConfigId computes configId from the content of the description documents.  Caller must hold h.mu
+func (h *Host) updateConfigId() {
+	f := fnv.New32a()
+
+	dd := h.root
+	dd.ConfigId = 0
+	if b, err := xml.Marshal(dd); err == nil {
+		f.Write(b)
+	}
+
+	for _, p := range h.sortedServices() {
+		sd := *h.services[p].Description
+		sd.ConfigId = 0
+		if b, err := xml.Marshal(sd); err == nil {
+			f.Write(b)
+		}
+	}
+
+	h.configId = int(f.Sum32() % (MAX_CONFIG_ID + 1))
+}
+
+func (h *Host) sortedServices() []string {
+	res := make([]string, 0, len(h.services))
+	for k := range h.services {
+		res = append(res, k)
+	}
+
+	sort.Strings(res)
+	return res
+}
+
+func writeXML(w http.ResponseWriter, r *http.Request, configId int, v interface{}) {
+	buf := bytes.NewBufferString(xml.Header)
+	e := xml.NewEncoder(buf)
+	e.Indent("", "  ")
+	if err := e.Encode(v); err != nil {
+		log.Printf("ERROR - Encode(): %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Header().Set("CONFIGID.UPNP.ORG", strconv.Itoa(configId))
+	if r.Method != http.MethodHead {
+		w.Write(buf.Bytes())
+	}
+}
+
+func (h *Host) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := path.Clean(r.URL.Path)
+
+	h.mu.RLock()
+	handler, ok := h.routes[p]
+	h.mu.RUnlock()
+	if ok {
+		handler.ServeHTTP(w, r)
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if p == DESCRIPTION_PATH {
+		dd := h.root
+		dd.Xmlns = description.DEVICE_NAMESPACE
+		dd.ConfigId = h.configId
+		writeXML(w, r, h.configId, &dd)
+		return
+	}
+
+	if i, ok := h.icons[p]; ok {
+		w.Header().Set("Content-Type", i.mimetype)
+		w.Header().Set("Content-Length", strconv.Itoa(len(i.data)))
+		if r.Method != http.MethodHead {
+			w.Write(i.data)
+		}
+		return
+	}
+
+	if strings.HasSuffix(p, "/scpd.xml") {
+		if s, ok := h.services[strings.TrimSuffix(p, "scpd.xml")]; ok {
+			sd := *s.Description
+			sd.Xmlns = description.SERVICE_NAMESPACE
+			sd.ConfigId = h.configId
+			if sd.UPnPMajorVersion < 1 {
+				sd.UPnPMajorVersion, sd.UPnPMinorVersion = h.root.UPnPMajorVersion, h.root.UPnPMinorVersion
+			}
+			writeXML(w, r, h.configId, &sd)
+			return
+		}
+	}
+
+	doLog("ServeHTTP() - not found: %s", p)
+	http.NotFound(w, r)
+}
+
+func doLog(fmt string, vars ...interface{}) {
+	if Logger != nil {
+		Logger.Printf(fmt, vars...)
+	}
+}
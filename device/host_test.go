@@ -0,0 +1,203 @@
+package device
+
+import (
+	"context"
+	"encoding/xml"
+	"github.com/mmmorris1975/go-upnp/control"
+	"github.com/mmmorris1975/go-upnp/description"
+	"github.com/mmmorris1975/go-upnp/eventing"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const switchPowerSCPD = `<?xml version="1.0"?>
+<scpd xmlns="urn:schemas-upnp-org:service-1-0"><specVersion><major>1</major><minor>0</minor></specVersion>
+<actionList><action><name>GetStatus</name><argumentList>
+<argument><name>ResultStatus</name><direction>out</direction><retval/><relatedStateVariable>Status</relatedStateVariable></argument>
+</argumentList></action></actionList>
+<serviceStateTable>
+<stateVariable sendEvents="yes"><name>Status</name><dataType>boolean</dataType><defaultValue>0</defaultValue></stateVariable>
+</serviceStateTable></scpd>`
+
+const (
+	binaryLight = "urn:schemas-upnp-org:device:BinaryLight:1"
+	switchPower = "urn:schemas-upnp-org:service:SwitchPower:1"
+)
+
+func newTestHost(t *testing.T) (*Host, *Service) {
+	sd := new(description.ServiceDescription)
+	if err := xml.Unmarshal([]byte(switchPowerSCPD), sd); err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewHost(description.Device{DeviceType: "urn:schemas-upnp-org:device:Basic:1", FriendlyName: "Test",
+		Manufacturer: "go-upnp", ModelName: "test",
+		DeviceList: []description.Device{{DeviceType: binaryLight, FriendlyName: "Light", Manufacturer: "go-upnp", ModelName: "light"}}})
+
+	light := h.Description().Device.DeviceList[0].UDN
+	svc, err := h.AddService(light, description.Service{ServiceType: switchPower, ServiceId: "urn:upnp-org:serviceId:SwitchPower"}, sd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svc.Control.Handle(switchPower, "GetStatus", func(c *control.ActionCall) ([]control.Arg, error) {
+		return []control.Arg{control.NewArg("ResultStatus", true)}, nil
+	})
+
+	return h, svc
+}
+
+func TestNewUDN(t *testing.T) {
+	a := NewUDN("host/device")
+	if a != NewUDN("host/device") || a == NewUDN("host/other") {
+		t.Error("expected UDN to depend only on the name")
+	}
+	if len(a) != 41 || a[19] != '5' {
+		t.Errorf("unexpected UDN %s", a)
+	}
+}
+
+func TestHost(t *testing.T) {
+	h, svc := newTestHost(t)
+	id := h.ConfigId()
+	if err := h.AddIcon("", description.Icon{Mimetype: "image/png", Width: 16, Height: 16, Depth: 8}, []byte("png")); err != nil {
+		t.Fatal(err)
+	}
+	if h.ConfigId() == id {
+		t.Error("expected configId to change after adding an icon")
+	}
+
+	if _, err := h.AddService("uuid:unknown", svc.Info, svc.Description); err == nil {
+		t.Error("expected error for unknown device")
+	}
+	if _, err := h.AddService(svc.UDN, svc.Info, svc.Description); err == nil {
+		t.Error("expected error for duplicate service")
+	}
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + DESCRIPTION_PATH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if !strings.Contains(string(b), `<root xmlns="urn:schemas-upnp-org:device-1-0"`) {
+		t.Errorf("missing namespace in description:\n%s", b)
+	}
+
+	dd, err := description.DescribeDevice(srv.URL+DESCRIPTION_PATH, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dd.ConfigId != h.ConfigId() || !strings.HasPrefix(dd.Device.UDN, "uuid:") || dd.Device.UDN != h.UDN() {
+		t.Errorf("unexpected description %+v", dd)
+	}
+
+	icon, err := dd.BuildURL(dd.Device.IconByMimetype("image/png").URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err := http.Get(icon.String()); err != nil || res.Header.Get("Content-Type") != "image/png" {
+		t.Errorf("unexpected icon response %v %v", res, err)
+	}
+
+	s := dd.ServiceByType(switchPower)
+	if s == nil || s.ControlURL != svc.Info.ControlURL {
+		t.Fatalf("unexpected service %+v", s)
+	}
+
+	u, _ := dd.BuildURL(s.SCPDURL)
+	sd, err := description.DescribeService(u.String(), 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sd.ConfigId != h.ConfigId() || sd.Xmlns != description.SERVICE_NAMESPACE || !sd.ActionList[0].ArgumentList[0].RetVal {
+		t.Errorf("unexpected service description %+v", sd)
+	}
+
+	a, err := control.NewAction(dd, switchPower, "GetStatus", 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret := struct {
+		ResultStatus string
+	}{}
+	if err := a.Invoke(&ret); err != nil || ret.ResultStatus != "1" {
+		t.Errorf("unexpected action result %+v %v", ret, err)
+	}
+
+	eu, _ := dd.BuildURL(s.EventSubURL)
+	cb := eventing.NewCallbackServer("127.0.0.1:0")
+	if err := cb.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cb.Close()
+
+	m, _ := eventing.NewSubscriptionManagerWithServer(eu, 1*time.Minute, cb)
+	ch := make(chan *eventing.Event, 1)
+	go m.Run(context.Background(), ch)
+	defer m.Close()
+
+	select {
+	case e := <-ch:
+		if len(e.Properties) != 1 || e.Properties[0].Result.Value != "0" {
+			t.Errorf("unexpected initial event %+v", e)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("timed out waiting for initial event")
+	}
+}
+
+func TestHostDescriptionCopy(t *testing.T) {
+	h, _ := newTestHost(t)
+
+	dd := h.Description()
+	dd.Device.DeviceList[0].FriendlyName = "Changed"
+	dd.Device.DeviceList[0].ServiceList[0].ServiceType = "Changed"
+
+	d := h.Description().Device.DeviceList[0]
+	if d.FriendlyName != "Light" || d.ServiceList[0].ServiceType != switchPower {
+		t.Errorf("changing the returned description changed the host %+v", d)
+	}
+}
+
+func TestHostDescriptionEmptyLists(t *testing.T) {
+	h, _ := newTestHost(t)
+
+	sd := &description.ServiceDescription{ServiceStateTable: []description.StateVariable{{Name: "Value", DataType: "string"}}}
+	svc, err := h.AddService(h.UDN(), description.Service{ServiceType: "urn:schemas-upnp-org:service:Empty:1",
+		ServiceId: "urn:upnp-org:serviceId:Empty"}, sd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	get := func(path string) string {
+		res, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		return string(b)
+	}
+
+	// the schemas require at least one element in each list
+	doc := get(DESCRIPTION_PATH) + get(svc.Info.SCPDURL)
+	for _, e := range []string{"iconList", "deviceList", "actionList", "argumentList", "allowedValueList", "allowedValueRange"} {
+		if strings.Contains(doc, "<"+e+"></"+e+">") || strings.Contains(doc, "<"+e+"/>") {
+			t.Errorf("empty %s in description:\n%s", e, doc)
+		}
+	}
+	if !strings.Contains(doc, "<deviceList>") || !strings.Contains(doc, "<name>Value</name>") {
+		t.Errorf("missing elements in description:\n%s", doc)
+	}
+}
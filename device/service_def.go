@@ -0,0 +1,253 @@
+package device
+
+import (
+	"fmt"
+	"github.com/mmmorris1975/go-upnp/control"
+	"github.com/mmmorris1975/go-upnp/description"
+	"sync"
+)
+
+// VariableDef declares a state variable of a service
+type VariableDef struct {
+	Name     string
+	DataType string
+	Default  string
+	// Send changes to event subscribers
+	Evented bool
+	Allowed []string
+	// Allowed value range, for numeric types
+	Min, Max, Step string
+}
+
+// ArgDef declares an action argument, bound to a state variable which gives its data type and allowed values
+type ArgDef struct {
+	Name     string
+	Variable string
+	// Only for the first out argument
+	RetVal bool
+}
+
+// ActionDef declares an action and its handler.  Out arguments not set by the handler are sent with the
+// current value of their related state variable
+type ActionDef struct {
+	Name    string
+	In      []ArgDef
+	Out     []ArgDef
+	Handler func(c *Call) error
+}
+
+// ServiceDef declares a service, its state variables and actions, from which the service description is
+// generated, see Host.Declare()
+type ServiceDef struct {
+	ServiceType string
+	ServiceId   string
+	Variables   []VariableDef
+	Actions     []ActionDef
+}
+
+// Description generates the service description, checking that every argument refers to a declared variable
+func (def *ServiceDef) Description() (*description.ServiceDescription, error) {
+	sd := &description.ServiceDescription{UPnPMajorVersion: 1, UPnPMinorVersion: 1}
+
+	for _, v := range def.Variables {
+		if len(v.Name) < 1 || len(v.DataType) < 1 {
+			return nil, fmt.Errorf("state variable name and data type are required")
+		}
+		if sd.StateVariableByName(v.Name) != nil {
+			return nil, fmt.Errorf("duplicate state variable %s", v.Name)
+		}
+
+		sv := description.StateVariable{Name: v.Name, DataType: v.DataType, DefaultValue: v.Default,
+			AllowedValueList: v.Allowed, MinValue: v.Min, MaxValue: v.Max, Step: v.Step, SendEvents: "no"}
+		if v.Evented {
+			sv.SendEvents = "yes"
+		}
+
+		if len(v.Default) > 0 {
+			if err := sv.Validate(v.Default); err != nil {
+				return nil, err
+			}
+		}
+		sd.ServiceStateTable = append(sd.ServiceStateTable, sv)
+	}
+
+	for _, a := range def.Actions {
+		if sd.ActionByName(a.Name) != nil {
+			return nil, fmt.Errorf("duplicate action %s", a.Name)
+		}
+
+		da := description.Action{Name: a.Name}
+		for _, dir := range []string{"in", "out"} {
+			args := a.In
+			if dir == "out" {
+				args = a.Out
+			}
+
+			for i, arg := range args {
+				if sd.StateVariableByName(arg.Variable) == nil {
+					return nil, fmt.Errorf("argument %s of action %s refers to unknown state variable %s", arg.Name, a.Name, arg.Variable)
+				}
+				if arg.RetVal && (dir == "in" || i > 0) {
+					return nil, fmt.Errorf("only the first out argument of action %s can be the return value", a.Name)
+				}
+
+				da.ArgumentList = append(da.ArgumentList, description.Argument{Name: arg.Name, Direction: dir,
+					RelatedStateVariable: arg.Variable, RetVal: arg.RetVal})
+			}
+		}
+		sd.ActionList = append(sd.ActionList, da)
+	}
+
+	return sd, nil
+}
+
+// DeclaredService is a service created from a ServiceDef, which keeps the value of its state variables.
+// Changes to evented variables are sent to subscribers
+type DeclaredService struct {
+	*Service
+	mu   sync.RWMutex
+	vars map[string]string
+}
+
+// Declare generates the description of the service, hosts it on the device with the UDN (the root device
+// if empty), and registers the action handlers
+func (h *Host) Declare(udn string, def *ServiceDef) (*DeclaredService, error) {
+	sd, err := def.Description()
+	if err != nil {
+		return nil, err
+	}
+
+	svc, err := h.AddService(udn, description.Service{ServiceType: def.ServiceType, ServiceId: def.ServiceId}, sd)
+	if err != nil {
+		return nil, err
+	}
+
+	ds := &DeclaredService{Service: svc, vars: make(map[string]string)}
+	for _, v := range sd.ServiceStateTable {
+		ds.vars[v.Name] = v.DefaultValue
+	}
+
+	// copy the actions, so later changes to def don't change the running service
+	for _, a := range def.Actions {
+		a := a
+		a.In = append([]ArgDef(nil), a.In...)
+		a.Out = append([]ArgDef(nil), a.Out...)
+		svc.Control.Handle(def.ServiceType, a.Name, func(c *control.ActionCall) ([]control.Arg, error) {
+			return ds.invoke(&a, c)
+		})
+	}
+
+	return ds, nil
+}
+
+// Get returns the current value of a state variable
+func (s *DeclaredService) Get(name string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.vars[name]
+}
+
+// Value returns the current value of a state variable, converted to a Go type as by StateVariable.ParseValue()
+func (s *DeclaredService) Value(name string) (interface{}, error) {
+	sv := s.Description.StateVariableByName(name)
+	if sv == nil {
+		return nil, fmt.Errorf("unknown state variable %s", name)
+	}
+	return sv.ParseValue(s.Get(name))
+}
+
+// Set changes the value of a state variable, which must be valid for its data type and allowed values
+func (s *DeclaredService) Set(name string, val interface{}) error {
+	return s.SetMany(map[string]interface{}{name: val})
+}
+
+// SetMany changes the value of several state variables, evented changes are sent in a single event.  No
+// variable is changed if any value is invalid
+func (s *DeclaredService) SetMany(vals map[string]interface{}) error {
+	strs := make(map[string]string, len(vals))
+	for k, v := range vals {
+		sv := s.Description.StateVariableByName(k)
+		if sv == nil {
+			return fmt.Errorf("unknown state variable %s", k)
+		}
+
+		str, err := sv.FormatValue(v)
+		if err != nil {
+			return err
+		}
+		strs[k] = str
+	}
+
+	// hold the lock while publishing, so events are sent in the order of changes
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	evented := make(map[string]string)
+	for k, v := range strs {
+		s.vars[k] = v
+		if sv := s.Description.StateVariableByName(k); sv.SendEvents == "yes" {
+			evented[k] = v
+		}
+	}
+
+	if len(evented) > 0 {
+		return s.Events.SetMany(evented)
+	}
+	return nil
+}
+
+// Call is an incoming action request for a DeclaredService
+type Call struct {
+	*control.ActionCall
+	Service *DeclaredService
+	in      map[string]interface{}
+	out     map[string]interface{}
+}
+
+// In returns the value of an input argument, converted to a Go type based on its related state variable
+func (c *Call) In(name string) interface{} {
+	return c.in[name]
+}
+
+// Out sets the value of an output argument
+func (c *Call) Out(name string, val interface{}) {
+	c.out[name] = val
+}
+
+func (s *DeclaredService) invoke(a *ActionDef, ac *control.ActionCall) ([]control.Arg, error) {
+	c := &Call{ActionCall: ac, Service: s, in: make(map[string]interface{}), out: make(map[string]interface{})}
+
+	// the control server has already checked the arguments against the description
+	for _, arg := range a.In {
+		v, err := s.Description.StateVariableByName(arg.Variable).ParseValue(ac.Arg(arg.Name))
+		if err != nil {
+			return nil, control.NewFault(control.ERR_ARGUMENT_VALUE_INVALID, "")
+		}
+		c.in[arg.Name] = v
+	}
+
+	if a.Handler != nil {
+		if err := a.Handler(c); err != nil {
+			return nil, err
+		}
+	}
+
+	res := make([]control.Arg, 0, len(a.Out))
+	for _, arg := range a.Out {
+		sv := s.Description.StateVariableByName(arg.Variable)
+
+		var str string
+		if v, ok := c.out[arg.Name]; ok {
+			var err error
+			if str, err = sv.FormatValue(v); err != nil {
+				return nil, fmt.Errorf("invalid value for output argument %s: %v", arg.Name, err)
+			}
+		} else {
+			str = s.Get(arg.Variable)
+		}
+
+		res = append(res, control.NewArg(arg.Name, str))
+	}
+
+	return res, nil
+}
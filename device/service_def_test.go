@@ -0,0 +1,141 @@
+package device
+
+import (
+	"context"
+	"github.com/mmmorris1975/go-upnp/control"
+	"github.com/mmmorris1975/go-upnp/description"
+	"github.com/mmmorris1975/go-upnp/eventing"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newSwitchPowerDef() *ServiceDef {
+	return &ServiceDef{
+		ServiceType: switchPower,
+		ServiceId:   "urn:upnp-org:serviceId:SwitchPower",
+		Variables: []VariableDef{
+			{Name: "Target", DataType: "boolean", Default: "0"},
+			{Name: "Status", DataType: "boolean", Default: "0", Evented: true},
+			{Name: "Level", DataType: "ui1", Default: "0", Min: "0", Max: "100"},
+		},
+		Actions: []ActionDef{
+			{Name: "SetTarget", In: []ArgDef{{Name: "newTargetValue", Variable: "Target"}}, Handler: func(c *Call) error {
+				v := c.In("newTargetValue").(bool)
+				return c.Service.SetMany(map[string]interface{}{"Target": v, "Status": v})
+			}},
+			{Name: "GetStatus", Out: []ArgDef{{Name: "ResultStatus", Variable: "Status", RetVal: true}}},
+			{Name: "GetLevel", Out: []ArgDef{{Name: "Level", Variable: "Level"}}, Handler: func(c *Call) error {
+				c.Out("Level", uint8(42))
+				return nil
+			}},
+		},
+	}
+}
+
+func TestServiceDefDescription(t *testing.T) {
+	sd, err := newSwitchPowerDef().Description()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sv := sd.StateVariableByName("Status"); sv == nil || sv.SendEvents != "yes" {
+		t.Errorf("unexpected Status variable %+v", sv)
+	}
+	if a := sd.ActionByName("GetStatus"); a == nil || !a.ArgumentList[0].RetVal || a.ArgumentList[0].Direction != "out" {
+		t.Errorf("unexpected GetStatus action %+v", a)
+	}
+
+	bad := []*ServiceDef{
+		{Variables: []VariableDef{{Name: "A", DataType: "ui1", Default: "x"}}},
+		{Variables: []VariableDef{{Name: "A", DataType: "ui1"}, {Name: "A", DataType: "ui1"}}},
+		{Actions: []ActionDef{{Name: "X", In: []ArgDef{{Name: "a", Variable: "Missing"}}}}},
+		{Variables: []VariableDef{{Name: "A", DataType: "ui1"}}, Actions: []ActionDef{{Name: "X", In: []ArgDef{{Name: "a", Variable: "A", RetVal: true}}}}},
+	}
+	for i, def := range bad {
+		if _, err := def.Description(); err == nil {
+			t.Errorf("test %d: expected error", i)
+		}
+	}
+}
+
+func TestDeclare(t *testing.T) {
+	h := NewHost(description.Device{DeviceType: binaryLight, FriendlyName: "Light", Manufacturer: "go-upnp", ModelName: "light"})
+	def := newSwitchPowerDef()
+	ds, err := h.Declare("", def)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the declared service keeps its own copy of the actions
+	def.Actions[2].Handler = nil
+	def.Actions[2].Out[0].Name = "Changed"
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	dd, err := description.DescribeDevice(srv.URL+DESCRIPTION_PATH, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	eu, _ := dd.BuildURL(dd.ServiceByType(switchPower).EventSubURL)
+	cb := eventing.NewCallbackServer("127.0.0.1:0")
+	if err := cb.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cb.Close()
+
+	m, _ := eventing.NewSubscriptionManagerWithServer(eu, 1*time.Minute, cb)
+	ch := make(chan *eventing.Event, 10)
+	go m.Run(context.Background(), ch)
+	defer m.Close()
+
+	recv := func() string {
+		select {
+		case e := <-ch:
+			return e.Properties[0].Result.Value
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for event")
+		}
+		return ""
+	}
+	if v := recv(); v != "0" {
+		t.Errorf("unexpected initial Status %s", v)
+	}
+
+	exec := control.NewExecutor(dd, 1, 2*time.Second)
+	ret := struct {
+		ResultStatus string
+		Level        string
+	}{}
+
+	if err := exec.Call(context.Background(), switchPower, "SetTarget", []control.Arg{control.NewArg("newTargetValue", true)}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if v := recv(); v != "1" {
+		t.Errorf("expected Status event 1, got %s", v)
+	}
+
+	if err := exec.Call(context.Background(), switchPower, "GetStatus", nil, &ret); err != nil || ret.ResultStatus != "1" {
+		t.Errorf("unexpected GetStatus result %+v %v", ret, err)
+	}
+	if err := exec.Call(context.Background(), switchPower, "GetLevel", nil, &ret); err != nil || ret.Level != "42" {
+		t.Errorf("unexpected GetLevel result %+v %v", ret, err)
+	}
+
+	err = exec.Call(context.Background(), switchPower, "SetTarget", []control.Arg{control.NewArg("newTargetValue", "maybe")}, nil)
+	if control.FaultCode(err) != control.ERR_ARGUMENT_VALUE_INVALID {
+		t.Errorf("expected fault 600, got %v", err)
+	}
+
+	if v, err := ds.Value("Target"); err != nil || v != true {
+		t.Errorf("unexpected Target %v %v", v, err)
+	}
+	if err := ds.Set("Level", 101); err == nil {
+		t.Error("expected error for out of range value")
+	}
+	if err := ds.Set("Unknown", 1); err == nil {
+		t.Error("expected error for unknown variable")
+	}
+}
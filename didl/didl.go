@@ -0,0 +1,283 @@
+package didl
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// XML namespaces used in DIDL-Lite documents
+const (
+	DIDL_NAMESPACE = "urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/"
+	DC_NAMESPACE   = "http://purl.org/dc/elements/1.1/"
+	UPNP_NAMESPACE = "urn:schemas-upnp-org:metadata-1-0/upnp/"
+	DLNA_NAMESPACE = "urn:schemas-dlna-org:metadata-1-0/"
+)
+
+// Resource is a res element of a DIDL-Lite object, one of the URIs the object can be fetched from
+type Resource struct {
+	URI string
+	// ex. http-get:*:audio/mpeg:DLNA.ORG_PN=MP3, see ParseProtocolInfo()
+	ProtocolInfo string
+	Duration     time.Duration
+	// Size in bytes, -1 if unknown
+	Size       int64
+	Bitrate    uint32
+	Resolution string
+}
+
+// Protocol returns the parsed protocolInfo of the resource
+func (r *Resource) Protocol() (ProtocolInfo, error) {
+	return ParseProtocolInfo(r.ProtocolInfo)
+}
+
+// Object holds the properties common to DIDL-Lite containers and items
+type Object struct {
+	ID         string
+	ParentID   string
+	Restricted bool
+	Title      string
+	Creator    string
+	// upnp:class, ex. object.container.album.musicAlbum or object.item.videoItem
+	Class       string
+	Date        string
+	Description string
+	Artist      string
+	Album       string
+	Genre       string
+	AlbumArtURI string
+	TrackNumber int
+	Resources   []Resource
+}
+
+type Container struct {
+	Object
+	// Number of children, -1 if not provided
+	ChildCount int
+	Searchable bool
+}
+
+type Item struct {
+	Object
+	// ID of the item this one refers to, if it is a reference
+	RefID string
+}
+
+// Document is a DIDL-Lite document, as returned by ContentDirectory Browse and Search, and used for
+// AVTransport metadata
+type Document struct {
+	Containers []Container
+	Items      []Item
+}
+
+// wireRes is the res element, for both decoding and encoding
+type wireRes struct {
+	ProtocolInfo string `xml:"protocolInfo,attr"`
+	Duration     string `xml:"duration,attr,omitempty"`
+	Size         string `xml:"size,attr,omitempty"`
+	Bitrate      string `xml:"bitrate,attr,omitempty"`
+	Resolution   string `xml:"resolution,attr,omitempty"`
+	URI          string `xml:",chardata"`
+}
+
+// decodeObject is the wire form of a container or item for decoding.  Element names are matched without
+// a namespace, since some servers get the dc: and upnp: namespaces wrong
+type decodeObject struct {
+	ID          string    `xml:"id,attr"`
+	ParentID    string    `xml:"parentID,attr"`
+	Restricted  string    `xml:"restricted,attr"`
+	ChildCount  string    `xml:"childCount,attr"`
+	Searchable  string    `xml:"searchable,attr"`
+	RefID       string    `xml:"refID,attr"`
+	Title       string    `xml:"title"`
+	Creator     string    `xml:"creator"`
+	Class       string    `xml:"class"`
+	Date        string    `xml:"date"`
+	Description string    `xml:"description"`
+	Artist      []string  `xml:"artist"`
+	Album       string    `xml:"album"`
+	Genre       []string  `xml:"genre"`
+	AlbumArtURI []string  `xml:"albumArtURI"`
+	TrackNumber string    `xml:"originalTrackNumber"`
+	Res         []wireRes `xml:"res"`
+}
+
+type decodeDocument struct {
+	XMLName    xml.Name       `xml:"DIDL-Lite"`
+	Containers []decodeObject `xml:"container"`
+	Items      []decodeObject `xml:"item"`
+}
+
+// encodeObject is the wire form of a container or item for encoding.  encoding/xml can't write namespace
+// prefixes, so the same hack as control.Envelope is used: prefixed names in the tags, with the prefixes
+// declared on the DIDL-Lite element
+type encodeObject struct {
+	XMLName     xml.Name
+	ID          string    `xml:"id,attr"`
+	ParentID    string    `xml:"parentID,attr"`
+	Restricted  string    `xml:"restricted,attr"`
+	ChildCount  string    `xml:"childCount,attr,omitempty"`
+	Searchable  string    `xml:"searchable,attr,omitempty"`
+	RefID       string    `xml:"refID,attr,omitempty"`
+	Title       string    `xml:"dc:title"`
+	Creator     string    `xml:"dc:creator,omitempty"`
+	Date        string    `xml:"dc:date,omitempty"`
+	Description string    `xml:"dc:description,omitempty"`
+	Artist      string    `xml:"upnp:artist,omitempty"`
+	Album       string    `xml:"upnp:album,omitempty"`
+	Genre       string    `xml:"upnp:genre,omitempty"`
+	AlbumArtURI string    `xml:"upnp:albumArtURI,omitempty"`
+	TrackNumber string    `xml:"upnp:originalTrackNumber,omitempty"`
+	Class       string    `xml:"upnp:class"`
+	Res         []wireRes `xml:"res"`
+}
+
+type encodeDocument struct {
+	XMLName    xml.Name       `xml:"DIDL-Lite"`
+	XMLNS      string         `xml:"xmlns,attr"`
+	XMLNSDC    string         `xml:"xmlns:dc,attr"`
+	XMLNSUPnP  string         `xml:"xmlns:upnp,attr"`
+	XMLNSDLNA  string         `xml:"xmlns:dlna,attr"`
+	Containers []encodeObject `xml:"container"`
+	Items      []encodeObject `xml:"item"`
+}
+
+func parseBool(s string) bool {
+	b, err := strconv.ParseBool(strings.TrimSpace(s))
+	return err == nil && b
+}
+
+func formatBool(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+func first(s []string) string {
+	if len(s) > 0 {
+		return strings.TrimSpace(s[0])
+	}
+	return ""
+}
+
+func (d *decodeObject) object() Object {
+	o := Object{
+		ID:          d.ID,
+		ParentID:    d.ParentID,
+		Restricted:  parseBool(d.Restricted),
+		Title:       strings.TrimSpace(d.Title),
+		Creator:     strings.TrimSpace(d.Creator),
+		Class:       strings.TrimSpace(d.Class),
+		Date:        strings.TrimSpace(d.Date),
+		Description: strings.TrimSpace(d.Description),
+		Artist:      first(d.Artist),
+		Album:       strings.TrimSpace(d.Album),
+		Genre:       first(d.Genre),
+		AlbumArtURI: first(d.AlbumArtURI),
+	}
+	o.TrackNumber, _ = strconv.Atoi(strings.TrimSpace(d.TrackNumber))
+
+	for _, r := range d.Res {
+		res := Resource{URI: strings.TrimSpace(r.URI), ProtocolInfo: r.ProtocolInfo, Resolution: r.Resolution, Size: -1}
+		res.Duration, _ = ParseDuration(r.Duration)
+		if n, err := strconv.ParseInt(r.Size, 10, 64); err == nil {
+			res.Size = n
+		}
+		if n, err := strconv.ParseUint(r.Bitrate, 10, 32); err == nil {
+			res.Bitrate = uint32(n)
+		}
+		o.Resources = append(o.Resources, res)
+	}
+
+	return o
+}
+
+func encode(name string, o *Object) encodeObject {
+	e := encodeObject{
+		XMLName:     xml.Name{Local: name},
+		ID:          o.ID,
+		ParentID:    o.ParentID,
+		Restricted:  formatBool(o.Restricted),
+		Title:       o.Title,
+		Creator:     o.Creator,
+		Date:        o.Date,
+		Description: o.Description,
+		Artist:      o.Artist,
+		Album:       o.Album,
+		Genre:       o.Genre,
+		AlbumArtURI: o.AlbumArtURI,
+		Class:       o.Class,
+	}
+	if o.TrackNumber > 0 {
+		e.TrackNumber = strconv.Itoa(o.TrackNumber)
+	}
+
+	for _, r := range o.Resources {
+		w := wireRes{ProtocolInfo: r.ProtocolInfo, Resolution: r.Resolution, URI: r.URI}
+		if r.Duration > 0 {
+			w.Duration = FormatDuration(r.Duration)
+		}
+		if r.Size >= 0 {
+			w.Size = strconv.FormatInt(r.Size, 10)
+		}
+		if r.Bitrate > 0 {
+			w.Bitrate = strconv.FormatUint(uint64(r.Bitrate), 10)
+		}
+		e.Res = append(e.Res, w)
+	}
+
+	return e
+}
+
+// Parse decodes a DIDL-Lite document
+func Parse(s string) (*Document, error) {
+	d := decodeDocument{}
+	if err := xml.Unmarshal([]byte(s), &d); err != nil {
+		return nil, err
+	}
+
+	doc := &Document{Containers: make([]Container, 0, len(d.Containers)), Items: make([]Item, 0, len(d.Items))}
+	for _, c := range d.Containers {
+		n, err := strconv.Atoi(c.ChildCount)
+		if err != nil {
+			n = -1
+		}
+		doc.Containers = append(doc.Containers, Container{Object: c.object(), ChildCount: n, Searchable: parseBool(c.Searchable)})
+	}
+
+	for _, i := range d.Items {
+		doc.Items = append(doc.Items, Item{Object: i.object(), RefID: i.RefID})
+	}
+
+	return doc, nil
+}
+
+// Marshal encodes the document, with the dc:, upnp: and dlna: namespace prefixes
+func (d *Document) Marshal() (string, error) {
+	e := encodeDocument{XMLNS: DIDL_NAMESPACE, XMLNSDC: DC_NAMESPACE, XMLNSUPnP: UPNP_NAMESPACE, XMLNSDLNA: DLNA_NAMESPACE}
+
+	for i := range d.Containers {
+		c := &d.Containers[i]
+		o := encode("container", &c.Object)
+		if c.ChildCount >= 0 {
+			o.ChildCount = strconv.Itoa(c.ChildCount)
+		}
+		o.Searchable = formatBool(c.Searchable)
+		e.Containers = append(e.Containers, o)
+	}
+
+	for i := range d.Items {
+		o := encode("item", &d.Items[i].Object)
+		o.RefID = d.Items[i].RefID
+		e.Items = append(e.Items, o)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := xml.NewEncoder(buf).Encode(e); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
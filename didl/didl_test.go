@@ -0,0 +1,182 @@
+package didl
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Browse results captured from real servers
+var samples = map[string]string{
+	"minidlna": `<DIDL-Lite xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:upnp="urn:schemas-upnp-org:metadata-1-0/upnp/" xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/" xmlns:dlna="urn:schemas-dlna-org:metadata-1-0/">` +
+		`<container id="64" parentID="0" restricted="1" searchable="1" childCount="4"><dc:title>Browse Folders</dc:title><upnp:class>object.container.storageFolder</upnp:class><upnp:storageUsed>-1</upnp:storageUsed></container>` +
+		`<item id="64$0$1" parentID="64$0" restricted="1"><dc:title>Song One</dc:title><upnp:class>object.item.audioItem.musicTrack</upnp:class>` +
+		`<dc:creator>Artist</dc:creator><upnp:artist>Artist</upnp:artist><upnp:album>Album</upnp:album><upnp:genre>Rock</upnp:genre>` +
+		`<upnp:originalTrackNumber>3</upnp:originalTrackNumber><dc:date>2001-01-01</dc:date>` +
+		`<upnp:albumArtURI dlna:profileID="JPEG_TN">http://10.0.0.2:8200/AlbumArt/1-1.jpg</upnp:albumArtURI>` +
+		`<res size="5234811" duration="0:03:38.045" bitrate="24000" sampleFrequency="44100" nrAudioChannels="2" protocolInfo="http-get:*:audio/mpeg:DLNA.ORG_PN=MP3;DLNA.ORG_OP=01">http://10.0.0.2:8200/MediaItems/1.mp3</res>` +
+		`</item></DIDL-Lite>`,
+	"mediatomb": `<DIDL-Lite xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:upnp="urn:schemas-upnp-org:metadata-1-0/upnp/">
+<item id="1021" parentID="1020" restricted="1">
+  <dc:title>Holiday 2019</dc:title>
+  <upnp:class>object.item.videoItem</upnp:class>
+  <dc:description>Beach &amp; mountains</dc:description>
+  <res protocolInfo="http-get:*:video/mp4:*" size="734003200" duration="1:02:03.500" resolution="1920x1080" bitrate="2500000">http://10.0.0.3:49152/content/media/object_id/1021/res_id/0/ext/file.mp4</res>
+  <res protocolInfo="http-get:*:image/jpeg:DLNA.ORG_PN=JPEG_TN" resolution="160x90">http://10.0.0.3:49152/content/media/object_id/1021/res_id/1/rct/th</res>
+</item>
+<item id="1022" parentID="1020" refID="1021" restricted="0">
+  <dc:title>Holiday 2019 (link)</dc:title>
+  <upnp:class>object.item.videoItem</upnp:class>
+</item>
+</DIDL-Lite>`,
+}
+
+func TestParse(t *testing.T) {
+	d, err := Parse(samples["minidlna"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(d.Containers) != 1 || d.Containers[0].ChildCount != 4 || !d.Containers[0].Searchable {
+		t.Errorf("unexpected containers %+v", d.Containers)
+	}
+
+	if len(d.Items) != 1 || d.Items[0].TrackNumber != 3 || d.Items[0].Date != "2001-01-01" {
+		t.Fatalf("unexpected items %+v", d.Items)
+	}
+
+	it := d.Items[0]
+	if it.Title != "Song One" || it.Artist != "Artist" || it.Album != "Album" || it.Genre != "Rock" ||
+		it.Class != "object.item.audioItem.musicTrack" || it.AlbumArtURI != "http://10.0.0.2:8200/AlbumArt/1-1.jpg" || !it.Restricted {
+		t.Errorf("unexpected item %+v", it)
+	}
+
+	r := it.Resources[0]
+	if r.Size != 5234811 || r.Duration != 218045*time.Millisecond || r.Bitrate != 24000 || r.URI != "http://10.0.0.2:8200/MediaItems/1.mp3" {
+		t.Errorf("unexpected resource %+v", r)
+	}
+
+	d, err = Parse(samples["mediatomb"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(d.Containers) != 0 || len(d.Items) != 2 {
+		t.Fatalf("unexpected document %+v", d)
+	}
+
+	i := d.Items[0]
+	if i.Description != "Beach & mountains" || len(i.Resources) != 2 {
+		t.Errorf("unexpected item %+v", i)
+	}
+
+	r = i.Resources[0]
+	if r.Duration != time.Hour+2*time.Minute+3500*time.Millisecond || r.Size != 734003200 || r.Resolution != "1920x1080" || r.Bitrate != 2500000 {
+		t.Errorf("unexpected resource %+v", r)
+	}
+	if r := i.Resources[1]; r.Size != -1 || r.Duration != 0 {
+		t.Errorf("unexpected resource %+v", r)
+	}
+
+	if i := d.Items[1]; i.RefID != "1021" || i.Restricted {
+		t.Errorf("unexpected reference item %+v", i)
+	}
+
+	if _, err := Parse("<DIDL-Lite><item>"); err == nil {
+		t.Error("expected error for truncated document")
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for name, s := range samples {
+		d, err := Parse(s)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		out, err := d.Marshal()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		d2, err := Parse(out)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if !reflect.DeepEqual(d, d2) {
+			t.Errorf("%s: round trip mismatch\n%+v\n%+v", name, d, d2)
+		}
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	d := Document{Items: []Item{{Object: Object{ID: "1", ParentID: "0", Restricted: true, Title: "A & B",
+		Class: "object.item.audioItem", Artist: "Band", TrackNumber: 2,
+		Resources: []Resource{{URI: "http://h/1.mp3", ProtocolInfo: "http-get:*:audio/mpeg:*", Duration: 65 * time.Second, Size: -1}}}}}}
+
+	s, err := d.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		`<DIDL-Lite xmlns="` + DIDL_NAMESPACE + `" xmlns:dc="` + DC_NAMESPACE + `" xmlns:upnp="` + UPNP_NAMESPACE + `"`,
+		`<item id="1" parentID="0" restricted="1">`,
+		`<dc:title>A &amp; B</dc:title>`,
+		`<upnp:artist>Band</upnp:artist>`,
+		`<upnp:originalTrackNumber>2</upnp:originalTrackNumber>`,
+		`<upnp:class>object.item.audioItem</upnp:class>`,
+		`<res protocolInfo="http-get:*:audio/mpeg:*" duration="0:01:05">http://h/1.mp3</res>`,
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("missing %s in %s", want, s)
+		}
+	}
+
+	if strings.Contains(s, "size=") || strings.Contains(s, "dc:creator") {
+		t.Errorf("unexpected empty values in %s", s)
+	}
+}
+
+func TestDuration(t *testing.T) {
+	tests := map[time.Duration]string{
+		0:                                     "0:00:00",
+		time.Hour + 65*time.Second:            "1:01:05",
+		218045 * time.Millisecond:             "0:03:38.045",
+		100*time.Hour + 3500*time.Millisecond: "100:00:03.5",
+		2*time.Second + 999*time.Microsecond:  "0:00:02",
+	}
+
+	for d, want := range tests {
+		s := FormatDuration(d)
+		if s != want {
+			t.Errorf("FormatDuration(%v): got %s, want %s", d, s, want)
+		}
+
+		if p, err := ParseDuration(s); err != nil || p != d.Truncate(time.Millisecond) {
+			t.Errorf("ParseDuration(%s): got %v, %v", s, p, err)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := map[string]time.Duration{
+		"0:03:25":         205 * time.Second,
+		"01:00:00.500":    time.Hour + 500*time.Millisecond,
+		"0:00:01.1/4":     1250 * time.Millisecond,
+		"NOT_IMPLEMENTED": 0,
+		"-0:00:05":        -5 * time.Second,
+	}
+
+	for s, want := range tests {
+		if d, err := ParseDuration(s); err != nil || d != want {
+			t.Errorf("%s: expected %s, got %s %v", s, want, d, err)
+		}
+	}
+
+	if _, err := ParseDuration("3:25"); err == nil {
+		t.Error("expected error for invalid duration")
+	}
+}
@@ -0,0 +1,76 @@
+package didl
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FormatDuration formats d as H+:MM:SS, as used by res@duration and AVTransport time values.  Fractions
+// of a second are added as milliseconds (H+:MM:SS.F+), if present
+func FormatDuration(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+	s := int64(d / time.Second)
+	res := fmt.Sprintf("%d:%02d:%02d", s/3600, (s/60)%60, s%60)
+
+	if ms := int64(d%time.Second) / int64(time.Millisecond); ms > 0 {
+		res += strings.TrimRight(fmt.Sprintf(".%03d", ms), "0")
+	}
+	return res
+}
+
+// ParseDuration parses a H+:MM:SS[.F+] or H+:MM:SS[.F0/F1] time value.  NOT_IMPLEMENTED and empty
+// values are returned as zero
+func ParseDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if len(s) < 1 || s == "NOT_IMPLEMENTED" {
+		return 0, nil
+	}
+
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimLeft(s, "+-")
+
+	var frac time.Duration
+	if i := strings.Index(s, "."); i >= 0 {
+		f := s[i+1:]
+		s = s[:i]
+
+		if j := strings.Index(f, "/"); j >= 0 {
+			n, err1 := strconv.Atoi(f[:j])
+			m, err2 := strconv.Atoi(f[j+1:])
+			if err1 != nil || err2 != nil || m == 0 {
+				return 0, fmt.Errorf("invalid duration fraction %s", f)
+			}
+			frac = time.Duration(n) * time.Second / time.Duration(m)
+		} else if len(f) > 0 {
+			v, err := strconv.ParseFloat("0."+f, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration fraction %s", f)
+			}
+			frac = time.Duration(v * float64(time.Second))
+		}
+	}
+
+	p := strings.Split(s, ":")
+	if len(p) != 3 {
+		return 0, fmt.Errorf("invalid duration %s", s)
+	}
+
+	var d time.Duration
+	for i, u := range []time.Duration{time.Hour, time.Minute, time.Second} {
+		n, err := strconv.Atoi(p[i])
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %s", s)
+		}
+		d += time.Duration(n) * u
+	}
+	d += frac
+
+	if neg {
+		d = -d
+	}
+	return d, nil
+}
@@ -0,0 +1,60 @@
+package didl
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ProtocolInfo is the protocolInfo of a resource, or of a renderer sink or server source
+// (<protocol>:<network>:<contentFormat>:<additionalInfo>), ex. http-get:*:audio/mpeg:DLNA.ORG_PN=MP3
+type ProtocolInfo struct {
+	Protocol       string
+	Network        string
+	ContentFormat  string
+	AdditionalInfo string
+}
+
+// ParseProtocolInfo parses a protocolInfo value, the additional info may contain ':'
+func ParseProtocolInfo(s string) (ProtocolInfo, error) {
+	p := strings.SplitN(strings.TrimSpace(s), ":", 4)
+	if len(p) != 4 {
+		return ProtocolInfo{}, fmt.Errorf("invalid protocolInfo %s", s)
+	}
+
+	return ProtocolInfo{Protocol: p[0], Network: p[1], ContentFormat: p[2], AdditionalInfo: p[3]}, nil
+}
+
+func (p ProtocolInfo) String() string {
+	return strings.Join([]string{p.Protocol, p.Network, p.ContentFormat, p.AdditionalInfo}, ":")
+}
+
+// Params returns the name=value pairs of the additional info, ex. DLNA.ORG_PN and DLNA.ORG_OP
+func (p ProtocolInfo) Params() map[string]string {
+	res := make(map[string]string)
+	if p.AdditionalInfo == "*" {
+		return res
+	}
+
+	for _, e := range strings.Split(p.AdditionalInfo, ";") {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) == 2 {
+			res[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+	return res
+}
+
+// Matches returns true if a resource with protocolInfo p can be played by a sink with protocolInfo
+// sink.  Wildcards (*) match anything, and the DLNA profile (DLNA.ORG_PN) must match if both set one
+func (p ProtocolInfo) Matches(sink ProtocolInfo) bool {
+	match := func(a, b string) bool {
+		return a == "*" || b == "*" || strings.EqualFold(a, b)
+	}
+
+	if !match(p.Protocol, sink.Protocol) || !match(p.Network, sink.Network) || !match(p.ContentFormat, sink.ContentFormat) {
+		return false
+	}
+
+	a, b := p.Params()["DLNA.ORG_PN"], sink.Params()["DLNA.ORG_PN"]
+	return len(a) < 1 || len(b) < 1 || a == b
+}
@@ -0,0 +1,56 @@
+package didl
+
+import (
+	"testing"
+)
+
+func TestParseProtocolInfo(t *testing.T) {
+	p, err := ParseProtocolInfo("http-get:*:audio/mpeg:DLNA.ORG_PN=MP3;DLNA.ORG_OP=01;DLNA.ORG_FLAGS=01700000000000000000000000000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.Protocol != "http-get" || p.Network != "*" || p.ContentFormat != "audio/mpeg" {
+		t.Errorf("unexpected protocolInfo %+v", p)
+	}
+
+	params := p.Params()
+	if params["DLNA.ORG_PN"] != "MP3" || params["DLNA.ORG_OP"] != "01" || len(params) != 3 {
+		t.Errorf("unexpected params %v", params)
+	}
+
+	// additional info containing ':' is kept whole
+	p, err = ParseProtocolInfo("rtsp-rtp-udp:*:video/mp4:rtsp://h:554/x")
+	if err != nil || p.AdditionalInfo != "rtsp://h:554/x" {
+		t.Errorf("unexpected protocolInfo %+v, %v", p, err)
+	}
+	if s := p.String(); s != "rtsp-rtp-udp:*:video/mp4:rtsp://h:554/x" {
+		t.Errorf("unexpected String() %s", s)
+	}
+
+	if _, err := ParseProtocolInfo("http-get:*:audio/mpeg"); err == nil {
+		t.Error("expected error for missing field")
+	}
+}
+
+func TestProtocolInfoMatches(t *testing.T) {
+	tests := []struct {
+		res, sink string
+		want      bool
+	}{
+		{"http-get:*:audio/mpeg:DLNA.ORG_PN=MP3", "http-get:*:audio/mpeg:*", true},
+		{"http-get:*:audio/mpeg:*", "http-get:*:*:*", true},
+		{"http-get:*:audio/mpeg:DLNA.ORG_PN=MP3", "http-get:*:audio/mpeg:DLNA.ORG_PN=MP3X", false},
+		{"http-get:*:audio/mpeg:*", "http-get:*:audio/flac:*", false},
+		{"rtsp-rtp-udp:*:audio/mpeg:*", "http-get:*:audio/mpeg:*", false},
+		{"http-get:*:Audio/MPEG:*", "http-get:*:audio/mpeg:*", true},
+	}
+
+	for _, tc := range tests {
+		r, _ := ParseProtocolInfo(tc.res)
+		s, _ := ParseProtocolInfo(tc.sink)
+		if got := r.Matches(s); got != tc.want {
+			t.Errorf("%s matches %s: got %v, want %v", tc.res, tc.sink, got, tc.want)
+		}
+	}
+}
@@ -3,6 +3,9 @@ package discovery
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"fmt"
+	"github.com/mmmorris1975/go-upnp/internal/mcast"
 	"io"
 	"log"
 	"net"
@@ -57,6 +60,8 @@ type SearchRequest struct {
 	Port   int
 	Target string
 	Wait   time.Duration
+	// Network interface to send the search from, the system default if nil
+	Interface *net.Interface
 }
 
 func NewSearchRequest() *SearchRequest {
@@ -142,16 +147,6 @@ func handleHttpError(err error) error {
 	return nil
 }
 
-func readHttpRequest(rdr io.Reader) (*http.Request, error) {
-	r, err := http.ReadRequest(bufio.NewReader(rdr))
-	if err != nil {
-		err = handleHttpError(err)
-		return nil, err
-	}
-
-	return r, nil
-}
-
 func readHttpResponse(rdr io.Reader) (*http.Response, error) {
 	r, err := http.ReadResponse(bufio.NewReader(rdr), nil)
 	if err != nil {
@@ -170,7 +165,7 @@ func search(req *SearchRequest, ch chan<- *SearchResponse) {
 		return
 	}
 
-	c, err := net.ListenPacket(a.Network(), ":0")
+	c, err := listenSearch(a, req.Interface)
 	if err != nil {
 		log.Printf("ERROR - ListenPacket(): %v", err)
 		close(ch)
@@ -203,6 +198,35 @@ func search(req *SearchRequest, ch chan<- *SearchResponse) {
 	}
 }
 
+// listenSearch opens the socket to send a search from, bound to the first IPv4 address of ifi if set
+func listenSearch(a *net.UDPAddr, ifi *net.Interface) (net.PacketConn, error) {
+	if ifi == nil {
+		return net.ListenPacket(a.Network(), ":0")
+	}
+
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, i := range addrs {
+		if n, ok := i.(*net.IPNet); ok && n.IP.To4() != nil {
+			c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: n.IP})
+			if err != nil {
+				return nil, err
+			}
+
+			if err := mcast.SetOptions(c, 0, n.IP); err != nil {
+				c.Close()
+				return nil, err
+			}
+			return c, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no IPv4 address on interface %s", ifi.Name)
+}
+
 func getSearchResponses(c net.PacketConn, ch chan<- *SearchResponse) {
 	defer close(ch)
 	defer c.Close()
@@ -261,39 +285,61 @@ func Discover(req *SearchRequest, ch chan<- *SearchResponse) error {
 	return nil
 }
 
+// ListenNotify passively listens for multicast NOTIFY messages, sending them to ch, until an error
+// occurs.  ch is closed before returning
 func ListenNotify(ch chan<- *NotifyResponse) error {
+	return ListenNotifyContext(context.Background(), ch)
+}
+
+// ListenNotifyContext passively listens for multicast NOTIFY messages like ListenNotify, but stops
+// listening (and closes ch) when ctx is done.  Each datagram is parsed on its own, so malformed
+// messages are skipped instead of ending the listener
+func ListenNotifyContext(ctx context.Context, ch chan<- *NotifyResponse) error {
+	defer close(ch)
+
 	addr, err := getUDPAddr(DISCOVERY_ADDR_DEFAULT, DISCOVERY_PORT_DEFAULT)
 	if err != nil {
 		log.Printf("ERROR - getUDPAddr(): %s", err)
-		close(ch)
 		return err
 	}
 
 	c, err := net.ListenMulticastUDP(addr.Network(), nil, addr)
 	if err != nil {
 		log.Printf("ERROR - ListenMulticastUDP(): %s", err)
-		close(ch)
 		return err
 	}
 	defer c.Close()
 
+	go func() {
+		<-ctx.Done()
+		c.Close()
+	}()
+
+	b := make([]byte, 8192)
 	for {
-		r, err := readHttpRequest(c)
+		n, _, err := c.ReadFrom(b)
 		if err != nil {
-			log.Printf("ERROR - readHttpResponse(): %v\n", err)
-			close(ch)
+			if ctx.Err() != nil {
+				return nil
+			}
+			log.Printf("ERROR - ReadFrom(): %v", err)
 			return err
 		}
-		if r == nil {
-			break
+
+		r, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(b[:n])))
+		if err != nil {
+			doLog("ListenNotifyContext() - skipping malformed message: %v", err)
+			continue
 		}
-		if r.Body != nil {
-			defer r.Body.Close()
+
+		if r.Method != "NOTIFY" {
+			continue
 		}
 
-		ch <- parseNotifyResponse(r)
+		select {
+		case ch <- parseNotifyResponse(r):
+		case <-ctx.Done():
+			return nil
+		}
 	}
-
-	close(ch)
-	return nil
 }
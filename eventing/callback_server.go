@@ -0,0 +1,268 @@
+package eventing
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DEFAULT_CALLBACK_PATH = "/upnp/event/"
+
+// DefaultCallbackServer is used by subscriptions created with NewSubscriptionManager(), and is started
+// on a random port the first time it is needed
+var DefaultCallbackServer = NewCallbackServer(":0")
+
+type callback struct {
+	path string
+	sid  string
+	fn   func(*Event)
+}
+
+// CallbackServer receives NOTIFY requests for any number of subscriptions.  Each subscription is given a
+// unique callback path under the server's path prefix, and requests are routed by path, or by SID if the
+// path is unknown.  Requests to a known path with a different SID than the subscription's are rejected.
+// The server can listen on its own address via Start(), or be mounted in an existing http.Server (at the
+// path prefix) by using it as an http.Handler and calling Advertise()
+type CallbackServer struct {
+	// Address to listen on when calling Start(), in host:port format
+	Addr string
+	// Path prefix for subscription callback URLs, must begin and end with '/'
+	Prefix string
+
+	mu       sync.RWMutex
+	srv      *http.Server
+	listener net.Listener
+	advHost  string
+	advPort  int
+	nextId   uint64
+	byPath   map[string]*callback
+	bySID    map[string]*callback
+}
+
+func NewCallbackServer(addr string) *CallbackServer {
+	return &CallbackServer{
+		Addr:   addr,
+		Prefix: DEFAULT_CALLBACK_PATH,
+		byPath: make(map[string]*callback),
+		bySID:  make(map[string]*callback),
+	}
+}
+
+// Start listens on Addr and serves NOTIFY requests in the background
+func (s *CallbackServer) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listener != nil {
+		return nil
+	}
+
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(s.Prefix, s)
+
+	s.listener = l
+	s.srv = &http.Server{Handler: mux}
+	go func() {
+		if err := s.srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Printf("ERROR - callback server Serve(): %v", err)
+		}
+	}()
+
+	return nil
+}
+
+// Close stops a server started with Start(), registered subscriptions are not affected
+func (s *CallbackServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.srv == nil {
+		return nil
+	}
+
+	err := s.srv.Close()
+	s.srv = nil
+	s.listener = nil
+	return err
+}
+
+// Advertise sets the host and port used in callback URLs, for servers mounted in another http.Server
+// or behind port forwarding.  If host is empty, the local address used to reach each device is used.
+// If port is 0, the port Start() is listening on is used
+func (s *CallbackServer) Advertise(host string, port int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.advHost = host
+	s.advPort = port
+}
+
+func (s *CallbackServer) running() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.listener != nil || s.advPort > 0
+}
+
+// callbackURL builds the callback URL sent to the device at target for the subscription path
+func (s *CallbackServer) callbackURL(target *url.URL, path string) (string, error) {
+	s.mu.RLock()
+	host, port := s.advHost, s.advPort
+	if port < 1 && s.listener != nil {
+		port = s.listener.Addr().(*net.TCPAddr).Port
+	}
+	s.mu.RUnlock()
+
+	if port < 1 {
+		return "", fmt.Errorf("callback server is not started, and no port advertised")
+	}
+
+	if len(host) < 1 {
+		h, err := localAddrFor(target)
+		if err != nil {
+			return "", err
+		}
+		host = h
+	}
+
+	return fmt.Sprintf("http://%s%s", net.JoinHostPort(host, strconv.Itoa(port)), path), nil
+}
+
+// localAddrFor determines which local address is used to connect to the host in the url
+func localAddrFor(u *url.URL) (string, error) {
+	host := u.Host
+	if len(u.Port()) < 1 {
+		host = net.JoinHostPort(u.Hostname(), "80")
+	}
+
+	c, err := net.Dial("tcp", host)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+
+	h, _, err := net.SplitHostPort(c.LocalAddr().String())
+	if err != nil {
+		return "", err
+	}
+
+	return h, nil
+}
+
+func (s *CallbackServer) register(fn func(*Event)) *callback {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextId++
+	cb := &callback{path: fmt.Sprintf("%s%d", s.Prefix, s.nextId), fn: fn}
+	s.byPath[cb.path] = cb
+
+	return cb
+}
+
+func (s *CallbackServer) setSID(cb *callback, sid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(cb.sid) > 0 {
+		delete(s.bySID, cb.sid)
+	}
+
+	cb.sid = sid
+	if len(sid) > 0 {
+		s.bySID[sid] = cb
+	}
+}
+
+func (s *CallbackServer) unregister(cb *callback) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.byPath, cb.path)
+	if len(cb.sid) > 0 {
+		delete(s.bySID, cb.sid)
+	}
+}
+
+func (s *CallbackServer) lookup(path, sid string) *callback {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if cb, ok := s.byPath[path]; ok {
+		// a stale subscription to the same callback, ex. from before a resubscribe
+		if len(cb.sid) > 0 && cb.sid != sid {
+			return nil
+		}
+		return cb
+	}
+
+	return s.bySID[sid]
+}
+
+func (s *CallbackServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "NOTIFY" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	h := parseEventHeader(r.Header)
+	if len(h.NT) < 1 || len(h.NTS) < 1 {
+		http.Error(w, "missing NT or NTS header", http.StatusBadRequest)
+		return
+	}
+
+	if h.NT != "upnp:event" || h.NTS != "upnp:propchange" || len(h.SID) < 1 {
+		http.Error(w, "invalid NT, NTS or SID header", http.StatusPreconditionFailed)
+		return
+	}
+
+	cb := s.lookup(strings.TrimSuffix(r.URL.Path, "/"), h.SID)
+	if cb == nil {
+		// tell the device we don't know about this subscription
+		http.Error(w, "unknown subscription", http.StatusPreconditionFailed)
+		return
+	}
+
+	// Respond with HTTP 200 for any other error, since it's likely a problem on our end
+	// Simply log it and bail out of the request, so we still get future notifications
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("ERROR - Failed to read notification body: %v", err)
+		return
+	}
+
+	d := EventData{}
+	if err = xml.Unmarshal(b, &d); err != nil {
+		log.Printf("ERROR - Unmarshal(): %v", err)
+		return
+	}
+
+	cb.fn(&Event{EventHeader: h, EventData: d})
+}
+
+func parseEventHeader(hdr http.Header) EventHeader {
+	seq, err := strconv.Atoi(hdr.Get("SEQ"))
+	if err != nil {
+		seq = 0
+	}
+
+	return EventHeader{
+		NT:       hdr.Get("NT"),
+		NTS:      hdr.Get("NTS"),
+		SID:      hdr.Get("SID"),
+		SEQ:      seq,
+		Received: time.Now(),
+	}
+}
@@ -0,0 +1,202 @@
+package eventing
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockPublisher accepts subscriptions, and can send events to subscribers
+type mockPublisher struct {
+	mu        sync.Mutex
+	callbacks map[string]string
+	seq       map[string]int
+	nextSID   int
+	// HTTP status returned to renewals, when non-zero
+	renewStatus int
+	renewals    int
+	// events sent to new subscribers before the SUBSCRIBE response
+	early []earlyEvent
+}
+
+type earlyEvent struct {
+	// SID of the event, the new subscription's SID if empty
+	sid string
+	seq int
+	v   string
+}
+
+func newMockPublisher() *mockPublisher {
+	return &mockPublisher{callbacks: make(map[string]string), seq: make(map[string]int)}
+}
+
+func (p *mockPublisher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch r.Method {
+	case "SUBSCRIBE":
+		sid := r.Header.Get("SID")
+		if len(sid) > 0 {
+			p.renewals++
+			if p.renewStatus > 0 {
+				w.WriteHeader(p.renewStatus)
+				return
+			}
+			if _, ok := p.callbacks[sid]; !ok {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+		} else {
+			p.nextSID++
+			sid = fmt.Sprintf("uuid:sid-%d", p.nextSID)
+			p.callbacks[sid] = strings.Trim(r.Header.Get("CALLBACK"), "<>")
+			p.seq[sid] = 0
+
+			for _, e := range p.early {
+				if len(e.sid) < 1 {
+					e.sid = sid
+				}
+				sendEvent(p.callbacks[sid], e.sid, e.seq, map[string]string{"V": e.v})
+			}
+		}
+		w.Header().Set("SID", sid)
+		w.Header().Set("TIMEOUT", r.Header.Get("TIMEOUT"))
+	case "UNSUBSCRIBE":
+		delete(p.callbacks, r.Header.Get("SID"))
+	}
+}
+
+func (p *mockPublisher) sids() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := make([]string, 0, len(p.callbacks))
+	for k := range p.callbacks {
+		s = append(s, k)
+	}
+	return s
+}
+
+// notify sends an event with the next SEQ for the SID, or the provided seq if >= 0
+func (p *mockPublisher) notify(sid string, seq int, vars map[string]string) (int, error) {
+	p.mu.Lock()
+	cb := p.callbacks[sid]
+	if seq < 0 {
+		seq = p.seq[sid]
+		p.seq[sid]++
+	}
+	p.mu.Unlock()
+
+	return sendEvent(cb, sid, seq, vars)
+}
+
+func sendEvent(cb, sid string, seq int, vars map[string]string) (int, error) {
+	buf := bytes.NewBufferString(`<?xml version="1.0"?><e:propertyset xmlns:e="urn:schemas-upnp-org:event-1-0">`)
+	for k, v := range vars {
+		fmt.Fprintf(buf, "<e:property><%s>%s</%s></e:property>", k, v, k)
+	}
+	buf.WriteString("</e:propertyset>")
+
+	req, _ := http.NewRequest("NOTIFY", cb, buf)
+	req.Header.Set("NT", "upnp:event")
+	req.Header.Set("NTS", "upnp:propchange")
+	req.Header.Set("SID", sid)
+	req.Header.Set("SEQ", fmt.Sprint(seq))
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+
+	return res.StatusCode, nil
+}
+
+func waitFor(t *testing.T, f func() bool) {
+	for i := 0; i < 100; i++ {
+		if f() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for condition")
+}
+
+func TestCallbackServer(t *testing.T) {
+	p := newMockPublisher()
+	dev := httptest.NewServer(p)
+	defer dev.Close()
+	u, _ := url.Parse(dev.URL)
+
+	srv := NewCallbackServer("127.0.0.1:0")
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	// multiple subscriptions in one process must share the server
+	chans := make([]chan map[string]string, 3)
+	for i := range chans {
+		m, err := NewSubscriptionManagerWithServer(u, 1*time.Minute, srv)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		chans[i] = make(chan map[string]string, 10)
+		go m.EventLoop(chans[i])
+	}
+
+	waitFor(t, func() bool { return len(p.sids()) == 3 })
+
+	for _, sid := range p.sids() {
+		if _, err := p.notify(sid, -1, map[string]string{"SID": sid}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// subscriptions may have been created in any order, but each must get exactly one distinct event
+	seen := make(map[string]bool)
+	for i, ch := range chans {
+		select {
+		case e := <-ch:
+			if seen[e["SID"]] {
+				t.Errorf("event for %s delivered more than once", e["SID"])
+			}
+			seen[e["SID"]] = true
+		case <-time.After(1 * time.Second):
+			t.Errorf("subscription %d did not receive event", i+1)
+		}
+	}
+
+	notify := func(t *testing.T, path, sid string) {
+		req, _ := http.NewRequest("NOTIFY", fmt.Sprintf("http://%s%s", srv.listener.Addr(), path), http.NoBody)
+		req.Header.Set("NT", "upnp:event")
+		req.Header.Set("NTS", "upnp:propchange")
+		req.Header.Set("SID", sid)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusPreconditionFailed {
+			t.Errorf("expected HTTP 412, got %d", res.StatusCode)
+		}
+	}
+
+	t.Run("unknown sid", func(t *testing.T) {
+		notify(t, "/upnp/event/999", "uuid:unknown")
+	})
+
+	t.Run("stale sid", func(t *testing.T) {
+		notify(t, "/upnp/event/1", "uuid:stale")
+	})
+}
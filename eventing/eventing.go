@@ -1,14 +1,14 @@
 package eventing
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"encoding/xml"
-	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 const (
@@ -19,10 +19,11 @@ const (
 var Logger *log.Logger
 
 type EventHeader struct {
-	NT  string
-	NTS string
-	SID string
-	SEQ int
+	NT       string
+	NTS      string
+	SID      string
+	SEQ      int
+	Received time.Time
 
 	// multicast event headers
 	USN    string
@@ -67,37 +68,23 @@ func NewEventData() *eventData {
 	return &eventData{XMLNS: "urn:schemas-upnp-org:event-1-0"}
 }
 
+// ListenMulticastEvents receives all multicast events, until an error occurs.  Use a MulticastListener
+// for filtering, cancellation and detection of missed events
 func ListenMulticastEvents(ch chan<- *Event) error {
-	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(MCAST_EVENT_ADDR, strconv.Itoa(MCAST_EVENT_PORT)))
-	if err != nil {
-		log.Printf("ERROR - ResolveUDPAddr(): %s", err)
-		close(ch)
-		return err
-	}
-
-	c, err := net.ListenMulticastUDP(addr.Network(), nil, addr)
-	if err != nil {
-		log.Printf("ERROR - ListenMulticastUDP(): %s", err)
-		close(ch)
-		return err
-	}
-	defer c.Close()
-
-	for true {
-		e, err := readEvent(c)
-		if err != nil {
-			log.Printf("ERROR - readEvent(): %v\n", err)
-			close(ch)
-			return err
-		}
+	events := make(chan *MulticastEvent, 10)
+	errs := make(chan error, 1)
+	go func() { errs <- NewMulticastListener().Listen(context.Background(), events) }()
 
-		ch <- e
+	for e := range events {
+		ch <- e.Event
 	}
-
 	close(ch)
-	return nil
+
+	return <-errs
 }
 
+// SendMulticastEvent sends a single multicast event, the caller manages SEQ and BOOTID.  Use a
+// MulticastPublisher to have these managed, and for size limits, TTL and interface selection
 func SendMulticastEvent(h *EventHeader, r *[]Result, laddr *net.UDPAddr) error {
 	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(MCAST_EVENT_ADDR, strconv.Itoa(MCAST_EVENT_PORT)))
 	if err != nil {
@@ -106,36 +93,13 @@ func SendMulticastEvent(h *EventHeader, r *[]Result, laddr *net.UDPAddr) error {
 	}
 
 	if len(h.LVL) < 1 {
-		h.LVL = "upnp:/info"
-	}
-
-	e := NewEventData()
-	for _, j := range *r {
-		e.Properties = append(e.Properties, property{Result: j})
+		h.LVL = LVL_INFO
 	}
 
-	buf := bytes.NewBufferString(xml.Header)
-	b, err := xml.Marshal(e)
+	b, err := buildMulticastEvent(h, *r, addr.String())
 	if err != nil {
-		log.Printf("ERROR - Marshal(): %v", err)
 		return err
 	}
-	buf.Write(b)
-
-	req, err := http.NewRequest("NOTIFY", "*", buf)
-	if err != nil {
-		log.Printf("ERROR - NewRequest(): %s", err)
-		return err
-	}
-	req.Host = addr.String()
-	req.Header.Set("Content-Type", "text/xml; charset=\"utf-8\"")
-	req.Header.Set("NT", "upnp:event")
-	req.Header.Set("NTS", "upnp:propchange")
-	req.Header.Set("LVL", h.LVL)
-	req.Header.Set("USN", h.USN)
-	req.Header.Set("SVCID", h.SVCID)
-	req.Header.Set("SEQ", strconv.Itoa(h.SEQ))
-	req.Header.Set("BOOTID.UPNP.ORG", strconv.Itoa(h.BootId))
 
 	// send event
 	c, err := net.DialUDP(addr.Network(), laddr, addr)
@@ -145,7 +109,7 @@ func SendMulticastEvent(h *EventHeader, r *[]Result, laddr *net.UDPAddr) error {
 	}
 	defer c.Close()
 
-	if err := req.Write(c); err != nil {
+	if _, err := c.Write(b); err != nil {
 		log.Printf("ERROR - Write(): %v", err)
 		return err
 	}
@@ -153,65 +117,42 @@ func SendMulticastEvent(h *EventHeader, r *[]Result, laddr *net.UDPAddr) error {
 	return nil
 }
 
-func readEvent(c *net.UDPConn) (*Event, error) {
-	rdr := bufio.NewReader(c)
-
-	r, err := http.ReadRequest(rdr)
-	if err != nil {
-		err = handleHttpError(err)
-		return nil, err
-	}
-	if r == nil {
-		return nil, nil
-	}
-	if r.Body != nil {
-		defer r.Body.Close()
-	}
-
-	h := EventHeader{}
-	h.NT = r.Header.Get("NT")
-	h.NTS = r.Header.Get("NTS")
-	h.USN = r.Header.Get("USN")
-	h.SVCID = r.Header.Get("SVCID")
-	h.LVL = r.Header.Get("LVL")
-
-	seq, err := strconv.Atoi(r.Header.Get("SEQ"))
-	if err != nil {
-		seq = 0
-	}
-	h.SEQ = seq
-
-	bid, err := strconv.Atoi(r.Header.Get("BOOTID.UPNP.ORG"))
-	if err != nil {
-		bid = 0
+// buildMulticastEvent serializes the NOTIFY request, so it can be sent in a single datagram
+func buildMulticastEvent(h *EventHeader, r []Result, host string) ([]byte, error) {
+	e := NewEventData()
+	for _, j := range r {
+		e.Properties = append(e.Properties, property{Result: j})
 	}
-	h.BootId = bid
 
-	d := EventData{}
-	b, err := ioutil.ReadAll(r.Body)
+	buf := bytes.NewBufferString(xml.Header)
+	b, err := xml.Marshal(e)
 	if err != nil {
+		log.Printf("ERROR - Marshal(): %v", err)
 		return nil, err
 	}
+	buf.Write(b)
 
-	err = xml.Unmarshal(b, &d)
+	req, err := http.NewRequest("NOTIFY", "*", buf)
 	if err != nil {
+		log.Printf("ERROR - NewRequest(): %s", err)
 		return nil, err
 	}
+	req.Host = host
+	req.Header.Set("Content-Type", "text/xml; charset=\"utf-8\"")
+	req.Header.Set("NT", "upnp:event")
+	req.Header.Set("NTS", "upnp:propchange")
+	req.Header.Set("LVL", h.LVL)
+	req.Header.Set("USN", h.USN)
+	req.Header.Set("SVCID", h.SVCID)
+	req.Header.Set("SEQ", strconv.Itoa(h.SEQ))
+	req.Header.Set("BOOTID.UPNP.ORG", strconv.Itoa(h.BootId))
 
-	return &Event{EventHeader: h, EventData: d}, nil
-}
-
-func handleHttpError(err error) error {
-	switch t := err.(type) {
-	case *net.OpError:
-		if !t.Temporary() {
-			return err
-		}
-	default:
-		return err
+	out := new(bytes.Buffer)
+	if err := req.Write(out); err != nil {
+		return nil, err
 	}
 
-	return nil
+	return out.Bytes(), nil
 }
 
 func doLog(fmt string, vars ...interface{}) {
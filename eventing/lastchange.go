@@ -0,0 +1,151 @@
+package eventing
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const LAST_CHANGE_VARIABLE = "LastChange"
+
+// LastChange is the decoded value of a LastChange state variable, used by UPnP AV (AVTransport,
+// RenderingControl) and other services to event changes to many variables, for many instances
+type LastChange struct {
+	// Namespace of the Event element, ex. urn:schemas-upnp-org:metadata-1-0/AVT/
+	Namespace string
+	Instances []InstanceChange
+}
+
+type InstanceChange struct {
+	InstanceID uint32
+	Variables  []ChangedVariable
+}
+
+// ChangedVariable is a single variable update.  Attrs holds any attributes other than val, like
+// channel="Master" for RenderingControl Volume and Mute
+type ChangedVariable struct {
+	Name    string
+	Value   string
+	Channel string
+	Attrs   map[string]string
+}
+
+// Instance returns the changes for the instance ID, or nil if there are none
+func (lc *LastChange) Instance(id uint32) *InstanceChange {
+	for i := range lc.Instances {
+		if id == lc.Instances[i].InstanceID {
+			return &lc.Instances[i]
+		}
+	}
+	return nil
+}
+
+// Get returns the value of the named variable for the channel (use an empty channel for variables
+// without one).  If the variable appears more than once, the last value is returned
+func (ic *InstanceChange) Get(name, channel string) (string, bool) {
+	val, found := "", false
+	for _, v := range ic.Variables {
+		if name == v.Name && channel == v.Channel {
+			val, found = v.Value, true
+		}
+	}
+	return val, found
+}
+
+// LastChange finds and decodes the LastChange variable in the event, returns nil if the event
+// doesn't have one
+func (e *Event) LastChange() (*LastChange, error) {
+	for _, p := range e.Properties {
+		if LAST_CHANGE_VARIABLE == p.Result.XMLName.Local {
+			return ParseLastChange(p.Result.Value)
+		}
+	}
+	return nil, nil
+}
+
+// ParseLastChange decodes the value of a LastChange variable.  The value should already be unescaped
+// by the XML decoding of the event, but some devices escape it twice, which is handled here
+func ParseLastChange(s string) (*LastChange, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "<") && strings.Contains(s, "&lt;") {
+		s = html.UnescapeString(s)
+	}
+
+	d := xml.NewDecoder(bytes.NewReader([]byte(s)))
+	d.Strict = false
+	d.Entity = xml.HTMLEntity
+
+	lc := new(LastChange)
+	var cur *InstanceChange
+	depth := 0
+
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch se := t.(type) {
+		case xml.StartElement:
+			depth++
+			switch depth {
+			case 1:
+				if se.Name.Local != "Event" {
+					return nil, fmt.Errorf("LastChange root element is %s, not Event", se.Name.Local)
+				}
+				lc.Namespace = se.Name.Space
+			case 2:
+				if se.Name.Local != "InstanceID" {
+					d.Skip()
+					depth--
+					continue
+				}
+
+				id, err := strconv.ParseUint(attrValue(se, "val"), 10, 32)
+				if err != nil {
+					return nil, fmt.Errorf("invalid InstanceID: %v", err)
+				}
+				lc.Instances = append(lc.Instances, InstanceChange{InstanceID: uint32(id)})
+				cur = &lc.Instances[len(lc.Instances)-1]
+			case 3:
+				v := ChangedVariable{Name: se.Name.Local, Attrs: make(map[string]string)}
+				for _, a := range se.Attr {
+					switch a.Name.Local {
+					case "val":
+						v.Value = a.Value
+					case "channel":
+						v.Channel = a.Value
+						v.Attrs[a.Name.Local] = a.Value
+					default:
+						v.Attrs[a.Name.Local] = a.Value
+					}
+				}
+				cur.Variables = append(cur.Variables, v)
+			}
+		case xml.EndElement:
+			depth--
+		}
+	}
+
+	if len(lc.Namespace) < 1 && len(lc.Instances) < 1 {
+		return nil, fmt.Errorf("no Event element found in LastChange")
+	}
+
+	return lc, nil
+}
+
+func attrValue(se xml.StartElement, name string) string {
+	for _, a := range se.Attr {
+		if name == a.Name.Local {
+			return a.Value
+		}
+	}
+	return ""
+}
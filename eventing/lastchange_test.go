@@ -0,0 +1,83 @@
+package eventing
+
+import (
+	"html"
+	"testing"
+)
+
+const avtLastChange = `<Event xmlns="urn:schemas-upnp-org:metadata-1-0/AVT/">
+<InstanceID val="0"><TransportState val="PLAYING"/><CurrentTrackURI val="http://192.0.2.1/a.mp3?x=1&amp;y=2"/>
+<CurrentTrackDuration val="0:03:25"/></InstanceID></Event>`
+
+const rcsLastChange = `<Event xmlns="urn:schemas-upnp-org:metadata-1-0/RCS/">
+<InstanceID val="0"><Volume channel="Master" val="24"/><Volume channel="LF" val="100"/><Mute channel="Master" val="0"/></InstanceID>
+<InstanceID val="1"><Volume channel="Master" val="5"/></InstanceID></Event>`
+
+func TestParseLastChange(t *testing.T) {
+	t.Run("avt", func(t *testing.T) {
+		lc, err := ParseLastChange(avtLastChange)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if lc.Namespace != "urn:schemas-upnp-org:metadata-1-0/AVT/" || len(lc.Instances) != 1 {
+			t.Fatalf("unexpected result %+v", lc)
+		}
+
+		i := lc.Instance(0)
+		if v, _ := i.Get("TransportState", ""); v != "PLAYING" {
+			t.Errorf("unexpected TransportState %s", v)
+		}
+		if v, _ := i.Get("CurrentTrackURI", ""); v != "http://192.0.2.1/a.mp3?x=1&y=2" {
+			t.Errorf("unexpected CurrentTrackURI %s", v)
+		}
+	})
+
+	t.Run("rcs channels", func(t *testing.T) {
+		lc, err := ParseLastChange(rcsLastChange)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if v, _ := lc.Instance(0).Get("Volume", "Master"); v != "24" {
+			t.Errorf("unexpected Master volume %s", v)
+		}
+		if v, _ := lc.Instance(0).Get("Volume", "LF"); v != "100" {
+			t.Errorf("unexpected LF volume %s", v)
+		}
+		if v, _ := lc.Instance(1).Get("Volume", "Master"); v != "5" {
+			t.Errorf("unexpected instance 1 volume %s", v)
+		}
+		if lc.Instance(2) != nil {
+			t.Error("unexpected instance 2")
+		}
+	})
+
+	t.Run("double escaped", func(t *testing.T) {
+		lc, err := ParseLastChange(html.EscapeString(rcsLastChange))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(lc.Instances) != 2 {
+			t.Errorf("unexpected result %+v", lc)
+		}
+	})
+
+	t.Run("event", func(t *testing.T) {
+		e := newTestEvent(0, "LastChange", avtLastChange)
+		lc, err := e.LastChange()
+		if err != nil || lc == nil {
+			t.Fatal(err)
+		}
+
+		if lc, _ := newTestEvent(0, "Status", "1").LastChange(); lc != nil {
+			t.Error("expected nil LastChange")
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		if _, err := ParseLastChange("<Foo/>"); err == nil {
+			t.Error("expected error")
+		}
+	})
+}
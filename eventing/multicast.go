@@ -0,0 +1,435 @@
+package eventing
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/mmmorris1975/go-upnp/internal/mcast"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event levels (LVL header) of multicast events, from most to least severe
+const (
+	LVL_EMERGENCY = "upnp:/emergency"
+	LVL_ALERT     = "upnp:/alert"
+	LVL_FAULT     = "upnp:/fault"
+	LVL_WARNING   = "upnp:/warning"
+	LVL_INFO      = "upnp:/info"
+	LVL_DEBUG     = "upnp:/debug"
+	LVL_GENERAL   = "upnp:/general"
+)
+
+var levels = []string{LVL_EMERGENCY, LVL_ALERT, LVL_FAULT, LVL_WARNING, LVL_INFO, LVL_DEBUG, LVL_GENERAL}
+
+// levelRank returns the severity of an event level, lower is more severe.  Unknown and vendor
+// defined levels are ranked with upnp:/general
+func levelRank(lvl string) int {
+	for i, l := range levels {
+		if strings.EqualFold(lvl, l) {
+			return i
+		}
+	}
+	return len(levels) - 1
+}
+
+// MulticastEvent is a multicast event, with the number of events from the same USN and SVCID
+// which were missed since the previous one was received
+type MulticastEvent struct {
+	*Event
+	Missed uint64
+}
+
+type multicastSource struct {
+	usn   string
+	svcid string
+}
+
+type multicastSeq struct {
+	seq    seqTracker
+	bootId int
+}
+
+// MulticastListener receives multicast events, optionally filtered by USN, SVCID and level
+type MulticastListener struct {
+	// Network interface to join the multicast group on, the system default if nil
+	Interface *net.Interface
+	// Only events from this USN, a device UDN matches all its services
+	USN string
+	// Only events for this service ID
+	SVCID string
+	// Only events of this level (LVL header), or more severe
+	Level string
+
+	mu  sync.Mutex
+	seq map[multicastSource]*multicastSeq
+}
+
+func NewMulticastListener() *MulticastListener {
+	return &MulticastListener{seq: make(map[multicastSource]*multicastSeq)}
+}
+
+// Listen receives multicast events until ctx is done, then closes ch.  Each datagram is parsed
+// on its own, so malformed messages are skipped instead of ending the listener.  Events which
+// don't match the filters, and duplicate or stale events, are dropped
+func (l *MulticastListener) Listen(ctx context.Context, ch chan<- *MulticastEvent) error {
+	defer close(ch)
+
+	addr, err := net.ResolveUDPAddr("udp4", net.JoinHostPort(MCAST_EVENT_ADDR, strconv.Itoa(MCAST_EVENT_PORT)))
+	if err != nil {
+		log.Printf("ERROR - ResolveUDPAddr(): %s", err)
+		return err
+	}
+
+	c, err := net.ListenMulticastUDP(addr.Network(), l.Interface, addr)
+	if err != nil {
+		log.Printf("ERROR - ListenMulticastUDP(): %s", err)
+		return err
+	}
+	defer c.Close()
+
+	go func() {
+		<-ctx.Done()
+		c.Close()
+	}()
+
+	b := make([]byte, 8192)
+	for {
+		n, _, err := c.ReadFrom(b)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			log.Printf("ERROR - ReadFrom(): %v", err)
+			return err
+		}
+
+		e, ok := l.handle(b[:n])
+		if !ok {
+			continue
+		}
+
+		select {
+		case ch <- e:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// handle parses a datagram, returning false if it should not be delivered
+func (l *MulticastListener) handle(b []byte) (*MulticastEvent, bool) {
+	e, err := parseMulticastEvent(b)
+	if err != nil {
+		doLog("Listen() - skipping malformed message: %v", err)
+		return nil, false
+	}
+
+	if !l.match(e) {
+		return nil, false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	src := multicastSource{usn: e.USN, svcid: e.SVCID}
+	s, ok := l.seq[src]
+	if !ok {
+		s = &multicastSeq{bootId: e.BootId}
+		l.seq[src] = s
+	}
+
+	// SEQ starts again when the device restarts
+	if s.bootId != e.BootId {
+		s.seq.reset()
+		s.bootId = e.BootId
+	}
+
+	me := &MulticastEvent{Event: e}
+	expected := s.seq.expected
+	switch s.seq.check(uint32(e.SEQ)) {
+	case seqStale:
+		doLog("Listen() - dropping stale event SEQ %d from %s %s", e.SEQ, e.USN, e.SVCID)
+		return nil, false
+	case seqGap:
+		me.Missed = seqDistance(expected, uint32(e.SEQ))
+	}
+
+	return me, true
+}
+
+func (l *MulticastListener) match(e *Event) bool {
+	if e.NT != "upnp:event" || e.NTS != "upnp:propchange" {
+		return false
+	}
+
+	if len(l.USN) > 0 && !matchUSN(e.USN, l.USN) {
+		return false
+	}
+
+	if len(l.SVCID) > 0 && e.SVCID != l.SVCID {
+		return false
+	}
+
+	if len(l.Level) > 0 && levelRank(e.LVL) > levelRank(l.Level) {
+		return false
+	}
+
+	return true
+}
+
+func parseMulticastEvent(b []byte) (*Event, error) {
+	r, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(b)))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+
+	h := EventHeader{}
+	h.NT = r.Header.Get("NT")
+	h.NTS = r.Header.Get("NTS")
+	h.USN = r.Header.Get("USN")
+	h.SVCID = r.Header.Get("SVCID")
+	h.LVL = r.Header.Get("LVL")
+
+	seq, err := strconv.Atoi(r.Header.Get("SEQ"))
+	if err != nil {
+		seq = 0
+	}
+	h.SEQ = seq
+
+	bid, err := strconv.Atoi(r.Header.Get("BOOTID.UPNP.ORG"))
+	if err != nil {
+		bid = 0
+	}
+	h.BootId = bid
+	h.Received = time.Now()
+
+	d := EventData{}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = xml.Unmarshal(body, &d); err != nil {
+		return nil, err
+	}
+
+	return &Event{EventHeader: h, EventData: d}, nil
+}
+
+const (
+	// Multicast events must fit in a single UDP datagram, this keeps them within an Ethernet frame
+	MAX_MULTICAST_EVENT_SIZE = 1472
+	// TTL of multicast event packets, as for SSDP
+	MULTICAST_EVENT_TTL = 2
+)
+
+// ErrEventTooLarge is returned when a single variable can't fit in a multicast event
+var ErrEventTooLarge = errors.New("event variable too large for a multicast message")
+
+// MulticastPublisher sends multicast events for a single service, managing SEQ and BOOTID.  Variables
+// which don't fit in one message are split across several, each with its own SEQ
+type MulticastPublisher struct {
+	USN   string
+	SVCID string
+	// TTL of sent packets
+	TTL int
+	// Network interface to send from, the system default if nil
+	Interface *net.Interface
+	// Largest message sent, in bytes
+	MaxSize int
+	// Number of extra times each message is sent, receivers drop the duplicates
+	Repeat      int
+	RepeatDelay time.Duration
+
+	mu     sync.Mutex
+	seq    uint32
+	bootId int
+	addr   *net.UDPAddr
+}
+
+// NewMulticastPublisher creates a publisher for the service, usn is the UDN of the device and the
+// service type (uuid:device-UUID::urn:domain-name:service:serviceType:ver)
+func NewMulticastPublisher(usn, svcid string, bootId int) (*MulticastPublisher, error) {
+	addr, err := net.ResolveUDPAddr("udp4", net.JoinHostPort(MCAST_EVENT_ADDR, strconv.Itoa(MCAST_EVENT_PORT)))
+	if err != nil {
+		return nil, err
+	}
+
+	p := &MulticastPublisher{
+		USN:         usn,
+		SVCID:       svcid,
+		TTL:         MULTICAST_EVENT_TTL,
+		MaxSize:     MAX_MULTICAST_EVENT_SIZE,
+		RepeatDelay: 100 * time.Millisecond,
+		bootId:      bootId,
+		addr:        addr,
+	}
+	return p, nil
+}
+
+// SetBootId changes the BOOTID sent with events, after the device restarts.  SEQ starts again at 0
+func (p *MulticastPublisher) SetBootId(id int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.bootId = id
+	p.seq = 0
+}
+
+// Publish sends the variables at the given level (LVL_INFO if empty), split across as many messages
+// as needed to stay within MaxSize
+func (p *MulticastPublisher) Publish(lvl string, vars ...Result) error {
+	c, msgs, err := p.send(lvl, vars)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// repeats are sent without holding p.mu, so the delay doesn't hold up other events
+	for i := 0; i < p.Repeat; i++ {
+		time.Sleep(p.RepeatDelay)
+
+		if err := write(c, msgs); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// send builds the messages and sends them once, holding p.mu so messages are sent in SEQ order.  The
+// connection is returned for repeating the messages, and must be closed by the caller
+func (p *MulticastPublisher) send(lvl string, vars []Result) (*net.UDPConn, [][]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	msgs, err := p.messages(lvl, vars)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	laddr, err := p.localAddr()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c, err := net.DialUDP(p.addr.Network(), laddr, p.addr)
+	if err != nil {
+		log.Printf("ERROR - DialUDP(): %v", err)
+		return nil, nil, err
+	}
+
+	var ifaddr net.IP
+	if laddr != nil {
+		ifaddr = laddr.IP
+	}
+	if err := mcast.SetOptions(c, p.TTL, ifaddr); err != nil {
+		doLog("Publish() - SetOptions(): %v", err)
+	}
+
+	if err := write(c, msgs); err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+
+	return c, msgs, nil
+}
+
+func write(c *net.UDPConn, msgs [][]byte) error {
+	for _, m := range msgs {
+		if _, err := c.Write(m); err != nil {
+			log.Printf("ERROR - Write(): %v", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// localAddr returns the first IPv4 address of Interface
+func (p *MulticastPublisher) localAddr() (*net.UDPAddr, error) {
+	if p.Interface == nil {
+		return nil, nil
+	}
+
+	addrs, err := p.Interface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.To4() != nil {
+			return &net.UDPAddr{IP: n.IP}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no IPv4 address on interface %s", p.Interface.Name)
+}
+
+// messages builds the datagrams for vars, assigning a SEQ to each.  Caller must hold p.mu
+func (p *MulticastPublisher) messages(lvl string, vars []Result) ([][]byte, error) {
+	if len(lvl) < 1 {
+		lvl = LVL_INFO
+	}
+
+	h := &EventHeader{LVL: lvl, USN: p.USN, SVCID: p.SVCID, BootId: p.bootId}
+	build := func(r []Result) ([]byte, error) {
+		h.SEQ = int(p.seq)
+		return buildMulticastEvent(h, r, p.addr.String())
+	}
+
+	// messages are sized with the current SEQ, leave room for the widest SEQ of a later message
+	limit := p.MaxSize - (len(strconv.FormatUint(MAX_EVENT_SEQ, 10)) - len(strconv.FormatUint(uint64(p.seq), 10)))
+
+	// check everything fits before any SEQ is used
+	groups := make([][]Result, 0)
+	cur := make([]Result, 0)
+	for _, v := range vars {
+		b, err := build(append(cur, v))
+		if err != nil {
+			return nil, err
+		}
+
+		if len(b) <= limit {
+			cur = append(cur, v)
+			continue
+		}
+
+		if len(cur) < 1 {
+			return nil, ErrEventTooLarge
+		}
+		groups = append(groups, cur)
+		cur = []Result{v}
+
+		if b, err = build(cur); err != nil {
+			return nil, err
+		} else if len(b) > limit {
+			return nil, ErrEventTooLarge
+		}
+	}
+	if len(cur) > 0 {
+		groups = append(groups, cur)
+	}
+
+	msgs := make([][]byte, 0, len(groups))
+	for _, g := range groups {
+		b, err := build(g)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, b)
+		p.seq = nextSeq(p.seq)
+	}
+
+	return msgs, nil
+}
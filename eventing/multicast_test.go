@@ -0,0 +1,171 @@
+package eventing
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newMulticastDatagram(usn, svcid, lvl string, seq, bootId int) []byte {
+	body := `<?xml version="1.0"?><e:propertyset xmlns:e="urn:schemas-upnp-org:event-1-0">` +
+		`<e:property><Alarm>1</Alarm></e:property></e:propertyset>`
+
+	return []byte(fmt.Sprintf("NOTIFY * HTTP/1.1\r\nHOST: 239.255.255.246:7900\r\n"+
+		"CONTENT-TYPE: text/xml; charset=\"utf-8\"\r\nUSN: %s\r\nSVCID: %s\r\nNT: upnp:event\r\n"+
+		"NTS: upnp:propchange\r\nSEQ: %d\r\nLVL: %s\r\nBOOTID.UPNP.ORG: %d\r\nCONTENT-LENGTH: %d\r\n\r\n%s",
+		usn, svcid, seq, lvl, bootId, len(body), body))
+}
+
+func TestMulticastListener(t *testing.T) {
+	l := NewMulticastListener()
+	l.USN = testUDN
+	l.Level = LVL_ALERT
+	usn := testUDN + "::urn:schemas-upnp-org:service:Alarm:1"
+
+	tests := []struct {
+		b      []byte
+		ok     bool
+		missed uint64
+	}{
+		{[]byte("garbage\r\n\r\n"), false, 0},
+		{newMulticastDatagram(usn, "urn:upnp-org:serviceId:Alarm", LVL_INFO, 1, 1), false, 0},
+		{newMulticastDatagram("uuid:other::x", "urn:upnp-org:serviceId:Alarm", LVL_FAULT, 1, 1), false, 0},
+		{newMulticastDatagram(usn, "urn:upnp-org:serviceId:Alarm", LVL_EMERGENCY, 5, 1), true, 0},
+		{newMulticastDatagram(usn, "urn:upnp-org:serviceId:Alarm", LVL_ALERT, 6, 1), true, 0},
+		{newMulticastDatagram(usn, "urn:upnp-org:serviceId:Alarm", LVL_ALERT, 6, 1), false, 0},
+		{newMulticastDatagram(usn, "urn:upnp-org:serviceId:Alarm", LVL_ALERT, 9, 1), true, 2},
+		// a different service of the same device is tracked separately
+		{newMulticastDatagram(usn, "urn:upnp-org:serviceId:Other", LVL_ALERT, 100, 1), true, 0},
+		// device restarted, SEQ starts again
+		{newMulticastDatagram(usn, "urn:upnp-org:serviceId:Alarm", LVL_ALERT, 1, 2), true, 0},
+	}
+
+	for i, tc := range tests {
+		e, ok := l.handle(tc.b)
+		if ok != tc.ok {
+			t.Errorf("test %d: expected %t, got %t", i, tc.ok, ok)
+			continue
+		}
+		if ok && (e.Missed != tc.missed || e.Properties[0].Result.Value != "1") {
+			t.Errorf("test %d: unexpected event %+v", i, e)
+		}
+	}
+}
+
+func TestLevelRank(t *testing.T) {
+	if levelRank(LVL_EMERGENCY) >= levelRank(LVL_ALERT) || levelRank(LVL_WARNING) >= levelRank(LVL_INFO) {
+		t.Error("unexpected level ordering")
+	}
+	if levelRank("vendor:/custom") != levelRank(LVL_GENERAL) {
+		t.Error("expected unknown levels to rank with general")
+	}
+}
+
+func TestMulticastPublisher(t *testing.T) {
+	usn := testUDN + "::urn:schemas-upnp-org:service:Alarm:1"
+	p, err := NewMulticastPublisher(usn, "urn:upnp-org:serviceId:Alarm", 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.MaxSize = 600
+	p.Repeat = 1
+	p.RepeatDelay = 0
+
+	// send to a local socket, instead of the multicast group
+	c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	p.addr = c.LocalAddr().(*net.UDPAddr)
+
+	vars := make([]Result, 0)
+	for i := 0; i < 6; i++ {
+		vars = append(vars, Result{XMLName: xml.Name{Local: fmt.Sprintf("Var%d", i)}, Value: strings.Repeat("x", 50)})
+	}
+
+	if err := p.Publish(LVL_WARNING, vars...); err != nil {
+		t.Fatal(err)
+	}
+
+	l := NewMulticastListener()
+	seen := make(map[string]bool)
+	missed := uint64(0)
+	b := make([]byte, 2048)
+	recvd := 0
+	for {
+		c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, _, err := c.ReadFrom(b)
+		if err != nil {
+			break
+		}
+		recvd++
+		if n > p.MaxSize {
+			t.Errorf("message size %d exceeds %d", n, p.MaxSize)
+		}
+
+		e, ok := l.handle(b[:n])
+		if !ok {
+			// repeated message
+			continue
+		}
+		if e.BootId != 7 || e.LVL != LVL_WARNING || e.USN != usn {
+			t.Errorf("unexpected header %+v", e.EventHeader)
+		}
+		missed += e.Missed
+		for _, v := range e.Properties {
+			seen[v.Result.XMLName.Local] = true
+		}
+	}
+
+	if len(seen) != len(vars) || missed != 0 {
+		t.Errorf("expected all %d variables without gaps, got %v (missed %d)", len(vars), seen, missed)
+	}
+
+	p.mu.Lock()
+	if p.seq < 2 || recvd != 2*int(p.seq) {
+		t.Errorf("expected variables split across repeated messages, got %d messages with SEQ %d", recvd, p.seq)
+	}
+	p.mu.Unlock()
+
+	big := Result{XMLName: xml.Name{Local: "Big"}, Value: strings.Repeat("x", 1000)}
+	if err := p.Publish("", big); err != ErrEventTooLarge {
+		t.Errorf("expected ErrEventTooLarge, got %v", err)
+	}
+
+	p.SetBootId(8)
+	if p.seq != 0 {
+		t.Errorf("expected SEQ reset, got %d", p.seq)
+	}
+}
+
+func TestMulticastPublisherSeqWidth(t *testing.T) {
+	p, err := NewMulticastPublisher(testUDN+"::urn:schemas-upnp-org:service:Alarm:1", "urn:upnp-org:serviceId:Alarm", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := Result{XMLName: xml.Name{Local: "Var"}, Value: strings.Repeat("x", 50)}
+
+	// a message with one variable fits with a 9 digit SEQ, but not a 10 digit one
+	p.seq = 1000000000
+	msgs, err := p.messages("", []Result{v})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.MaxSize = len(msgs[0]) - 1
+
+	// the second message would get a 10 digit SEQ
+	p.seq = 999999999
+	msgs, err = p.messages("", []Result{v, v})
+	if err != ErrEventTooLarge {
+		t.Errorf("expected ErrEventTooLarge, got %v", err)
+	}
+	for _, m := range msgs {
+		if len(m) > p.MaxSize {
+			t.Errorf("message size %d exceeds %d", len(m), p.MaxSize)
+		}
+	}
+}
@@ -0,0 +1,549 @@
+package eventing
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/xml"
+	"fmt"
+	"github.com/mmmorris1975/go-upnp/description"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Subscription duration used if the control point doesn't request one
+	DEFAULT_PUBLISHER_TIMEOUT = 30 * time.Minute
+	// Events queued for a subscriber beyond this are dropped, causing a SEQ gap so the control
+	// point knows to resubscribe
+	MAX_QUEUED_EVENTS = 32
+)
+
+type moderation struct {
+	maxRate  time.Duration
+	minDelta float64
+	lastSent time.Time
+	lastVal  string
+	pending  bool
+}
+
+type subscriber struct {
+	sid       string
+	callbacks []string
+	// variables from the STATEVAR header, all evented variables if empty
+	vars  []string
+	seq   uint32
+	timer *time.Timer
+	queue chan notifyMessage
+	done  chan struct{}
+}
+
+type notifyMessage struct {
+	seq  uint32
+	body []byte
+}
+
+// Publisher is the device side of unicast eventing, an http.Handler for the eventSubURL of a service.
+// It accepts SUBSCRIBE, renewal and UNSUBSCRIBE requests, sends the initial event with all evented
+// variables (or those requested with a STATEVAR header) to new subscribers, and sends NOTIFY requests
+// with an incrementing SEQ when variables change.  Variable changes can be moderated, using Moderate(),
+// similar to the maximumRate and minimumDelta attributes of a state variable in UPnP 1.0
+type Publisher struct {
+	// Longest subscription duration granted, longer requests are capped to this value
+	MaxTimeout time.Duration
+
+	mu     sync.Mutex
+	names  []string
+	vars   map[string]string
+	mod    map[string]*moderation
+	subs   map[string]*subscriber
+	client *http.Client
+	closed bool
+	// any variable may be published, when created without a service description
+	anyVar bool
+}
+
+// NewPublisher creates a publisher for the evented variables (sendEvents="yes") of the service
+// description, with their default values.  If sd is nil, any variable may be published
+func NewPublisher(sd *description.ServiceDescription) *Publisher {
+	p := &Publisher{
+		MaxTimeout: 24 * time.Hour,
+		names:      make([]string, 0),
+		vars:       make(map[string]string),
+		mod:        make(map[string]*moderation),
+		subs:       make(map[string]*subscriber),
+		client:     &http.Client{Timeout: 30 * time.Second},
+		anyVar:     sd == nil,
+	}
+
+	if sd != nil {
+		for _, v := range sd.ServiceStateTable {
+			if strings.EqualFold(v.SendEvents, "yes") {
+				p.names = append(p.names, v.Name)
+				p.vars[v.Name] = v.DefaultValue
+			}
+		}
+	}
+
+	return p
+}
+
+// Moderate limits events for the variable to at most one per maxRate, and suppresses changes to numeric
+// values smaller than minDelta.  Moderated changes are still sent in the initial event of new subscribers
+func (p *Publisher) Moderate(name string, maxRate time.Duration, minDelta float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.mod[name] = &moderation{maxRate: maxRate, minDelta: minDelta, lastVal: p.vars[name]}
+}
+
+// Set updates the value of an evented variable, and notifies subscribers if it changed
+func (p *Publisher) Set(name, value string) error {
+	return p.SetMany(map[string]string{name: value})
+}
+
+// SetMany updates the value of several evented variables, changed values are sent to subscribers
+// in a single event
+func (p *Publisher) SetMany(vars map[string]string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// nothing is changed unless every variable is valid
+	for n := range vars {
+		if !p.anyVar && p.evented(n) < 0 {
+			return fmt.Errorf("%s is not an evented variable", n)
+		}
+	}
+
+	changed := make([]string, 0, len(vars))
+	for _, n := range p.sortedNames(vars) {
+		v := vars[n]
+		old, ok := p.vars[n]
+		if !ok {
+			p.names = append(p.names, n)
+		}
+		p.vars[n] = v
+
+		if ok && old == v {
+			continue
+		}
+
+		if p.moderated(n, v) {
+			continue
+		}
+		changed = append(changed, n)
+	}
+
+	if len(changed) > 0 {
+		p.publish(changed)
+	}
+
+	return nil
+}
+
+func (p *Publisher) evented(name string) int {
+	for i, n := range p.names {
+		if name == n {
+			return i
+		}
+	}
+	return -1
+}
+
+// sortedNames orders the variables as in the service description, unknown variables go last
+func (p *Publisher) sortedNames(vars map[string]string) []string {
+	res := make([]string, 0, len(vars))
+	for _, n := range p.names {
+		if _, ok := vars[n]; ok {
+			res = append(res, n)
+		}
+	}
+
+	extra := make([]string, 0)
+	for n := range vars {
+		if p.evented(n) < 0 {
+			extra = append(extra, n)
+		}
+	}
+
+	sort.Strings(extra)
+
+	return append(res, extra...)
+}
+
+// moderated returns true if the change should not be evented now.  Caller must hold p.mu
+func (p *Publisher) moderated(name, value string) bool {
+	m, ok := p.mod[name]
+	if !ok {
+		return false
+	}
+
+	if m.minDelta > 0 {
+		o, err1 := strconv.ParseFloat(m.lastVal, 64)
+		n, err2 := strconv.ParseFloat(value, 64)
+		if err1 == nil && err2 == nil && math.Abs(n-o) < m.minDelta {
+			return true
+		}
+	}
+
+	if m.maxRate > 0 {
+		wait := m.maxRate - time.Since(m.lastSent)
+		if wait > 0 {
+			if !m.pending {
+				m.pending = true
+				time.AfterFunc(wait, func() { p.flush(name) })
+			}
+			return true
+		}
+	}
+
+	m.lastSent = time.Now()
+	m.lastVal = value
+	return false
+}
+
+// flush sends the latest value of a variable held back by maxRate moderation
+func (p *Publisher) flush(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	m := p.mod[name]
+	m.pending = false
+	if p.closed || m.lastVal == p.vars[name] {
+		return
+	}
+
+	m.lastSent = time.Now()
+	m.lastVal = p.vars[name]
+	p.publish([]string{name})
+}
+
+func (p *Publisher) propertySet(names []string) ([]byte, error) {
+	e := NewEventData()
+	for _, n := range names {
+		e.Properties = append(e.Properties, property{Result: Result{XMLName: xml.Name{Local: n}, Value: p.vars[n]}})
+	}
+
+	buf := bytes.NewBufferString(xml.Header)
+	b, err := xml.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(b)
+
+	return buf.Bytes(), nil
+}
+
+// publish queues an event with the named variables for all subscribers.  Caller must hold p.mu
+func (p *Publisher) publish(names []string) {
+	all, err := p.propertySet(names)
+	if err != nil {
+		log.Printf("ERROR - Marshal(): %v", err)
+		return
+	}
+
+	for _, s := range p.subs {
+		if len(s.vars) < 1 {
+			p.enqueue(s, all)
+			continue
+		}
+
+		sel := s.selected(names)
+		if len(sel) < 1 {
+			continue
+		}
+
+		b, err := p.propertySet(sel)
+		if err != nil {
+			log.Printf("ERROR - Marshal(): %v", err)
+			continue
+		}
+		p.enqueue(s, b)
+	}
+}
+
+// selected returns the names the subscriber asked for with STATEVAR, in the order of names
+func (s *subscriber) selected(names []string) []string {
+	if len(s.vars) < 1 {
+		return names
+	}
+
+	res := make([]string, 0, len(names))
+	for _, n := range names {
+		for _, v := range s.vars {
+			if n == v {
+				res = append(res, n)
+				break
+			}
+		}
+	}
+	return res
+}
+
+// enqueue assigns the next SEQ to the event.  Caller must hold p.mu
+func (p *Publisher) enqueue(s *subscriber, b []byte) {
+	msg := notifyMessage{seq: s.seq, body: b}
+	s.seq = nextSeq(s.seq)
+
+	select {
+	case s.queue <- msg:
+	default:
+		doLog("event queue full for SID %s, dropping SEQ %d", s.sid, msg.seq)
+	}
+}
+
+// deliver sends queued events to the subscriber, in order
+func (p *Publisher) deliver(s *subscriber) {
+	for {
+		select {
+		case <-s.done:
+			return
+		case msg := <-s.queue:
+			if err := p.sendNotify(s, msg); err != nil {
+				doLog("deliver() - SID %s SEQ %d: %v", s.sid, msg.seq, err)
+			}
+		}
+	}
+}
+
+// sendNotify tries each callback URL in order, until one accepts the event
+func (p *Publisher) sendNotify(s *subscriber, msg notifyMessage) error {
+	var err error
+
+	for _, cb := range s.callbacks {
+		var req *http.Request
+		req, err = http.NewRequest("NOTIFY", cb, bytes.NewReader(msg.body))
+		if err != nil {
+			continue
+		}
+		req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+		req.Header.Set("NT", "upnp:event")
+		req.Header.Set("NTS", "upnp:propchange")
+		req.Header.Set("SID", s.sid)
+		req.Header.Set("SEQ", strconv.FormatUint(uint64(msg.seq), 10))
+
+		var res *http.Response
+		res, err = p.client.Do(req)
+		if err != nil {
+			continue
+		}
+		res.Body.Close()
+
+		if res.StatusCode == http.StatusOK {
+			return nil
+		}
+		err = fmt.Errorf("NOTIFY to %s returned HTTP %d", cb, res.StatusCode)
+	}
+
+	return err
+}
+
+var callbackRe = regexp.MustCompile(`<([^>]+)>`)
+
+func parseCallbacks(h string) []string {
+	res := make([]string, 0)
+	for _, m := range callbackRe.FindAllStringSubmatch(h, -1) {
+		u, err := url.Parse(strings.TrimSpace(m[1]))
+		if err == nil && u.Scheme == "http" && len(u.Host) > 0 {
+			res = append(res, u.String())
+		}
+	}
+	return res
+}
+
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+func (p *Publisher) timeout(h string) time.Duration {
+	d, err := parseTimeout(h)
+	if err != nil {
+		d = DEFAULT_PUBLISHER_TIMEOUT
+	}
+
+	if p.MaxTimeout > 0 && d > p.MaxTimeout {
+		d = p.MaxTimeout
+	}
+	return d
+}
+
+func (p *Publisher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sid := r.Header.Get("SID")
+	nt := r.Header.Get("NT")
+	cb := r.Header.Get("CALLBACK")
+
+	switch r.Method {
+	case "SUBSCRIBE":
+		if len(sid) > 0 {
+			if len(nt) > 0 || len(cb) > 0 {
+				http.Error(w, "SID header not allowed with NT or CALLBACK", http.StatusBadRequest)
+				return
+			}
+			p.renew(w, r, sid)
+			return
+		}
+
+		if nt != "upnp:event" {
+			http.Error(w, "invalid NT header", http.StatusPreconditionFailed)
+			return
+		}
+		p.subscribe(w, r, cb)
+	case "UNSUBSCRIBE":
+		if len(nt) > 0 || len(cb) > 0 {
+			http.Error(w, "NT and CALLBACK headers not allowed", http.StatusBadRequest)
+			return
+		}
+		p.unsubscribe(w, sid)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeSubscribeResponse(w http.ResponseWriter, sid string, d time.Duration) {
+	w.Header().Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	w.Header().Set("Server", fmt.Sprintf(`%s/%s UPnP/1.1 xxx/1.0`, runtime.GOOS, runtime.Version()))
+	w.Header().Set("SID", sid)
+	w.Header().Set("TIMEOUT", fmt.Sprintf("Second-%d", int(math.Ceil(d.Seconds()))))
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusOK)
+}
+
+func (p *Publisher) subscribe(w http.ResponseWriter, r *http.Request, cb string) {
+	callbacks := parseCallbacks(cb)
+	if len(callbacks) < 1 {
+		http.Error(w, "missing or invalid CALLBACK header", http.StatusPreconditionFailed)
+		return
+	}
+
+	d := p.timeout(r.Header.Get("TIMEOUT"))
+	s := &subscriber{
+		sid:       "uuid:" + newUUID(),
+		callbacks: callbacks,
+		vars:      parseStateVarList(r.Header.Get("STATEVAR")),
+		queue:     make(chan notifyMessage, MAX_QUEUED_EVENTS),
+		done:      make(chan struct{}),
+	}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	for _, v := range s.vars {
+		if !p.anyVar && p.evented(v) < 0 {
+			p.mu.Unlock()
+			http.Error(w, fmt.Sprintf("%s is not an evented variable", v), http.StatusPreconditionFailed)
+			return
+		}
+	}
+	// the initial event, with all evented variables, is queued as SEQ 0 before any change can be, and
+	// is delivered once the SUBSCRIBE response is sent
+	b, err := p.propertySet(s.selected(p.names))
+	if err != nil {
+		p.mu.Unlock()
+		log.Printf("ERROR - Marshal(): %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	p.enqueue(s, b)
+	p.subs[s.sid] = s
+	s.timer = time.AfterFunc(d, func() { p.expire(s.sid) })
+	p.mu.Unlock()
+
+	if len(s.vars) > 0 {
+		w.Header().Set("ACCEPTED-STATEVAR", strings.Join(s.vars, ","))
+	}
+	writeSubscribeResponse(w, s.sid, d)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	go p.deliver(s)
+}
+
+func (p *Publisher) renew(w http.ResponseWriter, r *http.Request, sid string) {
+	p.mu.Lock()
+	s, ok := p.subs[sid]
+	d := p.timeout(r.Header.Get("TIMEOUT"))
+	if ok {
+		s.timer.Reset(d)
+	}
+	p.mu.Unlock()
+
+	if !ok {
+		http.Error(w, "unknown SID", http.StatusPreconditionFailed)
+		return
+	}
+
+	writeSubscribeResponse(w, sid, d)
+}
+
+func (p *Publisher) unsubscribe(w http.ResponseWriter, sid string) {
+	if len(sid) < 1 {
+		http.Error(w, "missing SID header", http.StatusPreconditionFailed)
+		return
+	}
+
+	if !p.remove(sid) {
+		http.Error(w, "unknown SID", http.StatusPreconditionFailed)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (p *Publisher) expire(sid string) {
+	if p.remove(sid) {
+		doLog("subscription %s expired", sid)
+	}
+}
+
+func (p *Publisher) remove(sid string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s, ok := p.subs[sid]
+	if !ok {
+		return false
+	}
+
+	s.timer.Stop()
+	close(s.done)
+	delete(p.subs, sid)
+	return true
+}
+
+// Subscribers returns the number of active subscriptions
+func (p *Publisher) Subscribers() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.subs)
+}
+
+// Close removes all subscriptions, and stops accepting new ones
+func (p *Publisher) Close() {
+	p.mu.Lock()
+	p.closed = true
+	sids := make([]string, 0, len(p.subs))
+	for k := range p.subs {
+		sids = append(sids, k)
+	}
+	p.mu.Unlock()
+
+	for _, s := range sids {
+		p.remove(s)
+	}
+}
@@ -0,0 +1,249 @@
+package eventing
+
+import (
+	"context"
+	"encoding/xml"
+	"github.com/mmmorris1975/go-upnp/description"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func newTestPublisher(t *testing.T) *Publisher {
+	sd := new(description.ServiceDescription)
+	if err := xml.Unmarshal([]byte(mockSCPD), sd); err != nil {
+		t.Fatal(err)
+	}
+	return NewPublisher(sd)
+}
+
+func sendRequest(t *testing.T, method, u string, hdr map[string]string) *http.Response {
+	req, _ := http.NewRequest(method, u, nil)
+	for k, v := range hdr {
+		req.Header.Set(k, v)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res
+}
+
+func TestPublisher(t *testing.T) {
+	p := newTestPublisher(t)
+	p.Set("Status", "0")
+	defer p.Close()
+
+	dev := httptest.NewServer(p)
+	defer dev.Close()
+	u, _ := url.Parse(dev.URL)
+
+	srv := NewCallbackServer("127.0.0.1:0")
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	m, err := NewSubscriptionManagerWithServer(u, 1*time.Minute, srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan *Event, 10)
+	go m.Run(context.Background(), ch)
+	sid := waitForState(t, m, StateSubscribed).SID
+
+	recv := func() *Event {
+		select {
+		case e := <-ch:
+			return e
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for event")
+		}
+		return nil
+	}
+
+	e := recv()
+	if e.SEQ != 0 || e.SID != sid || len(e.Properties) != 2 {
+		t.Fatalf("unexpected initial event %+v", e)
+	}
+
+	p.Set("Status", "0")
+	p.SetMany(map[string]string{"LoadLevelStatus": "50", "Status": "1"})
+	e = recv()
+	if e.SEQ != 1 || len(e.Properties) != 2 || e.Properties[0].Result.XMLName.Local != "Status" {
+		t.Errorf("unexpected event %+v", e)
+	}
+
+	if err := p.Set("Unknown", "x"); err == nil {
+		t.Error("expected error setting non-evented variable")
+	}
+
+	// an invalid variable must leave the others unchanged
+	if err := p.SetMany(map[string]string{"Status": "0", "Unknown": "x"}); err == nil {
+		t.Error("expected error setting non-evented variable")
+	}
+	p.Set("Status", "0")
+	e = recv()
+	if e.SEQ != 2 || len(e.Properties) != 1 || e.Properties[0].Result.Value != "0" {
+		t.Errorf("unexpected event %+v", e)
+	}
+
+	m.Close()
+	waitFor(t, func() bool { return p.Subscribers() == 0 })
+}
+
+func TestPublisherNoDescription(t *testing.T) {
+	p := NewPublisher(nil)
+	defer p.Close()
+
+	for _, n := range []string{"A", "B"} {
+		if err := p.Set(n, "1"); err != nil {
+			t.Errorf("unexpected error setting %s: %v", n, err)
+		}
+	}
+}
+
+func TestPublisherModeration(t *testing.T) {
+	p := newTestPublisher(t)
+	p.Set("LoadLevelStatus", "0")
+	p.Moderate("LoadLevelStatus", 200*time.Millisecond, 5)
+	defer p.Close()
+
+	events := make(chan *Event, 10)
+	cb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e := &Event{EventHeader: parseEventHeader(r.Header)}
+		if err := xml.NewDecoder(r.Body).Decode(&e.EventData); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		events <- e
+	}))
+	defer cb.Close()
+
+	dev := httptest.NewServer(p)
+	defer dev.Close()
+
+	res := sendRequest(t, "SUBSCRIBE", dev.URL, map[string]string{"NT": "upnp:event", "CALLBACK": "<" + cb.URL + ">"})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("SUBSCRIBE returned HTTP %d", res.StatusCode)
+	}
+	<-events
+
+	p.Set("LoadLevelStatus", "2")  // below minimumDelta
+	p.Set("LoadLevelStatus", "10") // sent
+	p.Set("LoadLevelStatus", "20") // held back by maximumRate
+	p.Set("LoadLevelStatus", "30")
+
+	for _, want := range []string{"10", "30"} {
+		select {
+		case e := <-events:
+			if v := e.Properties[0].Result.Value; v != want {
+				t.Errorf("expected %s, got %s", want, v)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for %s", want)
+		}
+	}
+
+	select {
+	case e := <-events:
+		t.Errorf("unexpected event %+v", e)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestPublisherRequests(t *testing.T) {
+	p := newTestPublisher(t)
+	p.MaxTimeout = 500 * time.Millisecond
+	defer p.Close()
+
+	dev := httptest.NewServer(p)
+	defer dev.Close()
+
+	tests := []struct {
+		method string
+		hdr    map[string]string
+		status int
+	}{
+		{"SUBSCRIBE", map[string]string{"NT": "upnp:event"}, http.StatusPreconditionFailed},
+		{"SUBSCRIBE", map[string]string{"NT": "upnp:event", "CALLBACK": "<ftp://x/>"}, http.StatusPreconditionFailed},
+		{"SUBSCRIBE", map[string]string{"NT": "ssdp:all", "CALLBACK": "<http://127.0.0.1:1/>"}, http.StatusPreconditionFailed},
+		{"SUBSCRIBE", map[string]string{"SID": "uuid:x", "NT": "upnp:event"}, http.StatusBadRequest},
+		{"SUBSCRIBE", map[string]string{"SID": "uuid:x"}, http.StatusPreconditionFailed},
+		{"UNSUBSCRIBE", map[string]string{}, http.StatusPreconditionFailed},
+		{"UNSUBSCRIBE", map[string]string{"SID": "uuid:x", "CALLBACK": "<http://127.0.0.1:1/>"}, http.StatusBadRequest},
+		{"GET", map[string]string{}, http.StatusMethodNotAllowed},
+	}
+
+	for _, tc := range tests {
+		if res := sendRequest(t, tc.method, dev.URL, tc.hdr); res.StatusCode != tc.status {
+			t.Errorf("%s %v: expected HTTP %d, got %d", tc.method, tc.hdr, tc.status, res.StatusCode)
+		}
+	}
+
+	res := sendRequest(t, "SUBSCRIBE", dev.URL, map[string]string{"NT": "upnp:event",
+		"CALLBACK": "<http://127.0.0.1:1/><http://127.0.0.1:2/>", "TIMEOUT": "Second-1800"})
+	if res.StatusCode != http.StatusOK || res.Header.Get("TIMEOUT") != "Second-1" {
+		t.Fatalf("unexpected SUBSCRIBE response %d %v", res.StatusCode, res.Header)
+	}
+
+	// a short lived subscription, with unreachable callbacks, must expire
+	waitFor(t, func() bool { return p.Subscribers() == 0 })
+	if res := sendRequest(t, "UNSUBSCRIBE", dev.URL, map[string]string{"SID": res.Header.Get("SID")}); res.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("expected expired SID to be unknown, got HTTP %d", res.StatusCode)
+	}
+}
+
+func TestPublisherStateVariables(t *testing.T) {
+	p := newTestPublisher(t)
+	defer p.Close()
+
+	dev := httptest.NewServer(p)
+	defer dev.Close()
+	u, _ := url.Parse(dev.URL)
+
+	res := sendRequest(t, "SUBSCRIBE", dev.URL, map[string]string{"NT": "upnp:event",
+		"CALLBACK": "<http://127.0.0.1:1/>", "STATEVAR": "Status,Unknown"})
+	if res.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("expected HTTP 412 for unknown STATEVAR, got %d", res.StatusCode)
+	}
+
+	srv := NewCallbackServer("127.0.0.1:0")
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	m, _ := NewSubscriptionManagerWithServer(u, 1*time.Minute, srv)
+	m.StateVariables = []string{"LoadLevelStatus"}
+
+	ch := make(chan *Event, 10)
+	go m.Run(context.Background(), ch)
+	defer m.Close()
+	waitForState(t, m, StateSubscribed)
+
+	m.mu.Lock()
+	if len(m.AcceptedStateVariables) != 1 || m.AcceptedStateVariables[0] != "LoadLevelStatus" {
+		t.Errorf("unexpected accepted variables %v", m.AcceptedStateVariables)
+	}
+	m.mu.Unlock()
+
+	p.Set("Status", "1")
+	p.Set("LoadLevelStatus", "20")
+
+	for _, want := range []int{0, 1} {
+		select {
+		case e := <-ch:
+			if e.SEQ != want || len(e.Properties) != 1 || e.Properties[0].Result.XMLName.Local != "LoadLevelStatus" {
+				t.Errorf("unexpected event %+v", e)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for event")
+		}
+	}
+}
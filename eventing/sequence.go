@@ -0,0 +1,75 @@
+package eventing
+
+// Event SEQ numbers start at 0 for the initial event, and wrap from MAX_EVENT_SEQ to 1
+const MAX_EVENT_SEQ = 4294967295
+
+type seqState int
+
+const (
+	seqInOrder seqState = iota
+	seqInitial
+	seqStale
+	seqGap
+)
+
+func (s seqState) String() string {
+	switch s {
+	case seqInitial:
+		return "initial"
+	case seqStale:
+		return "stale"
+	case seqGap:
+		return "gap"
+	}
+	return "in order"
+}
+
+func nextSeq(s uint32) uint32 {
+	if s == MAX_EVENT_SEQ {
+		return 1
+	}
+	return s + 1
+}
+
+// seqDistance returns how far b is ahead of a in the sequence space 1 to MAX_EVENT_SEQ
+func seqDistance(a, b uint32) uint64 {
+	const m = uint64(MAX_EVENT_SEQ)
+	return (uint64(b) + m - uint64(a)) % m
+}
+
+// seqTracker checks the SEQ of each event from a single source against the expected value
+type seqTracker struct {
+	expected uint32
+	valid    bool
+}
+
+func (t *seqTracker) reset() {
+	t.valid = false
+}
+
+func (t *seqTracker) check(seq uint32) seqState {
+	if seq == 0 {
+		t.expected = 1
+		t.valid = true
+		return seqInitial
+	}
+
+	if !t.valid {
+		// missed the initial event (ex. joined a multicast group late), start tracking from here
+		t.expected = nextSeq(seq)
+		t.valid = true
+		return seqInOrder
+	}
+
+	d := seqDistance(t.expected, seq)
+	switch {
+	case d == 0:
+		t.expected = nextSeq(seq)
+		return seqInOrder
+	case d < 1<<31:
+		t.expected = nextSeq(seq)
+		return seqGap
+	}
+
+	return seqStale
+}
@@ -0,0 +1,31 @@
+package eventing
+
+import "testing"
+
+func TestSeqTracker(t *testing.T) {
+	tests := []struct {
+		name string
+		seqs []uint32
+		want []seqState
+	}{
+		{"in order", []uint32{0, 1, 2, 3}, []seqState{seqInitial, seqInOrder, seqInOrder, seqInOrder}},
+		{"gap", []uint32{0, 1, 3, 4}, []seqState{seqInitial, seqInOrder, seqGap, seqInOrder}},
+		{"duplicate", []uint32{0, 1, 1, 2}, []seqState{seqInitial, seqInOrder, seqStale, seqInOrder}},
+		{"stale", []uint32{0, 1, 2, 3, 2}, []seqState{seqInitial, seqInOrder, seqInOrder, seqInOrder, seqStale}},
+		{"wrap", []uint32{MAX_EVENT_SEQ - 1, MAX_EVENT_SEQ, 1, 2}, []seqState{seqInOrder, seqInOrder, seqInOrder, seqInOrder}},
+		{"wrap gap", []uint32{MAX_EVENT_SEQ - 1, 2}, []seqState{seqInOrder, seqGap}},
+		{"wrap stale", []uint32{MAX_EVENT_SEQ, 1, MAX_EVENT_SEQ}, []seqState{seqInOrder, seqInOrder, seqStale}},
+		{"resubscribed", []uint32{0, 1, 2, 0, 1}, []seqState{seqInitial, seqInOrder, seqInOrder, seqInitial, seqInOrder}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tr := new(seqTracker)
+			for i, s := range tc.seqs {
+				if r := tr.check(s); r != tc.want[i] {
+					t.Errorf("SEQ %d (index %d): got %s, want %s", s, i, r, tc.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,393 @@
+package eventing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/mmmorris1975/go-upnp/description"
+	"github.com/mmmorris1975/go-upnp/discovery"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ErrDeviceGone is reported in a StateLost status when the device sends ssdp:byebye
+var ErrDeviceGone = errors.New("device left the network")
+
+// ServiceSubscription subscribes to a service of the device with the given UDN, and follows the device
+// across restarts.  The event URL is found via discovery and description, and SSDP notifications are
+// monitored so the URL is resolved again, and a new subscription made, when the device comes back after
+// an ssdp:byebye, or announces a new BOOTID or location
+type ServiceSubscription struct {
+	UDN         string
+	ServiceType string
+	Lifetime    time.Duration
+	// Limit events to these variables, see SubscriptionManager
+	StateVariables []string
+	// Wait time for discovery and description requests
+	Wait time.Duration
+
+	server *CallbackServer
+	status chan SubscriptionStatus
+	// set when Run() starts, used by tests to avoid SSDP
+	notify <-chan *discovery.NotifyResponse
+}
+
+// activeSubscription is the SubscriptionManager for the current incarnation of the device
+type activeSubscription struct {
+	m        *SubscriptionManager
+	location string
+	bootId   int
+	cancel   context.CancelFunc
+	done     chan struct{}
+	// receives the error if the SubscriptionManager stops on its own
+	failed chan error
+}
+
+func (a *activeSubscription) stop() {
+	a.cancel()
+	<-a.done
+}
+
+// resolution is the result of finding the event URL of the service
+type resolution struct {
+	// generation of the request, results of superseded requests are ignored
+	gen      int
+	recheck  bool
+	u        *url.URL
+	location string
+	bootId   int
+	err      error
+}
+
+// NewServiceSubscription creates a subscription for the service type of the device with the UDN (in
+// uuid:device-UUID format), using the DefaultCallbackServer
+func NewServiceSubscription(udn, svcType string, exp time.Duration) (*ServiceSubscription, error) {
+	if !DefaultCallbackServer.running() {
+		if err := DefaultCallbackServer.Start(); err != nil {
+			return nil, err
+		}
+	}
+
+	return NewServiceSubscriptionWithServer(udn, svcType, exp, DefaultCallbackServer), nil
+}
+
+func NewServiceSubscriptionWithServer(udn, svcType string, exp time.Duration, srv *CallbackServer) *ServiceSubscription {
+	return &ServiceSubscription{
+		UDN:         udn,
+		ServiceType: svcType,
+		Lifetime:    exp,
+		Wait:        discovery.DISCOVERY_WAIT_MIN_DURATION,
+		server:      srv,
+		status:      make(chan SubscriptionStatus, 10),
+	}
+}
+
+// Status reports changes in the state of the subscription, as for SubscriptionManager.  A StateLost status
+// with ErrDeviceGone is sent when the device leaves the network, and StateResubscribed once a subscription
+// to the device is made again
+func (s *ServiceSubscription) Status() <-chan SubscriptionStatus {
+	return s.status
+}
+
+func (s *ServiceSubscription) sendStatus(st SubscriptionStatus) {
+	select {
+	case s.status <- st:
+	default:
+		doLog("status channel full, dropping %s status for %s", st.State, s.UDN)
+	}
+}
+
+// Run delivers events from the service to ch until ctx is done, re-subscribing whenever the device
+// restarts.  The device is searched for and described in the background, so SSDP notifications are
+// still handled in the meantime.  The channel is closed before returning
+func (s *ServiceSubscription) Run(ctx context.Context, ch chan<- *Event) error {
+	defer close(ch)
+	defer close(s.status)
+
+	if !s.server.running() {
+		return fmt.Errorf("callback server is not running")
+	}
+
+	notify := s.notify
+	if notify == nil {
+		n := make(chan *discovery.NotifyResponse, 10)
+		go discovery.ListenNotifyContext(ctx, n)
+		notify = n
+	}
+
+	var cur *activeSubscription
+	var curStatus <-chan SubscriptionStatus
+	var curFailed <-chan error
+	// retryC fires to try subscribing again, recheckC to check if the event URL changed
+	var retryC, recheckC <-chan time.Time
+	retry := MIN_RETRY_INTERVAL
+	subscribed := false
+
+	resolved := make(chan resolution)
+	gen := 0
+	// location being resolved to subscribe, nil if none
+	var resolving *string
+
+	resolve := func(location string, bootId int, recheck bool) {
+		gen++
+		r := resolution{gen: gen, recheck: recheck}
+		go func() {
+			r.u, r.location, r.bootId, r.err = s.resolve(location)
+			if bootId > 0 {
+				r.bootId = bootId
+			}
+
+			select {
+			case resolved <- r:
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	// stop ends the current subscription, and any attempt to make one.  If the device is gone the
+	// subscription is dropped without sending UNSUBSCRIBE
+	stop := func(gone bool) {
+		if cur != nil {
+			if gone {
+				cur.m.abandon()
+			}
+			cur.stop()
+			cur = nil
+			curStatus = nil
+			curFailed = nil
+		}
+		gen++
+		resolving = nil
+		retryC = nil
+		recheckC = nil
+	}
+	defer stop(false)
+
+	start := func(location string, bootId int) {
+		stop(false)
+		resolving = &location
+		resolve(location, bootId, false)
+	}
+
+	fail := func(err error) {
+		log.Printf("ERROR - unable to subscribe to %s of %s: %v", s.ServiceType, s.UDN, err)
+		s.sendStatus(SubscriptionStatus{State: StateLost, Err: err, Time: time.Now()})
+
+		retryC = time.After(retry)
+		if retry *= 2; retry > MAX_RETRY_INTERVAL {
+			retry = MAX_RETRY_INTERVAL
+		}
+	}
+	start("", 0)
+
+	for {
+		select {
+		case <-ctx.Done():
+			stop(false)
+			s.sendStatus(SubscriptionStatus{State: StateClosed, Time: time.Now()})
+			return nil
+		case <-retryC:
+			start("", 0)
+		case <-recheckC:
+			// the subscription manager can't reach the event URL, check if the device moved
+			recheckC = nil
+			if cur != nil {
+				resolve("", 0, true)
+			}
+		case r := <-resolved:
+			if r.gen != gen {
+				continue
+			}
+
+			if r.recheck {
+				if r.err != nil || cur == nil || r.u.String() == cur.m.URL.String() {
+					continue
+				}
+				log.Printf("INFO - event URL for %s changed to %s, resubscribing", s.UDN, r.u)
+				stop(false)
+			}
+			resolving = nil
+
+			if r.err != nil {
+				fail(r.err)
+				continue
+			}
+
+			a, err := s.start(ctx, r.u, r.location, r.bootId, ch)
+			if err != nil {
+				fail(err)
+				continue
+			}
+
+			retry = MIN_RETRY_INTERVAL
+			cur = a
+			curStatus = a.m.Status()
+			curFailed = a.failed
+		case err := <-curFailed:
+			stop(false)
+			fail(err)
+		case st, ok := <-curStatus:
+			if !ok {
+				curStatus = nil
+				continue
+			}
+
+			switch st.State {
+			case StateClosed:
+				// the outer subscription is still active
+				continue
+			case StateSubscribed:
+				if subscribed {
+					st.State = StateResubscribed
+				}
+				subscribed = true
+			case StateLost:
+				if st.Err != errPreconditionFailed && recheckC == nil {
+					recheckC = time.After(MIN_RETRY_INTERVAL)
+				}
+			}
+			s.sendStatus(st)
+		case n, ok := <-notify:
+			if !ok {
+				notify = nil
+				continue
+			}
+
+			switch s.checkNotify(cur, n) {
+			case notifyGone:
+				log.Printf("INFO - %s left the network", s.UDN)
+				stop(true)
+				s.sendStatus(SubscriptionStatus{State: StateLost, Err: ErrDeviceGone, Time: time.Now()})
+			case notifyRestart:
+				if resolving != nil && *resolving == n.Location {
+					continue
+				}
+				log.Printf("INFO - %s announced at %s, subscribing", s.UDN, n.Location)
+				start(n.Location, n.BootId)
+			}
+		}
+	}
+}
+
+type notifyAction int
+
+const (
+	notifyIgnore notifyAction = iota
+	notifyGone
+	notifyRestart
+)
+
+// checkNotify decides what to do about an SSDP notification, based on the current subscription
+func (s *ServiceSubscription) checkNotify(cur *activeSubscription, n *discovery.NotifyResponse) notifyAction {
+	if !matchUSN(n.USN, s.UDN) {
+		return notifyIgnore
+	}
+
+	switch n.NTS {
+	case "ssdp:byebye":
+		if cur != nil {
+			return notifyGone
+		}
+	case "ssdp:alive":
+		if cur == nil {
+			return notifyRestart
+		}
+		if n.BootId > 0 && cur.bootId > 0 && n.BootId != cur.bootId {
+			return notifyRestart
+		}
+		if len(n.Location) > 0 && n.Location != cur.location {
+			return notifyRestart
+		}
+	case "ssdp:update":
+		// device changed network interfaces, subscriptions are retained but the BOOTID changes
+		if cur != nil && n.NextBootId > 0 {
+			cur.bootId = n.NextBootId
+		}
+	}
+
+	return notifyIgnore
+}
+
+// matchUSN returns true if the USN (uuid:device-UUID[::type]) belongs to the device UDN
+func matchUSN(usn, udn string) bool {
+	return usn == udn || strings.HasPrefix(usn, udn+"::")
+}
+
+// resolve finds the event URL of the service, searching for the device if location is empty.
+// Returns the URL, and the description location and BOOTID it was resolved from
+func (s *ServiceSubscription) resolve(location string) (*url.URL, string, int, error) {
+	bootId := 0
+	if len(location) < 1 {
+		ch := make(chan *discovery.SearchResponse, 10)
+		req := discovery.NewSearchRequest()
+		req.Target = s.UDN
+		req.Wait = s.Wait
+		discovery.Discover(req, ch)
+
+		for r := range ch {
+			if len(location) < 1 && matchUSN(r.USN, s.UDN) {
+				location = r.Location
+				bootId = r.BootId
+			}
+		}
+
+		if len(location) < 1 {
+			return nil, "", 0, fmt.Errorf("device %s not found", s.UDN)
+		}
+	}
+
+	dd, err := description.DescribeDevice(location, s.Wait)
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	d := dd.DeviceByUDN(s.UDN)
+	if d == nil {
+		return nil, "", 0, fmt.Errorf("device %s not found in description at %s", s.UDN, location)
+	}
+
+	for _, e := range d.ServiceList {
+		if s.ServiceType == e.ServiceType {
+			u, err := dd.BuildURL(e.EventSubURL)
+			return u, location, bootId, err
+		}
+	}
+
+	return nil, "", 0, fmt.Errorf("device %s has no %s service", s.UDN, s.ServiceType)
+}
+
+func (s *ServiceSubscription) start(ctx context.Context, u *url.URL, location string, bootId int, ch chan<- *Event) (*activeSubscription, error) {
+	m, err := NewSubscriptionManagerWithServer(u, s.Lifetime, s.server)
+	if err != nil {
+		return nil, err
+	}
+	m.StateVariables = s.StateVariables
+
+	ctx, cancel := context.WithCancel(ctx)
+	a := &activeSubscription{m: m, location: location, bootId: bootId, cancel: cancel,
+		done: make(chan struct{}), failed: make(chan error, 1)}
+
+	events := make(chan *Event, 10)
+	go func() {
+		if err := m.Run(ctx, events); err != nil {
+			log.Printf("ERROR - subscription error: %v", err)
+			a.failed <- err
+			close(events)
+		}
+	}()
+
+	// events are forwarded until Run() closes the channel, so ch is never written after stop() returns
+	go func() {
+		defer close(a.done)
+		for e := range events {
+			select {
+			case ch <- e:
+			case <-ctx.Done():
+			}
+		}
+	}()
+
+	return a, nil
+}
@@ -0,0 +1,171 @@
+package eventing
+
+import (
+	"context"
+	"fmt"
+	"github.com/mmmorris1975/go-upnp/discovery"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testUDN = "uuid:11111111-2222-3333-4444-555555555555"
+
+const mockServiceDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0"><specVersion><major>1</major><minor>1</minor></specVersion>
+<device><deviceType>urn:schemas-upnp-org:device:BinaryLight:1</deviceType><UDN>%s</UDN>
+<serviceList><service><serviceType>urn:schemas-upnp-org:service:SwitchPower:1</serviceType>
+<serviceId>urn:upnp-org:serviceId:SwitchPower</serviceId><SCPDURL>/scpd.xml</SCPDURL>
+<controlURL>/ctl</controlURL><eventSubURL>/evt</eventSubURL></service></serviceList></device></root>`
+
+func newMockDevice(p *mockPublisher) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/evt", p)
+	mux.HandleFunc("/desc.xml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, mockServiceDescription, testUDN)
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestCheckNotify(t *testing.T) {
+	s := &ServiceSubscription{UDN: testUDN}
+	cur := &activeSubscription{location: "http://192.0.2.1/desc.xml", bootId: 5}
+
+	n := func(usn, nts, loc string, boot int) *discovery.NotifyResponse {
+		r := &discovery.NotifyResponse{NTS: nts}
+		r.USN = usn
+		r.Location = loc
+		r.BootId = boot
+		return r
+	}
+
+	tests := []struct {
+		name string
+		cur  *activeSubscription
+		n    *discovery.NotifyResponse
+		want notifyAction
+	}{
+		{"other device", cur, n("uuid:other::upnp:rootdevice", "ssdp:byebye", "", 0), notifyIgnore},
+		{"similar udn", cur, n(testUDN+"0", "ssdp:byebye", "", 0), notifyIgnore},
+		{"byebye", cur, n(testUDN+"::upnp:rootdevice", "ssdp:byebye", "", 0), notifyGone},
+		{"byebye not subscribed", nil, n(testUDN, "ssdp:byebye", "", 0), notifyIgnore},
+		{"alive same", cur, n(testUDN, "ssdp:alive", cur.location, 5), notifyIgnore},
+		{"alive new bootid", cur, n(testUDN, "ssdp:alive", cur.location, 6), notifyRestart},
+		{"alive new location", cur, n(testUDN, "ssdp:alive", "http://192.0.2.2/desc.xml", 5), notifyRestart},
+		{"alive not subscribed", nil, n(testUDN, "ssdp:alive", cur.location, 5), notifyRestart},
+	}
+
+	for _, tc := range tests {
+		if r := s.checkNotify(tc.cur, tc.n); r != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.name, r, tc.want)
+		}
+	}
+}
+
+func TestServiceSubscription(t *testing.T) {
+	p := newMockPublisher()
+	dev := newMockDevice(p)
+	defer dev.Close()
+
+	srv := NewCallbackServer("127.0.0.1:0")
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	notify := make(chan *discovery.NotifyResponse, 10)
+	s := NewServiceSubscriptionWithServer(testUDN, "urn:schemas-upnp-org:service:SwitchPower:1", 1*time.Minute, srv)
+	s.notify = notify
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := make(chan *Event, 10)
+	go s.Run(ctx, ch)
+
+	waitStatus := func(state SubscriptionState) SubscriptionStatus {
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case st := <-s.Status():
+				if st.State == state {
+					return st
+				}
+			case <-timeout:
+				t.Fatalf("timed out waiting for %s", state)
+			}
+		}
+	}
+
+	alive := func(boot int) {
+		n := &discovery.NotifyResponse{NTS: "ssdp:alive"}
+		n.USN = testUDN + "::upnp:rootdevice"
+		n.Location = dev.URL + "/desc.xml"
+		n.BootId = boot
+		notify <- n
+	}
+
+	// device can't be found by search, so wait for it to announce itself
+	alive(1)
+	sid := waitStatus(StateSubscribed).SID
+
+	p.notify(sid, -1, map[string]string{"Status": "1"})
+	select {
+	case e := <-ch:
+		if e.SID != sid {
+			t.Errorf("unexpected event %+v", e)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("no event received")
+	}
+
+	// device restarts, with a new BOOTID
+	alive(2)
+	st := waitStatus(StateResubscribed)
+	if st.SID == sid {
+		t.Error("expected a new SID after device restart")
+	}
+
+	bye := &discovery.NotifyResponse{NTS: "ssdp:byebye"}
+	bye.USN = testUDN
+	notify <- bye
+	if st := waitStatus(StateLost); st.Err != ErrDeviceGone {
+		t.Errorf("unexpected error %v", st.Err)
+	}
+
+	// a device which has left is not sent UNSUBSCRIBE
+	if sids := p.sids(); len(sids) != 1 || sids[0] != st.SID {
+		t.Errorf("unexpected subscriptions at device %v", sids)
+	}
+
+	alive(3)
+	sid = waitStatus(StateResubscribed).SID
+
+	p.notify(sid, -1, map[string]string{"Status": "0"})
+	select {
+	case e := <-ch:
+		if e.Properties[0].Result.Value != "0" {
+			t.Errorf("unexpected event %+v", e)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("no event received after resubscribe")
+	}
+
+	cancel()
+	waitStatus(StateClosed)
+}
+
+func TestServiceSubscriptionNoServer(t *testing.T) {
+	s := NewServiceSubscriptionWithServer(testUDN, "urn:schemas-upnp-org:service:SwitchPower:1", 1*time.Minute,
+		NewCallbackServer("127.0.0.1:0"))
+	s.notify = make(chan *discovery.NotifyResponse)
+
+	ch := make(chan *Event)
+	if err := s.Run(context.Background(), ch); err == nil {
+		t.Error("expected error with a callback server which is not running")
+	}
+	if _, ok := <-ch; ok {
+		t.Error("expected event channel to be closed")
+	}
+}
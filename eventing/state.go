@@ -0,0 +1,145 @@
+package eventing
+
+import (
+	"github.com/mmmorris1975/go-upnp/description"
+	"sync"
+	"time"
+)
+
+// StateVariableValue is an evented state variable, with the value converted to the Go type for its
+// UPnP data type (see description.StateVariable.ParseValue).  If the value could not be converted, Value
+// holds the raw string and Err describes the problem
+type StateVariableValue struct {
+	Name     string
+	DataType string
+	Raw      string
+	Value    interface{}
+	Err      error
+}
+
+// StateEvent is an event with its state variables decoded using the service description
+type StateEvent struct {
+	SID      string
+	SEQ      int
+	Received time.Time
+	// UDN of the device, and type of the service, sending the event
+	Device    string
+	Service   string
+	Variables []StateVariableValue
+}
+
+// Variable returns the named variable from the event
+func (e *StateEvent) Variable(name string) (StateVariableValue, bool) {
+	for _, v := range e.Variables {
+		if name == v.Name {
+			return v, true
+		}
+	}
+	return StateVariableValue{}, false
+}
+
+// EventDecoder converts events from a service in to StateEvents, using the ServiceStateTable of the
+// service description to decode variable values.  It optionally keeps a snapshot of the current value
+// of every evented variable
+type EventDecoder struct {
+	UDN         string
+	ServiceType string
+	desc        *description.ServiceDescription
+
+	mu      sync.RWMutex
+	track   bool
+	state   map[string]StateVariableValue
+	updated time.Time
+}
+
+func NewEventDecoder(sd *description.ServiceDescription, udn, svcType string) *EventDecoder {
+	return &EventDecoder{UDN: udn, ServiceType: svcType, desc: sd}
+}
+
+// TrackState enables the current state snapshot, updated by each call to Decode()
+func (d *EventDecoder) TrackState() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.track = true
+	if d.state == nil {
+		d.state = make(map[string]StateVariableValue)
+	}
+}
+
+func (d *EventDecoder) Decode(e *Event) *StateEvent {
+	se := &StateEvent{
+		SID:       e.SID,
+		SEQ:       e.SEQ,
+		Received:  e.Received,
+		Device:    d.UDN,
+		Service:   d.ServiceType,
+		Variables: make([]StateVariableValue, 0, len(e.Properties)),
+	}
+
+	for _, p := range e.Properties {
+		se.Variables = append(se.Variables, d.decodeValue(p.Result.XMLName.Local, p.Result.Value))
+	}
+
+	d.mu.Lock()
+	if d.track {
+		for _, v := range se.Variables {
+			d.state[v.Name] = v
+		}
+		d.updated = se.Received
+	}
+	d.mu.Unlock()
+
+	return se
+}
+
+func (d *EventDecoder) decodeValue(name, raw string) StateVariableValue {
+	v := StateVariableValue{Name: name, DataType: "string", Raw: raw, Value: raw}
+
+	var sv *description.StateVariable
+	if d.desc != nil {
+		sv = d.desc.StateVariableByName(name)
+	}
+	if sv == nil {
+		return v
+	}
+
+	v.DataType = sv.DataType
+	if x, err := sv.ParseValue(raw); err != nil {
+		v.Err = err
+	} else {
+		v.Value = x
+	}
+
+	return v
+}
+
+// Run decodes events from in and sends them to out, until in is closed.  Closes out before returning
+func (d *EventDecoder) Run(in <-chan *Event, out chan<- *StateEvent) {
+	defer close(out)
+
+	for e := range in {
+		out <- d.Decode(e)
+	}
+}
+
+// Get returns the current value of the variable, if state tracking is enabled and it has been evented
+func (d *EventDecoder) Get(name string) (StateVariableValue, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	v, ok := d.state[name]
+	return v, ok
+}
+
+// State returns a copy of the current value of all evented variables, and the time of the last update
+func (d *EventDecoder) State() (map[string]StateVariableValue, time.Time) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	s := make(map[string]StateVariableValue, len(d.state))
+	for k, v := range d.state {
+		s[k] = v
+	}
+	return s, d.updated
+}
@@ -0,0 +1,63 @@
+package eventing
+
+import (
+	"encoding/xml"
+	"github.com/mmmorris1975/go-upnp/description"
+	"testing"
+	"time"
+)
+
+const mockSCPD = `<?xml version="1.0"?>
+<scpd xmlns="urn:schemas-upnp-org:service-1-0"><specVersion><major>1</major><minor>1</minor></specVersion>
+<serviceStateTable>
+<stateVariable sendEvents="yes"><name>Status</name><dataType>boolean</dataType></stateVariable>
+<stateVariable sendEvents="yes"><name>LoadLevelStatus</name><dataType>ui1</dataType></stateVariable>
+</serviceStateTable></scpd>`
+
+func newTestEvent(seq int, vars ...string) *Event {
+	e := &Event{EventHeader: EventHeader{SID: "uuid:sid-1", SEQ: seq, Received: time.Now()}}
+	for i := 0; i+1 < len(vars); i += 2 {
+		e.Properties = append(e.Properties, Property{Result: Result{XMLName: xml.Name{Local: vars[i]}, Value: vars[i+1]}})
+	}
+	return e
+}
+
+func TestEventDecoder(t *testing.T) {
+	sd := new(description.ServiceDescription)
+	if err := xml.Unmarshal([]byte(mockSCPD), sd); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewEventDecoder(sd, testUDN, "urn:schemas-upnp-org:service:Dimming:1")
+	d.TrackState()
+
+	se := d.Decode(newTestEvent(0, "Status", "1", "LoadLevelStatus", "75", "Vendor", "x"))
+	if se.SEQ != 0 || se.SID != "uuid:sid-1" || se.Device != testUDN {
+		t.Errorf("unexpected header %+v", se)
+	}
+
+	if v, _ := se.Variable("Status"); v.Value != true {
+		t.Errorf("unexpected Status %+v", v)
+	}
+	if v, _ := se.Variable("LoadLevelStatus"); v.Value != uint8(75) {
+		t.Errorf("unexpected LoadLevelStatus %+v", v)
+	}
+	if v, _ := se.Variable("Vendor"); v.Value != "x" || v.DataType != "string" {
+		t.Errorf("unknown variables should be strings %+v", v)
+	}
+
+	se = d.Decode(newTestEvent(1, "LoadLevelStatus", "300"))
+	if v, _ := se.Variable("LoadLevelStatus"); v.Err == nil || v.Value != "300" {
+		t.Errorf("expected decode error %+v", v)
+	}
+
+	d.Decode(newTestEvent(2, "LoadLevelStatus", "10"))
+	state, _ := d.State()
+	if len(state) != 3 || state["Status"].Value != true || state["LoadLevelStatus"].Value != uint8(10) {
+		t.Errorf("unexpected state %+v", state)
+	}
+
+	if v, ok := d.Get("LoadLevelStatus"); !ok || v.Raw != "10" {
+		t.Errorf("unexpected value %+v", v)
+	}
+}
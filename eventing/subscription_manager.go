@@ -1,15 +1,15 @@
 package eventing
 
 import (
-	"encoding/xml"
+	"context"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"net"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -19,97 +19,441 @@ const (
 	// Devices will provide a default value if subscription duration
 	// exceeds their internal max allowed value
 	// practical limit on duration value is (2^31 - 1)
+
+	// Delay between attempts to replace a lost subscription, doubled after each failure
+	MIN_RETRY_INTERVAL = 1 * time.Second
+	MAX_RETRY_INTERVAL = 5 * time.Minute
+)
+
+// errPreconditionFailed is returned for a renewal when the device no longer knows about our SID
+var errPreconditionFailed = errors.New("SUBSCRIBE request returned HTTP 412")
+
+type SubscriptionState int
+
+const (
+	// The initial subscription request was accepted
+	StateSubscribed SubscriptionState = iota
+	// A renewal request is about to be sent
+	StateRenewing
+	// The renewal request was accepted
+	StateRenewed
+	// A subscription or renewal request failed, the Err field has the reason.  A new subscription
+	// will be attempted, with backoff between failed attempts
+	StateLost
+	// A new subscription was accepted after the previous one was lost
+	StateResubscribed
+	// Events were missed, so the subscription was replaced by a new one. The initial event of
+	// the new subscription, containing all evented variables, follows this state change
+	StateResynchronized
+	// The subscription was cancelled, this is the last status sent before the channel is closed
+	StateClosed
 )
 
+func (s SubscriptionState) String() string {
+	switch s {
+	case StateSubscribed:
+		return "subscribed"
+	case StateRenewing:
+		return "renewing"
+	case StateRenewed:
+		return "renewed"
+	case StateLost:
+		return "lost"
+	case StateResubscribed:
+		return "resubscribed"
+	case StateResynchronized:
+		return "resynchronized"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+type SubscriptionStatus struct {
+	State SubscriptionState
+	SID   string
+	Err   error
+	Time  time.Time
+}
+
 type SubscriptionManager struct {
-	URL      *url.URL
-	SID      string
+	URL *url.URL
+	SID string
+	// Subscription duration granted by the device
 	Lifetime time.Duration
-	listener net.Listener
+	// Limit events to these variables (UPnP 2.0 STATEVAR header), all variables are delivered if empty.
+	// Must be set before calling Run()
+	StateVariables []string
+	// Variables the device agreed to send, from the ACCEPTED-STATEVAR header.  Empty if the device
+	// ignored the STATEVAR header, in which case events are filtered before delivery
+	AcceptedStateVariables []string
+	requested              time.Duration
+	server                 *CallbackServer
+	cb                     *callback
+	mu                     sync.Mutex
+	seq                    seqTracker
+	status                 chan SubscriptionStatus
+	resync                 chan struct{}
+	sidSet                 chan struct{}
+	cancel                 context.CancelFunc
+	done                   chan struct{}
+	closeErr               error
+	gone                   bool
 }
 
+// EventLoop subscribes and delivers the state variables of each event as a map, until the
+// subscription is closed
 func (m *SubscriptionManager) EventLoop(ch chan<- map[string]string) {
-	// start NOTIFY handler to recieve event data in background,
-	// needs to be listening before sending subscription request
 	events := make(chan *Event, 10)
-	go notifyHandler(m.listener, events)
-
-	// start goroutine to do initial subscription request, and
-	// manage resubscription activities
-	go m.manageSubscription()
+	go func() {
+		if err := m.Run(context.Background(), events); err != nil {
+			log.Printf("ERROR - subscription error: %v", err)
+			close(events)
+		}
+	}()
 
 	for e := range events {
-		m := make(map[string]string)
+		v := make(map[string]string)
 		for _, p := range e.Properties {
-			m[p.Result.XMLName.Local] = p.Result.Value
+			v[p.Result.XMLName.Local] = p.Result.Value
 		}
-		ch <- m
+		ch <- v
 	}
 }
 
-func (m *SubscriptionManager) Unsubscribe() error {
-	req, err := http.NewRequest("UNSUBSCRIBE", m.URL.String(), http.NoBody)
-	if err != nil {
-		return err
+// Run subscribes, delivering events to ch, and keeps the subscription alive until ctx is done
+// or Close() is called.  The subscription is cancelled at the device, and ch closed, before
+// returning.  Changes in the state of the subscription are reported on the Status() channel.  If
+// the subscription can not be run an error is returned, and ch is left open
+func (m *SubscriptionManager) Run(ctx context.Context, ch chan<- *Event) error {
+	if !m.server.running() {
+		return fmt.Errorf("callback server is not running")
 	}
 
-	if len(m.SID) > 0 {
-		req.Header.Set("SID", m.SID)
-	} else {
-		// no SID, just return
+	m.mu.Lock()
+	if m.cancel != nil {
+		m.mu.Unlock()
+		return fmt.Errorf("subscription already running")
+	}
+	ctx, m.cancel = context.WithCancel(ctx)
+	m.done = make(chan struct{})
+	m.mu.Unlock()
+	defer close(ch)
+
+	// register with the callback server to recieve event data in background,
+	// needs to be done before sending subscription request
+	events := make(chan *Event, 10)
+	m.cb = m.server.register(func(e *Event) {
+		select {
+		case events <- e:
+		case <-ctx.Done():
+		}
+	})
+
+	loopDone := make(chan struct{})
+	go func() {
+		m.manageSubscription(ctx)
+		close(loopDone)
+	}()
+
+	// events received while (re)subscribing, before the SID of the subscription is known
+	pending := make([]*Event, 0)
+
+	for {
+		select {
+		case <-ctx.Done():
+			<-loopDone
+			m.shutdown()
+			return nil
+		case e := <-events:
+			if len(m.currentSID()) < 1 {
+				if len(pending) < cap(events) {
+					pending = append(pending, e)
+				} else {
+					doLog("dropping event SEQ %d for SID %s received while subscribing", e.SEQ, e.SID)
+				}
+				continue
+			}
+			m.deliver(ctx, e, ch)
+		case <-m.sidSet:
+			for _, e := range pending {
+				m.deliver(ctx, e, ch)
+			}
+			pending = pending[:0]
+		}
+	}
+}
+
+func (m *SubscriptionManager) deliver(ctx context.Context, e *Event, ch chan<- *Event) {
+	if !m.checkSequence(e) || !m.filterEvent(e) {
+		return
+	}
+
+	select {
+	case ch <- e:
+	case <-ctx.Done():
+	}
+}
+
+// filterEvent removes variables not in StateVariables, returns false if none are left
+func (m *SubscriptionManager) filterEvent(e *Event) bool {
+	if len(m.StateVariables) < 1 {
+		return true
+	}
+
+	props := make([]Property, 0, len(e.Properties))
+	for _, p := range e.Properties {
+		for _, n := range m.StateVariables {
+			if p.Result.XMLName.Local == n {
+				props = append(props, p)
+				break
+			}
+		}
+	}
+	e.Properties = props
+
+	return len(props) > 0
+}
+
+// Close stops renewing the subscription and cancels it at the device
+func (m *SubscriptionManager) Close() error {
+	m.mu.Lock()
+	cancel, done := m.cancel, m.done
+	m.mu.Unlock()
+
+	if cancel == nil {
 		return nil
 	}
 
-	c := http.Client{}
-	res, err := c.Do(req)
-	if err != nil {
-		// not http errors
-		return err
+	cancel()
+	<-done
+	return m.closeErr
+}
+
+// abandon makes the subscription end without sending UNSUBSCRIBE, for a device which has left the network
+func (m *SubscriptionManager) abandon() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gone = true
+}
+
+// Unsubscribe is the same as Close()
+func (m *SubscriptionManager) Unsubscribe() error {
+	return m.Close()
+}
+
+func (m *SubscriptionManager) shutdown() {
+	m.server.unregister(m.cb)
+
+	m.mu.Lock()
+	sid := m.SID
+	m.SID = ""
+	m.mu.Unlock()
+
+	m.mu.Lock()
+	gone := m.gone
+	m.mu.Unlock()
+
+	if !gone {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		m.closeErr = m.sendUnsubscribe(ctx, sid)
 	}
-	defer res.Body.Close()
+	m.sendStatus(StateClosed, sid, m.closeErr)
+	close(m.status)
+	close(m.done)
+}
 
-	if res.StatusCode != 200 {
-		return fmt.Errorf("UNSUBSCRIBE request returned HTTP %d", res.StatusCode)
+// Status returns a channel reporting changes in the state of the subscription.  The channel is
+// buffered, and status updates are dropped if it is full.  It is closed after the subscription is
+// cancelled at the device, when Run() returns
+func (m *SubscriptionManager) Status() <-chan SubscriptionStatus {
+	return m.status
+}
+
+func (m *SubscriptionManager) sendStatus(s SubscriptionState, sid string, err error) {
+	select {
+	case m.status <- SubscriptionStatus{State: s, SID: sid, Err: err, Time: time.Now()}:
+	default:
+		doLog("status channel full, dropping %s status for SID %s", s, sid)
+	}
+}
+
+// checkSequence returns false if the event should be dropped.  If events were missed, the event
+// is delivered, but the subscription is replaced to get a fresh initial event
+func (m *SubscriptionManager) checkSequence(e *Event) bool {
+	m.mu.Lock()
+	if len(m.SID) < 1 || e.SID != m.SID {
+		m.mu.Unlock()
+		doLog("dropping event for replaced SID %s", e.SID)
+		return false
+	}
+	r := m.seq.check(uint32(e.SEQ))
+	m.mu.Unlock()
+
+	switch r {
+	case seqStale:
+		doLog("dropping stale or duplicate event SEQ %d for SID %s", e.SEQ, e.SID)
+		return false
+	case seqGap:
+		log.Printf("WARNING - missed events before SEQ %d for SID %s, resubscribing", e.SEQ, e.SID)
+		select {
+		case m.resync <- struct{}{}:
+		default:
+		}
 	}
 
-	return nil
+	return true
+}
+
+func (m *SubscriptionManager) currentSID() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.SID
+}
+
+func (m *SubscriptionManager) clearSID() string {
+	m.mu.Lock()
+	sid := m.SID
+	m.SID = ""
+	m.seq.reset()
+	m.mu.Unlock()
+
+	m.server.setSID(m.cb, "")
+	return sid
+}
+
+// manageSubscription subscribes, and renews the subscription before it expires, until ctx is done.
+// Lost subscriptions are replaced with a new subscription, with backoff between failed attempts
+func (m *SubscriptionManager) manageSubscription(ctx context.Context) {
+	retry := MIN_RETRY_INTERVAL
+	lost := false
+
+	for {
+		if len(m.currentSID()) < 1 {
+			if err := m.subscribe(ctx); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+
+				log.Printf("ERROR - subscription error: %v", err)
+				m.sendStatus(StateLost, "", err)
+				lost = true
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(retry):
+				}
+
+				if retry *= 2; retry > MAX_RETRY_INTERVAL {
+					retry = MAX_RETRY_INTERVAL
+				}
+				continue
+			}
+
+			retry = MIN_RETRY_INTERVAL
+			if lost {
+				m.sendStatus(StateResubscribed, m.currentSID(), nil)
+			} else {
+				m.sendStatus(StateSubscribed, m.currentSID(), nil)
+			}
+			lost = false
+		}
+
+		m.mu.Lock()
+		renew := time.NewTimer(m.Lifetime * 9 / 10)
+		m.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			renew.Stop()
+			return
+		case <-m.resync:
+			renew.Stop()
+			old := m.clearSID()
+			if err := m.sendUnsubscribe(ctx, old); err != nil {
+				doLog("manageSubscription() - UNSUBSCRIBE %s: %v", old, err)
+			}
+
+			err := m.subscribe(ctx)
+			if err != nil {
+				log.Printf("ERROR - resubscribe error: %v", err)
+				lost = true
+			}
+			m.sendStatus(StateResynchronized, m.currentSID(), err)
+		case <-renew.C:
+			sid := m.currentSID()
+			m.sendStatus(StateRenewing, sid, nil)
+			log.Printf("INFO - Renewing subscription for SID %s", sid)
+
+			if err := m.renew(ctx, sid); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+
+				// the device has forgotten us, or we can't reach it. In either case a new subscription
+				// is needed, since the old one will expire before we could retry the renewal
+				log.Printf("ERROR - renewal error for SID %s: %v", sid, err)
+				m.clearSID()
+				m.sendStatus(StateLost, sid, err)
+				lost = true
+
+				if err != errPreconditionFailed {
+					select {
+					case <-ctx.Done():
+						return
+					case <-time.After(retry):
+					}
+				}
+				continue
+			}
+
+			m.sendStatus(StateRenewed, sid, nil)
+		}
+	}
 }
 
-func (m *SubscriptionManager) manageSubscription() error {
-	req, err := m.newSubscriptionRequest()
+func (m *SubscriptionManager) newSubscriptionRequest(ctx context.Context) (*http.Request, error) {
+	req, err := http.NewRequest("SUBSCRIBE", m.URL.String(), http.NoBody)
 	if err != nil {
-		log.Printf("ERROR - Unable to build subscription request: %v", err)
-		return err
+		return nil, err
 	}
+	req = req.WithContext(ctx)
+	req.Header.Set("TIMEOUT", fmt.Sprintf("Second-%d", int(m.requested.Seconds())))
 
-	if len(m.SID) < 1 {
-		req.Header.Set("NT", "upnp:event")
-		req.Header.Set("CALLBACK", fmt.Sprintf("<http://%s/>", m.listener.Addr()))
-	} else {
-		req.Header.Set("SID", m.SID)
+	return req, nil
+}
 
-		renewTime := m.Lifetime.Seconds() * 0.9
-		time.Sleep(time.Duration(renewTime) * time.Second)
-		log.Printf("INFO - Renewing subscription for SID %s", m.SID)
+func (m *SubscriptionManager) subscribe(ctx context.Context) error {
+	req, err := m.newSubscriptionRequest(ctx)
+	if err != nil {
+		return err
 	}
 
-	err = m.doSubscriptionRequest(req)
+	u, err := m.server.callbackURL(m.URL, m.cb.path)
 	if err != nil {
-		log.Printf("ERROR - subscription error: %v", err)
 		return err
 	}
 
-	return m.manageSubscription()
+	req.Header.Set("NT", "upnp:event")
+	req.Header.Set("CALLBACK", fmt.Sprintf("<%s>", u))
+	if len(m.StateVariables) > 0 {
+		req.Header.Set("STATEVAR", strings.Join(m.StateVariables, ","))
+	}
+
+	return m.doSubscriptionRequest(req)
 }
 
-func (m *SubscriptionManager) newSubscriptionRequest() (*http.Request, error) {
-	req, err := http.NewRequest("SUBSCRIBE", m.URL.String(), http.NoBody)
+func (m *SubscriptionManager) renew(ctx context.Context, sid string) error {
+	req, err := m.newSubscriptionRequest(ctx)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	req.Header.Set("TIMEOUT", fmt.Sprintf("Second-%d", int(m.Lifetime.Seconds())))
+	req.Header.Set("SID", sid)
 
-	return req, nil
+	return m.doSubscriptionRequest(req)
 }
 
 func (m *SubscriptionManager) doSubscriptionRequest(req *http.Request) error {
@@ -121,105 +465,141 @@ func (m *SubscriptionManager) doSubscriptionRequest(req *http.Request) error {
 	}
 	defer res.Body.Close()
 
+	if res.StatusCode == http.StatusPreconditionFailed {
+		return errPreconditionFailed
+	}
+
 	if res.StatusCode != 200 {
 		return fmt.Errorf("SUBSCRIBE request returned HTTP %d", res.StatusCode)
 	}
 
-	tmout := -1
-	h := res.Header.Get("TIMEOUT")
-	if len(h) > 0 {
-		t := strings.Split(h, "-")
-		tmout, _ = strconv.Atoi(t[1])
+	sid := res.Header.Get("SID")
+	if len(sid) < 1 {
+		sid = req.Header.Get("SID")
+	}
+	if len(sid) < 1 {
+		return fmt.Errorf("SUBSCRIBE response has no SID")
 	}
 
-	m.SID = res.Header.Get("SID")
-	m.Lifetime = time.Duration(tmout) * time.Second
+	tmout, err := parseTimeout(res.Header.Get("TIMEOUT"))
+	if err != nil {
+		doLog("doSubscriptionRequest() - %v, using requested duration %s", err, m.requested)
+		tmout = m.requested
+	}
+
+	m.mu.Lock()
+	m.SID = sid
+	m.Lifetime = tmout
+	if h := res.Header.Get("ACCEPTED-STATEVAR"); len(h) > 0 {
+		m.AcceptedStateVariables = parseStateVarList(h)
+	}
+	m.mu.Unlock()
+	m.server.setSID(m.cb, sid)
+
+	select {
+	case m.sidSet <- struct{}{}:
+	default:
+	}
 
 	return nil
 }
 
-// FIXME - url may become invalid if device we're subscribing to restarts and the subscription url changes.
-// Change this to the service name we want to subscribe to, and deal with the discovery and url building internally
-// otherwise our subscription loops may crash when it attempts to resubscribe to a dead endpoint
-// Provide ability to filter discovery/description data, in case more than 1 is found?
-// - description.DiscoverDeviceDescription() only returns the 1st discovered device, so either we modify that
-//   behavior, or we just go with it, and assume our service name is targeted enough to find the right one
-func NewSubscriptionManager(url *url.URL, exp time.Duration) (*SubscriptionManager, error) {
-	if exp < MIN_SUBSCRIPTION_DURATION {
-		log.Printf("WARNING - provided subscription duration less than allowed minimum duration (%s), using default of %s",
-			MIN_SUBSCRIPTION_DURATION.String(), DEFAULT_SUBSCRIPTION_DURATION.String())
-		exp = DEFAULT_SUBSCRIPTION_DURATION
+// parseStateVarList parses the comma separated list of a STATEVAR or ACCEPTED-STATEVAR header
+func parseStateVarList(h string) []string {
+	res := make([]string, 0)
+	for _, v := range strings.Split(h, ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			res = append(res, v)
+		}
 	}
+	return res
+}
 
-	l, err := setupListener(url)
-	if err != nil {
-		return nil, err
+// parseTimeout parses a TIMEOUT header value of the form Second-1800.  UPnP 1.0 devices may
+// return Second-infinite, in which case the subscription is still renewed periodically, at
+// the maximum subscription duration
+func parseTimeout(h string) (time.Duration, error) {
+	h = strings.TrimSpace(h)
+	i := strings.Index(h, "-")
+	if i < 0 || !strings.EqualFold(h[:i], "Second") {
+		return 0, fmt.Errorf("invalid TIMEOUT header '%s'", h)
 	}
 
-	s := SubscriptionManager{
-		URL:      url,
-		Lifetime: exp,
-		listener: l,
+	v := h[i+1:]
+	if strings.EqualFold(v, "infinite") {
+		return DEFAULT_SUBSCRIPTION_DURATION, nil
 	}
 
-	return &s, nil
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid TIMEOUT header '%s'", h)
+	}
+
+	d := time.Duration(n) * time.Second
+	if d < MIN_SUBSCRIPTION_DURATION {
+		d = MIN_SUBSCRIPTION_DURATION
+	}
+
+	return d, nil
 }
 
-func setupListener(url *url.URL) (net.Listener, error) {
-	// Determine which local address will be used for the subscription requests
-	c, err := net.Dial("tcp", url.Host)
-	if err != nil {
-		return nil, err
+func (m *SubscriptionManager) sendUnsubscribe(ctx context.Context, sid string) error {
+	if len(sid) < 1 {
+		return nil
 	}
-	defer c.Close()
 
-	h, _, err := net.SplitHostPort(c.LocalAddr().String())
+	req, err := http.NewRequest("UNSUBSCRIBE", m.URL.String(), http.NoBody)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	req = req.WithContext(ctx)
+	req.Header.Set("SID", sid)
 
-	// Instantiate listener on ephemeral port
-	l, err := net.Listen("tcp", fmt.Sprintf("%s:0", h))
+	c := http.Client{}
+	res, err := c.Do(req)
 	if err != nil {
-		return nil, err
+		// not http errors
+		return err
 	}
+	defer res.Body.Close()
 
-	return l, nil
-}
-
-func notifyHandler(l net.Listener, ch chan<- *Event) error {
-	// Always respond with HTTP 200 (even if error, since it's likely a problem on our end)
-	// Simply log any errors and bail out of the request, so we still get future notifications
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
+	if res.StatusCode != 200 {
+		return fmt.Errorf("UNSUBSCRIBE request returned HTTP %d", res.StatusCode)
+	}
 
-		seq, err := strconv.Atoi(r.Header.Get("SEQ"))
-		if err != nil {
-			seq = 0
-		}
+	return nil
+}
 
-		h := EventHeader{
-			NT:  r.Header.Get("NT"),
-			NTS: r.Header.Get("NTS"),
-			SID: r.Header.Get("SID"),
-			SEQ: seq,
+// NewSubscriptionManager creates a subscription for the event URL of a service.  The URL may become
+// invalid if the device restarts, use NewServiceSubscription() to follow a device across restarts
+func NewSubscriptionManager(url *url.URL, exp time.Duration) (*SubscriptionManager, error) {
+	if !DefaultCallbackServer.running() {
+		if err := DefaultCallbackServer.Start(); err != nil {
+			return nil, err
 		}
+	}
 
-		b, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			log.Printf("ERROR - Failed to read notification body: %v", err)
-			return
-		}
+	return NewSubscriptionManagerWithServer(url, exp, DefaultCallbackServer)
+}
 
-		d := EventData{}
-		if err = xml.Unmarshal(b, &d); err != nil {
-			log.Printf("ERROR - Unmarshal(): %v", err)
-			return
-		}
+// NewSubscriptionManagerWithServer creates a subscription which receives events via the provided
+// callback server, which must be started (or advertised) before calling Run() or EventLoop()
+func NewSubscriptionManagerWithServer(url *url.URL, exp time.Duration, srv *CallbackServer) (*SubscriptionManager, error) {
+	if exp < MIN_SUBSCRIPTION_DURATION {
+		log.Printf("WARNING - provided subscription duration less than allowed minimum duration (%s), using default of %s",
+			MIN_SUBSCRIPTION_DURATION.String(), DEFAULT_SUBSCRIPTION_DURATION.String())
+		exp = DEFAULT_SUBSCRIPTION_DURATION
+	}
 
-		e := Event{EventHeader: h, EventData: d}
-		ch <- &e
-	})
+	s := SubscriptionManager{
+		URL:       url,
+		Lifetime:  exp,
+		requested: exp,
+		server:    srv,
+		status:    make(chan SubscriptionStatus, 10),
+		resync:    make(chan struct{}, 1),
+		sidSet:    make(chan struct{}, 1),
+	}
 
-	return http.Serve(l, nil)
+	return &s, nil
 }
@@ -0,0 +1,255 @@
+package eventing
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func newTestSubscription(t *testing.T, p *mockPublisher, exp time.Duration) (*SubscriptionManager, func()) {
+	dev := httptest.NewServer(p)
+	u, _ := url.Parse(dev.URL)
+
+	srv := NewCallbackServer("127.0.0.1:0")
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewSubscriptionManagerWithServer(u, exp, srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return m, func() {
+		srv.Close()
+		dev.Close()
+	}
+}
+
+// waitForState reads status updates until the given state is seen
+func waitForState(t *testing.T, m *SubscriptionManager, state SubscriptionState) SubscriptionStatus {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case s, ok := <-m.Status():
+			if !ok {
+				t.Fatalf("status channel closed waiting for %s", state)
+			}
+			if s.State == state {
+				return s
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s status", state)
+		}
+	}
+}
+
+func TestSequenceGap(t *testing.T) {
+	p := newMockPublisher()
+	m, done := newTestSubscription(t, p, 1*time.Minute)
+	defer done()
+
+	ch := make(chan map[string]string, 10)
+	go m.EventLoop(ch)
+	defer m.Close()
+	sid := waitForState(t, m, StateSubscribed).SID
+
+	recv := func() string {
+		select {
+		case e := <-ch:
+			return e["V"]
+		case <-time.After(1 * time.Second):
+			return ""
+		}
+	}
+
+	p.notify(sid, 0, map[string]string{"V": "initial"})
+	p.notify(sid, 1, map[string]string{"V": "one"})
+	p.notify(sid, 1, map[string]string{"V": "duplicate"})
+	p.notify(sid, 3, map[string]string{"V": "three"})
+
+	for _, want := range []string{"initial", "one", "three"} {
+		if v := recv(); v != want {
+			t.Fatalf("expected event %s, got '%s'", want, v)
+		}
+	}
+
+	s := waitForState(t, m, StateResynchronized)
+	if s.Err != nil || s.SID == sid || len(s.SID) < 1 {
+		t.Errorf("unexpected status %+v", s)
+	}
+
+	// old subscription must be cancelled, and events for the new SID delivered
+	if sids := p.sids(); len(sids) != 1 || sids[0] != m.currentSID() {
+		t.Errorf("unexpected subscriptions at device %v", sids)
+	}
+
+	p.notify(m.currentSID(), -1, map[string]string{"V": "new initial"})
+	if v := recv(); v != "new initial" {
+		t.Errorf("expected new initial event, got '%s'", v)
+	}
+}
+
+func TestEventsBeforeSID(t *testing.T) {
+	p := newMockPublisher()
+	p.early = []earlyEvent{{sid: "uuid:stale", seq: 7, v: "stale"}, {seq: 0, v: "initial"}}
+	m, done := newTestSubscription(t, p, 1*time.Minute)
+	defer done()
+
+	ch := make(chan map[string]string, 10)
+	go m.EventLoop(ch)
+	defer m.Close()
+
+	select {
+	case e := <-ch:
+		if e["V"] != "initial" {
+			t.Fatalf("expected initial event, got '%s'", e["V"])
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("initial event sent before the SUBSCRIBE response was not delivered")
+	}
+
+	// the stale event must not have reset the sequence, so SEQ 1 follows the initial event
+	p.notify(m.currentSID(), 1, map[string]string{"V": "one"})
+	select {
+	case e := <-ch:
+		if e["V"] != "one" {
+			t.Errorf("expected event one, got '%s'", e["V"])
+		}
+	case <-time.After(1 * time.Second):
+		t.Error("event one not delivered")
+	}
+
+	select {
+	case s := <-m.Status():
+		if s.State == StateResynchronized {
+			t.Errorf("unexpected resync %+v", s)
+		}
+	default:
+	}
+}
+
+func TestSubscriptionLifecycle(t *testing.T) {
+	p := newMockPublisher()
+	m, done := newTestSubscription(t, p, 1*time.Second)
+	defer done()
+
+	ch := make(chan *Event, 10)
+	errs := make(chan error, 1)
+	go func() { errs <- m.Run(context.Background(), ch) }()
+
+	sid := waitForState(t, m, StateSubscribed).SID
+
+	// a second Run fails without closing its channel, or the running subscription's
+	other := make(chan *Event)
+	if err := m.Run(context.Background(), other); err == nil {
+		t.Error("expected error running the subscription twice")
+	}
+	select {
+	case <-other:
+		t.Error("channel closed by a failed Run")
+	default:
+	}
+
+	m.mu.Lock()
+	if m.Lifetime != 1*time.Second {
+		t.Errorf("unexpected lifetime %s", m.Lifetime)
+	}
+	m.mu.Unlock()
+
+	// renewal after 90% of the 1 second lifetime
+	waitForState(t, m, StateRenewing)
+	if s := waitForState(t, m, StateRenewed); s.SID != sid {
+		t.Errorf("renewed SID changed from %s to %s", sid, s.SID)
+	}
+
+	// device forgets the subscription, renewal gets HTTP 412, and we must subscribe again
+	p.mu.Lock()
+	delete(p.callbacks, sid)
+	p.mu.Unlock()
+
+	if s := waitForState(t, m, StateLost); s.Err != errPreconditionFailed {
+		t.Errorf("expected precondition failed error, got %v", s.Err)
+	}
+	s := waitForState(t, m, StateResubscribed)
+	if s.SID == sid || len(s.SID) < 1 {
+		t.Errorf("unexpected resubscribed SID %s", s.SID)
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, m, StateClosed)
+
+	if err := <-errs; err != nil {
+		t.Errorf("unexpected Run error %v", err)
+	}
+	if _, ok := <-ch; ok {
+		t.Error("event channel not closed")
+	}
+	if len(p.sids()) != 0 {
+		t.Errorf("subscription not cancelled at device: %v", p.sids())
+	}
+}
+
+func TestParseTimeout(t *testing.T) {
+	tests := []struct {
+		h    string
+		want time.Duration
+		err  bool
+	}{
+		{"Second-1800", 30 * time.Minute, false},
+		{"second-300", 5 * time.Minute, false},
+		{"Second-infinite", DEFAULT_SUBSCRIPTION_DURATION, false},
+		{"1800", 0, true},
+		{"Second-", 0, true},
+		{"", 0, true},
+	}
+
+	for _, tc := range tests {
+		d, err := parseTimeout(tc.h)
+		if (err != nil) != tc.err || d != tc.want {
+			t.Errorf("%q: got %s, %v", tc.h, d, err)
+		}
+	}
+}
+
+func TestStateVariables(t *testing.T) {
+	if v := parseStateVarList(" Status, LoadLevelStatus ,,"); len(v) != 2 || v[1] != "LoadLevelStatus" {
+		t.Errorf("unexpected STATEVAR list %v", v)
+	}
+
+	// the mock device ignores STATEVAR, so events are filtered by the client
+	p := newMockPublisher()
+	m, done := newTestSubscription(t, p, 1*time.Minute)
+	defer done()
+	m.StateVariables = []string{"Status"}
+
+	ch := make(chan *Event, 10)
+	go m.Run(context.Background(), ch)
+	defer m.Close()
+	sid := waitForState(t, m, StateSubscribed).SID
+
+	p.notify(sid, 0, map[string]string{"Status": "1", "Other": "x"})
+	p.notify(sid, 1, map[string]string{"Other": "y"})
+	p.notify(sid, 2, map[string]string{"Status": "0"})
+
+	for _, want := range []string{"1", "0"} {
+		select {
+		case e := <-ch:
+			if len(e.Properties) != 1 || e.Properties[0].Result.Value != want {
+				t.Errorf("expected only Status %s, got %+v", want, e.Properties)
+			}
+		case <-time.After(1 * time.Second):
+			t.Fatal("timed out waiting for event")
+		}
+	}
+
+	m.mu.Lock()
+	if len(m.AcceptedStateVariables) != 0 {
+		t.Errorf("unexpected accepted variables %v", m.AcceptedStateVariables)
+	}
+	m.mu.Unlock()
+}
@@ -1,15 +1,42 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"github.com/mmmorris1975/go-upnp/eventing"
 	"log"
+	"net"
 )
 
 func main() {
-	ch := make(chan *eventing.Event, 10)
-	go eventing.ListenMulticastEvents(ch)
+	ifname := flag.String("interface", "", "Network interface to listen on")
+	usn := flag.String("usn", "", "Only show events from this USN or device UDN")
+	lvl := flag.String("level", "", "Only show events of this level or more severe (ex. upnp:/alert)")
+	flag.Parse()
+
+	l := eventing.NewMulticastListener()
+	l.USN = *usn
+	l.Level = *lvl
+
+	if len(*ifname) > 0 {
+		i, err := net.InterfaceByName(*ifname)
+		if err != nil {
+			log.Fatalf("%+v", err)
+		}
+		l.Interface = i
+	}
+
+	ch := make(chan *eventing.MulticastEvent, 10)
+	go func() {
+		if err := l.Listen(context.Background(), ch); err != nil {
+			log.Fatalf("%+v", err)
+		}
+	}()
 
 	for e := range ch {
-		log.Printf("EVENT: %v", e)
+		if e.Missed > 0 {
+			log.Printf("MISSED %d events from %s %s", e.Missed, e.USN, e.SVCID)
+		}
+		log.Printf("EVENT: %v", e.Event)
 	}
 }
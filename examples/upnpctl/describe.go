@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"github.com/mmmorris1975/go-upnp/inventory"
+	"io"
+	"os"
+	"strings"
+)
+
+func describe(args []string) error {
+	fs := newFlagSet("describe", "")
+	d := addDeviceFlags(fs, "upnp:rootdevice")
+	scpd := fs.Bool("scpd", false, "Include the actions and state variables of each service")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return usageErrorf("unexpected arguments %v", fs.Args())
+	}
+
+	dd, err := d.device()
+	if err != nil {
+		return err
+	}
+
+	r := inventory.NewRootDevice(dd, nil)
+	if *scpd {
+		if r, err = inventory.Describe(dd.Location(), d.timeout); err != nil {
+			return err
+		}
+	}
+
+	if d.jsonOut {
+		return writeJSON(os.Stdout, r)
+	}
+
+	printDevice(os.Stdout, &r.Device, "")
+	return nil
+}
+
+func printDevice(w io.Writer, v *inventory.Device, indent string) {
+	fmt.Fprintf(w, "%s%s \"%s\" %s\n", indent, v.DeviceType, v.FriendlyName, v.UDN)
+	if len(v.Manufacturer) > 0 || len(v.ModelName) > 0 {
+		fmt.Fprintf(w, "%s  %s %s\n", indent, v.Manufacturer, v.ModelName)
+	}
+
+	for _, s := range v.Services {
+		fmt.Fprintf(w, "%s  service %s (%s)\n", indent, s.ServiceType, s.ServiceId)
+		if len(s.Error) > 0 {
+			fmt.Fprintf(w, "%s    error %s\n", indent, s.Error)
+		}
+
+		for _, a := range s.Actions {
+			fmt.Fprintf(w, "%s    action %s(%s)", indent, a.Name, formatArgs(&s, a.Arguments, "in"))
+			if out := formatArgs(&s, a.Arguments, "out"); len(out) > 0 {
+				fmt.Fprintf(w, " -> (%s)", out)
+			}
+			fmt.Fprintln(w)
+		}
+
+		for _, sv := range s.StateVariables {
+			fmt.Fprintf(w, "%s    variable %s %s", indent, sv.Name, sv.DataType)
+			if len(sv.AllowedValues) > 0 {
+				fmt.Fprintf(w, " {%s}", strings.Join(sv.AllowedValues, ","))
+			}
+			if r := sv.AllowedValueRange; r != nil {
+				fmt.Fprintf(w, " [%s..%s]", r.Minimum, r.Maximum)
+			}
+			if sv.SendEvents {
+				fmt.Fprint(w, " evented")
+			}
+			fmt.Fprintln(w)
+		}
+	}
+
+	for i := range v.Devices {
+		printDevice(w, &v.Devices[i], indent+"  ")
+	}
+}
+
+func formatArgs(s *inventory.Service, args []inventory.Argument, dir string) string {
+	res := make([]string, 0, len(args))
+	for _, a := range args {
+		if a.Direction != dir {
+			continue
+		}
+
+		t := "?"
+		for _, sv := range s.StateVariables {
+			if sv.Name == a.RelatedStateVariable {
+				t = sv.DataType
+			}
+		}
+		res = append(res, a.Name+" "+t)
+	}
+	return strings.Join(res, ", ")
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+type discoverResult struct {
+	USN      string `json:"usn"`
+	Target   string `json:"st"`
+	Location string `json:"location"`
+	Server   string `json:"server,omitempty"`
+	BootId   int    `json:"bootId,omitempty"`
+	ConfigId int    `json:"configId,omitempty"`
+}
+
+func discover(args []string) error {
+	fs := newFlagSet("discover", "")
+	d := addSearchFlags(fs, "ssdp:all")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return usageErrorf("unexpected arguments %v", fs.Args())
+	}
+
+	ifi, err := d.iface()
+	if err != nil {
+		return err
+	}
+
+	res := make([]discoverResult, 0)
+	for _, r := range search(d.target, ifi, d.timeout) {
+		res = append(res, discoverResult{USN: r.USN, Target: r.ST, Location: r.Location, Server: r.Server,
+			BootId: r.BootId, ConfigId: r.ConfigId})
+	}
+
+	if d.jsonOut {
+		if err := writeJSON(os.Stdout, res); err != nil {
+			return err
+		}
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "USN\tST\tLOCATION\tSERVER")
+		for _, r := range res {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.USN, r.Target, r.Location, r.Server)
+		}
+		w.Flush()
+	}
+
+	if len(res) < 1 {
+		return notFoundErrorf("no devices responded to %s within %s", d.target, d.timeout.Round(time.Millisecond))
+	}
+	return nil
+}
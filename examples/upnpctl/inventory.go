@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/mmmorris1975/go-upnp/discovery"
+	"github.com/mmmorris1975/go-upnp/inventory"
+	"os"
+)
+
+func snapshot(args []string) error {
+	fs := newFlagSet("inventory", "")
+	d := addSearchFlags(fs, "ssdp:all")
+	diff := fs.String("diff", "", "Print the changes since this previous inventory (JSON file) instead of the inventory")
+	yamlOut := fs.Bool("yaml", false, "Print YAML instead of JSON")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return usageErrorf("unexpected arguments %v", fs.Args())
+	}
+
+	var old *inventory.Inventory
+	if len(*diff) > 0 {
+		b, err := os.ReadFile(*diff)
+		if err != nil {
+			return err
+		}
+
+		old = new(inventory.Inventory)
+		if err := json.Unmarshal(b, old); err != nil {
+			return fmt.Errorf("%s: %v", *diff, err)
+		}
+	}
+
+	ifi, err := d.iface()
+	if err != nil {
+		return err
+	}
+
+	req := discovery.NewSearchRequest()
+	req.Target = d.target
+	req.Wait = d.timeout
+	req.Interface = ifi
+
+	inv, err := inventory.Snapshot(req)
+	if err != nil {
+		return err
+	}
+
+	write := func(v interface{}) error {
+		if *yamlOut {
+			return inventory.WriteYAML(os.Stdout, v)
+		}
+		return writeJSON(os.Stdout, v)
+	}
+
+	if old == nil {
+		return write(inv)
+	}
+
+	changes := inventory.Diff(old, inv)
+	if d.jsonOut || *yamlOut {
+		return write(changes)
+	}
+
+	for _, c := range changes {
+		loc := ""
+		if c.New != nil {
+			loc = c.New.Location
+		} else if c.Old != nil {
+			loc = c.Old.Location
+		}
+		fmt.Printf("%-8s %s %s\n", c.Type, c.UDN, loc)
+	}
+	return nil
+}
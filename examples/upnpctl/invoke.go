@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"github.com/mmmorris1975/go-upnp/control"
+	"github.com/mmmorris1975/go-upnp/description"
+	"os"
+	"strings"
+)
+
+// actionResult receives the out arguments of any action
+type actionResult struct {
+	Args []struct {
+		XMLName xml.Name
+		Value   string `xml:",chardata"`
+	} `xml:",any"`
+}
+
+// actionArgs checks the name=value arguments against the in arguments of the action, returning them in
+// the order of the action description
+func actionArgs(sd *description.ServiceDescription, a *description.Action, args []string) ([]control.Arg, error) {
+	vals := make(map[string]string)
+	for _, e := range args {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 || len(kv[0]) < 1 {
+			return nil, usageErrorf("invalid argument %s, expecting name=value", e)
+		}
+		vals[kv[0]] = kv[1]
+	}
+
+	res := make([]control.Arg, 0)
+	for _, in := range a.Arguments("in") {
+		v, ok := vals[in.Name]
+		if !ok {
+			return nil, usageErrorf("missing argument %s", in.Name)
+		}
+		delete(vals, in.Name)
+
+		if sv := sd.StateVariableByName(in.RelatedStateVariable); sv != nil {
+			if err := sv.Validate(v); err != nil {
+				return nil, usageErrorf("argument %s: %v", in.Name, err)
+			}
+		}
+		res = append(res, control.NewArg(in.Name, v))
+	}
+
+	for k := range vals {
+		return nil, usageErrorf("%s has no argument %s", a.Name, k)
+	}
+
+	return res, nil
+}
+
+func invoke(args []string) error {
+	fs := newFlagSet("invoke", "[name=value ...]")
+	d := addDeviceFlags(fs, "")
+	svc := fs.String("service", "", "Service type, short name (ex. AVTransport) or service ID")
+	action := fs.String("action", "", "Action name")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if len(*action) < 1 {
+		return usageErrorf("-action is required")
+	}
+
+	dd, err := d.device()
+	if err != nil {
+		return err
+	}
+
+	s, sd, err := findService(dd, *svc, d.timeout)
+	if err != nil {
+		return err
+	}
+
+	a := sd.ActionByName(*action)
+	if a == nil {
+		return notFoundErrorf("service %s has no action %s", s.ServiceType, *action)
+	}
+
+	in, err := actionArgs(sd, a, fs.Args())
+	if err != nil {
+		return err
+	}
+
+	r := new(actionResult)
+	e := control.NewExecutor(dd, 1, d.timeout)
+	if err := e.Call(context.Background(), s.ServiceType, a.Name, in, r); err != nil {
+		return err
+	}
+
+	out := make(map[string]string)
+	for _, v := range r.Args {
+		out[v.XMLName.Local] = v.Value
+	}
+
+	if d.jsonOut {
+		return writeJSON(os.Stdout, out)
+	}
+
+	// print in the order of the action description, then anything else the device returned
+	for _, o := range a.Arguments("out") {
+		if v, ok := out[o.Name]; ok {
+			fmt.Printf("%s=%s\n", o.Name, v)
+			delete(out, o.Name)
+		}
+	}
+	for _, v := range r.Args {
+		if _, ok := out[v.XMLName.Local]; ok {
+			fmt.Printf("%s=%s\n", v.XMLName.Local, v.Value)
+		}
+	}
+
+	return nil
+}
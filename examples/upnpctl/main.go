@@ -0,0 +1,299 @@
+// upnpctl is a command line tool to discover, describe and control UPnP devices
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/mmmorris1975/go-upnp/control"
+	"github.com/mmmorris1975/go-upnp/description"
+	"github.com/mmmorris1975/go-upnp/discovery"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Exit codes, for use in scripts
+const (
+	EXIT_OK = 0
+	// Request failed, or other runtime error
+	EXIT_ERROR = 1
+	// Invalid command line, or action arguments which don't match the SCPD
+	EXIT_USAGE = 2
+	// No device, service or action matched
+	EXIT_NOT_FOUND = 3
+	// The device returned a SOAP fault
+	EXIT_FAULT = 4
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands = []command{
+	{"discover", "search for devices", discover},
+	{"describe", "show the device tree, and optionally the SCPD of each service", describe},
+	{"invoke", "call an action, with name=value arguments", invoke},
+	{"subscribe", "subscribe to a service and print its events", subscribe},
+	{"monitor", "print SSDP NOTIFY messages", monitor},
+	{"inventory", "describe every device found as JSON, or the changes since a previous inventory", snapshot},
+}
+
+// exitError carries the exit code for an error
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// errFlags is returned for invalid flags, which the flag package has already reported with the usage
+var errFlags = usageErrorf("invalid flags")
+
+func usageErrorf(format string, v ...interface{}) error {
+	return &exitError{EXIT_USAGE, fmt.Errorf(format, v...)}
+}
+
+func notFoundErrorf(format string, v ...interface{}) error {
+	return &exitError{EXIT_NOT_FOUND, fmt.Errorf(format, v...)}
+}
+
+func exitCode(err error) int {
+	var e *exitError
+	switch {
+	case err == nil:
+		return EXIT_OK
+	case errors.As(err, &e):
+		return e.code
+	case control.IsFault(err):
+		return EXIT_FAULT
+	case err == flag.ErrHelp:
+		return EXIT_OK
+	}
+	return EXIT_ERROR
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s <command> [flags]\n\ncommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.name, c.usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nrun '%s <command> -h' for the flags of a command\n", os.Args[0])
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(EXIT_USAGE)
+	}
+
+	for _, c := range commands {
+		if c.name == os.Args[1] {
+			err := c.run(os.Args[2:])
+			if err != nil && err != flag.ErrHelp && err != errFlags {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", c.name, err)
+			}
+			os.Exit(exitCode(err))
+		}
+	}
+
+	usage()
+	os.Exit(EXIT_USAGE)
+}
+
+// parseFlags parses the flags of a command, invalid flags are a usage error
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	err := fs.Parse(args)
+	if err != nil && err != flag.ErrHelp {
+		return errFlags
+	}
+	return err
+}
+
+func newFlagSet(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s %s [flags] %s\n", os.Args[0], name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// searchFlags select the devices to search for
+type searchFlags struct {
+	target  string
+	ifname  string
+	timeout time.Duration
+	jsonOut bool
+}
+
+func addSearchFlags(fs *flag.FlagSet, target string) *searchFlags {
+	d := new(searchFlags)
+	fs.StringVar(&d.target, "target", target, "Search target (UDN, device or service type)")
+	fs.StringVar(&d.ifname, "interface", "", "Network interface to search from")
+	fs.DurationVar(&d.timeout, "timeout", 3*time.Second, "Search and request timeout")
+	fs.BoolVar(&d.jsonOut, "json", false, "Output JSON")
+	return d
+}
+
+// deviceFlags selects a device by description URL, or by search target
+type deviceFlags struct {
+	searchFlags
+	location string
+}
+
+func addDeviceFlags(fs *flag.FlagSet, target string) *deviceFlags {
+	d := new(deviceFlags)
+	fs.StringVar(&d.location, "location", "", "URL of the device description")
+	fs.StringVar(&d.target, "target", target, "Search target (UDN, device or service type) to find the device, if -location is not set")
+	fs.StringVar(&d.ifname, "interface", "", "Network interface to search from")
+	fs.DurationVar(&d.timeout, "timeout", 3*time.Second, "Search and request timeout")
+	fs.BoolVar(&d.jsonOut, "json", false, "Output JSON")
+	return d
+}
+
+func (d *searchFlags) iface() (*net.Interface, error) {
+	if len(d.ifname) < 1 {
+		return nil, nil
+	}
+
+	i, err := net.InterfaceByName(d.ifname)
+	if err != nil {
+		return nil, usageErrorf("%v", err)
+	}
+	return i, nil
+}
+
+// search sends an M-SEARCH, returning the unique responses
+func search(target string, ifi *net.Interface, wait time.Duration) []*discovery.SearchResponse {
+	req := discovery.NewSearchRequest()
+	req.Target = target
+	req.Wait = wait
+	req.Interface = ifi
+
+	ch := make(chan *discovery.SearchResponse, 10)
+	discovery.Discover(req, ch)
+
+	seen := make(map[string]bool)
+	res := make([]*discovery.SearchResponse, 0)
+	for r := range ch {
+		k := r.USN + " " + r.Location
+		if !seen[k] {
+			seen[k] = true
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+// device returns the description of the selected device
+func (d *deviceFlags) device() (*description.DeviceDescription, error) {
+	loc := d.location
+	if len(loc) < 1 {
+		if len(d.target) < 1 {
+			return nil, usageErrorf("one of -location or -target is required")
+		}
+
+		ifi, err := d.iface()
+		if err != nil {
+			return nil, err
+		}
+
+		r := search(d.target, ifi, d.timeout)
+		if len(r) < 1 {
+			return nil, notFoundErrorf("no device found for %s", d.target)
+		}
+		loc = r[0].Location
+	}
+
+	return description.DescribeDevice(loc, d.timeout)
+}
+
+// matchService returns true if name is the service type, the service type without version, its short
+// name (ex. AVTransport), or the service ID
+func matchService(s *description.Service, name string) bool {
+	if name == s.ServiceType || name == s.ServiceId {
+		return true
+	}
+
+	p := strings.Split(s.ServiceType, ":")
+	if len(p) >= 5 {
+		return name == p[3] || name == strings.Join(p[:4], ":")
+	}
+	return false
+}
+
+// findService returns the first service in the device tree matching name, and its description
+func findService(dd *description.DeviceDescription, name string, wait time.Duration) (*description.Service, *description.ServiceDescription, error) {
+	if len(name) < 1 {
+		return nil, nil, usageErrorf("-service is required")
+	}
+
+	var found *description.Service
+	var walk func(d *description.Device)
+	walk = func(d *description.Device) {
+		for i := range d.ServiceList {
+			if found == nil && matchService(&d.ServiceList[i], name) {
+				found = &d.ServiceList[i]
+			}
+		}
+		for i := range d.DeviceList {
+			walk(&d.DeviceList[i])
+		}
+	}
+	walk(&dd.Device)
+
+	if found == nil {
+		return nil, nil, notFoundErrorf("device %s has no service %s", dd.Device.UDN, name)
+	}
+
+	u, err := dd.BuildURL(found.SCPDURL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sd, err := description.DescribeService(u.String(), wait)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return found, sd, nil
+}
+
+// runContext is done on SIGINT or SIGTERM, or after d if > 0
+func runContext(d time.Duration) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	if d <= 0 {
+		return ctx, stop
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d)
+	return ctx, func() {
+		cancel()
+		stop()
+	}
+}
+
+func writeJSONLine(w io.Writer, v interface{}) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	return e.Encode(v)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"github.com/mmmorris1975/go-upnp/discovery"
+	"os"
+	"strings"
+	"time"
+)
+
+type notifyView struct {
+	Time     time.Time `json:"time"`
+	NTS      string    `json:"nts"`
+	NT       string    `json:"nt"`
+	USN      string    `json:"usn"`
+	Location string    `json:"location,omitempty"`
+	Server   string    `json:"server,omitempty"`
+	BootId   int       `json:"bootId,omitempty"`
+}
+
+func monitor(args []string) error {
+	fs := newFlagSet("monitor", "")
+	usn := fs.String("usn", "", "Only show notifications with a USN starting with this (ex. a device UDN)")
+	nts := fs.String("nts", "", "Only show notifications of this type (ssdp:alive, ssdp:byebye, ssdp:update)")
+	duration := fs.Duration("duration", 0, "Stop after this long, 0 runs until interrupted")
+	jsonOut := fs.Bool("json", false, "Output JSON, one object per line")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return usageErrorf("unexpected arguments %v", fs.Args())
+	}
+
+	ctx, cancel := runContext(*duration)
+	defer cancel()
+
+	ch := make(chan *discovery.NotifyResponse, 10)
+	errs := make(chan error, 1)
+	go func() { errs <- discovery.ListenNotifyContext(ctx, ch) }()
+
+	for n := range ch {
+		if !strings.HasPrefix(n.USN, *usn) || (len(*nts) > 0 && n.NTS != *nts) {
+			continue
+		}
+
+		v := notifyView{Time: time.Now(), NTS: n.NTS, NT: n.NT, USN: n.USN, Location: n.Location, Server: n.Server,
+			BootId: n.BootId}
+		if *jsonOut {
+			// single line, so the output can be processed line by line
+			if err := writeJSONLine(os.Stdout, v); err != nil {
+				return err
+			}
+			continue
+		}
+
+		fmt.Printf("%s %-12s %s %s %s\n", v.Time.Format(time.RFC3339), v.NTS, v.USN, v.NT, v.Location)
+	}
+
+	return <-errs
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"github.com/mmmorris1975/go-upnp/eventing"
+	"os"
+	"time"
+)
+
+type eventView struct {
+	SID       string                 `json:"sid"`
+	SEQ       int                    `json:"seq"`
+	Received  time.Time              `json:"received"`
+	Variables map[string]interface{} `json:"variables"`
+}
+
+func subscribe(args []string) error {
+	fs := newFlagSet("subscribe", "")
+	d := addDeviceFlags(fs, "")
+	svc := fs.String("service", "", "Service type, short name (ex. AVTransport) or service ID")
+	duration := fs.Duration("duration", 0, "Stop after this long, 0 runs until interrupted")
+	lifetime := fs.Duration("lifetime", eventing.DEFAULT_SUBSCRIPTION_DURATION, "Requested subscription lifetime")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return usageErrorf("unexpected arguments %v", fs.Args())
+	}
+
+	dd, err := d.device()
+	if err != nil {
+		return err
+	}
+
+	s, sd, err := findService(dd, *svc, d.timeout)
+	if err != nil {
+		return err
+	}
+
+	u, err := dd.BuildURL(s.EventSubURL)
+	if err != nil {
+		return err
+	}
+
+	m, err := eventing.NewSubscriptionManager(u, *lifetime)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := runContext(*duration)
+	defer cancel()
+
+	events := make(chan *eventing.Event, 10)
+	errs := make(chan error, 1)
+	go func() { errs <- m.Run(ctx, events) }()
+
+	go func() {
+		for st := range m.Status() {
+			if st.Err != nil {
+				fmt.Fprintf(os.Stderr, "%s %s: %v\n", st.Time.Format(time.RFC3339), st.State, st.Err)
+			} else {
+				fmt.Fprintf(os.Stderr, "%s %s %s\n", st.Time.Format(time.RFC3339), st.State, st.SID)
+			}
+		}
+	}()
+
+	dec := eventing.NewEventDecoder(sd, dd.Device.UDN, s.ServiceType)
+	for e := range events {
+		se := dec.Decode(e)
+
+		if d.jsonOut {
+			v := eventView{SID: se.SID, SEQ: se.SEQ, Received: se.Received, Variables: make(map[string]interface{})}
+			for _, sv := range se.Variables {
+				v.Variables[sv.Name] = sv.Value
+			}
+			if err := writeJSON(os.Stdout, v); err != nil {
+				return err
+			}
+			continue
+		}
+
+		for _, sv := range se.Variables {
+			fmt.Printf("%s %d %s=%v\n", se.Received.Format(time.RFC3339), se.SEQ, sv.Name, sv.Value)
+		}
+	}
+
+	return <-errs
+}
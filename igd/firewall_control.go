@@ -0,0 +1,368 @@
+package igd
+
+import (
+	"context"
+	"fmt"
+	"github.com/mmmorris1975/go-upnp/control"
+	"github.com/mmmorris1975/go-upnp/description"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	WAN_IPV6_FIREWALL_CONTROL_1 = "urn:schemas-upnp-org:service:WANIPv6FirewallControl:1"
+
+	// Lease time limits of a pinhole
+	DEFAULT_PINHOLE_LEASE = 1 * time.Hour
+	MAX_PINHOLE_LEASE     = 24 * time.Hour
+	// First retry after a failed update of a pinhole lease, doubled after each failure
+	PINHOLE_RETRY_INTERVAL = 10 * time.Second
+
+	// IANA protocol number for any protocol
+	PROTOCOL_ANY = 65535
+)
+
+// WANIPv6FirewallControl error codes
+const (
+	ERR_PINHOLE_SPACE_EXHAUSTED               = 701
+	ERR_FIREWALL_DISABLED                     = 702
+	ERR_INBOUND_PINHOLE_NOT_ALLOWED           = 703
+	ERR_NO_SUCH_ENTRY                         = 704
+	ERR_PROTOCOL_NOT_SUPPORTED                = 705
+	ERR_INTERNAL_PORT_WILDCARDING_NOT_ALLOWED = 706
+	ERR_PROTOCOL_WILDCARDING_NOT_ALLOWED      = 707
+	ERR_INVALID_LAYER2_ADDRESS                = 708
+	ERR_NO_TRAFFIC_RECEIVED                   = 709
+)
+
+// Pinhole is an inbound IPv6 firewall rule
+type Pinhole struct {
+	// Empty string is a wildcard, matching any remote host
+	RemoteHost string
+	// Zero is a wildcard, matching any port
+	RemotePort uint16
+	// IPv6 address of the host receiving the traffic, required
+	InternalClient string
+	// Zero is a wildcard, matching any port
+	InternalPort uint16
+	// TCP, UDP, an IANA protocol number, or empty for any protocol
+	Protocol string
+	// Defaults to DEFAULT_PINHOLE_LEASE, and is limited to MAX_PINHOLE_LEASE
+	LeaseTime time.Duration
+}
+
+// FirewallControl is a client for the WANIPv6FirewallControl service of an IGDv2 gateway.  Pinholes
+// added with Open() are kept open until closed, or until Close() is called
+type FirewallControl struct {
+	Device      *description.DeviceDescription
+	ServiceType string
+	exec        *control.Executor
+	wait        time.Duration
+
+	mu     sync.Mutex
+	leases map[*PinholeLease]bool
+}
+
+// PinholeLease is a pinhole added with Open(), which is updated before its lease expires
+type PinholeLease struct {
+	Pinhole
+	f *FirewallControl
+
+	mu     sync.Mutex
+	id     uint16
+	timer  *time.Timer
+	closed bool
+	// when the pinhole expires at the gateway, unless updated
+	expires time.Time
+	// next retry interval after a failed update, zero if the last update succeeded
+	retry time.Duration
+}
+
+// NewFirewallControl creates a FirewallControl client for the gateway device
+func NewFirewallControl(dd *description.DeviceDescription, wait time.Duration) (*FirewallControl, error) {
+	return newFirewallControl(dd, control.NewExecutor(dd, MAX_CONCURRENT_REQUESTS, wait), wait)
+}
+
+// FirewallControl returns a FirewallControl client for the gateway, sharing the Client's executor
+func (c *Client) FirewallControl() (*FirewallControl, error) {
+	return newFirewallControl(c.Device, c.exec, c.wait)
+}
+
+func newFirewallControl(dd *description.DeviceDescription, e *control.Executor, wait time.Duration) (*FirewallControl, error) {
+	if dd.ServiceByType(WAN_IPV6_FIREWALL_CONTROL_1) == nil {
+		return nil, fmt.Errorf("no WANIPv6FirewallControl service found")
+	}
+
+	return &FirewallControl{Device: dd, ServiceType: WAN_IPV6_FIREWALL_CONTROL_1, exec: e, wait: wait,
+		leases: make(map[*PinholeLease]bool)}, nil
+}
+
+func (f *FirewallControl) call(ctx context.Context, action string, args []control.Arg, ret interface{}) error {
+	return f.exec.Call(ctx, f.ServiceType, action, args, ret)
+}
+
+type FirewallStatus struct {
+	FirewallEnabled       bool
+	InboundPinholeAllowed bool
+}
+
+func (f *FirewallControl) GetFirewallStatus(ctx context.Context) (*FirewallStatus, error) {
+	r := struct {
+		Enabled string `xml:"FirewallEnabled"`
+		Allowed string `xml:"InboundPinholeAllowed"`
+	}{}
+
+	if err := f.call(ctx, "GetFirewallStatus", nil, &r); err != nil {
+		return nil, err
+	}
+
+	return &FirewallStatus{FirewallEnabled: parseBool(r.Enabled), InboundPinholeAllowed: parseBool(r.Allowed)}, nil
+}
+
+// protocolNumber converts the Pinhole protocol to its IANA protocol number
+func protocolNumber(proto string) (uint16, error) {
+	switch strings.ToUpper(strings.TrimSpace(proto)) {
+	case "":
+		return PROTOCOL_ANY, nil
+	case "TCP":
+		return 6, nil
+	case "UDP":
+		return 17, nil
+	case "UDPLITE":
+		return 136, nil
+	}
+
+	n, err := strconv.ParseUint(proto, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid protocol %s", proto)
+	}
+	return uint16(n), nil
+}
+
+func leaseSeconds(d time.Duration) uint32 {
+	if d <= 0 {
+		d = DEFAULT_PINHOLE_LEASE
+	}
+	if d > MAX_PINHOLE_LEASE {
+		d = MAX_PINHOLE_LEASE
+	}
+	if d < time.Second {
+		d = time.Second
+	}
+	return uint32(d / time.Second)
+}
+
+// AddPinhole adds the pinhole, returning its UniqueID.  The pinhole is removed by the gateway when the
+// lease expires, unless updated with UpdatePinhole()
+func (f *FirewallControl) AddPinhole(ctx context.Context, p Pinhole) (uint16, error) {
+	if len(p.InternalClient) < 1 {
+		return 0, fmt.Errorf("pinhole InternalClient is required")
+	}
+
+	proto, err := protocolNumber(p.Protocol)
+	if err != nil {
+		return 0, err
+	}
+
+	args := []control.Arg{
+		control.NewArg("RemoteHost", p.RemoteHost),
+		control.NewArg("RemotePort", p.RemotePort),
+		control.NewArg("InternalClient", p.InternalClient),
+		control.NewArg("InternalPort", p.InternalPort),
+		control.NewArg("Protocol", proto),
+		control.NewArg("LeaseTime", leaseSeconds(p.LeaseTime)),
+	}
+
+	r := struct {
+		ID uint16 `xml:"UniqueID"`
+	}{}
+	if err := f.call(ctx, "AddPinhole", args, &r); err != nil {
+		return 0, err
+	}
+
+	return r.ID, nil
+}
+
+func (f *FirewallControl) UpdatePinhole(ctx context.Context, id uint16, lease time.Duration) error {
+	args := []control.Arg{
+		control.NewArg("UniqueID", id),
+		control.NewArg("NewLeaseTime", leaseSeconds(lease)),
+	}
+
+	return f.call(ctx, "UpdatePinhole", args, nil)
+}
+
+func (f *FirewallControl) DeletePinhole(ctx context.Context, id uint16) error {
+	return f.call(ctx, "DeletePinhole", []control.Arg{control.NewArg("UniqueID", id)}, nil)
+}
+
+// GetPinholePackets returns the number of packets which went through the pinhole
+func (f *FirewallControl) GetPinholePackets(ctx context.Context, id uint16) (uint32, error) {
+	r := struct {
+		Packets uint32 `xml:"PinholePackets"`
+	}{}
+
+	if err := f.call(ctx, "GetPinholePackets", []control.Arg{control.NewArg("UniqueID", id)}, &r); err != nil {
+		return 0, err
+	}
+
+	return r.Packets, nil
+}
+
+// CheckPinholeWorking returns true if traffic went through the pinhole.  Gateways which can't tell return
+// error 709 (NoTrafficReceived) if no traffic was seen
+func (f *FirewallControl) CheckPinholeWorking(ctx context.Context, id uint16) (bool, error) {
+	r := struct {
+		Working string `xml:"IsWorking"`
+	}{}
+
+	if err := f.call(ctx, "CheckPinholeWorking", []control.Arg{control.NewArg("UniqueID", id)}, &r); err != nil {
+		if control.FaultCode(err) == ERR_NO_TRAFFIC_RECEIVED {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return parseBool(r.Working), nil
+}
+
+// Open adds the pinhole, and updates it before the lease expires until the PinholeLease or the
+// FirewallControl is closed.  If the gateway forgets the pinhole (error 704), it is added again
+func (f *FirewallControl) Open(ctx context.Context, p Pinhole) (*PinholeLease, error) {
+	id, err := f.AddPinhole(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	p.LeaseTime = time.Duration(leaseSeconds(p.LeaseTime)) * time.Second
+	l := &PinholeLease{Pinhole: p, f: f, id: id}
+
+	f.mu.Lock()
+	f.leases[l] = true
+	f.mu.Unlock()
+
+	l.mu.Lock()
+	l.expires = time.Now().Add(p.LeaseTime)
+	l.schedule()
+	l.mu.Unlock()
+
+	return l, nil
+}
+
+// Leases returns the pinholes opened with Open() which are not closed
+func (f *FirewallControl) Leases() []*PinholeLease {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	res := make([]*PinholeLease, 0, len(f.leases))
+	for l := range f.leases {
+		res = append(res, l)
+	}
+	return res
+}
+
+// Close deletes all pinholes opened with Open(), returning the first error
+func (f *FirewallControl) Close() error {
+	var res error
+	for _, l := range f.Leases() {
+		if err := l.Close(); err != nil && res == nil {
+			res = err
+		}
+	}
+	return res
+}
+
+// ID returns the UniqueID of the pinhole, which changes if it had to be added again
+func (l *PinholeLease) ID() uint16 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.id
+}
+
+// schedule the next update, called with mu held
+func (l *PinholeLease) schedule() {
+	l.timer = time.AfterFunc(l.LeaseTime*9/10, l.renew)
+}
+
+// scheduleRetry schedules the next update after a failure, backing off but trying again before the pinhole
+// expires.  Called with mu held
+func (l *PinholeLease) scheduleRetry() {
+	if l.retry < 1 {
+		l.retry = PINHOLE_RETRY_INTERVAL
+	}
+
+	wait := l.retry
+	if rem := time.Until(l.expires); rem > 0 && wait > rem {
+		wait = rem
+	}
+
+	if l.retry *= 2; l.retry > l.LeaseTime*9/10 {
+		l.retry = l.LeaseTime * 9 / 10
+	}
+	l.timer = time.AfterFunc(wait, l.renew)
+}
+
+func (l *PinholeLease) renew() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return
+	}
+
+	ctx, cancel := requestContext(l.f.wait)
+	defer cancel()
+
+	err := l.f.UpdatePinhole(ctx, l.id, l.LeaseTime)
+	if control.FaultCode(err) == ERR_NO_SUCH_ENTRY {
+		doLog("pinhole %d is gone, adding it again", l.id)
+
+		var id uint16
+		if id, err = l.f.AddPinhole(ctx, l.Pinhole); err == nil {
+			l.id = id
+		}
+	}
+
+	if err != nil {
+		log.Printf("ERROR - unable to update pinhole %d: %v", l.id, err)
+		l.scheduleRetry()
+		return
+	}
+
+	l.retry = 0
+	l.expires = time.Now().Add(l.LeaseTime)
+	l.schedule()
+}
+
+// Close stops updating the pinhole and deletes it from the gateway
+func (l *PinholeLease) Close() error {
+	l.f.mu.Lock()
+	delete(l.f.leases, l)
+	l.f.mu.Unlock()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	l.timer.Stop()
+
+	ctx, cancel := requestContext(l.f.wait)
+	defer cancel()
+
+	err := l.f.DeletePinhole(ctx, l.id)
+	if control.FaultCode(err) == ERR_NO_SUCH_ENTRY {
+		return nil
+	}
+	return err
+}
+
+func parseBool(s string) bool {
+	s = strings.TrimSpace(s)
+	return s == "1" || strings.EqualFold(s, "true") || strings.EqualFold(s, "yes")
+}
@@ -0,0 +1,274 @@
+package igd
+
+import (
+	"context"
+	"github.com/mmmorris1975/go-upnp/control"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func (g *mockGateway) firewallControl(srv *control.Server) {
+	st := WAN_IPV6_FIREWALL_CONTROL_1
+	g.pinholes = make(map[int]Pinhole)
+
+	srv.Handle(st, "GetFirewallStatus", func(c *control.ActionCall) ([]control.Arg, error) {
+		return []control.Arg{
+			control.NewArg("FirewallEnabled", true),
+			control.NewArg("InboundPinholeAllowed", true),
+		}, nil
+	})
+
+	srv.Handle(st, "AddPinhole", func(c *control.ActionCall) ([]control.Arg, error) {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+
+		port, _ := strconv.Atoi(c.Arg("InternalPort"))
+		lease, _ := strconv.Atoi(c.Arg("LeaseTime"))
+		if lease < 1 || lease > 86400 {
+			return nil, control.NewFault(control.ERR_ARGUMENT_VALUE_OUT_OF_RANGE, "")
+		}
+
+		g.nextPinhole++
+		g.pinholes[g.nextPinhole] = Pinhole{InternalClient: c.Arg("InternalClient"), InternalPort: uint16(port),
+			Protocol: c.Arg("Protocol"), LeaseTime: time.Duration(lease) * time.Second}
+		return []control.Arg{control.NewArg("UniqueID", g.nextPinhole)}, nil
+	})
+
+	lookup := func(c *control.ActionCall) (int, error) {
+		id, _ := strconv.Atoi(c.Arg("UniqueID"))
+		if _, ok := g.pinholes[id]; !ok {
+			return 0, control.NewFault(ERR_NO_SUCH_ENTRY, "NoSuchEntry")
+		}
+		return id, nil
+	}
+
+	srv.Handle(st, "UpdatePinhole", func(c *control.ActionCall) ([]control.Arg, error) {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+
+		if _, err := lookup(c); err != nil {
+			return nil, err
+		}
+		if g.pinholeFailures > 0 {
+			g.pinholeFailures--
+			return nil, control.NewFault(control.ERR_ACTION_FAILED, "")
+		}
+		g.pinholeUpdates++
+		return nil, nil
+	})
+
+	srv.Handle(st, "DeletePinhole", func(c *control.ActionCall) ([]control.Arg, error) {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+
+		id, err := lookup(c)
+		if err != nil {
+			return nil, err
+		}
+		delete(g.pinholes, id)
+		return nil, nil
+	})
+
+	srv.Handle(st, "GetPinholePackets", func(c *control.ActionCall) ([]control.Arg, error) {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+
+		if _, err := lookup(c); err != nil {
+			return nil, err
+		}
+		return []control.Arg{control.NewArg("PinholePackets", 17)}, nil
+	})
+
+	srv.Handle(st, "CheckPinholeWorking", func(c *control.ActionCall) ([]control.Arg, error) {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+
+		if _, err := lookup(c); err != nil {
+			return nil, err
+		}
+		return nil, control.NewFault(ERR_NO_TRAFFIC_RECEIVED, "NoTrafficReceived")
+	})
+}
+
+func TestProtocolNumber(t *testing.T) {
+	tests := map[string]uint16{"": PROTOCOL_ANY, "tcp": 6, "UDP": 17, "58": 58}
+	for s, want := range tests {
+		if n, err := protocolNumber(s); err != nil || n != want {
+			t.Errorf("protocolNumber(%s): got %d, %v", s, n, err)
+		}
+	}
+
+	if _, err := protocolNumber("SCTPX"); err == nil {
+		t.Error("expected error for unknown protocol")
+	}
+}
+
+func TestFirewallControl(t *testing.T) {
+	g := new(mockGateway)
+	c, done := newMockClient(t, g)
+	defer done()
+	ctx := context.Background()
+
+	f, err := c.FirewallControl()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := f.GetFirewallStatus(ctx)
+	if err != nil || !s.FirewallEnabled || !s.InboundPinholeAllowed {
+		t.Errorf("unexpected status %+v, %v", s, err)
+	}
+
+	if _, err := f.AddPinhole(ctx, Pinhole{InternalPort: 22}); err == nil {
+		t.Error("expected error without InternalClient")
+	}
+
+	p := Pinhole{InternalClient: "2001:db8::2", InternalPort: 22, Protocol: "TCP", LeaseTime: 48 * time.Hour}
+	id, err := f.AddPinhole(ctx, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := g.pinholes[int(id)]; e.Protocol != "6" || e.LeaseTime != MAX_PINHOLE_LEASE {
+		t.Errorf("unexpected pinhole %+v", e)
+	}
+
+	if n, err := f.GetPinholePackets(ctx, id); err != nil || n != 17 {
+		t.Errorf("unexpected packets %d, %v", n, err)
+	}
+	if ok, err := f.CheckPinholeWorking(ctx, id); err != nil || ok {
+		t.Errorf("unexpected working %v, %v", ok, err)
+	}
+
+	if err := f.DeletePinhole(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.UpdatePinhole(ctx, id, time.Hour); control.FaultCode(err) != ERR_NO_SUCH_ENTRY {
+		t.Errorf("expected no such entry, got %v", err)
+	}
+}
+
+func TestPinholeLease(t *testing.T) {
+	g := new(mockGateway)
+	c, done := newMockClient(t, g)
+	defer done()
+
+	f, err := c.FirewallControl()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := f.Open(context.Background(), Pinhole{InternalClient: "2001:db8::2", InternalPort: 443, Protocol: "TCP"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Leases()) != 1 || l.LeaseTime != DEFAULT_PINHOLE_LEASE {
+		t.Fatalf("unexpected lease %+v", l)
+	}
+
+	// renew quickly, and make the gateway forget the pinhole so it is added again
+	l.mu.Lock()
+	l.timer.Stop()
+	l.LeaseTime = 100 * time.Millisecond
+	l.schedule()
+	l.mu.Unlock()
+
+	time.Sleep(250 * time.Millisecond)
+
+	g.mu.Lock()
+	updates := g.pinholeUpdates
+	delete(g.pinholes, int(l.ID()))
+	g.mu.Unlock()
+
+	if updates < 1 {
+		t.Errorf("expected pinhole to be updated")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	g.mu.Lock()
+	n := len(g.pinholes)
+	g.mu.Unlock()
+	if n != 1 || l.ID() == 1 {
+		t.Errorf("expected pinhole to be added again, got %d pinholes with id %d", n, l.ID())
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(g.pinholes) != 0 || len(f.Leases()) != 0 {
+		t.Errorf("pinholes not deleted: %v", g.pinholes)
+	}
+
+	// closing again is a no-op
+	if err := l.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPinholeLeaseNoWait(t *testing.T) {
+	g := new(mockGateway)
+	c, done := newMockClient(t, g)
+	defer done()
+
+	f, err := c.FirewallControl()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.wait = 0
+
+	l, err := f.Open(context.Background(), Pinhole{InternalClient: "2001:db8::2", InternalPort: 443, Protocol: "TCP"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(g.pinholes) != 0 {
+		t.Errorf("pinhole not deleted: %v", g.pinholes)
+	}
+}
+
+func TestPinholeLeaseRetry(t *testing.T) {
+	g := new(mockGateway)
+	c, done := newMockClient(t, g)
+	defer done()
+
+	f, err := c.FirewallControl()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	l, err := f.Open(context.Background(), Pinhole{InternalClient: "2001:db8::2", InternalPort: 443, Protocol: "TCP"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first updates fail, the next must come before the pinhole expires rather than a lease later
+	g.mu.Lock()
+	g.pinholeFailures = 2
+	g.mu.Unlock()
+
+	l.mu.Lock()
+	l.timer.Stop()
+	l.expires = time.Now().Add(200 * time.Millisecond)
+	l.retry = 20 * time.Millisecond
+	l.timer = time.AfterFunc(0, l.renew)
+	l.mu.Unlock()
+
+	time.Sleep(150 * time.Millisecond)
+
+	g.mu.Lock()
+	updates := g.pinholeUpdates
+	g.mu.Unlock()
+	if updates != 1 {
+		t.Errorf("expected pinhole to be updated once after failures, got %d", updates)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.retry != 0 || time.Until(l.expires) < DEFAULT_PINHOLE_LEASE/2 {
+		t.Errorf("lease not reset after a successful update, retry %s expires %s", l.retry, l.expires)
+	}
+}
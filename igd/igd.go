@@ -0,0 +1,427 @@
+package igd
+
+import (
+	"context"
+	"fmt"
+	"github.com/mmmorris1975/go-upnp/control"
+	"github.com/mmmorris1975/go-upnp/description"
+	"github.com/mmmorris1975/go-upnp/discovery"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	IGD_V1_DEVICE        = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+	IGD_V2_DEVICE        = "urn:schemas-upnp-org:device:InternetGatewayDevice:2"
+	WAN_IP_CONNECTION_1  = "urn:schemas-upnp-org:service:WANIPConnection:1"
+	WAN_IP_CONNECTION_2  = "urn:schemas-upnp-org:service:WANIPConnection:2"
+	WAN_PPP_CONNECTION_1 = "urn:schemas-upnp-org:service:WANPPPConnection:1"
+
+	// Maximum number of concurrent requests sent to a gateway, cheap devices don't handle more
+	MAX_CONCURRENT_REQUESTS = 2
+
+	// Timeout of requests made without a caller's context, when the client has no wait
+	DEFAULT_REQUEST_TIMEOUT = 30 * time.Second
+)
+
+// WANIPConnection and WANPPPConnection error codes
+const (
+	ERR_ACTION_NOT_AUTHORIZED                = 606
+	ERR_NO_SUCH_ENTRY_IN_ARRAY               = 714
+	ERR_WILDCARD_NOT_PERMITTED_IN_SRC_IP     = 715
+	ERR_WILDCARD_NOT_PERMITTED_IN_EXT_PORT   = 716
+	ERR_CONFLICT_IN_MAPPING_ENTRY            = 718
+	ERR_SAME_PORT_VALUES_REQUIRED            = 724
+	ERR_ONLY_PERMANENT_LEASES_SUPPORTED      = 725
+	ERR_REMOTE_HOST_ONLY_SUPPORTS_WILDCARD   = 726
+	ERR_EXTERNAL_PORT_ONLY_SUPPORTS_WILDCARD = 727
+	ERR_NO_PORT_MAPS_AVAILABLE               = 728
+	ERR_CONFLICT_WITH_OTHER_MECHANISMS       = 729
+	ERR_WILDCARD_NOT_PERMITTED_IN_INT_PORT   = 732
+)
+
+// Order of preference when choosing the WAN connection service of a gateway
+var connectionServices = []string{WAN_IP_CONNECTION_2, WAN_IP_CONNECTION_1, WAN_PPP_CONNECTION_1}
+
+var Logger *log.Logger
+
+type PortMapping struct {
+	// Empty string is a wildcard, matching any remote host
+	RemoteHost   string
+	ExternalPort uint16
+	// TCP or UDP
+	Protocol     string
+	InternalPort uint16
+	// Defaults to the local address used to reach the gateway, if empty
+	InternalClient string
+	Enabled        bool
+	Description    string
+	// Zero is a permanent (or the maximum allowed) lease
+	LeaseDuration time.Duration
+}
+
+type portMappingEntry struct {
+	RemoteHost     string `xml:"NewRemoteHost"`
+	ExternalPort   uint16 `xml:"NewExternalPort"`
+	Protocol       string `xml:"NewProtocol"`
+	InternalPort   uint16 `xml:"NewInternalPort"`
+	InternalClient string `xml:"NewInternalClient"`
+	Enabled        string `xml:"NewEnabled"`
+	Description    string `xml:"NewPortMappingDescription"`
+	LeaseDuration  uint32 `xml:"NewLeaseDuration"`
+}
+
+func (e *portMappingEntry) portMapping() PortMapping {
+	return PortMapping{
+		RemoteHost:     e.RemoteHost,
+		ExternalPort:   e.ExternalPort,
+		Protocol:       strings.ToUpper(e.Protocol),
+		InternalPort:   e.InternalPort,
+		InternalClient: e.InternalClient,
+		Enabled:        e.Enabled == "1" || strings.EqualFold(e.Enabled, "true"),
+		Description:    e.Description,
+		LeaseDuration:  time.Duration(e.LeaseDuration) * time.Second,
+	}
+}
+
+// Client is a port mapping client for the WAN connection service of a single gateway
+type Client struct {
+	Device      *description.DeviceDescription
+	ServiceType string
+	exec        *control.Executor
+	wait        time.Duration
+}
+
+// Discover searches for IGDv1 and IGDv2 gateways, returning a Client for each gateway found.  Clients
+// for gateways with a connected WAN connection service are returned first
+func Discover(wait time.Duration) ([]*Client, error) {
+	seen := make(map[string]bool)
+	connected := make([]*Client, 0)
+	other := make([]*Client, 0)
+
+	for _, t := range []string{IGD_V2_DEVICE, IGD_V1_DEVICE} {
+		ch := make(chan *discovery.SearchResponse, 10)
+		req := discovery.NewSearchRequest()
+		req.Target = t
+		req.Wait = wait
+		discovery.Discover(req, ch)
+
+		for r := range ch {
+			if seen[r.Location] {
+				continue
+			}
+			seen[r.Location] = true
+
+			dd, err := description.DescribeDevice(r.Location, wait)
+			if err != nil {
+				doLog("Discover() - DescribeDevice(%s): %v", r.Location, err)
+				continue
+			}
+
+			c, err := NewClient(dd, wait)
+			if err != nil {
+				doLog("Discover() - NewClient(%s): %v", r.Location, err)
+				continue
+			}
+
+			if c.Connected() {
+				connected = append(connected, c)
+			} else {
+				other = append(other, c)
+			}
+		}
+	}
+
+	return append(connected, other...), nil
+}
+
+// DiscoverGateway returns the first gateway found by Discover, preferring a connected gateway
+func DiscoverGateway(wait time.Duration) (*Client, error) {
+	c, err := Discover(wait)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(c) < 1 {
+		return nil, fmt.Errorf("no internet gateway device found")
+	}
+
+	return c[0], nil
+}
+
+// NewClient creates a Client for the gateway device.  If the gateway has more than one WAN connection
+// service, the first one reporting a Connected status is used
+func NewClient(dd *description.DeviceDescription, wait time.Duration) (*Client, error) {
+	e := control.NewExecutor(dd, MAX_CONCURRENT_REQUESTS, wait)
+
+	var found *Client
+	for _, st := range connectionServices {
+		if dd.ServiceByType(st) == nil {
+			continue
+		}
+
+		c := &Client{Device: dd, ServiceType: st, exec: e, wait: wait}
+		if c.Connected() {
+			return c, nil
+		}
+
+		if found == nil {
+			found = c
+		}
+	}
+
+	if found == nil {
+		return nil, fmt.Errorf("no WANIPConnection or WANPPPConnection service found")
+	}
+
+	return found, nil
+}
+
+// Executor returns the control.Executor used by the client, to add interceptors or send other actions
+func (c *Client) Executor() *control.Executor {
+	return c.exec
+}
+
+func (c *Client) call(ctx context.Context, action string, args []control.Arg, ret interface{}) error {
+	return c.exec.Call(ctx, c.ServiceType, action, args, ret)
+}
+
+type StatusInfo struct {
+	ConnectionStatus string
+	LastError        string
+	Uptime           time.Duration
+}
+
+func (c *Client) GetStatusInfo(ctx context.Context) (*StatusInfo, error) {
+	r := struct {
+		Status    string `xml:"NewConnectionStatus"`
+		LastError string `xml:"NewLastConnectionError"`
+		Uptime    uint32 `xml:"NewUptime"`
+	}{}
+
+	if err := c.call(ctx, "GetStatusInfo", nil, &r); err != nil {
+		return nil, err
+	}
+
+	return &StatusInfo{
+		ConnectionStatus: r.Status,
+		LastError:        r.LastError,
+		Uptime:           time.Duration(r.Uptime) * time.Second,
+	}, nil
+}
+
+// requestContext returns a context for a request made without a caller's context, bounded by wait, or
+// DEFAULT_REQUEST_TIMEOUT if wait is not set
+func requestContext(wait time.Duration) (context.Context, context.CancelFunc) {
+	if wait <= 0 {
+		wait = DEFAULT_REQUEST_TIMEOUT
+	}
+	return context.WithTimeout(context.Background(), wait)
+}
+
+// Connected returns true if the WAN connection status is Connected
+func (c *Client) Connected() bool {
+	ctx, cancel := requestContext(c.wait)
+	defer cancel()
+
+	s, err := c.GetStatusInfo(ctx)
+	if err != nil {
+		doLog("Connected() - GetStatusInfo(): %v", err)
+		return false
+	}
+
+	return s.ConnectionStatus == "Connected"
+}
+
+func (c *Client) GetExternalIPAddress(ctx context.Context) (net.IP, error) {
+	r := struct {
+		IP string `xml:"NewExternalIPAddress"`
+	}{}
+
+	if err := c.call(ctx, "GetExternalIPAddress", nil, &r); err != nil {
+		return nil, err
+	}
+
+	ip := net.ParseIP(strings.TrimSpace(r.IP))
+	if ip == nil {
+		return nil, fmt.Errorf("gateway returned invalid external IP address '%s'", r.IP)
+	}
+
+	return ip, nil
+}
+
+// LocalAddr returns the address of this host used to communicate with the gateway
+func (c *Client) LocalAddr() (net.IP, error) {
+	u, err := c.Device.BuildURL("/")
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.Dial("udp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+func (c *Client) mappingArgs(m *PortMapping) ([]control.Arg, error) {
+	if len(m.InternalClient) < 1 {
+		ip, err := c.LocalAddr()
+		if err != nil {
+			return nil, err
+		}
+		m.InternalClient = ip.String()
+	}
+
+	if len(m.Protocol) < 1 {
+		m.Protocol = "TCP"
+	}
+
+	return []control.Arg{
+		control.NewArg("NewRemoteHost", m.RemoteHost),
+		control.NewArg("NewExternalPort", m.ExternalPort),
+		control.NewArg("NewProtocol", strings.ToUpper(m.Protocol)),
+		control.NewArg("NewInternalPort", m.InternalPort),
+		control.NewArg("NewInternalClient", m.InternalClient),
+		control.NewArg("NewEnabled", m.Enabled),
+		control.NewArg("NewPortMappingDescription", m.Description),
+		control.NewArg("NewLeaseDuration", uint32(m.LeaseDuration.Seconds())),
+	}, nil
+}
+
+func (c *Client) AddPortMapping(ctx context.Context, m PortMapping) error {
+	args, err := c.mappingArgs(&m)
+	if err != nil {
+		return err
+	}
+
+	return c.call(ctx, "AddPortMapping", args, nil)
+}
+
+// AddAnyPortMapping asks the gateway to create the mapping, using a different external port if the
+// requested port is unavailable.  Returns the external port reserved by the gateway.  Only supported
+// by WANIPConnection:2
+func (c *Client) AddAnyPortMapping(ctx context.Context, m PortMapping) (uint16, error) {
+	if c.ServiceType != WAN_IP_CONNECTION_2 {
+		return 0, control.NewFault(control.ERR_INVALID_ACTION, "AddAnyPortMapping requires WANIPConnection:2")
+	}
+
+	args, err := c.mappingArgs(&m)
+	if err != nil {
+		return 0, err
+	}
+
+	r := struct {
+		Port uint16 `xml:"NewReservedPort"`
+	}{}
+	if err := c.call(ctx, "AddAnyPortMapping", args, &r); err != nil {
+		return 0, err
+	}
+
+	return r.Port, nil
+}
+
+func (c *Client) DeletePortMapping(ctx context.Context, remoteHost string, extPort uint16, proto string) error {
+	args := []control.Arg{
+		control.NewArg("NewRemoteHost", remoteHost),
+		control.NewArg("NewExternalPort", extPort),
+		control.NewArg("NewProtocol", strings.ToUpper(proto)),
+	}
+
+	return c.call(ctx, "DeletePortMapping", args, nil)
+}
+
+func (c *Client) GetSpecificPortMappingEntry(ctx context.Context, remoteHost string, extPort uint16, proto string) (*PortMapping, error) {
+	args := []control.Arg{
+		control.NewArg("NewRemoteHost", remoteHost),
+		control.NewArg("NewExternalPort", extPort),
+		control.NewArg("NewProtocol", strings.ToUpper(proto)),
+	}
+
+	e := new(portMappingEntry)
+	if err := c.call(ctx, "GetSpecificPortMappingEntry", args, e); err != nil {
+		return nil, err
+	}
+	e.RemoteHost = remoteHost
+	e.ExternalPort = extPort
+	e.Protocol = proto
+
+	m := e.portMapping()
+	return &m, nil
+}
+
+// ListPortMappings returns up to count port mappings (all remaining mappings if count < 1), starting at
+// the given index, using GetGenericPortMappingEntry.  Call again with start set to the previous start
+// plus the number of mappings returned to get the next page
+func (c *Client) ListPortMappings(ctx context.Context, start, count int) ([]PortMapping, error) {
+	res := make([]PortMapping, 0)
+
+	for i := start; count < 1 || i < start+count; i++ {
+		e := new(portMappingEntry)
+		err := c.call(ctx, "GetGenericPortMappingEntry", []control.Arg{control.NewArg("NewPortMappingIndex", i)}, e)
+		if err != nil {
+			// some gateways incorrectly return 714 instead of 713 at the end of the list
+			switch control.FaultCode(err) {
+			case control.ERR_SPECIFIED_ARRAY_INDEX_INVALID, ERR_NO_SUCH_ENTRY_IN_ARRAY:
+				return res, nil
+			}
+			return res, err
+		}
+
+		res = append(res, e.portMapping())
+	}
+
+	return res, nil
+}
+
+// KeepPortMapping adds the mapping, and adds it again before the lease expires, until the context is
+// done.  The mapping is deleted from the gateway before returning.  Blocks until ctx is done or the
+// mapping can not be added, returning the error from the gateway
+func (c *Client) KeepPortMapping(ctx context.Context, m PortMapping) error {
+	if err := c.AddPortMapping(ctx, m); err != nil {
+		return err
+	}
+
+	defer func() {
+		// ctx is already done, so use a new context for cleanup
+		dctx, cancel := requestContext(c.wait)
+		defer cancel()
+
+		if err := c.DeletePortMapping(dctx, m.RemoteHost, m.ExternalPort, m.Protocol); err != nil {
+			doLog("KeepPortMapping() - DeletePortMapping(): %v", err)
+		}
+	}()
+
+	if m.LeaseDuration <= 0 {
+		<-ctx.Done()
+		return nil
+	}
+
+	t := time.NewTicker(m.LeaseDuration * 9 / 10)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+			if err := c.AddPortMapping(ctx, m); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
+			doLog("KeepPortMapping() - renewed %s port %d", m.Protocol, m.ExternalPort)
+		}
+	}
+}
+
+func doLog(fmt string, vars ...interface{}) {
+	if Logger != nil {
+		Logger.Printf(fmt, vars...)
+	}
+}
@@ -0,0 +1,307 @@
+package igd
+
+import (
+	"context"
+	"fmt"
+	"github.com/mmmorris1975/go-upnp/control"
+	"github.com/mmmorris1975/go-upnp/description"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+const mockGatewayDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0"><specVersion><major>1</major><minor>0</minor></specVersion>
+<device><deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType><UDN>uuid:mock-gateway</UDN>
+<deviceList><device><deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+<serviceList><service><serviceType>urn:schemas-upnp-org:service:WANCommonInterfaceConfig:1</serviceType>
+<serviceId>urn:upnp-org:serviceId:WANCommonIFC1</serviceId><SCPDURL>/wcic.xml</SCPDURL>
+<controlURL>/wcic</controlURL><eventSubURL>/wcic-evt</eventSubURL></service></serviceList>
+<deviceList><device><deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+<serviceList><service><serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+<serviceId>urn:upnp-org:serviceId:WANIPConn1</serviceId><SCPDURL>/scpd.xml</SCPDURL>
+<controlURL>/ctl</controlURL><eventSubURL>/evt</eventSubURL></service>
+<service><serviceType>urn:schemas-upnp-org:service:WANIPv6FirewallControl:1</serviceType>
+<serviceId>urn:upnp-org:serviceId:WANIPv6Firewall1</serviceId><SCPDURL>/fw.xml</SCPDURL>
+<controlURL>/fw</controlURL><eventSubURL>/fw-evt</eventSubURL></service></serviceList>
+</device></deviceList></device></deviceList></device></root>`
+
+// mockGateway is an in-memory WANIPConnection:1 implementation
+type mockGateway struct {
+	mu       sync.Mutex
+	mappings []PortMapping
+	adds     int
+	// reject non-zero leases with error 725, like many IGDv1 gateways
+	permanentOnly bool
+
+	// WANCommonInterfaceConfig counters and link status
+	bytesSent, bytesReceived uint32
+	noPacketCounters         bool
+	linkStatus               string
+
+	// WANIPv6FirewallControl pinholes by UniqueID
+	pinholes       map[int]Pinhole
+	nextPinhole    int
+	pinholeUpdates int
+	// number of updates to fail with error 501
+	pinholeFailures int
+}
+
+func (g *mockGateway) server() *httptest.Server {
+	srv := control.NewServer()
+	st := WAN_IP_CONNECTION_1
+
+	srv.Handle(st, "GetStatusInfo", func(c *control.ActionCall) ([]control.Arg, error) {
+		return []control.Arg{
+			control.NewArg("NewConnectionStatus", "Connected"),
+			control.NewArg("NewLastConnectionError", "ERROR_NONE"),
+			control.NewArg("NewUptime", 3600),
+		}, nil
+	})
+
+	srv.Handle(st, "GetExternalIPAddress", func(c *control.ActionCall) ([]control.Arg, error) {
+		return []control.Arg{control.NewArg("NewExternalIPAddress", "203.0.113.7")}, nil
+	})
+
+	srv.Handle(st, "AddPortMapping", func(c *control.ActionCall) ([]control.Arg, error) {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		g.adds++
+
+		ext, _ := strconv.Atoi(c.Arg("NewExternalPort"))
+		in, _ := strconv.Atoi(c.Arg("NewInternalPort"))
+		lease, _ := strconv.Atoi(c.Arg("NewLeaseDuration"))
+		if g.permanentOnly && lease > 0 {
+			return nil, control.NewFault(ERR_ONLY_PERMANENT_LEASES_SUPPORTED, "OnlyPermanentLeasesSupported")
+		}
+
+		m := PortMapping{
+			ExternalPort:   uint16(ext),
+			Protocol:       c.Arg("NewProtocol"),
+			InternalPort:   uint16(in),
+			InternalClient: c.Arg("NewInternalClient"),
+			Enabled:        c.Arg("NewEnabled") == "1",
+			Description:    c.Arg("NewPortMappingDescription"),
+			LeaseDuration:  time.Duration(lease) * time.Second,
+		}
+
+		for i, e := range g.mappings {
+			if e.ExternalPort == m.ExternalPort && e.Protocol == m.Protocol {
+				if e.InternalClient != m.InternalClient {
+					return nil, control.NewFault(ERR_CONFLICT_IN_MAPPING_ENTRY, "ConflictInMappingEntry")
+				}
+				g.mappings[i] = m
+				return nil, nil
+			}
+		}
+		g.mappings = append(g.mappings, m)
+		return nil, nil
+	})
+
+	srv.Handle(st, "DeletePortMapping", func(c *control.ActionCall) ([]control.Arg, error) {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+
+		ext, _ := strconv.Atoi(c.Arg("NewExternalPort"))
+		for i, e := range g.mappings {
+			if int(e.ExternalPort) == ext && e.Protocol == c.Arg("NewProtocol") {
+				g.mappings = append(g.mappings[:i], g.mappings[i+1:]...)
+				return nil, nil
+			}
+		}
+		return nil, control.NewFault(ERR_NO_SUCH_ENTRY_IN_ARRAY, "NoSuchEntryInArray")
+	})
+
+	srv.Handle(st, "GetGenericPortMappingEntry", func(c *control.ActionCall) ([]control.Arg, error) {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+
+		i, _ := strconv.Atoi(c.Arg("NewPortMappingIndex"))
+		if i >= len(g.mappings) {
+			return nil, control.NewFault(control.ERR_SPECIFIED_ARRAY_INDEX_INVALID, "")
+		}
+
+		m := g.mappings[i]
+		return []control.Arg{
+			control.NewArg("NewRemoteHost", ""),
+			control.NewArg("NewExternalPort", m.ExternalPort),
+			control.NewArg("NewProtocol", m.Protocol),
+			control.NewArg("NewInternalPort", m.InternalPort),
+			control.NewArg("NewInternalClient", m.InternalClient),
+			control.NewArg("NewEnabled", m.Enabled),
+			control.NewArg("NewPortMappingDescription", m.Description),
+			control.NewArg("NewLeaseDuration", int(m.LeaseDuration.Seconds())),
+		}, nil
+	})
+
+	srv.Handle(st, "GetSpecificPortMappingEntry", func(c *control.ActionCall) ([]control.Arg, error) {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+
+		ext, _ := strconv.Atoi(c.Arg("NewExternalPort"))
+		for _, m := range g.mappings {
+			if int(m.ExternalPort) == ext && m.Protocol == c.Arg("NewProtocol") {
+				return []control.Arg{
+					control.NewArg("NewInternalPort", m.InternalPort),
+					control.NewArg("NewInternalClient", m.InternalClient),
+					control.NewArg("NewEnabled", m.Enabled),
+					control.NewArg("NewPortMappingDescription", m.Description),
+					control.NewArg("NewLeaseDuration", int(m.LeaseDuration.Seconds())),
+				}, nil
+			}
+		}
+		return nil, control.NewFault(ERR_NO_SUCH_ENTRY_IN_ARRAY, "NoSuchEntryInArray")
+	})
+
+	g.interfaceConfig(srv)
+	g.firewallControl(srv)
+
+	mux := http.NewServeMux()
+	mux.Handle("/ctl", srv)
+	mux.Handle("/wcic", srv)
+	mux.Handle("/fw", srv)
+	mux.HandleFunc("/desc.xml", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(mockGatewayDescription))
+	})
+
+	return httptest.NewServer(mux)
+}
+
+func newMockClient(t *testing.T, g *mockGateway) (*Client, func()) {
+	s := g.server()
+
+	dd, err := description.DescribeDevice(s.URL+"/desc.xml", 1*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewClient(dd, 1*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c, s.Close
+}
+
+func TestClient(t *testing.T) {
+	g := new(mockGateway)
+	c, done := newMockClient(t, g)
+	defer done()
+	ctx := context.Background()
+
+	if c.ServiceType != WAN_IP_CONNECTION_1 {
+		t.Fatalf("unexpected service type %s", c.ServiceType)
+	}
+
+	t.Run("external ip", func(t *testing.T) {
+		ip, err := c.GetExternalIPAddress(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip.String() != "203.0.113.7" {
+			t.Errorf("unexpected ip %s", ip)
+		}
+	})
+
+	t.Run("add", func(t *testing.T) {
+		for i := 0; i < 5; i++ {
+			m := PortMapping{ExternalPort: uint16(8000 + i), InternalPort: 80, Protocol: "tcp", Enabled: true,
+				Description: fmt.Sprintf("test %d", i), LeaseDuration: 1 * time.Hour}
+			if err := c.AddPortMapping(ctx, m); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// InternalClient should default to our local address
+		if g.mappings[0].InternalClient != "127.0.0.1" {
+			t.Errorf("unexpected internal client %s", g.mappings[0].InternalClient)
+		}
+	})
+
+	t.Run("conflict", func(t *testing.T) {
+		m := PortMapping{ExternalPort: 8000, InternalPort: 80, Protocol: "TCP", InternalClient: "192.0.2.1"}
+		if err := c.AddPortMapping(ctx, m); control.FaultCode(err) != ERR_CONFLICT_IN_MAPPING_ENTRY {
+			t.Errorf("expected conflict, got %v", err)
+		}
+	})
+
+	t.Run("specific", func(t *testing.T) {
+		m, err := c.GetSpecificPortMappingEntry(ctx, "", 8002, "TCP")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Description != "test 2" || m.LeaseDuration != 1*time.Hour || !m.Enabled {
+			t.Errorf("unexpected mapping %+v", m)
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		all, err := c.ListPortMappings(ctx, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(all) != 5 {
+			t.Errorf("expected 5 mappings, got %d", len(all))
+		}
+
+		page, err := c.ListPortMappings(ctx, 3, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) != 2 || page[0].ExternalPort != 8003 {
+			t.Errorf("unexpected page %+v", page)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if err := c.DeletePortMapping(ctx, "", 8000, "TCP"); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.DeletePortMapping(ctx, "", 8000, "TCP"); control.FaultCode(err) != ERR_NO_SUCH_ENTRY_IN_ARRAY {
+			t.Errorf("expected no such entry, got %v", err)
+		}
+	})
+}
+
+func TestKeepPortMapping(t *testing.T) {
+	g := new(mockGateway)
+	c, done := newMockClient(t, g)
+	defer done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+
+	m := PortMapping{ExternalPort: 9000, InternalPort: 9000, Protocol: "UDP", LeaseDuration: 100 * time.Millisecond}
+	if err := c.KeepPortMapping(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+
+	if g.adds < 3 {
+		t.Errorf("expected mapping to be renewed, only added %d times", g.adds)
+	}
+	if len(g.mappings) != 0 {
+		t.Error("mapping not deleted")
+	}
+}
+
+func TestKeepPortMappingNoWait(t *testing.T) {
+	g := new(mockGateway)
+	c, done := newMockClient(t, g)
+	defer done()
+	c.wait = 0
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	m := PortMapping{ExternalPort: 9000, InternalPort: 9000, Protocol: "UDP"}
+	if err := c.KeepPortMapping(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(g.mappings) != 0 {
+		t.Error("mapping not deleted")
+	}
+}
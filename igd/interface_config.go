@@ -0,0 +1,259 @@
+package igd
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"github.com/mmmorris1975/go-upnp/control"
+	"github.com/mmmorris1975/go-upnp/description"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	WAN_COMMON_INTERFACE_CONFIG_1 = "urn:schemas-upnp-org:service:WANCommonInterfaceConfig:1"
+
+	// Default interval between TrafficSamples sent by Poll()
+	DEFAULT_POLL_INTERVAL = 10 * time.Second
+)
+
+// InterfaceConfig is a client for the WANCommonInterfaceConfig service of a gateway, which reports the
+// link properties and traffic counters of the WAN interface
+type InterfaceConfig struct {
+	Device      *description.DeviceDescription
+	ServiceType string
+	exec        *control.Executor
+}
+
+type LinkProperties struct {
+	// DSL, POTS, Cable, Ethernet
+	AccessType string
+	// bits per second
+	UpstreamMaxBitRate   uint32
+	DownstreamMaxBitRate uint32
+	// Up, Down, Initializing, Unavailable
+	PhysicalLinkStatus string
+}
+
+// NewInterfaceConfig creates an InterfaceConfig client for the gateway device
+func NewInterfaceConfig(dd *description.DeviceDescription, wait time.Duration) (*InterfaceConfig, error) {
+	return newInterfaceConfig(dd, control.NewExecutor(dd, MAX_CONCURRENT_REQUESTS, wait))
+}
+
+// InterfaceConfig returns an InterfaceConfig client for the gateway, sharing the Client's executor
+func (c *Client) InterfaceConfig() (*InterfaceConfig, error) {
+	return newInterfaceConfig(c.Device, c.exec)
+}
+
+func newInterfaceConfig(dd *description.DeviceDescription, e *control.Executor) (*InterfaceConfig, error) {
+	if dd.ServiceByType(WAN_COMMON_INTERFACE_CONFIG_1) == nil {
+		return nil, fmt.Errorf("no WANCommonInterfaceConfig service found")
+	}
+
+	return &InterfaceConfig{Device: dd, ServiceType: WAN_COMMON_INTERFACE_CONFIG_1, exec: e}, nil
+}
+
+func (c *InterfaceConfig) GetCommonLinkProperties(ctx context.Context) (*LinkProperties, error) {
+	r := struct {
+		AccessType string `xml:"NewWANAccessType"`
+		Upstream   uint32 `xml:"NewLayer1UpstreamMaxBitRate"`
+		Downstream uint32 `xml:"NewLayer1DownstreamMaxBitRate"`
+		Status     string `xml:"NewPhysicalLinkStatus"`
+	}{}
+
+	if err := c.exec.Call(ctx, c.ServiceType, "GetCommonLinkProperties", nil, &r); err != nil {
+		return nil, err
+	}
+
+	return &LinkProperties{
+		AccessType:           r.AccessType,
+		UpstreamMaxBitRate:   r.Upstream,
+		DownstreamMaxBitRate: r.Downstream,
+		PhysicalLinkStatus:   r.Status,
+	}, nil
+}
+
+// counter calls one of the GetTotal* actions.  The counters are ui4, but some gateways return larger
+// values, so they are parsed as 64 bit
+func (c *InterfaceConfig) counter(ctx context.Context, action, arg string) (uint64, error) {
+	r := struct {
+		Values []struct {
+			XMLName xml.Name
+			Value   string `xml:",chardata"`
+		} `xml:",any"`
+	}{}
+
+	if err := c.exec.Call(ctx, c.ServiceType, action, nil, &r); err != nil {
+		return 0, err
+	}
+
+	for _, v := range r.Values {
+		if v.XMLName.Local == arg {
+			return strconv.ParseUint(strings.TrimSpace(v.Value), 10, 64)
+		}
+	}
+
+	return 0, fmt.Errorf("%s response has no %s", action, arg)
+}
+
+func (c *InterfaceConfig) GetTotalBytesSent(ctx context.Context) (uint64, error) {
+	return c.counter(ctx, "GetTotalBytesSent", "NewTotalBytesSent")
+}
+
+func (c *InterfaceConfig) GetTotalBytesReceived(ctx context.Context) (uint64, error) {
+	return c.counter(ctx, "GetTotalBytesReceived", "NewTotalBytesReceived")
+}
+
+func (c *InterfaceConfig) GetTotalPacketsSent(ctx context.Context) (uint64, error) {
+	return c.counter(ctx, "GetTotalPacketsSent", "NewTotalPacketsSent")
+}
+
+func (c *InterfaceConfig) GetTotalPacketsReceived(ctx context.Context) (uint64, error) {
+	return c.counter(ctx, "GetTotalPacketsReceived", "NewTotalPacketsReceived")
+}
+
+// counterDelta returns the increase of a traffic counter between two samples.  A counter which goes
+// down is assumed to have wrapped if it was in the upper half of the 32 bit range, otherwise the gateway
+// was restarted (or the counter reset) and the new value is the increase
+func counterDelta(prev, cur uint64) uint64 {
+	if cur >= prev {
+		return cur - prev
+	}
+
+	if prev <= math.MaxUint32 && prev > math.MaxUint32/2 {
+		return cur + math.MaxUint32 + 1 - prev
+	}
+
+	return cur
+}
+
+// TrafficSample is a reading of the WAN interface counters, sent by Poll()
+type TrafficSample struct {
+	Time time.Time
+	// Totals since polling started, these don't wrap
+	BytesSent       uint64
+	BytesReceived   uint64
+	PacketsSent     uint64
+	PacketsReceived uint64
+	// bytes per second since the previous sample, zero in the first sample
+	SendRate    float64
+	ReceiveRate float64
+	Link        LinkProperties
+	// true if the PhysicalLinkStatus is different from the previous sample
+	LinkChanged bool
+}
+
+// trafficCounters holds the last raw value of each counter, and the accumulated totals
+type trafficCounters struct {
+	raw, total [4]uint64
+	valid      [4]bool
+}
+
+func (t *trafficCounters) update(i int, v uint64) uint64 {
+	if t.valid[i] {
+		t.total[i] += counterDelta(t.raw[i], v)
+	}
+	t.raw[i] = v
+	t.valid[i] = true
+
+	return t.total[i]
+}
+
+// Poll reads the traffic counters and link properties every interval (DEFAULT_POLL_INTERVAL if < 1),
+// sending a TrafficSample to ch, until ctx is done.  Failed requests are logged and the sample skipped.
+// Packet counters are optional in the service, so they are no longer requested if the gateway doesn't
+// support them.  ch is closed before returning
+func (c *InterfaceConfig) Poll(ctx context.Context, interval time.Duration, ch chan<- TrafficSample) error {
+	defer close(ch)
+
+	if interval < 1 {
+		interval = DEFAULT_POLL_INTERVAL
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	counters := new(trafficCounters)
+	packets := true
+	var prev *TrafficSample
+
+	for {
+		s, err := c.sample(ctx, counters, &packets)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			log.Printf("ERROR - traffic poll of %s: %v", c.Device.Device.FriendlyName, err)
+		} else {
+			if prev != nil {
+				if secs := s.Time.Sub(prev.Time).Seconds(); secs > 0 {
+					s.SendRate = float64(s.BytesSent-prev.BytesSent) / secs
+					s.ReceiveRate = float64(s.BytesReceived-prev.BytesReceived) / secs
+				}
+				s.LinkChanged = s.Link.PhysicalLinkStatus != prev.Link.PhysicalLinkStatus
+			}
+			prev = s
+
+			select {
+			case ch <- *s:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		}
+	}
+}
+
+func (c *InterfaceConfig) sample(ctx context.Context, counters *trafficCounters, packets *bool) (*TrafficSample, error) {
+	s := &TrafficSample{Time: time.Now()}
+
+	sent, err := c.GetTotalBytesSent(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	recvd, err := c.GetTotalBytesReceived(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s.BytesSent = counters.update(0, sent)
+	s.BytesReceived = counters.update(1, recvd)
+
+	if *packets {
+		ps, err1 := c.GetTotalPacketsSent(ctx)
+		pr, err2 := c.GetTotalPacketsReceived(ctx)
+		if err1 == nil && err2 == nil {
+			s.PacketsSent = counters.update(2, ps)
+			s.PacketsReceived = counters.update(3, pr)
+		} else if unsupported(err1) || unsupported(err2) {
+			doLog("Poll() - packet counters not supported: %v %v", err1, err2)
+			*packets = false
+		}
+	}
+
+	l, err := c.GetCommonLinkProperties(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.Link = *l
+
+	return s, nil
+}
+
+// unsupported returns true if the error means the gateway doesn't implement the action
+func unsupported(err error) bool {
+	switch control.FaultCode(err) {
+	case control.ERR_INVALID_ACTION, control.ERR_OPTIONAL_ACTION_NOT_IMPLEMENTED:
+		return true
+	}
+	return false
+}
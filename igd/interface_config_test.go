@@ -0,0 +1,153 @@
+package igd
+
+import (
+	"context"
+	"github.com/mmmorris1975/go-upnp/control"
+	"math"
+	"testing"
+	"time"
+)
+
+func (g *mockGateway) interfaceConfig(srv *control.Server) {
+	st := WAN_COMMON_INTERFACE_CONFIG_1
+
+	counter := func(name string, v func() uint32) control.ActionHandler {
+		return func(c *control.ActionCall) ([]control.Arg, error) {
+			g.mu.Lock()
+			defer g.mu.Unlock()
+			return []control.Arg{control.NewArg(name, v())}, nil
+		}
+	}
+
+	srv.Handle(st, "GetTotalBytesSent", counter("NewTotalBytesSent", func() uint32 { return g.bytesSent }))
+	srv.Handle(st, "GetTotalBytesReceived", counter("NewTotalBytesReceived", func() uint32 { return g.bytesReceived }))
+
+	packets := func(name string) control.ActionHandler {
+		return func(c *control.ActionCall) ([]control.Arg, error) {
+			g.mu.Lock()
+			defer g.mu.Unlock()
+
+			if g.noPacketCounters {
+				return nil, control.NewFault(control.ERR_INVALID_ACTION, "")
+			}
+			return []control.Arg{control.NewArg(name, 42)}, nil
+		}
+	}
+	srv.Handle(st, "GetTotalPacketsSent", packets("NewTotalPacketsSent"))
+	srv.Handle(st, "GetTotalPacketsReceived", packets("NewTotalPacketsReceived"))
+
+	srv.Handle(st, "GetCommonLinkProperties", func(c *control.ActionCall) ([]control.Arg, error) {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+
+		status := g.linkStatus
+		if len(status) < 1 {
+			status = "Up"
+		}
+
+		return []control.Arg{
+			control.NewArg("NewWANAccessType", "Ethernet"),
+			control.NewArg("NewLayer1UpstreamMaxBitRate", 20000000),
+			control.NewArg("NewLayer1DownstreamMaxBitRate", 100000000),
+			control.NewArg("NewPhysicalLinkStatus", status),
+		}, nil
+	})
+}
+
+func TestCounterDelta(t *testing.T) {
+	tests := []struct {
+		prev, cur, want uint64
+	}{
+		{100, 250, 150},
+		{math.MaxUint32 - 99, 50, 150},
+		// reset, not a wrap
+		{1000, 10, 10},
+		// 64 bit counters don't wrap at 32 bits
+		{math.MaxUint32 + 100, 10, 10},
+	}
+
+	for _, tc := range tests {
+		if got := counterDelta(tc.prev, tc.cur); got != tc.want {
+			t.Errorf("counterDelta(%d, %d): got %d, want %d", tc.prev, tc.cur, got, tc.want)
+		}
+	}
+}
+
+func TestInterfaceConfig(t *testing.T) {
+	g := &mockGateway{bytesSent: math.MaxUint32 - 999, bytesReceived: 5000}
+	c, done := newMockClient(t, g)
+	defer done()
+
+	ic, err := c.InterfaceConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := ic.GetCommonLinkProperties(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.AccessType != "Ethernet" || l.UpstreamMaxBitRate != 20000000 || l.DownstreamMaxBitRate != 100000000 || l.PhysicalLinkStatus != "Up" {
+		t.Errorf("unexpected link properties %+v", l)
+	}
+
+	if n, err := ic.GetTotalBytesReceived(context.Background()); err != nil || n != 5000 {
+		t.Errorf("unexpected bytes received %d, %v", n, err)
+	}
+
+	t.Run("poll", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		ch := make(chan TrafficSample)
+		errs := make(chan error, 1)
+		go func() { errs <- ic.Poll(ctx, 50*time.Millisecond, ch) }()
+
+		s := <-ch
+		if s.BytesSent != 0 || s.SendRate != 0 || s.PacketsSent != 0 || s.LinkChanged {
+			t.Errorf("unexpected first sample %+v", s)
+		}
+
+		// sent counter wraps
+		g.mu.Lock()
+		g.bytesSent = 1000
+		g.bytesReceived = 15000
+		g.linkStatus = "Down"
+		g.mu.Unlock()
+
+		s = <-ch
+		if s.BytesSent != 2000 || s.BytesReceived != 10000 || !s.LinkChanged || s.Link.PhysicalLinkStatus != "Down" {
+			t.Errorf("unexpected sample %+v", s)
+		}
+		if s.SendRate <= 0 || s.ReceiveRate <= s.SendRate {
+			t.Errorf("unexpected rates %+v", s)
+		}
+
+		s = <-ch
+		if s.BytesSent != 2000 || s.SendRate != 0 || s.LinkChanged {
+			t.Errorf("unexpected sample %+v", s)
+		}
+
+		cancel()
+		for range ch {
+		}
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("no packet counters", func(t *testing.T) {
+		g.mu.Lock()
+		g.noPacketCounters = true
+		g.mu.Unlock()
+		packets := true
+
+		s, err := ic.sample(context.Background(), new(trafficCounters), &packets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if packets || s.PacketsSent != 0 {
+			t.Errorf("packet counters should be disabled, got %+v", s)
+		}
+	})
+}
@@ -0,0 +1,446 @@
+package igd
+
+import (
+	"context"
+	"fmt"
+	"github.com/mmmorris1975/go-upnp/control"
+	"github.com/mmmorris1975/go-upnp/discovery"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Interval to add permanent mappings again, in case the gateway lost them without a BOOTID change
+	MAPPING_CHECK_INTERVAL = 10 * time.Minute
+	// Interval to retry mappings which failed, or conflict with another client's mapping
+	MAPPING_RETRY_INTERVAL = 1 * time.Minute
+)
+
+type MappingState int
+
+const (
+	// The mapping was added to the gateway
+	MappingAdded MappingState = iota
+	// The mapping was added again, before the lease expired or after the gateway restarted
+	MappingRenewed
+	// The external port is mapped to another client (error 718), it will be retried
+	MappingConflict
+	// The mapping could not be added, the Err field has the reason.  It will be retried
+	MappingFailed
+	// The mapping was deleted from the gateway
+	MappingRemoved
+)
+
+func (s MappingState) String() string {
+	switch s {
+	case MappingAdded:
+		return "added"
+	case MappingRenewed:
+		return "renewed"
+	case MappingConflict:
+		return "conflict"
+	case MappingFailed:
+		return "failed"
+	case MappingRemoved:
+		return "removed"
+	}
+	return "unknown"
+}
+
+type MappingStatus struct {
+	Mapping PortMapping
+	State   MappingState
+	Err     error
+	Time    time.Time
+}
+
+// ManagedMapping is a mapping in the desired set of a MappingManager
+type ManagedMapping struct {
+	PortMapping
+	// true if the mapping was added to the gateway
+	Active bool
+	// Error from the last attempt to add the mapping
+	Err error
+}
+
+type mappingKey struct {
+	remoteHost string
+	extPort    uint16
+	proto      string
+}
+
+type managedMapping struct {
+	ManagedMapping
+	next time.Time
+}
+
+// MappingManager keeps a desired set of port mappings on a gateway.  Mappings are added again before
+// their lease expires, and whenever the gateway restarts (detected by SSDP notifications with a new
+// BOOTID, or an ssdp:alive after ssdp:byebye).  If the gateway only supports permanent leases (error
+// 725, common for IGDv1), all mappings are added with a zero lease from then on, and added again every
+// CheckInterval.  All mappings are deleted when Run() returns
+type MappingManager struct {
+	Client        *Client
+	CheckInterval time.Duration
+	RetryInterval time.Duration
+
+	mu            sync.Mutex
+	desired       map[mappingKey]*managedMapping
+	permanentOnly bool
+	status        chan MappingStatus
+	running       bool
+	// set when Run() returns and the status channel is closed
+	closed bool
+	wake   chan struct{}
+	// set before Run() starts, used by tests to avoid SSDP
+	notify <-chan *discovery.NotifyResponse
+}
+
+func NewMappingManager(c *Client) *MappingManager {
+	return &MappingManager{
+		Client:        c,
+		CheckInterval: MAPPING_CHECK_INTERVAL,
+		RetryInterval: MAPPING_RETRY_INTERVAL,
+		desired:       make(map[mappingKey]*managedMapping),
+		status:        make(chan MappingStatus, 10),
+		wake:          make(chan struct{}, 1),
+	}
+}
+
+func keyOf(pm *PortMapping) mappingKey {
+	return mappingKey{remoteHost: pm.RemoteHost, extPort: pm.ExternalPort, proto: strings.ToUpper(pm.Protocol)}
+}
+
+// Status reports each change to a mapping.  The channel is closed when Run() returns
+func (m *MappingManager) Status() <-chan MappingStatus {
+	return m.status
+}
+
+func (m *MappingManager) sendStatus(pm PortMapping, s MappingState, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return
+	}
+
+	select {
+	case m.status <- MappingStatus{Mapping: pm, State: s, Err: err, Time: time.Now()}:
+	default:
+		doLog("status channel full, dropping %s status for %s port %d", s, pm.Protocol, pm.ExternalPort)
+	}
+}
+
+func (m *MappingManager) poke() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Add puts the mapping in the desired set, replacing a mapping with the same remote host, external
+// port and protocol.  It is added to the gateway by Run()
+func (m *MappingManager) Add(pm PortMapping) {
+	if len(pm.Protocol) < 1 {
+		pm.Protocol = "TCP"
+	}
+	pm.Protocol = strings.ToUpper(pm.Protocol)
+
+	m.mu.Lock()
+	k := keyOf(&pm)
+	mm := &managedMapping{ManagedMapping: ManagedMapping{PortMapping: pm}}
+	// a replaced mapping is still on the gateway until the new one is added over it
+	if old, ok := m.desired[k]; ok {
+		mm.Active = old.Active
+	}
+	m.desired[k] = mm
+	m.mu.Unlock()
+
+	m.poke()
+}
+
+// Remove takes the mapping out of the desired set, and deletes it from the gateway
+func (m *MappingManager) Remove(ctx context.Context, remoteHost string, extPort uint16, proto string) error {
+	k := mappingKey{remoteHost: remoteHost, extPort: extPort, proto: strings.ToUpper(proto)}
+
+	m.mu.Lock()
+	mm, ok := m.desired[k]
+	delete(m.desired, k)
+	m.mu.Unlock()
+
+	if !ok || !mm.Active {
+		return nil
+	}
+
+	return m.delete(ctx, mm.PortMapping)
+}
+
+func (m *MappingManager) delete(ctx context.Context, pm PortMapping) error {
+	err := m.Client.DeletePortMapping(ctx, pm.RemoteHost, pm.ExternalPort, pm.Protocol)
+	if err != nil && control.FaultCode(err) != ERR_NO_SUCH_ENTRY_IN_ARRAY {
+		return err
+	}
+
+	m.sendStatus(pm, MappingRemoved, nil)
+	return nil
+}
+
+// Mappings returns the desired set of mappings, and their state
+func (m *MappingManager) Mappings() []ManagedMapping {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	res := make([]ManagedMapping, 0, len(m.desired))
+	for _, mm := range m.desired {
+		res = append(res, mm.ManagedMapping)
+	}
+	return res
+}
+
+// PermanentOnly returns true if the gateway rejected a lease duration, so mappings are permanent
+func (m *MappingManager) PermanentOnly() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.permanentOnly
+}
+
+// Run adds the desired mappings and keeps them on the gateway until ctx is done, then deletes them.
+// A MappingManager can only be run once
+func (m *MappingManager) Run(ctx context.Context) error {
+	m.mu.Lock()
+	if m.running || m.closed {
+		m.mu.Unlock()
+		return fmt.Errorf("mapping manager already run")
+	}
+	m.running = true
+	m.mu.Unlock()
+
+	defer func() {
+		m.mu.Lock()
+		m.closed = true
+		close(m.status)
+		m.mu.Unlock()
+	}()
+	defer m.cleanup()
+
+	notify := m.notify
+	if notify == nil {
+		n := make(chan *discovery.NotifyResponse, 10)
+		go discovery.ListenNotifyContext(ctx, n)
+		notify = n
+	}
+
+	bootId := 0
+	gone := false
+	t := time.NewTimer(0)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		case <-m.wake:
+		case n, ok := <-notify:
+			if !ok {
+				notify = nil
+				continue
+			}
+			if !m.isGateway(n) {
+				continue
+			}
+
+			switch n.NTS {
+			case "ssdp:byebye":
+				gone = true
+				continue
+			case "ssdp:update":
+				if n.NextBootId > 0 {
+					bootId = n.NextBootId
+				}
+				continue
+			case "ssdp:alive":
+				restarted := gone || (n.BootId > 0 && bootId > 0 && n.BootId != bootId)
+				gone = false
+				if n.BootId > 0 {
+					bootId = n.BootId
+				}
+				if !restarted {
+					continue
+				}
+
+				log.Printf("INFO - gateway %s restarted, adding port mappings again", n.USN)
+				m.resetAll()
+			}
+		}
+
+		next := m.sync(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if !t.Stop() {
+			select {
+			case <-t.C:
+			default:
+			}
+		}
+		t.Reset(time.Until(next))
+	}
+}
+
+// isGateway returns true if the notification is from the gateway device of the Client
+func (m *MappingManager) isGateway(n *discovery.NotifyResponse) bool {
+	if udn := m.Client.Device.Device.UDN; len(udn) > 0 {
+		return n.USN == udn || strings.HasPrefix(n.USN, udn+"::")
+	}
+
+	// no UDN in the description, compare the host of the description location
+	u, err := m.Client.Device.BuildURL("/")
+	if err != nil {
+		return false
+	}
+	l, err := url.Parse(n.Location)
+	return err == nil && l.Host == u.Host
+}
+
+// resetAll makes every mapping due to be added
+func (m *MappingManager) resetAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, mm := range m.desired {
+		mm.next = time.Time{}
+	}
+}
+
+// sync adds the mappings which are due, returning when the next one is due
+func (m *MappingManager) sync(ctx context.Context) time.Time {
+	now := time.Now()
+	next := now.Add(m.CheckInterval)
+
+	m.mu.Lock()
+	due := make([]mappingKey, 0)
+	for k, mm := range m.desired {
+		if !mm.next.After(now) {
+			due = append(due, k)
+		} else if mm.next.Before(next) {
+			next = mm.next
+		}
+	}
+	m.mu.Unlock()
+
+	for _, k := range due {
+		if ctx.Err() != nil {
+			break
+		}
+
+		if n := m.apply(ctx, k); n.Before(next) {
+			next = n
+		}
+	}
+
+	return next
+}
+
+// apply adds a single mapping to the gateway, returning when it is due again
+func (m *MappingManager) apply(ctx context.Context, k mappingKey) time.Time {
+	m.mu.Lock()
+	mm, ok := m.desired[k]
+	if !ok {
+		m.mu.Unlock()
+		return time.Now().Add(m.CheckInterval)
+	}
+	pm := mm.PortMapping
+	active := mm.Active
+	if m.permanentOnly {
+		pm.LeaseDuration = 0
+	}
+	m.mu.Unlock()
+
+	err := m.Client.AddPortMapping(ctx, pm)
+	if control.FaultCode(err) == ERR_ONLY_PERMANENT_LEASES_SUPPORTED && pm.LeaseDuration > 0 {
+		log.Printf("INFO - gateway only supports permanent leases, mappings will be refreshed every %s", m.CheckInterval)
+		m.mu.Lock()
+		m.permanentOnly = true
+		m.mu.Unlock()
+
+		pm.LeaseDuration = 0
+		err = m.Client.AddPortMapping(ctx, pm)
+	}
+
+	now := time.Now()
+	var next time.Time
+	switch {
+	case err == nil:
+		if active {
+			m.sendStatus(pm, MappingRenewed, nil)
+		} else {
+			m.sendStatus(pm, MappingAdded, nil)
+		}
+		active = true
+		next = now.Add(m.CheckInterval)
+		if pm.LeaseDuration > 0 && pm.LeaseDuration*9/10 < m.CheckInterval {
+			next = now.Add(pm.LeaseDuration * 9 / 10)
+		}
+	case control.FaultCode(err) == ERR_CONFLICT_IN_MAPPING_ENTRY:
+		log.Printf("WARNING - %s port %d is mapped to another client", pm.Protocol, pm.ExternalPort)
+		m.sendStatus(pm, MappingConflict, err)
+		active = false
+		next = now.Add(m.RetryInterval)
+	default:
+		if ctx.Err() != nil {
+			return now
+		}
+		log.Printf("ERROR - unable to add %s port %d mapping: %v", pm.Protocol, pm.ExternalPort, err)
+		m.sendStatus(pm, MappingFailed, err)
+		next = now.Add(m.RetryInterval)
+	}
+
+	// the mapping may have been removed or replaced while the request was sent
+	m.mu.Lock()
+	cur, ok := m.desired[k]
+	if ok && cur == mm {
+		mm.Active = active
+		mm.Err = err
+		mm.next = next
+	} else if ok && err == nil {
+		// the replaced mapping is now on the gateway
+		cur.Active = true
+	}
+	m.mu.Unlock()
+
+	if !ok && err == nil {
+		if err := m.delete(ctx, pm); err != nil {
+			log.Printf("ERROR - unable to delete %s port %d mapping: %v", pm.Protocol, pm.ExternalPort, err)
+		}
+	}
+
+	return next
+}
+
+// cleanup deletes all active mappings from the gateway, allowing each request the client's wait time, or
+// DEFAULT_REQUEST_TIMEOUT if not set
+func (m *MappingManager) cleanup() {
+	for _, mm := range m.Mappings() {
+		if !mm.Active {
+			continue
+		}
+
+		ctx, cancel := requestContext(m.Client.wait)
+		if err := m.delete(ctx, mm.PortMapping); err != nil {
+			log.Printf("ERROR - unable to delete %s port %d mapping: %v", mm.Protocol, mm.ExternalPort, err)
+		}
+		cancel()
+	}
+
+	m.mu.Lock()
+	for _, mm := range m.desired {
+		mm.Active = false
+		mm.next = time.Time{}
+	}
+	m.mu.Unlock()
+}
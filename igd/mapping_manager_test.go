@@ -0,0 +1,177 @@
+package igd
+
+import (
+	"context"
+	"github.com/mmmorris1975/go-upnp/discovery"
+	"testing"
+	"time"
+)
+
+// waitStatus waits for a status with the state for each port, in any order
+func waitStatus(t *testing.T, ch <-chan MappingStatus, want MappingState, ports ...uint16) MappingStatus {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+
+	pending := make(map[uint16]bool)
+	for _, p := range ports {
+		pending[p] = true
+	}
+
+	var last MappingStatus
+	for len(pending) > 0 {
+		select {
+		case s, ok := <-ch:
+			if !ok {
+				t.Fatalf("status channel closed waiting for %s of ports %v", want, pending)
+			}
+			if s.State == want && pending[s.Mapping.ExternalPort] {
+				delete(pending, s.Mapping.ExternalPort)
+				last = s
+			}
+		case <-timeout:
+			t.Fatalf("timeout waiting for %s of ports %v", want, pending)
+		}
+	}
+	return last
+}
+
+func (g *mockGateway) mapped(port uint16) *PortMapping {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, m := range g.mappings {
+		if m.ExternalPort == port {
+			return &m
+		}
+	}
+	return nil
+}
+
+func TestMappingManager(t *testing.T) {
+	g := &mockGateway{permanentOnly: true}
+	c, done := newMockClient(t, g)
+	defer done()
+
+	// another client already has port 7000
+	g.mappings = append(g.mappings, PortMapping{ExternalPort: 7000, Protocol: "TCP", InternalClient: "192.0.2.1"})
+
+	notify := make(chan *discovery.NotifyResponse)
+	m := NewMappingManager(c)
+	m.notify = notify
+	m.RetryInterval = 50 * time.Millisecond
+
+	m.Add(PortMapping{ExternalPort: 5000, InternalPort: 5000, Protocol: "tcp", LeaseDuration: time.Hour})
+	m.Add(PortMapping{ExternalPort: 5001, InternalPort: 5001, Protocol: "UDP"})
+	m.Add(PortMapping{ExternalPort: 7000, InternalPort: 7000})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errs := make(chan error, 1)
+	go func() { errs <- m.Run(ctx) }()
+
+	st := m.Status()
+	waitStatus(t, st, MappingAdded, 5000, 5001)
+	if s := waitStatus(t, st, MappingConflict, 7000); s.Err == nil {
+		t.Error("expected conflict error")
+	}
+	// conflicts are retried
+	waitStatus(t, st, MappingConflict, 7000)
+
+	if !m.PermanentOnly() {
+		t.Error("expected fallback to permanent leases")
+	}
+	if pm := g.mapped(5000); pm == nil || pm.LeaseDuration != 0 {
+		t.Errorf("unexpected mapping %+v", pm)
+	}
+
+	t.Run("reboot", func(t *testing.T) {
+		alive := func(boot int) {
+			n := &discovery.NotifyResponse{NTS: "ssdp:alive"}
+			n.USN = "uuid:mock-gateway::upnp:rootdevice"
+			n.BootId = boot
+			notify <- n
+		}
+		alive(1)
+
+		// the gateway restarts and forgets everything
+		g.mu.Lock()
+		g.mappings = g.mappings[:1]
+		g.mu.Unlock()
+
+		// another device's notification is ignored
+		other := &discovery.NotifyResponse{NTS: "ssdp:alive"}
+		other.USN = "uuid:other"
+		other.BootId = 7
+		notify <- other
+
+		alive(2)
+		waitStatus(t, st, MappingRenewed, 5000, 5001)
+
+		if g.mapped(5000) == nil || g.mapped(5001) == nil {
+			t.Errorf("mappings not added again: %+v", g.mappings)
+		}
+	})
+
+	t.Run("replace", func(t *testing.T) {
+		m.Add(PortMapping{ExternalPort: 5000, InternalPort: 5002, Protocol: "TCP", LeaseDuration: time.Hour})
+
+		// the replaced mapping was active, so the new one is added over it
+		waitStatus(t, st, MappingRenewed, 5000)
+		if pm := g.mapped(5000); pm == nil || pm.InternalPort != 5002 {
+			t.Errorf("mapping not replaced: %+v", pm)
+		}
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		if err := m.Remove(context.Background(), "", 5001, "udp"); err != nil {
+			t.Fatal(err)
+		}
+		waitStatus(t, st, MappingRemoved, 5001)
+
+		if g.mapped(5001) != nil || len(m.Mappings()) != 2 {
+			t.Errorf("mapping not removed: %+v", m.Mappings())
+		}
+	})
+
+	cancel()
+	waitStatus(t, st, MappingRemoved, 5000)
+	for range st {
+	}
+	if err := <-errs; err != nil {
+		t.Error(err)
+	}
+
+	if g.mapped(5000) != nil || g.mapped(7000) == nil {
+		t.Errorf("unexpected mappings after shutdown: %+v", g.mappings)
+	}
+
+	// status updates after Run() returns, ex. from Remove(), are dropped
+	m.sendStatus(PortMapping{ExternalPort: 5000}, MappingRemoved, nil)
+	if err := m.Run(context.Background()); err == nil {
+		t.Error("expected error running the manager again")
+	}
+}
+
+func TestMappingManagerRenewal(t *testing.T) {
+	g := new(mockGateway)
+	c, done := newMockClient(t, g)
+	defer done()
+
+	m := NewMappingManager(c)
+	m.notify = make(chan *discovery.NotifyResponse)
+	m.Add(PortMapping{ExternalPort: 6000, InternalPort: 6000, LeaseDuration: 100 * time.Millisecond})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	if err := m.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if g.adds < 3 {
+		t.Errorf("expected mapping to be renewed, only added %d times", g.adds)
+	}
+	if m.PermanentOnly() || len(g.mappings) != 0 {
+		t.Errorf("unexpected state after shutdown: %+v", g.mappings)
+	}
+}
@@ -0,0 +1,2 @@
+// Package mcast sets socket options for sending multicast packets, shared by discovery and eventing
+package mcast
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+
+package mcast
+
+import (
+	"net"
+)
+
+// SetOptions is not supported on this platform, packets are sent with the system default TTL, from the
+// interface of the bound local address
+func SetOptions(c *net.UDPConn, ttl int, ifaddr net.IP) error {
+	return nil
+}
@@ -0,0 +1,37 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package mcast
+
+import (
+	"net"
+	"syscall"
+)
+
+// SetOptions sets the TTL (if > 0) and outgoing interface (if an IPv4 address) of multicast packets
+// sent on c
+func SetOptions(c *net.UDPConn, ttl int, ifaddr net.IP) error {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		if ttl > 0 {
+			if serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, ttl); serr != nil {
+				return
+			}
+		}
+
+		if ip := ifaddr.To4(); ip != nil {
+			var a [4]byte
+			copy(a[:], ip)
+			serr = syscall.SetsockoptInet4Addr(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, a)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	return serr
+}
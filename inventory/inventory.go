@@ -0,0 +1,240 @@
+// Package inventory provides a JSON model of UPnP devices, combining SSDP metadata, the device tree,
+// and the actions and state variables of each service.  The JSON field names follow the element names
+// of the UPnP description documents, in camel case, and are stable: fields are only added, and changes
+// to existing fields increment SCHEMA_VERSION.  WriteYAML writes the same model as YAML, with the JSON
+// field names, for tools which prefer it
+package inventory
+
+import (
+	"github.com/mmmorris1975/go-upnp/description"
+	"github.com/mmmorris1975/go-upnp/discovery"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// SCHEMA_VERSION is the version of the JSON model, reported in Inventory.SchemaVersion
+const SCHEMA_VERSION = 1
+
+var Logger *log.Logger
+
+// SSDP is the discovery metadata of a root device
+type SSDP struct {
+	// USN of the upnp:rootdevice response, if the device sent one
+	USN        string `json:"usn"`
+	Server     string `json:"server,omitempty"`
+	BootId     int    `json:"bootId,omitempty"`
+	ConfigId   int    `json:"configId,omitempty"`
+	SearchPort int    `json:"searchPort,omitempty"`
+	// max-age of the CACHE-CONTROL header, in seconds
+	MaxAge int `json:"maxAge,omitempty"`
+	// Search targets (ST) the device responded to, sorted
+	Targets []string `json:"targets,omitempty"`
+}
+
+// RootDevice is a device description document, and the devices and services in it
+type RootDevice struct {
+	Location    string `json:"location"`
+	SpecVersion string `json:"specVersion,omitempty"`
+	ConfigId    int    `json:"configId,omitempty"`
+	SSDP        *SSDP  `json:"ssdp,omitempty"`
+	Device      Device `json:"device"`
+	// Set if the description could not be retrieved, in which case Device is empty
+	Error string `json:"error,omitempty"`
+}
+
+type Device struct {
+	DeviceType       string    `json:"deviceType"`
+	FriendlyName     string    `json:"friendlyName"`
+	Manufacturer     string    `json:"manufacturer,omitempty"`
+	ManufacturerURL  string    `json:"manufacturerURL,omitempty"`
+	ModelDescription string    `json:"modelDescription,omitempty"`
+	ModelName        string    `json:"modelName,omitempty"`
+	ModelNumber      string    `json:"modelNumber,omitempty"`
+	ModelURL         string    `json:"modelURL,omitempty"`
+	SerialNumber     string    `json:"serialNumber,omitempty"`
+	UDN              string    `json:"udn"`
+	UPC              string    `json:"upc,omitempty"`
+	PresentationURL  string    `json:"presentationURL,omitempty"`
+	Icons            []Icon    `json:"icons,omitempty"`
+	Services         []Service `json:"services,omitempty"`
+	Devices          []Device  `json:"devices,omitempty"`
+}
+
+type Icon struct {
+	Mimetype string `json:"mimetype"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	Depth    int    `json:"depth"`
+	URL      string `json:"url"`
+}
+
+// Service URLs are absolute, resolved against the description location
+type Service struct {
+	ServiceType string `json:"serviceType"`
+	ServiceId   string `json:"serviceId"`
+	SCPDURL     string `json:"scpdURL"`
+	ControlURL  string `json:"controlURL"`
+	EventSubURL string `json:"eventSubURL,omitempty"`
+	// Service description, empty if not retrieved
+	SpecVersion    string          `json:"specVersion,omitempty"`
+	Actions        []Action        `json:"actions,omitempty"`
+	StateVariables []StateVariable `json:"stateVariables,omitempty"`
+	// Set if the service description could not be retrieved
+	Error string `json:"error,omitempty"`
+}
+
+type Action struct {
+	Name      string     `json:"name"`
+	Arguments []Argument `json:"arguments,omitempty"`
+}
+
+type Argument struct {
+	Name string `json:"name"`
+	// in or out
+	Direction            string `json:"direction"`
+	RelatedStateVariable string `json:"relatedStateVariable"`
+	RetVal               bool   `json:"retval,omitempty"`
+}
+
+type StateVariable struct {
+	Name              string      `json:"name"`
+	DataType          string      `json:"dataType"`
+	SendEvents        bool        `json:"sendEvents"`
+	Multicast         bool        `json:"multicast,omitempty"`
+	DefaultValue      string      `json:"defaultValue,omitempty"`
+	AllowedValues     []string    `json:"allowedValues,omitempty"`
+	AllowedValueRange *ValueRange `json:"allowedValueRange,omitempty"`
+}
+
+type ValueRange struct {
+	Minimum string `json:"minimum"`
+	Maximum string `json:"maximum"`
+	Step    string `json:"step,omitempty"`
+}
+
+func specVersion(major, minor int) string {
+	if major < 1 {
+		return ""
+	}
+	return strconv.Itoa(major) + "." + strconv.Itoa(minor)
+}
+
+func yes(s string) bool {
+	s = strings.TrimSpace(s)
+	return strings.EqualFold(s, "yes") || s == "1" || strings.EqualFold(s, "true")
+}
+
+// NewSSDP converts a search response to the SSDP model
+func NewSSDP(r *discovery.SSDPResponse) *SSDP {
+	s := &SSDP{USN: r.USN, Server: r.Server, BootId: r.BootId, ConfigId: r.ConfigId, SearchPort: r.SearchPort}
+
+	for _, d := range strings.Split(r.CacheControl, ",") {
+		kv := strings.SplitN(strings.TrimSpace(d), "=", 2)
+		if len(kv) == 2 && strings.EqualFold(strings.TrimSpace(kv[0]), "max-age") {
+			s.MaxAge, _ = strconv.Atoi(strings.TrimSpace(kv[1]))
+		}
+	}
+
+	return s
+}
+
+// NewRootDevice converts the device description to the model.  scpds holds the service descriptions
+// by SCPD URL, resolved against the description location.  Services without one only have their URLs set
+func NewRootDevice(dd *description.DeviceDescription, scpds map[string]*description.ServiceDescription) *RootDevice {
+	return &RootDevice{
+		Location:    dd.Location(),
+		SpecVersion: specVersion(dd.UPnPMajorVersion, dd.UPnPMinorVersion),
+		ConfigId:    dd.ConfigId,
+		Device:      newDevice(dd, &dd.Device, scpds),
+	}
+}
+
+// resolve makes the URL absolute, if the description has a location
+func resolve(dd *description.DeviceDescription, path string) string {
+	if len(path) < 1 || len(dd.Location()) < 1 {
+		return path
+	}
+
+	u, err := dd.BuildURL(path)
+	if err != nil {
+		return path
+	}
+	return u.String()
+}
+
+func newDevice(dd *description.DeviceDescription, d *description.Device, scpds map[string]*description.ServiceDescription) Device {
+	res := Device{
+		DeviceType:       d.DeviceType,
+		FriendlyName:     d.FriendlyName,
+		Manufacturer:     d.Manufacturer,
+		ManufacturerURL:  d.ManufacturerURL,
+		ModelDescription: d.ModelDescription,
+		ModelName:        d.ModelName,
+		ModelNumber:      d.ModelNumber,
+		ModelURL:         d.ModelURL,
+		SerialNumber:     d.SerialNumber,
+		UDN:              d.UDN,
+		UPC:              d.UPC,
+		PresentationURL:  resolve(dd, d.PresentationURL),
+	}
+
+	for _, i := range d.IconList {
+		res.Icons = append(res.Icons, Icon{Mimetype: i.Mimetype, Width: i.Width, Height: i.Height, Depth: i.Depth,
+			URL: resolve(dd, i.URL)})
+	}
+
+	for _, s := range d.ServiceList {
+		svc := Service{
+			ServiceType: s.ServiceType,
+			ServiceId:   s.ServiceId,
+			SCPDURL:     resolve(dd, s.SCPDURL),
+			ControlURL:  resolve(dd, s.ControlURL),
+			EventSubURL: resolve(dd, s.EventSubURL),
+		}
+		if sd, ok := scpds[svc.SCPDURL]; ok && sd != nil {
+			setServiceDescription(&svc, sd)
+		}
+		res.Services = append(res.Services, svc)
+	}
+
+	for i := range d.DeviceList {
+		res.Devices = append(res.Devices, newDevice(dd, &d.DeviceList[i], scpds))
+	}
+
+	return res
+}
+
+func setServiceDescription(svc *Service, sd *description.ServiceDescription) {
+	svc.SpecVersion = specVersion(sd.UPnPMajorVersion, sd.UPnPMinorVersion)
+
+	for _, a := range sd.ActionList {
+		act := Action{Name: a.Name}
+		for _, arg := range a.ArgumentList {
+			act.Arguments = append(act.Arguments, Argument{Name: arg.Name, Direction: strings.ToLower(strings.TrimSpace(arg.Direction)),
+				RelatedStateVariable: arg.RelatedStateVariable, RetVal: arg.RetVal})
+		}
+		svc.Actions = append(svc.Actions, act)
+	}
+
+	for _, v := range sd.ServiceStateTable {
+		sv := StateVariable{
+			Name:          v.Name,
+			DataType:      v.DataType,
+			SendEvents:    yes(v.SendEvents),
+			Multicast:     yes(v.Multicast),
+			DefaultValue:  v.DefaultValue,
+			AllowedValues: v.AllowedValueList,
+		}
+		if len(v.MinValue) > 0 || len(v.MaxValue) > 0 {
+			sv.AllowedValueRange = &ValueRange{Minimum: v.MinValue, Maximum: v.MaxValue, Step: v.Step}
+		}
+		svc.StateVariables = append(svc.StateVariables, sv)
+	}
+}
+
+func doLog(fmt string, vars ...interface{}) {
+	if Logger != nil {
+		Logger.Printf(fmt, vars...)
+	}
+}
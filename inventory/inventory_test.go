@@ -0,0 +1,196 @@
+package inventory
+
+import (
+	"encoding/json"
+	"github.com/mmmorris1975/go-upnp/description"
+	"github.com/mmmorris1975/go-upnp/device"
+	"github.com/mmmorris1975/go-upnp/discovery"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestHost(t *testing.T) *httptest.Server {
+	h := device.NewHost(description.Device{DeviceType: "urn:schemas-upnp-org:device:DimmableLight:1",
+		FriendlyName: "Lamp", Manufacturer: "ACME", ModelName: "L1", UDN: "uuid:lamp-1"})
+
+	def := &device.ServiceDef{
+		ServiceType: "urn:schemas-upnp-org:service:Dimming:1",
+		ServiceId:   "urn:upnp-org:serviceId:Dimming",
+		Variables: []device.VariableDef{
+			{Name: "LoadLevelStatus", DataType: "ui1", Default: "0", Evented: true, Min: "0", Max: "100", Step: "1"},
+			{Name: "Mode", DataType: "string", Default: "normal", Allowed: []string{"normal", "night"}},
+		},
+		Actions: []device.ActionDef{
+			{Name: "GetLoadLevelStatus", Out: []device.ArgDef{{Name: "retLoadlevelStatus", Variable: "LoadLevelStatus", RetVal: true}}},
+		},
+	}
+	if _, err := h.Declare(h.UDN(), def); err != nil {
+		t.Fatal(err)
+	}
+
+	return httptest.NewServer(h)
+}
+
+func TestDescribe(t *testing.T) {
+	s := newTestHost(t)
+	defer s.Close()
+
+	loc := s.URL + device.DESCRIPTION_PATH
+	r, err := Describe(loc, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Location != loc || r.SpecVersion != "1.1" || r.ConfigId < 1 || r.Device.UDN != "uuid:lamp-1" {
+		t.Errorf("unexpected root device %+v", r)
+	}
+
+	if len(r.Device.Services) != 1 {
+		t.Fatalf("unexpected services %+v", r.Device.Services)
+	}
+	svc := r.Device.Services[0]
+	if !strings.HasPrefix(svc.ControlURL, s.URL+"/") || !strings.HasPrefix(svc.SCPDURL, s.URL+"/") || len(svc.Error) > 0 {
+		t.Errorf("unexpected service %+v", svc)
+	}
+
+	if len(svc.Actions) != 1 || svc.Actions[0].Arguments[0].Direction != "out" || !svc.Actions[0].Arguments[0].RetVal {
+		t.Errorf("unexpected actions %+v", svc.Actions)
+	}
+
+	if len(svc.StateVariables) != 2 {
+		t.Fatalf("unexpected state variables %+v", svc.StateVariables)
+	}
+	if v := svc.StateVariables[0]; !v.SendEvents || v.AllowedValueRange == nil || v.AllowedValueRange.Maximum != "100" {
+		t.Errorf("unexpected state variable %+v", v)
+	}
+	if v := svc.StateVariables[1]; v.SendEvents || len(v.AllowedValues) != 2 || v.AllowedValueRange != nil {
+		t.Errorf("unexpected state variable %+v", v)
+	}
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"udn":"uuid:lamp-1"`, `"serviceId":"urn:upnp-org:serviceId:Dimming"`, `"sendEvents":true`,
+		`"allowedValueRange":{"minimum":"0","maximum":"100","step":"1"}`, `"retval":true`} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("missing %s in %s", want, b)
+		}
+	}
+	if strings.Contains(string(b), "XMLName") {
+		t.Errorf("unexpected XMLName in %s", b)
+	}
+
+	// the same device encodes to the same JSON
+	r2, _ := Describe(loc, time.Second)
+	if b2, _ := json.Marshal(r2); string(b2) != string(b) {
+		t.Errorf("JSON not stable:\n%s\n%s", b, b2)
+	}
+
+	if _, err := Describe(s.URL+"/missing.xml", time.Second); err == nil {
+		t.Error("expected error for missing description")
+	}
+}
+
+func TestDescribeEmbeddedServiceId(t *testing.T) {
+	h := device.NewHost(description.Device{DeviceType: "urn:schemas-upnp-org:device:Basic:1", FriendlyName: "Hub",
+		Manufacturer: "ACME", ModelName: "H1", UDN: "uuid:hub-1",
+		DeviceList: []description.Device{
+			{DeviceType: "urn:schemas-upnp-org:device:BinaryLight:1", FriendlyName: "A", Manufacturer: "ACME", ModelName: "L1", UDN: "uuid:light-a"},
+			{DeviceType: "urn:schemas-upnp-org:device:BinaryLight:1", FriendlyName: "B", Manufacturer: "ACME", ModelName: "L1", UDN: "uuid:light-b"},
+		}})
+
+	// both lights have a service with the same serviceId, and different actions
+	for _, udn := range []string{"uuid:light-a", "uuid:light-b"} {
+		def := &device.ServiceDef{
+			ServiceType: "urn:schemas-upnp-org:service:SwitchPower:1",
+			ServiceId:   "urn:upnp-org:serviceId:SwitchPower",
+			Variables:   []device.VariableDef{{Name: "Status", DataType: "boolean", Default: "0"}},
+			Actions:     []device.ActionDef{{Name: "Get" + strings.TrimPrefix(udn, "uuid:light-"), Out: []device.ArgDef{{Name: "Status", Variable: "Status"}}}},
+		}
+		if _, err := h.Declare(udn, def); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	r, err := Describe(s.URL+device.DESCRIPTION_PATH, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(r.Device.Devices) != 2 {
+		t.Fatalf("unexpected devices %+v", r.Device.Devices)
+	}
+	for i, want := range []string{"Geta", "Getb"} {
+		svcs := r.Device.Devices[i].Services
+		if len(svcs) != 1 || len(svcs[0].Actions) != 1 || svcs[0].Actions[0].Name != want {
+			t.Errorf("expected action %s for device %d, got %+v", want, i, svcs)
+		}
+	}
+}
+
+func TestNewSSDP(t *testing.T) {
+	r := &discovery.SSDPResponse{USN: "uuid:lamp-1::upnp:rootdevice", CacheControl: "no-cache, max-age = 1800", BootId: 3}
+	s := NewSSDP(r)
+	if s.MaxAge != 1800 || s.BootId != 3 || s.USN != r.USN {
+		t.Errorf("unexpected SSDP %+v", s)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	dev := func(udn, name string, boot int) RootDevice {
+		return RootDevice{Location: "http://h/" + udn, SSDP: &SSDP{BootId: boot},
+			Device: Device{UDN: udn, FriendlyName: name}}
+	}
+
+	old := &Inventory{Devices: []RootDevice{dev("uuid:a", "A", 1), dev("uuid:b", "B", 1), dev("uuid:c", "C", 1)}}
+	new := &Inventory{Devices: []RootDevice{dev("uuid:a", "A", 2), dev("uuid:b", "B2", 1), dev("uuid:d", "D", 1)}}
+
+	c := Diff(old, new)
+	if len(c) != 3 {
+		t.Fatalf("unexpected changes %+v", c)
+	}
+
+	want := []struct {
+		t   ChangeType
+		udn string
+	}{{DeviceChanged, "uuid:b"}, {DeviceRemoved, "uuid:c"}, {DeviceAdded, "uuid:d"}}
+	for i, w := range want {
+		if c[i].Type != w.t || c[i].UDN != w.udn {
+			t.Errorf("change %d: got %s %s, want %s %s", i, c[i].Type, c[i].UDN, w.t, w.udn)
+		}
+	}
+
+	if c[0].Old.Device.FriendlyName != "B" || c[0].New.Device.FriendlyName != "B2" || c[1].New != nil || c[2].Old != nil {
+		t.Errorf("unexpected change details %+v", c)
+	}
+
+	if len(Diff(new, new)) != 0 {
+		t.Error("expected no changes")
+	}
+
+	// description failed in the old inventory, and the device is also at an IPv6 location
+	failed := RootDevice{Location: "http://h/uuid:a", Error: "timeout"}
+	v6 := dev("uuid:a", "A", 1)
+	v6.Location = "http://[2001:db8::1]/uuid:a"
+	old = &Inventory{Devices: []RootDevice{failed, v6}}
+	new = &Inventory{Devices: []RootDevice{v6, dev("uuid:a", "A", 1)}}
+
+	c = Diff(old, new)
+	if len(c) != 1 || c[0].Type != DeviceChanged || c[0].UDN != "uuid:a" || c[0].Old.Error != "timeout" {
+		t.Errorf("unexpected changes %+v", c)
+	}
+
+	// a device which moved is changed, not removed and added
+	moved := dev("uuid:a", "A", 1)
+	moved.Location = "http://h2/uuid:a"
+	c = Diff(&Inventory{Devices: []RootDevice{dev("uuid:a", "A", 1)}}, &Inventory{Devices: []RootDevice{moved}})
+	if len(c) != 1 || c[0].Type != DeviceChanged {
+		t.Errorf("unexpected changes %+v", c)
+	}
+}
@@ -0,0 +1,265 @@
+package inventory
+
+import (
+	"github.com/mmmorris1975/go-upnp/description"
+	"github.com/mmmorris1975/go-upnp/discovery"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Maximum number of devices described at once by Snapshot()
+const MAX_CONCURRENT_DESCRIBE = 4
+
+// Inventory is a snapshot of the devices on the network.  Devices are sorted by root device UDN, then
+// location, so snapshots of an unchanged network encode to the same JSON apart from Time and SSDP
+type Inventory struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	Time          time.Time    `json:"time"`
+	Devices       []RootDevice `json:"devices"`
+}
+
+// Describe retrieves the description at location, and the description of each service.  Errors getting
+// a service description are recorded in the Error field of the Service
+func Describe(location string, wait time.Duration) (*RootDevice, error) {
+	dd, err := description.DescribeDevice(location, wait)
+	if err != nil {
+		return nil, err
+	}
+
+	scpds := make(map[string]*description.ServiceDescription)
+	errs := make(map[string]string)
+
+	var walk func(d *description.Device)
+	walk = func(d *description.Device) {
+		for _, s := range d.ServiceList {
+			// embedded devices can have services with the same serviceId, but not the same SCPD URL
+			k := resolve(dd, s.SCPDURL)
+			if _, ok := scpds[k]; ok {
+				continue
+			}
+
+			u, err := dd.BuildURL(s.SCPDURL)
+			if err == nil {
+				scpds[k], err = description.DescribeService(u.String(), wait)
+			}
+			if err != nil {
+				doLog("Describe() - DescribeService(%s): %v", s.SCPDURL, err)
+				errs[k] = err.Error()
+			}
+		}
+		for i := range d.DeviceList {
+			walk(&d.DeviceList[i])
+		}
+	}
+	walk(&dd.Device)
+
+	r := NewRootDevice(dd, scpds)
+	r.Location = location
+	setServiceErrors(&r.Device, errs)
+
+	return r, nil
+}
+
+func setServiceErrors(d *Device, errs map[string]string) {
+	for i := range d.Services {
+		d.Services[i].Error = errs[d.Services[i].SCPDURL]
+	}
+	for i := range d.Devices {
+		setServiceErrors(&d.Devices[i], errs)
+	}
+}
+
+// Snapshot searches for devices with the request (ssdp:all if nil), and describes each root device
+// found.  Devices whose description can't be retrieved are included, with the Error field set
+func Snapshot(req *discovery.SearchRequest) (*Inventory, error) {
+	if req == nil {
+		req = discovery.NewSearchRequest()
+	}
+
+	ch := make(chan *discovery.SearchResponse, 10)
+	if err := discovery.Discover(req, ch); err != nil {
+		return nil, err
+	}
+
+	// group the responses by description location, one per root device
+	roots := make(map[string]*SSDP)
+	targets := make(map[string]map[string]bool)
+	for r := range ch {
+		if len(r.Location) < 1 {
+			continue
+		}
+
+		s, ok := roots[r.Location]
+		if !ok {
+			s = NewSSDP(&r.SSDPResponse)
+			roots[r.Location] = s
+			targets[r.Location] = make(map[string]bool)
+		}
+
+		// the location also answers for embedded devices and services, prefer the root device USN
+		if r.ST == "upnp:rootdevice" {
+			s.USN = r.USN
+		}
+		targets[r.Location][r.ST] = true
+	}
+
+	inv := &Inventory{SchemaVersion: SCHEMA_VERSION, Time: time.Now().UTC(), Devices: make([]RootDevice, 0, len(roots))}
+	wait := req.Wait
+	if wait < discovery.DISCOVERY_WAIT_MIN_DURATION {
+		wait = discovery.DISCOVERY_WAIT_MIN_DURATION
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, MAX_CONCURRENT_DESCRIBE)
+
+	for loc, s := range roots {
+		for t := range targets[loc] {
+			s.Targets = append(s.Targets, t)
+		}
+		sort.Strings(s.Targets)
+
+		wg.Add(1)
+		go func(loc string, s *SSDP) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			r, err := Describe(loc, wait)
+			if err != nil {
+				doLog("Snapshot() - Describe(%s): %v", loc, err)
+				r = &RootDevice{Location: loc, Error: err.Error()}
+			}
+			r.SSDP = s
+
+			mu.Lock()
+			inv.Devices = append(inv.Devices, *r)
+			mu.Unlock()
+		}(loc, s)
+	}
+	wg.Wait()
+
+	inv.sort()
+	return inv, nil
+}
+
+func (inv *Inventory) sort() {
+	sort.Slice(inv.Devices, func(i, j int) bool {
+		a, b := &inv.Devices[i], &inv.Devices[j]
+		if a.Device.UDN != b.Device.UDN {
+			return a.Device.UDN < b.Device.UDN
+		}
+		return a.Location < b.Location
+	})
+}
+
+type ChangeType string
+
+const (
+	DeviceAdded   ChangeType = "added"
+	DeviceRemoved ChangeType = "removed"
+	DeviceChanged ChangeType = "changed"
+)
+
+// Change is a difference between two inventories, for a root device
+type Change struct {
+	Type ChangeType `json:"type"`
+	UDN  string     `json:"udn"`
+	// The device in the old inventory, nil if added
+	Old *RootDevice `json:"old,omitempty"`
+	// The device in the new inventory, nil if removed
+	New *RootDevice `json:"new,omitempty"`
+}
+
+// same compares everything but the SSDP metadata, which changes with each boot
+func same(a, b *RootDevice) bool {
+	return a.Location == b.Location && a.SpecVersion == b.SpecVersion && a.ConfigId == b.ConfigId &&
+		a.Error == b.Error && reflect.DeepEqual(a.Device, b.Device)
+}
+
+// Diff returns the root devices added, removed or changed (other than SSDP metadata) from old to new,
+// sorted by UDN.  Devices are matched by UDN and location, then by UDN (a device which moved), then by
+// location when either device has no UDN (its description could not be retrieved).  Root devices with
+// the same UDN at different locations, ex. IPv4 and IPv6, are kept apart
+func Diff(old, new *Inventory) []Change {
+	matches := []func(o, n *RootDevice) bool{
+		func(o, n *RootDevice) bool {
+			return len(o.Device.UDN) > 0 && o.Device.UDN == n.Device.UDN && o.Location == n.Location
+		},
+		func(o, n *RootDevice) bool {
+			return len(o.Device.UDN) > 0 && o.Device.UDN == n.Device.UDN
+		},
+		func(o, n *RootDevice) bool {
+			return o.Location == n.Location && (len(o.Device.UDN) < 1 || len(n.Device.UDN) < 1)
+		},
+	}
+
+	// index of the matching old device for each new device, -1 if none
+	pair := make([]int, len(new.Devices))
+	for i := range pair {
+		pair[i] = -1
+	}
+	used := make([]bool, len(old.Devices))
+
+	for _, match := range matches {
+		for i := range new.Devices {
+			if pair[i] >= 0 {
+				continue
+			}
+
+			for j := range old.Devices {
+				if !used[j] && match(&old.Devices[j], &new.Devices[i]) {
+					pair[i] = j
+					used[j] = true
+					break
+				}
+			}
+		}
+	}
+
+	res := make([]Change, 0)
+	for i := range new.Devices {
+		n := &new.Devices[i]
+		if pair[i] < 0 {
+			res = append(res, Change{Type: DeviceAdded, UDN: n.Device.UDN, New: n})
+			continue
+		}
+
+		o := &old.Devices[pair[i]]
+		if !same(o, n) {
+			udn := n.Device.UDN
+			if len(udn) < 1 {
+				udn = o.Device.UDN
+			}
+			res = append(res, Change{Type: DeviceChanged, UDN: udn, Old: o, New: n})
+		}
+	}
+
+	for j := range old.Devices {
+		if !used[j] {
+			o := &old.Devices[j]
+			res = append(res, Change{Type: DeviceRemoved, UDN: o.Device.UDN, Old: o})
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].UDN != res[j].UDN {
+			return res[i].UDN < res[j].UDN
+		}
+		if res[i].Type != res[j].Type {
+			return res[i].Type < res[j].Type
+		}
+		return res[i].location() < res[j].location()
+	})
+	return res
+}
+
+// location returns the location of the new device, or the old one if it was removed
+func (c *Change) location() string {
+	if c.New != nil {
+		return c.New.Location
+	}
+	return c.Old.Location
+}
@@ -0,0 +1,154 @@
+package inventory
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// yamlNode is a JSON value, keeping the order of object members
+type yamlNode struct {
+	// scalar, in JSON syntax, if keys and items are nil
+	scalar string
+	keys   []string
+	items  []*yamlNode
+	object bool
+	array  bool
+}
+
+var plainKeyRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// WriteYAML writes v as a YAML document, with the same field names and order as its JSON encoding.
+// Strings are always double quoted, so values such as "yes" or "1.0" keep their type
+func WriteYAML(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	n, err := decodeNode(d)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString("---\n")
+	switch {
+	case n.object && len(n.items) > 0:
+		writeYAMLObject(bw, n, 0, false)
+	case n.array && len(n.items) > 0:
+		writeYAMLArray(bw, n, 0)
+	default:
+		bw.WriteString(n.scalar + "\n")
+	}
+	return bw.Flush()
+}
+
+func decodeNode(d *json.Decoder) (*yamlNode, error) {
+	t, err := d.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch v := t.(type) {
+	case json.Delim:
+		n := new(yamlNode)
+		switch v {
+		case '{':
+			n.object, n.scalar = true, "{}"
+		case '[':
+			n.array, n.scalar = true, "[]"
+		default:
+			return nil, fmt.Errorf("unexpected %s", v)
+		}
+
+		for d.More() {
+			if n.object {
+				k, err := d.Token()
+				if err != nil {
+					return nil, err
+				}
+				n.keys = append(n.keys, k.(string))
+			}
+
+			e, err := decodeNode(d)
+			if err != nil {
+				return nil, err
+			}
+			n.items = append(n.items, e)
+		}
+
+		// closing delimiter
+		if _, err := d.Token(); err != nil {
+			return nil, err
+		}
+		return n, nil
+	case string:
+		b, _ := json.Marshal(v)
+		return &yamlNode{scalar: string(b)}, nil
+	case json.Number:
+		return &yamlNode{scalar: v.String()}, nil
+	case bool:
+		return &yamlNode{scalar: fmt.Sprint(v)}, nil
+	case nil:
+		return &yamlNode{scalar: "null"}, nil
+	}
+
+	return nil, fmt.Errorf("unexpected token %v", t)
+}
+
+// nested returns true if the node is written on the lines after its key or sequence marker
+func (n *yamlNode) nested() bool {
+	return (n.object || n.array) && len(n.items) > 0
+}
+
+// writeYAMLObject writes the members of an object at the indent.  If inline, the first member follows a
+// sequence marker already written
+func writeYAMLObject(w *bufio.Writer, n *yamlNode, indent int, inline bool) {
+	pad := strings.Repeat(" ", indent)
+	for i, k := range n.keys {
+		if i > 0 || !inline {
+			w.WriteString(pad)
+		}
+
+		if !plainKeyRe.MatchString(k) {
+			b, _ := json.Marshal(k)
+			k = string(b)
+		}
+
+		v := n.items[i]
+		if !v.nested() {
+			w.WriteString(k + ": " + v.scalar + "\n")
+			continue
+		}
+
+		w.WriteString(k + ":\n")
+		if v.object {
+			writeYAMLObject(w, v, indent+2, false)
+		} else {
+			writeYAMLArray(w, v, indent+2)
+		}
+	}
+}
+
+func writeYAMLArray(w *bufio.Writer, n *yamlNode, indent int) {
+	pad := strings.Repeat(" ", indent)
+	for _, v := range n.items {
+		switch {
+		case !v.nested():
+			w.WriteString(pad + "- " + v.scalar + "\n")
+		case v.object:
+			w.WriteString(pad + "- ")
+			writeYAMLObject(w, v, indent+2, true)
+		default:
+			w.WriteString(pad + "-\n")
+			writeYAMLArray(w, v, indent+2)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package inventory
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteYAML(t *testing.T) {
+	v := struct {
+		Name   string            `json:"name"`
+		Count  int               `json:"count"`
+		Ok     bool              `json:"ok"`
+		Empty  []string          `json:"empty"`
+		Nil    *SSDP             `json:"nil"`
+		Values []string          `json:"values"`
+		Ranges []ValueRange      `json:"ranges"`
+		Nested [][]int           `json:"nested"`
+		Map    map[string]string `json:"map"`
+	}{
+		Name:   "yes",
+		Count:  3,
+		Ok:     true,
+		Empty:  []string{},
+		Values: []string{"a: b", "1.0"},
+		Ranges: []ValueRange{{Minimum: "0", Maximum: "100", Step: "1"}},
+		Nested: [][]int{{1, 2}},
+		Map:    map[string]string{"x-y": "z"},
+	}
+
+	want := `---
+name: "yes"
+count: 3
+ok: true
+empty: []
+nil: null
+values:
+  - "a: b"
+  - "1.0"
+ranges:
+  - minimum: "0"
+    maximum: "100"
+    step: "1"
+nested:
+  -
+    - 1
+    - 2
+map:
+  "x-y": "z"
+`
+
+	buf := new(bytes.Buffer)
+	if err := WriteYAML(buf, v); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+}